@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"cloud/internal/auth"
+	"cloud/internal/db"
+)
+
+var authService *auth.Auth
+
+// openAuth sets up sign in with a password and the JWTs API clients use,
+// signed with JWT_SECRET (or a key derived from SESSION_SECRET)
+func openAuth() {
+	authService = auth.NewAuth(metadata, signingKey("JWT_SECRET", "cloud jwt"))
+}
+
+// userKey is the request context key of the signed in user's email
+type userKey struct{}
+
+// withUser returns ctx carrying the signed in user's email
+func withUser(ctx context.Context, email string) context.Context {
+	return context.WithValue(ctx, userKey{}, email)
+}
+
+// userEmail returns the email of the user requireAuth let through
+func userEmail(r *http.Request) string {
+	email, _ := r.Context().Value(userKey{}).(string)
+	return email
+}
+
+// authenticate returns the email of the user a request comes from: the
+// one named by its bearer token if it has one, the session user otherwise.
+// An invalid token is an error rather than falling back to the session.
+// Sessions of a user who has since been given a new ID are signed out.
+func authenticate(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header {
+			return "", auth.ErrInvalidToken
+		}
+		user, err := authService.Authenticate(r.Context(), token)
+		if err != nil {
+			return "", err
+		}
+		return user.Email, nil
+	}
+
+	session, _ := store.Get(r, "session")
+	email, _ := session.Values["email"].(string)
+	if email == "" {
+		return "", nil
+	}
+	userID, _ := session.Values["user_id"].(string)
+	current, err := authService.Current(r.Context(), email, userID)
+	if err != nil || !current {
+		return "", err
+	}
+	return email, nil
+}
+
+// accountRequest is the body of a registration or login
+type accountRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Name     string `json:"name,omitempty"`
+}
+
+// accountResponse carries the token of a newly signed in user
+type accountResponse struct {
+	Token string      `json:"token"`
+	User  accountUser `json:"user"`
+}
+
+type accountUser struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// handleRegister creates a user who signs in with a password
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req accountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := authService.Register(r.Context(), req.Email, req.Password, req.Name)
+	if err != nil {
+		writeAuthError(w, r, err, "registering")
+		return
+	}
+	log.Printf("Registered user %s", user.Email)
+	signIn(w, r, user, http.StatusCreated)
+}
+
+// handleLogin signs a user in with their password
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req accountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	user, err := authService.Login(r.Context(), req.Email, req.Password)
+	if err != nil {
+		writeAuthError(w, r, err, "logging in")
+		return
+	}
+	signIn(w, r, user, http.StatusOK)
+}
+
+// signIn starts a browser session for user and answers with a token for
+// API clients, which are free to ignore the cookie
+func signIn(w http.ResponseWriter, r *http.Request, user db.User, status int) {
+	if err := auth.StartSession(w, r, user); err != nil {
+		log.Printf("[%s] Error saving session: %v", requestID(r), err)
+		writeError(w, r, http.StatusInternalServerError, "Error signing in")
+		return
+	}
+	token, err := authService.GenerateToken(user.ID)
+	if err != nil {
+		log.Printf("[%s] Error generating token: %v", requestID(r), err)
+		writeError(w, r, http.StatusInternalServerError, "Error signing in")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(accountResponse{
+		Token: token,
+		User:  accountUser{ID: user.ID, Email: user.Email, Name: user.Name},
+	})
+}
+
+// writeAuthError maps auth service errors onto HTTP responses
+func writeAuthError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	switch {
+	case errors.Is(err, auth.ErrInvalidCredentials):
+		writeError(w, r, http.StatusUnauthorized, "Invalid email or password")
+	case errors.Is(err, auth.ErrEmailTaken):
+		writeError(w, r, http.StatusConflict, "An account with this email already exists")
+	case errors.Is(err, auth.ErrInvalidEmail):
+		writeError(w, r, http.StatusBadRequest, "Invalid email address")
+	case errors.Is(err, auth.ErrWeakPassword):
+		writeError(w, r, http.StatusBadRequest, "Passwords must be at least 8 characters")
+	default:
+		log.Printf("[%s] Error %s: %v", requestID(r), action, err)
+		writeError(w, r, http.StatusInternalServerError, "Error "+action)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud/internal/files"
+)
+
+// adminEmails are the users who may use the /admin routes, from
+// ADMIN_EMAILS
+var adminEmails = make(map[string]bool)
+
+// loadAdmins reads ADMIN_EMAILS, a comma separated list of emails
+func loadAdmins() {
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			adminEmails[strings.ToLower(email)] = true
+		}
+	}
+}
+
+// requireAdmin answers users who are not admins with a 403 error. It runs
+// behind requireAuth.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := userEmail(r)
+		if !adminEmails[strings.ToLower(email)] {
+			writeError(w, r, http.StatusForbidden, "Only admins can do that")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// reconcileGrace is passed to every reconcile pass, see RECONCILE_GRACE
+var reconcileGrace time.Duration
+
+// lastReconcile is the report of the last background pass, kept for
+// admins to read
+var (
+	lastReconcileMu sync.Mutex
+	lastReconcile   *files.ReconcileReport
+)
+
+func saveReconcileReport(report files.ReconcileReport) {
+	lastReconcileMu.Lock()
+	defer lastReconcileMu.Unlock()
+	lastReconcile = &report
+}
+
+// handleGetReconcileReport returns the report of the last reconcile pass
+func handleGetReconcileReport(w http.ResponseWriter, r *http.Request) {
+	lastReconcileMu.Lock()
+	report := lastReconcile
+	lastReconcileMu.Unlock()
+	if report == nil {
+		writeError(w, r, http.StatusNotFound, "No reconcile pass has finished yet")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleRunReconcile runs a reconcile pass now. With ?dry_run=true it only
+// reports what it would repair.
+func handleRunReconcile(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	report, err := fileService.Reconcile(r.Context(), reconcileGrace, dryRun)
+	if err != nil {
+		log.Printf("[%s] Error reconciling files: %v", requestID(r), err)
+		writeError(w, r, http.StatusInternalServerError, "Error reconciling files")
+		return
+	}
+	if !dryRun {
+		saveReconcileReport(report)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// apiError is the body of every error response:
+//
+//	{"error": {"code": "not_found", "message": "Note not found", "request_id": "..."}}
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+// errorCode turns an HTTP status into a stable machine readable code such
+// as "not_found" or "precondition_failed"
+func errorCode(status int) string {
+	return strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+func newAPIError(r *http.Request, status int, message string) apiError {
+	return apiError{
+		Code:      errorCode(status),
+		Message:   message,
+		RequestID: requestID(r),
+	}
+}
+
+// errorResponse is the envelope every error is sent in
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+// writeError sends a JSON error envelope
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: newAPIError(r, status, message)})
+}
+
+type requestIDKey struct{}
+
+// withRequestID tags every request with an ID, taken from a sane incoming
+// X-Request-ID header or generated, and echoes it in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 || strings.ContainsAny(id, " \t\r\n") {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// apiPrefix is the mount point of the current API version
+const apiPrefix = "/api/v1"
+
+// registerAPIRoutes mounts the JSON API. Routes come from the apiRoutes
+// table, which also documents them for the OpenAPI spec.
+func registerAPIRoutes(r *mux.Router) {
+	api := r.PathPrefix(apiPrefix).Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, "No such endpoint")
+	})
+	api.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+	})
+
+	for _, route := range apiRoutes {
+		handler := route.Handler
+		if route.Admin {
+			handler = requireAdmin(handler)
+		}
+		if !route.Public {
+			handler = requireAuth(handler)
+		}
+		api.HandleFunc(route.Path, handler).Methods(route.Method)
+	}
+}
+
+// registerLegacyRoutes keeps the routes from before /api/v1 working for
+// existing scripts. Responses carry Deprecation and a Link to the
+// successor route; they will be removed in a later release.
+func registerLegacyRoutes(r *mux.Router) {
+	legacy := func(method, path, successor string, h http.HandlerFunc) {
+		r.HandleFunc(path, deprecated(successor, requireAuth(h))).Methods(method)
+	}
+
+	legacy("POST", "/upload", "/api/v1/files", handleFileUpload)
+	legacy("GET", "/files", "/api/v1/files", handleListFiles)
+	legacy("GET", "/files/{id}", "/api/v1/files/{id}/content", handleDownloadFile)
+	legacy("DELETE", "/files/{id}/delete", "/api/v1/files/{id}", handleDeleteFile)
+	legacy("PUT", "/files/{id}/move", "/api/v1/files/{id}", handleMoveFile)
+	legacy("GET", "/files/{id}/versions", "/api/v1/files/{id}/versions", handleListFileVersions)
+	legacy("POST", "/files/{id}/versions", "/api/v1/files/{id}/versions", handleUploadFileVersion)
+	legacy("GET", "/files/{id}/versions/{version}", "/api/v1/files/{id}/versions/{version}/content", handleDownloadFileVersion)
+	legacy("POST", "/files/{id}/restore/{version}", "/api/v1/files/{id}/versions/{version}/restore", handleRestoreFileVersion)
+	legacy("GET", "/search", "/api/v1/search", handleSearch)
+
+	legacy("POST", "/folders/create", "/api/v1/folders", handleCreateFolder)
+	legacy("GET", "/folders/{id}", "/api/v1/folders/{id}", handleGetFolder)
+	legacy("PUT", "/folders/{id}/rename", "/api/v1/folders/{id}", handleRenameFolder)
+	legacy("PUT", "/folders/{id}/move", "/api/v1/folders/{id}", handleMoveFolder)
+	legacy("DELETE", "/folders/{id}/delete", "/api/v1/folders/{id}", handleDeleteFolder)
+
+	legacy("GET", "/notes", "/api/v1/notes", handleListNotes)
+	legacy("POST", "/notes/create", "/api/v1/notes", handleCreateNote)
+	legacy("GET", "/notes/{id}", "/api/v1/notes/{id}", handleGetNote)
+	legacy("PUT", "/notes/{id}/update", "/api/v1/notes/{id}", handleUpdateNote)
+	legacy("DELETE", "/notes/{id}/delete", "/api/v1/notes/{id}", handleDeleteNote)
+	legacy("GET", "/notes/{id}/revisions", "/api/v1/notes/{id}/revisions", handleListNoteRevisions)
+	legacy("GET", "/notes/{id}/revisions/{rev}", "/api/v1/notes/{id}/revisions/{rev}", handleGetNoteRevision)
+	legacy("GET", "/notes/{id}/diff", "/api/v1/notes/{id}/diff", handleDiffNoteRevisions)
+	legacy("POST", "/notes/{id}/restore/{rev}", "/api/v1/notes/{id}/revisions/{rev}/restore", handleRestoreNoteRevision)
+}
+
+// deprecated marks responses of a legacy route, pointing at its successor.
+// {var} placeholders in successor are filled from the route variables.
+func deprecated(successor string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link := successor
+		for name, value := range mux.Vars(r) {
+			link = strings.ReplaceAll(link, "{"+name+"}", url.PathEscape(value))
+		}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", "<"+link+`>; rel="successor-version"`)
+		next(w, r)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"cloud/internal/acl"
+	"cloud/internal/collab"
+	"cloud/internal/notes"
+	"cloud/internal/ws"
+)
+
+var collabService *collab.Service
+
+// noteAccess lets into an editing session everyone who can see a note,
+// and lets those with at least editor rights change it
+func noteAccess(ctx context.Context, email, noteID string) (string, bool, error) {
+	access, err := aclService.Check(ctx, email, acl.Note, noteID, acl.RoleViewer)
+	if errors.Is(err, acl.ErrNotFound) {
+		return "", false, notes.ErrNotFound
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return access.Owner, access.Role.Allows(acl.RoleEditor), nil
+}
+
+// announceSnapshot tells those who can see a note that an editing session
+// saved it
+func announceSnapshot(owner string, note notes.Note) {
+	notify(context.Background(), owner, acl.Note, note.ID, ws.NoteUpdated, note)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud/internal/db"
+	"cloud/internal/storage"
+)
+
+// canInline reports whether a browser may display a content type in place
+// with ?inline=1. Anything that can run script in our origin, such as HTML
+// or SVG, is always downloaded as an attachment.
+func canInline(mediaType string) bool {
+	mediaType = strings.ToLower(mediaType)
+	switch {
+	case mediaType == "application/pdf", mediaType == "text/plain":
+		return true
+	case mediaType == "image/svg+xml":
+		return false
+	}
+	return strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "video/") ||
+		strings.HasPrefix(mediaType, "audio/")
+}
+
+// download describes stored content being sent to a client
+type download struct {
+	Filename    string
+	ContentType string
+	ETag        string
+	Modified    time.Time
+}
+
+// fileDownload describes the current content of a file. Every version of a
+// file is immutable, so its ID and version make a strong ETag.
+func fileDownload(f db.File) download {
+	version := f.Version
+	if version == 0 {
+		version = 1
+	}
+	return download{
+		Filename:    f.Filename,
+		ContentType: f.ContentType,
+		ETag:        fmt.Sprintf(`"%s.v%d"`, f.FileID, version),
+		Modified:    f.UploadedAt,
+	}
+}
+
+func versionDownload(f db.File, v db.FileVersion) download {
+	return download{
+		Filename:    f.Filename,
+		ContentType: v.ContentType,
+		ETag:        fmt.Sprintf(`"%s.v%d"`, f.FileID, v.Version),
+		Modified:    v.UploadedAt,
+	}
+}
+
+// notModified reports whether serveContent will answer r with 304 Not
+// Modified, by the same rules as http.ServeContent
+func notModified(r *http.Request, d download) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if d.ETag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == d.ETag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || d.Modified.IsZero() {
+		return false
+	}
+	return !d.Modified.Truncate(time.Second).After(since)
+}
+
+// serveContent sends a stored object. http.ServeContent takes care of
+// Range and If-Range (206 Partial Content) and of If-None-Match and
+// If-Modified-Since (304 Not Modified). With ?inline=1 types that are safe
+// to display are sent inline for previews; everything else is an
+// attachment.
+func serveContent(w http.ResponseWriter, r *http.Request, object storage.Object, d download) {
+	contentType := d.ContentType
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		contentType, mediaType = "application/octet-stream", "application/octet-stream"
+	}
+
+	disposition := "attachment"
+	if inline := r.URL.Query().Get("inline"); (inline == "1" || inline == "true") && canInline(mediaType) {
+		disposition = "inline"
+		// Previews only display; nothing in them may load or run anything
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'")
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": d.Filename}))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if d.ETag != "" {
+		w.Header().Set("ETag", d.ETag)
+	}
+
+	http.ServeContent(w, r, d.Filename, d.Modified, object)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"cloud/internal/acl"
+	"cloud/internal/ws"
+)
+
+// hub holds the open /ws connections
+var hub *ws.Hub
+
+// permissionChange is the payload of permissions.changed. Role is empty
+// when the grant was revoked.
+type permissionChange struct {
+	Type  acl.Resource `json:"type"`
+	ID    string       `json:"id"`
+	Email string       `json:"email"`
+	Role  acl.Role     `json:"role,omitempty"`
+}
+
+// handleWebSocket streams change events for everything the session user
+// can see, so open dashboards refresh when it changes elsewhere
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	hub.Serve(w, r, email)
+}
+
+// audience lists who can see one of owner's resources. If that cannot be
+// worked out only the owner is told about changes.
+func audience(ctx context.Context, owner string, res acl.Resource, id string) []string {
+	to, err := aclService.Audience(ctx, owner, res, id)
+	if err != nil {
+		log.Printf("Error listing who can see %s %s: %v", res, id, err)
+		return []string{owner}
+	}
+	return to
+}
+
+// accessAudience is audience for a resource email has access to but may
+// not own
+func accessAudience(ctx context.Context, email string, res acl.Resource, id string) []string {
+	access, err := aclService.Check(ctx, email, res, id, acl.RoleViewer)
+	if err != nil {
+		return []string{email}
+	}
+	return audience(ctx, access.Owner, res, id)
+}
+
+// notify sends an event about one of owner's resources to everyone who
+// can see it
+func notify(ctx context.Context, owner string, res acl.Resource, id, event string, payload interface{}) {
+	publish(audience(ctx, owner, res, id), event, payload)
+}
+
+// publish sends an event to every connection of each user in to
+func publish(to []string, event string, payload interface{}) {
+	sent := make(map[string]bool, len(to))
+	for _, email := range to {
+		if sent[email] {
+			continue
+		}
+		sent[email] = true
+		hub.BroadcastToUser(email, ws.Message{Type: event, Payload: payload})
+	}
+}
+
+// handleGetWebSocketStats reports the open connections and how many
+// messages were delivered or dropped
+func handleGetWebSocketStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hub.Stats())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"cloud/internal/acl"
+	"cloud/internal/files"
+	"cloud/internal/ws"
+)
+
+func handleListFileVersions(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := authorize(w, r, acl.File, mux.Vars(r)["id"], acl.RoleViewer)
+	if !ok {
+		return
+	}
+
+	versions, err := fileService.Versions(r.Context(), owner, mux.Vars(r)["id"])
+	if err != nil {
+		writeFileError(w, r, err, "listing versions")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// handleUploadFileVersion stores the uploaded "file" form field as the new
+// content of an existing file
+func handleUploadFileVersion(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := authorize(w, r, acl.File, mux.Vars(r)["id"], acl.RoleEditor)
+	if !ok || !checkQuota(w, r, owner) {
+		return
+	}
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error parsing form")
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Error getting file")
+		return
+	}
+	defer file.Close()
+
+	fileRecord, err := fileService.AddVersion(r.Context(), owner, mux.Vars(r)["id"], files.Upload{
+		Filename:    header.Filename,
+		ContentType: header.Header.Get("Content-Type"),
+		Size:        header.Size,
+		Body:        file,
+	})
+	if err != nil {
+		writeFileError(w, r, err, "uploading version")
+		return
+	}
+	searchIndex.Put(fileDocument(fileRecord))
+	notify(r.Context(), owner, acl.File, fileRecord.FileID, ws.FileUpdated, fileRecord)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(fileRecord)
+}
+
+func handleDownloadFileVersion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	owner, _, ok := authorize(w, r, acl.File, vars["id"], acl.RoleViewer)
+	if !ok {
+		return
+	}
+
+	version, err := strconv.Atoi(vars["version"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid version")
+		return
+	}
+
+	fileRecord, v, object, err := fileService.OpenVersion(r.Context(), owner, vars["id"], version)
+	if err != nil {
+		writeFileError(w, r, err, "downloading version")
+		return
+	}
+	defer object.Close()
+
+	serveContent(w, r, object, versionDownload(fileRecord, v))
+}
+
+// handleRestoreFileVersion copies an older version into a new current
+// version
+func handleRestoreFileVersion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	owner, _, ok := authorize(w, r, acl.File, vars["id"], acl.RoleEditor)
+	if !ok {
+		return
+	}
+
+	version, err := strconv.Atoi(vars["version"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid version")
+		return
+	}
+
+	fileRecord, err := fileService.Restore(r.Context(), owner, vars["id"], version)
+	if err != nil {
+		writeFileError(w, r, err, "restoring version")
+		return
+	}
+	searchIndex.Put(fileDocument(fileRecord))
+	notify(r.Context(), owner, acl.File, fileRecord.FileID, ws.FileUpdated, fileRecord)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileRecord)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"cloud/internal/acl"
+	"cloud/internal/db"
+	"cloud/internal/folders"
+	"cloud/internal/search"
+	"cloud/internal/ws"
+)
+
+// writeFolderError maps folders service errors onto HTTP responses
+func writeFolderError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	switch {
+	case errors.Is(err, folders.ErrNotFound), errors.Is(err, folders.ErrFileNotFound):
+		writeError(w, r, http.StatusNotFound, err.Error())
+	case errors.Is(err, folders.ErrInvalidName), errors.Is(err, folders.ErrCycle):
+		writeError(w, r, http.StatusBadRequest, err.Error())
+	case errors.Is(err, folders.ErrNameTaken), errors.Is(err, folders.ErrNotEmpty):
+		writeError(w, r, http.StatusConflict, err.Error())
+	default:
+		log.Printf("[%s] Error %s: %v", requestID(r), action, err)
+		writeError(w, r, http.StatusInternalServerError, "Error "+action)
+	}
+}
+
+// folderRequest is the body of folder create, rename and move requests
+type folderRequest struct {
+	Name     string `json:"name"`
+	ParentID string `json:"parent_id"`
+}
+
+func handleCreateFolder(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	var req folderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	folder, err := folderService.Create(r.Context(), email, req.ParentID, req.Name)
+	if err != nil {
+		writeFolderError(w, r, err, "creating folder")
+		return
+	}
+	notify(r.Context(), email, acl.Folder, folder.FolderID, ws.FolderCreated, folder)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(folder)
+}
+
+// handleGetFolder lists a folder's subfolders and files. The id "root"
+// lists the top level.
+func handleGetFolder(w http.ResponseWriter, r *http.Request) {
+	owner := userEmail(r)
+	folderID := mux.Vars(r)["id"]
+
+	// Everyone's root is their own; other folders may be shared
+	if folderID != folders.RootID && folderID != "" {
+		var ok bool
+		if owner, _, ok = authorize(w, r, acl.Folder, folderID, acl.RoleViewer); !ok {
+			return
+		}
+	}
+
+	listing, err := folderService.List(r.Context(), owner, folderID)
+	if err != nil {
+		writeFolderError(w, r, err, "listing folder")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+func handleRenameFolder(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := authorize(w, r, acl.Folder, mux.Vars(r)["id"], acl.RoleOwner)
+	if !ok {
+		return
+	}
+
+	var req folderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	folder, err := folderService.Rename(r.Context(), owner, mux.Vars(r)["id"], req.Name)
+	if err != nil {
+		writeFolderError(w, r, err, "renaming folder")
+		return
+	}
+	notify(r.Context(), owner, acl.Folder, folder.FolderID, ws.FolderUpdated, folder)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(folder)
+}
+
+func handleMoveFolder(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := authorize(w, r, acl.Folder, mux.Vars(r)["id"], acl.RoleOwner)
+	if !ok {
+		return
+	}
+
+	var req folderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	// Both those who could see it before and after the move are told
+	before := audience(r.Context(), owner, acl.Folder, mux.Vars(r)["id"])
+	folder, err := folderService.Move(r.Context(), owner, mux.Vars(r)["id"], req.ParentID)
+	if err != nil {
+		writeFolderError(w, r, err, "moving folder")
+		return
+	}
+	publish(append(before, audience(r.Context(), owner, acl.Folder, folder.FolderID)...), ws.FolderUpdated, folder)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(folder)
+}
+
+// folderUpdate is a partial folder update; absent fields are unchanged
+type folderUpdate struct {
+	Name     *string `json:"name"`
+	ParentID *string `json:"parent_id"`
+}
+
+// handleUpdateFolder applies a partial update: name renames the folder and
+// parent_id moves it
+func handleUpdateFolder(w http.ResponseWriter, r *http.Request) {
+	folderID := mux.Vars(r)["id"]
+	owner, _, ok := authorize(w, r, acl.Folder, folderID, acl.RoleOwner)
+	if !ok {
+		return
+	}
+
+	var req folderUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Name == nil && req.ParentID == nil {
+		writeError(w, r, http.StatusBadRequest, "Nothing to update, expected name or parent_id")
+		return
+	}
+
+	before := audience(r.Context(), owner, acl.Folder, folderID)
+	var folder db.Folder
+	var err error
+	if req.Name != nil {
+		if folder, err = folderService.Rename(r.Context(), owner, folderID, *req.Name); err != nil {
+			writeFolderError(w, r, err, "renaming folder")
+			return
+		}
+	}
+	if req.ParentID != nil {
+		if folder, err = folderService.Move(r.Context(), owner, folderID, *req.ParentID); err != nil {
+			writeFolderError(w, r, err, "moving folder")
+			return
+		}
+	}
+	publish(append(before, audience(r.Context(), owner, acl.Folder, folderID)...), ws.FolderUpdated, folder)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(folder)
+}
+
+// handleDeleteFolder deletes an empty folder, or with ?recursive=true the
+// folder and everything in it
+func handleDeleteFolder(w http.ResponseWriter, r *http.Request) {
+	recursive := r.URL.Query().Get("recursive") == "true"
+	owner, _, ok := authorize(w, r, acl.Folder, mux.Vars(r)["id"], acl.RoleOwner)
+	if !ok {
+		return
+	}
+
+	// The folder is gone afterwards, taking the way to its grants with it
+	folderID := mux.Vars(r)["id"]
+	to := audience(r.Context(), owner, acl.Folder, folderID)
+	removed, err := folderService.Delete(r.Context(), owner, folderID, recursive)
+	if err != nil {
+		writeFolderError(w, r, err, "deleting folder")
+		return
+	}
+	for _, f := range removed {
+		searchIndex.Delete(owner, search.TypeFile, f.FileID)
+	}
+	publish(to, ws.FolderDeleted, ws.Deleted{ID: folderID})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleMoveFile moves a file to another folder without touching its data
+func handleMoveFile(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := authorize(w, r, acl.File, mux.Vars(r)["id"], acl.RoleOwner)
+	if !ok {
+		return
+	}
+
+	var req folderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	before := audience(r.Context(), owner, acl.File, mux.Vars(r)["id"])
+	file, err := folderService.MoveFile(r.Context(), owner, mux.Vars(r)["id"], req.ParentID)
+	if err != nil {
+		writeFolderError(w, r, err, "moving file")
+		return
+	}
+	publish(append(before, audience(r.Context(), owner, acl.File, file.FileID)...), ws.FileUpdated, file)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
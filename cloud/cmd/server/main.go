@@ -1,34 +1,52 @@
 package main
 
 import (
+    "context"
+    "errors"
     "log"
     "net/http"
     "os"
     "path/filepath"
+    "strings"
     "encoding/json"
-    "io/ioutil"
-    "io"
     "fmt"
     "time"
-    "sort"
 
     "github.com/gorilla/mux"
     "github.com/gorilla/sessions"
     "github.com/joho/godotenv"
-    "github.com/google/uuid"
 
+    "cloud/internal/acl"
     "cloud/internal/auth"
+    "cloud/internal/collab"
+    "cloud/internal/database"
     "cloud/internal/db"
+    "cloud/internal/files"
+    "cloud/internal/folders"
+    "cloud/internal/notes"
+    "cloud/internal/quota"
+    "cloud/internal/search"
+    "cloud/internal/shares"
     "cloud/internal/storage"
+    "cloud/internal/trash"
+    "cloud/internal/uploads"
+    "cloud/internal/ws"
 )
 
 var (
-    store *sessions.CookieStore
+    store         *sessions.CookieStore
+    objects       storage.ObjectStore
+    metadata      db.MetadataStore
+    noteService   *notes.Service
+    searchIndex   *search.Index
+    folderService *folders.Service
+    fileService   *files.Service
+    uploadService *uploads.Service
 )
 
 func init() {
     if err := godotenv.Load(); err != nil {
-        log.Fatal("Error loading .env file")
+        log.Println("No .env file found, using process environment")
     }
 
     // Initialize auth
@@ -36,27 +54,182 @@ func init() {
 
     // Initialize session store
     store = sessions.NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))
+}
 
-    // Initialize database connection
-    if err := db.InitDB(); err != nil {
+// openStores connects the metadata and object stores used by the handlers
+func openStores() {
+    // Initialize metadata store (Cassandra or embedded JSON, see METADATA_BACKEND)
+    var err error
+    metadata, err = openMetadataStore()
+    if err != nil {
         log.Fatalf("Failed to initialize database: %v", err)
     }
 
-    // Initialize MinIO storage
-    if err := storage.InitStorage(); err != nil {
-        log.Fatalf("Failed to initialize MinIO storage: %v", err)
+    // Initialize object storage (MinIO or local disk, see STORAGE_BACKEND)
+    storageConfig := storage.ConfigFromEnv()
+    objects, err = storage.Open(context.Background(), storageConfig)
+    if err != nil {
+        log.Fatalf("Failed to initialize %s storage: %v", storageConfig.Backend, err)
+    }
+
+    policy, err := files.PolicyFromEnv()
+    if err != nil {
+        log.Fatalf("Invalid FILE_DUPLICATE_POLICY: %v", err)
+    }
+    limit, err := quota.LimitFromEnv()
+    if err != nil {
+        log.Fatal(err)
+    }
+    quotaService = quota.NewService(metadata, limit)
+    fileService = files.NewService(metadata, objects, policy, quotaService)
+    folderService = folders.NewService(metadata, fileService)
+
+    // Background pruning of old file versions
+    retention, err := files.RetentionFromEnv()
+    if err != nil {
+        log.Fatalf("Invalid file version retention: %v", err)
+    }
+    if retention.Enabled() {
+        interval := time.Hour
+        if v := os.Getenv("FILE_VERSIONS_PRUNE_INTERVAL"); v != "" {
+            if interval, err = time.ParseDuration(v); err != nil || interval <= 0 {
+                log.Fatalf("Invalid FILE_VERSIONS_PRUNE_INTERVAL %q", v)
+            }
+        }
+        go fileService.RunPruner(context.Background(), retention, interval)
+    }
+
+    // Background repair of files whose records and objects disagree
+    loadAdmins()
+    if reconcileGrace, err = files.ReconcileGraceFromEnv(); err != nil {
+        log.Fatal(err)
+    }
+    reconcileInterval := time.Hour
+    if v := os.Getenv("RECONCILE_INTERVAL"); v != "" {
+        if reconcileInterval, err = time.ParseDuration(v); err != nil || reconcileInterval <= 0 {
+            log.Fatalf("Invalid RECONCILE_INTERVAL %q", v)
+        }
+    }
+    reconcileRepair, err := files.ReconcileRepairFromEnv()
+    if err != nil {
+        log.Fatal(err)
+    }
+    go fileService.RunReconciler(context.Background(), reconcileGrace, reconcileInterval, reconcileRepair, saveReconcileReport)
+
+    // Search index, rebuilt from the metadata store if missing
+    searchIndex = openSearchIndex(context.Background())
+
+    // Resumable uploads, assembled with multipart uploads in object storage
+    multipart, ok := objects.(storage.MultipartStore)
+    if !ok {
+        log.Fatalf("%s storage does not support multipart uploads", storageConfig.Backend)
+    }
+    ttl, err := uploads.TTLFromEnv()
+    if err != nil {
+        log.Fatal(err)
+    }
+    uploadService = uploads.NewService(metadata, multipart, fileService, ttl)
+    uploadService.OnFinish(func(f db.File) {
+        searchIndex.Put(fileDocument(f))
+        notify(context.Background(), f.UserEmail, acl.File, f.FileID, ws.FileUploaded, f)
+    })
+    go uploadService.RunReaper(context.Background(), time.Hour)
+    openPresigner()
+
+    shareService = shares.NewService(metadata, fileService)
+    aclService = acl.NewService(metadata)
+
+    // Change events for open dashboards, shared between instances through
+    // the bus named by EVENT_BUS
+    busConfig := ws.BusConfigFromEnv()
+    bus, err := ws.OpenBus(busConfig)
+    if err != nil {
+        log.Fatalf("Failed to open %s event bus: %v", busConfig.Backend, err)
+    }
+    hub = ws.NewHub(bus)
+    go hub.Run(context.Background())
+
+    noteService = notes.NewService(metadata)
+    noteService.OnChange(indexNoteChange)
+
+    // Notes edited together over /ws, saved every NOTE_SNAPSHOT_INTERVAL
+    snapshotInterval, err := collab.SnapshotIntervalFromEnv()
+    if err != nil {
+        log.Fatal(err)
+    }
+    collabService = collab.NewService(noteService, hub, noteAccess)
+    collabService.OnSave(announceSnapshot)
+    noteService.OnChange(collabService.NoteChanged)
+    hub.OnMessage(collabService.Handle)
+    hub.OnClose(collabService.Disconnect)
+    go collabService.RunSnapshotter(context.Background(), snapshotInterval)
+
+    // Trash, emptied of items older than TRASH_RETENTION_DAYS
+    trashRetention, err := trash.RetentionFromEnv()
+    if err != nil {
+        log.Fatal(err)
+    }
+    trashService = trash.NewService(fileService, noteService, trashRetention)
+    go trashService.RunPurger(context.Background(), time.Hour)
+
+    // Carry over notes saved by the old file based handlers
+    if n, err := noteService.ImportDir(context.Background(), "notes"); err != nil {
+        log.Printf("Error importing legacy notes: %v", err)
+    } else if n > 0 {
+        log.Printf("Imported %d legacy notes", n)
     }
 }
 
-type Note struct {
-    ID        string    `json:"id"`
-    Title     string    `json:"title"`
-    Content   string    `json:"content"`
-    CreatedAt time.Time `json:"createdAt"`
-    UpdatedAt time.Time `json:"updatedAt"`
+// openMetadataStore connects to the metadata backend named by METADATA_BACKEND
+func openMetadataStore() (db.MetadataStore, error) {
+    switch backend := os.Getenv("METADATA_BACKEND"); backend {
+    case "", "cassandra":
+        return db.NewCassandraStore(context.Background(), db.CassandraConfigFromEnv())
+    case "json":
+        path := os.Getenv("METADATA_PATH")
+        if path == "" {
+            path = filepath.Join("data", "metadata.json")
+        }
+        return database.NewDB(path)
+    default:
+        return nil, fmt.Errorf("unknown metadata backend %q", backend)
+    }
 }
 
 func main() {
+    if len(os.Args) > 1 && os.Args[1] == "migrate" {
+        runMigrate(os.Args[2:])
+        return
+    }
+
+    if len(os.Args) > 1 && os.Args[1] == "quota" {
+        runQuota(os.Args[2:])
+        return
+    }
+
+    if len(os.Args) > 1 && os.Args[1] == "openapi" {
+        runOpenAPI()
+        return
+    }
+
+    openStores()
+    openAuth()
+
+    r := newRouter()
+    checkAPISpec(r)
+
+    port := os.Getenv("PORT")
+    if port == "" {
+        port = "8080"
+    }
+
+    log.Printf("Server starting on port %s...", port)
+    if err := http.ListenAndServe(":"+port, withRequestID(r)); err != nil {
+        log.Fatal(err)
+    }
+}
+
+func newRouter() *mux.Router {
     r := mux.NewRouter()
 
     // Serve static files
@@ -66,42 +239,51 @@ func main() {
     // Auth routes
     r.HandleFunc("/", handleHome)
     r.HandleFunc("/login", auth.HandleGoogleLogin)
-    r.HandleFunc("/auth/google/callback", auth.HandleGoogleCallback)
+    r.HandleFunc("/auth/google/callback", authService.HandleGoogleCallback)
+    r.HandleFunc("/auth/register", handleRegister).Methods("POST")
+    r.HandleFunc("/auth/login", handleLogin).Methods("POST")
     r.HandleFunc("/logout", handleLogout)
 
+    // API documentation
+    r.HandleFunc("/api/docs", handleAPIDocs).Methods("GET")
+
+    // Public share links
+    r.HandleFunc("/s/{token}", handleSharePage).Methods("GET")
+
     // Protected routes
     r.HandleFunc("/dashboard", requireAuth(handleDashboard))
-    r.HandleFunc("/upload", requireAuth(handleFileUpload)).Methods("POST")
-    r.HandleFunc("/files", requireAuth(handleListFiles)).Methods("GET")
-    r.HandleFunc("/files/{filename}", requireAuth(handleDownloadFile)).Methods("GET")
-    r.HandleFunc("/files/{filename}/delete", requireAuth(handleDeleteFile)).Methods("DELETE")
-
-    // Note routes
-    r.HandleFunc("/notes", requireAuth(handleListNotes)).Methods("GET")
-    r.HandleFunc("/notes/create", requireAuth(handleCreateNote)).Methods("POST")
-    r.HandleFunc("/notes/{id}", requireAuth(handleGetNote)).Methods("GET")
-    r.HandleFunc("/notes/{id}/update", requireAuth(handleUpdateNote)).Methods("PUT")
-    r.HandleFunc("/notes/{id}/delete", requireAuth(handleDeleteNote)).Methods("DELETE")
+    r.HandleFunc("/ws", requireAuth(handleWebSocket))
+    registerAPIRoutes(r)
+    registerLegacyRoutes(r)
 
-    port := os.Getenv("PORT")
-    if port == "" {
-        port = "8080"
-    }
-
-    log.Printf("Server starting on port %s...", port)
-    if err := http.ListenAndServe(":"+port, r); err != nil {
-        log.Fatal(err)
-    }
+    return r
 }
 
+// requireAuth lets through requests with a session cookie or a bearer
+// token, making the user's email available through userEmail. It sends
+// browsers without a session to the login page and answers API clients
+// with a 401 error.
 func requireAuth(next http.HandlerFunc) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        session, _ := store.Get(r, "session")
-        if email, ok := session.Values["email"].(string); !ok || email == "" {
-            http.Redirect(w, r, "/", http.StatusSeeOther)
+        email, err := authenticate(r)
+        if errors.Is(err, auth.ErrInvalidToken) {
+            writeError(w, r, http.StatusUnauthorized, "Invalid or expired token")
+            return
+        }
+        if err != nil {
+            log.Printf("[%s] Error checking token: %v", requestID(r), err)
+            writeError(w, r, http.StatusInternalServerError, "Error checking token")
+            return
+        }
+        if email == "" {
+            if strings.Contains(r.Header.Get("Accept"), "text/html") {
+                http.Redirect(w, r, "/", http.StatusSeeOther)
+                return
+            }
+            writeError(w, r, http.StatusUnauthorized, "Not logged in")
             return
         }
-        next(w, r)
+        next(w, r.WithContext(withUser(r.Context(), email)))
     }
 }
 
@@ -113,6 +295,7 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
     session, _ := store.Get(r, "session")
     session.Values["email"] = ""
     session.Values["name"] = ""
+    session.Values["user_id"] = ""
     session.Save(r, w)
     http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -121,307 +304,288 @@ func handleDashboard(w http.ResponseWriter, r *http.Request) {
     http.ServeFile(w, r, "web/templates/dashboard.html")
 }
 
+// writeFileError maps files service errors onto HTTP responses
+func writeFileError(w http.ResponseWriter, r *http.Request, err error, action string) {
+    switch {
+    case errors.Is(err, files.ErrNotFound):
+        writeError(w, r, http.StatusNotFound, "File not found")
+    case errors.Is(err, files.ErrVersionNotFound):
+        writeError(w, r, http.StatusNotFound, "Version not found")
+    case errors.Is(err, files.ErrDuplicate):
+        writeError(w, r, http.StatusConflict, err.Error())
+    case errors.Is(err, files.ErrInvalidName):
+        writeError(w, r, http.StatusBadRequest, "Invalid filename")
+    case errors.Is(err, quota.ErrExceeded):
+        writeError(w, r, http.StatusRequestEntityTooLarge, "Storage quota exceeded; delete files or old versions, or empty the trash, to make room, see /api/v1/me/usage")
+    default:
+        log.Printf("[%s] Error %s: %v", requestID(r), action, err)
+        writeError(w, r, http.StatusInternalServerError, "Error "+action)
+    }
+}
+
 func handleFileUpload(w http.ResponseWriter, r *http.Request) {
-    session, _ := store.Get(r, "session")
-    email := session.Values["email"].(string)
+    email := userEmail(r)
+    if !checkQuota(w, r, email) {
+        return
+    }
 
     // Parse multipart form
     if err := r.ParseMultipartForm(32 << 20); err != nil {
-        http.Error(w, "Error parsing form", http.StatusBadRequest)
+        writeError(w, r, http.StatusBadRequest, "Error parsing form")
         return
     }
 
     file, header, err := r.FormFile("file")
     if err != nil {
-        http.Error(w, "Error getting file", http.StatusBadRequest)
+        writeError(w, r, http.StatusBadRequest, "Error getting file")
         return
     }
     defer file.Close()
 
-    // Create a new file record
-    fileID := uuid.New().String()
-    fileRecord := db.File{
-        UserEmail:    email,
-        FileID:       fileID,
-        Filename:     header.Filename,
-        Size:         header.Size,
-        ContentType:  header.Header.Get("Content-Type"),
-        StoragePath:  fmt.Sprintf("%s/%s", email, header.Filename),
-        UploadedAt:   time.Now(),
-    }
-
-    // Upload file to MinIO
-    storagePath, err := storage.UploadFile(email, header.Filename, header.Size, file)
+    // Files go to the root unless a parent_id form field names a folder
+    parentID, err := folderService.ResolveParent(r.Context(), email, r.FormValue("parent_id"))
     if err != nil {
-        http.Error(w, "Error uploading file", http.StatusInternalServerError)
+        writeFolderError(w, r, err, "checking folder")
         return
     }
-    fileRecord.StoragePath = storagePath
 
-    // Save file metadata to database
-    if err := db.SaveFileMetadata(fileRecord); err != nil {
-        // Try to delete the uploaded file if metadata save fails
-        storage.DeleteFile(email, header.Filename)
-        http.Error(w, "Error saving file metadata", http.StatusInternalServerError)
+    fileRecord, err := fileService.Upload(r.Context(), email, files.Upload{
+        Filename:    header.Filename,
+        ParentID:    parentID,
+        ContentType: header.Header.Get("Content-Type"),
+        Size:        header.Size,
+        Body:        file,
+    })
+    if err != nil {
+        writeFileError(w, r, err, "uploading file")
         return
     }
+    searchIndex.Put(fileDocument(fileRecord))
+    notify(r.Context(), email, acl.File, fileRecord.FileID, ws.FileUploaded, fileRecord)
 
+    w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(fileRecord)
 }
 
-func handleDownloadFile(w http.ResponseWriter, r *http.Request) {
-    session, _ := store.Get(r, "session")
-    email := session.Values["email"].(string)
-    vars := mux.Vars(r)
-    filename := vars["filename"]
+func handleGetFile(w http.ResponseWriter, r *http.Request) {
+    owner, _, ok := authorize(w, r, acl.File, mux.Vars(r)["id"], acl.RoleViewer)
+    if !ok {
+        return
+    }
 
-    // Get file metadata from database
-    files, err := db.GetUserFiles(email)
+    fileRecord, err := fileService.Get(r.Context(), owner, mux.Vars(r)["id"])
     if err != nil {
-        http.Error(w, "Error getting file metadata", http.StatusInternalServerError)
+        writeFileError(w, r, err, "reading file")
         return
     }
 
-    var fileRecord db.File
-    for _, f := range files {
-        if f.Filename == filename {
-            fileRecord = f
-            break
-        }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(fileRecord)
+}
+
+// fileUpdate is a partial file update; absent fields are unchanged
+type fileUpdate struct {
+    ParentID *string `json:"parent_id"`
+}
+
+// handleUpdateFile applies a partial update to a file record. Only
+// parent_id can change, which moves the file.
+func handleUpdateFile(w http.ResponseWriter, r *http.Request) {
+    fileID := mux.Vars(r)["id"]
+    owner, _, ok := authorize(w, r, acl.File, fileID, acl.RoleOwner)
+    if !ok {
+        return
     }
 
-    if fileRecord.FileID == "" {
-        http.Error(w, "File not found", http.StatusNotFound)
+    var req fileUpdate
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, r, http.StatusBadRequest, "Invalid request body")
         return
     }
 
-    // Get file from MinIO
-    object, err := storage.DownloadFile(email, filename)
+    fileRecord, err := fileService.Get(r.Context(), owner, fileID)
     if err != nil {
-        http.Error(w, "Error downloading file", http.StatusInternalServerError)
+        writeFileError(w, r, err, "reading file")
         return
     }
-    defer object.Close()
+    if req.ParentID != nil {
+        // Both those who could see it before and after the move are told
+        before := audience(r.Context(), owner, acl.File, fileID)
+        fileRecord, err = folderService.MoveFile(r.Context(), owner, fileID, *req.ParentID)
+        if err != nil {
+            writeFolderError(w, r, err, "moving file")
+            return
+        }
+        publish(append(before, audience(r.Context(), owner, acl.File, fileID)...), ws.FileUpdated, fileRecord)
+    }
 
-    // Set response headers
-    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
-    w.Header().Set("Content-Type", fileRecord.ContentType)
-    w.Header().Set("Content-Length", fmt.Sprintf("%d", fileRecord.Size))
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(fileRecord)
+}
 
-    // Stream file to response
-    if _, err := io.Copy(w, object); err != nil {
-        log.Printf("Error streaming file: %v", err)
+func handleDownloadFile(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    owner, _, ok := authorize(w, r, acl.File, vars["id"], acl.RoleViewer)
+    if !ok {
+        return
     }
+
+    fileRecord, object, err := fileService.Open(r.Context(), owner, vars["id"])
+    if err != nil {
+        writeFileError(w, r, err, "downloading file")
+        return
+    }
+    defer object.Close()
+
+    serveContent(w, r, object, fileDownload(fileRecord))
 }
 
 func handleDeleteFile(w http.ResponseWriter, r *http.Request) {
-    session, _ := store.Get(r, "session")
-    email := session.Values["email"].(string)
     vars := mux.Vars(r)
-    filename := vars["filename"]
-
-    // Delete file from MinIO
-    if err := storage.DeleteFile(email, filename); err != nil {
-        http.Error(w, "Error deleting file from storage", http.StatusInternalServerError)
+    owner, _, ok := authorize(w, r, acl.File, vars["id"], acl.RoleOwner)
+    if !ok {
         return
     }
 
-    // Delete file metadata from database
-    if err := db.DeleteFile(email, filename); err != nil {
-        http.Error(w, "Error deleting file metadata", http.StatusInternalServerError)
+    fileRecord, err := fileService.Trash(r.Context(), owner, vars["id"])
+    if err != nil {
+        writeFileError(w, r, err, "deleting file")
         return
     }
+    searchIndex.Delete(owner, search.TypeFile, fileRecord.FileID)
+    notify(r.Context(), owner, acl.File, fileRecord.FileID, ws.FileDeleted, ws.Deleted{ID: fileRecord.FileID})
 
     w.WriteHeader(http.StatusOK)
 }
 
 func handleListFiles(w http.ResponseWriter, r *http.Request) {
-    session, _ := store.Get(r, "session")
-    email := session.Values["email"].(string)
+    email := userEmail(r)
 
-    files, err := db.GetUserFiles(email)
+    files, err := fileService.List(r.Context(), email)
     if err != nil {
-        http.Error(w, "Error getting files", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Error getting files")
         return
     }
+    if files == nil {
+        files = []db.File{}
+    }
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(files)
 }
 
 func handleCreateNote(w http.ResponseWriter, r *http.Request) {
-    session, _ := store.Get(r, "session")
-    email := session.Values["email"].(string)
+    email := userEmail(r)
 
-    var note Note
+    var note notes.Note
     if err := json.NewDecoder(r.Body).Decode(&note); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
-        return
-    }
-
-    note.ID = uuid.New().String()
-    note.CreatedAt = time.Now()
-    note.UpdatedAt = time.Now()
-
-    userDir := filepath.Join("notes", email)
-    if err := os.MkdirAll(userDir, 0755); err != nil {
-        http.Error(w, "Error creating user directory", http.StatusInternalServerError)
+        writeError(w, r, http.StatusBadRequest, "Invalid request body")
         return
     }
 
-    noteFile := filepath.Join(userDir, note.ID+".json")
-    noteData, err := json.Marshal(note)
+    note, err := noteService.Create(r.Context(), email, note)
     if err != nil {
-        http.Error(w, "Error encoding note", http.StatusInternalServerError)
-        return
-    }
-
-    if err := ioutil.WriteFile(noteFile, noteData, 0644); err != nil {
-        http.Error(w, "Error saving note", http.StatusInternalServerError)
+        log.Printf("[%s] Error creating note: %v", requestID(r), err)
+        writeError(w, r, http.StatusInternalServerError, "Error saving note")
         return
     }
+    publish([]string{email}, ws.NoteCreated, note)
 
     w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("ETag", noteETag(note.Version))
     json.NewEncoder(w).Encode(note)
 }
 
 func handleListNotes(w http.ResponseWriter, r *http.Request) {
-    session, _ := store.Get(r, "session")
-    email := session.Values["email"].(string)
+    email := userEmail(r)
 
-    userDir := filepath.Join("notes", email)
-    if err := os.MkdirAll(userDir, 0755); err != nil {
-        http.Error(w, "Error accessing user directory", http.StatusInternalServerError)
-        return
-    }
-
-    files, err := ioutil.ReadDir(userDir)
+    userNotes, err := noteService.List(r.Context(), email)
     if err != nil {
-        http.Error(w, "Error reading notes", http.StatusInternalServerError)
+        log.Printf("[%s] Error listing notes: %v", requestID(r), err)
+        writeError(w, r, http.StatusInternalServerError, "Error reading notes")
         return
     }
 
-    var notes []Note
-    for _, file := range files {
-        if filepath.Ext(file.Name()) == ".json" {
-            noteData, err := ioutil.ReadFile(filepath.Join(userDir, file.Name()))
-            if err != nil {
-                continue
-            }
-
-            var note Note
-            if err := json.Unmarshal(noteData, &note); err != nil {
-                continue
-            }
-            notes = append(notes, note)
-        }
-    }
-
-    // Sort notes by UpdatedAt (most recent first)
-    sort.Slice(notes, func(i, j int) bool {
-        return notes[i].UpdatedAt.After(notes[j].UpdatedAt)
-    })
-
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(notes)
+    json.NewEncoder(w).Encode(userNotes)
 }
 
 func handleGetNote(w http.ResponseWriter, r *http.Request) {
-    session, _ := store.Get(r, "session")
-    email := session.Values["email"].(string)
     vars := mux.Vars(r)
     noteID := vars["id"]
-
-    noteFile := filepath.Join("notes", email, noteID+".json")
-    if _, err := os.Stat(noteFile); os.IsNotExist(err) {
-        http.Error(w, "Note not found", http.StatusNotFound)
+    owner, _, ok := authorize(w, r, acl.Note, noteID, acl.RoleViewer)
+    if !ok {
         return
     }
 
-    noteData, err := ioutil.ReadFile(noteFile)
-    if err != nil {
-        http.Error(w, "Error reading note", http.StatusInternalServerError)
+    note, err := noteService.Get(r.Context(), owner, noteID)
+    if errors.Is(err, notes.ErrNotFound) {
+        writeError(w, r, http.StatusNotFound, "Note not found")
         return
     }
-
-    var note Note
-    if err := json.Unmarshal(noteData, &note); err != nil {
-        http.Error(w, "Error parsing note", http.StatusInternalServerError)
+    if err != nil {
+        log.Printf("[%s] Error reading note: %v", requestID(r), err)
+        writeError(w, r, http.StatusInternalServerError, "Error reading note")
         return
     }
 
     w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("ETag", noteETag(note.Version))
     json.NewEncoder(w).Encode(note)
 }
 
 func handleUpdateNote(w http.ResponseWriter, r *http.Request) {
-    session, _ := store.Get(r, "session")
-    email := session.Values["email"].(string)
     vars := mux.Vars(r)
     noteID := vars["id"]
-
-    var updatedNote Note
-    if err := json.NewDecoder(r.Body).Decode(&updatedNote); err != nil {
-        http.Error(w, "Invalid request body", http.StatusBadRequest)
+    owner, email, ok := authorize(w, r, acl.Note, noteID, acl.RoleEditor)
+    if !ok {
         return
     }
 
-    noteFile := filepath.Join("notes", email, noteID+".json")
-    if _, err := os.Stat(noteFile); os.IsNotExist(err) {
-        http.Error(w, "Note not found", http.StatusNotFound)
+    expected, ok := ifMatchVersion(r)
+    if !ok {
+        writeError(w, r, http.StatusBadRequest, "Invalid If-Match header")
         return
     }
 
-    // Read existing note
-    noteData, err := ioutil.ReadFile(noteFile)
-    if err != nil {
-        http.Error(w, "Error reading note", http.StatusInternalServerError)
-        return
-    }
-
-    var existingNote Note
-    if err := json.Unmarshal(noteData, &existingNote); err != nil {
-        http.Error(w, "Error parsing note", http.StatusInternalServerError)
+    var updatedNote notes.Note
+    if err := json.NewDecoder(r.Body).Decode(&updatedNote); err != nil {
+        writeError(w, r, http.StatusBadRequest, "Invalid request body")
         return
     }
 
-    // Update note
-    existingNote.Title = updatedNote.Title
-    existingNote.Content = updatedNote.Content
-    existingNote.UpdatedAt = time.Now()
-
-    // Save updated note
-    noteData, err = json.Marshal(existingNote)
+    note, err := noteService.UpdateAs(r.Context(), owner, email, noteID, updatedNote, expected)
     if err != nil {
-        http.Error(w, "Error encoding note", http.StatusInternalServerError)
-        return
-    }
-
-    if err := ioutil.WriteFile(noteFile, noteData, 0644); err != nil {
-        http.Error(w, "Error saving note", http.StatusInternalServerError)
+        writeNoteError(w, r, err, "saving note")
         return
     }
+    notify(r.Context(), owner, acl.Note, noteID, ws.NoteUpdated, note)
 
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(existingNote)
+    w.Header().Set("ETag", noteETag(note.Version))
+    json.NewEncoder(w).Encode(note)
 }
 
 func handleDeleteNote(w http.ResponseWriter, r *http.Request) {
-    session, _ := store.Get(r, "session")
-    email := session.Values["email"].(string)
     vars := mux.Vars(r)
     noteID := vars["id"]
+    owner, _, ok := authorize(w, r, acl.Note, noteID, acl.RoleOwner)
+    if !ok {
+        return
+    }
 
-    noteFile := filepath.Join("notes", email, noteID+".json")
-    if err := os.Remove(noteFile); err != nil {
-        if os.IsNotExist(err) {
-            http.Error(w, "Note not found", http.StatusNotFound)
-        } else {
-            http.Error(w, "Error deleting note", http.StatusInternalServerError)
-        }
+    expected, ok := ifMatchVersion(r)
+    if !ok {
+        writeError(w, r, http.StatusBadRequest, "Invalid If-Match header")
+        return
+    }
+
+    if _, err := noteService.Trash(r.Context(), owner, noteID, expected); err != nil {
+        writeNoteError(w, r, err, "deleting note")
         return
     }
+    notify(r.Context(), owner, acl.Note, noteID, ws.NoteDeleted, ws.Deleted{ID: noteID})
 
     w.WriteHeader(http.StatusOK)
 }
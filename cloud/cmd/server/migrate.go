@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"cloud/internal/db"
+)
+
+// runMigrate implements "server migrate [-status]", which brings the
+// Cassandra keyspace up to the schema version compiled into this binary
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	statusOnly := flags.Bool("status", false, "list migrations and whether they have been applied")
+	flags.Parse(args)
+
+	if backend := os.Getenv("METADATA_BACKEND"); backend != "" && backend != "cassandra" {
+		log.Printf("METADATA_BACKEND is %q, nothing to migrate", backend)
+		return
+	}
+
+	ctx := context.Background()
+	cfg := db.CassandraConfigFromEnv()
+
+	if *statusOnly {
+		status, err := db.SchemaStatus(ctx, cfg)
+		if err != nil {
+			log.Fatalf("Failed to read schema status: %v", err)
+		}
+		for _, m := range status {
+			applied := "pending"
+			if !m.AppliedAt.IsZero() {
+				applied = "applied " + m.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", m.Version, m.Name, applied)
+		}
+		return
+	}
+
+	applied, err := db.Migrate(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+	if len(applied) == 0 {
+		log.Printf("Schema is up to date (version %d)", db.LatestSchemaVersion())
+		return
+	}
+	log.Printf("Migrated %s to version %d", cfg.Keyspace, applied[len(applied)-1].Version)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"cloud/internal/acl"
+	"cloud/internal/notes"
+	"cloud/internal/ws"
+)
+
+// writeNoteError maps notes service errors onto HTTP responses
+func writeNoteError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	var conflict *notes.ConflictError
+	switch {
+	case errors.As(err, &conflict):
+		writeNoteConflict(w, r, conflict)
+	case errors.Is(err, notes.ErrNotFound):
+		writeError(w, r, http.StatusNotFound, "Note not found")
+	case errors.Is(err, notes.ErrRevisionNotFound):
+		writeError(w, r, http.StatusNotFound, "Revision not found")
+	case errors.Is(err, notes.ErrDiffTooLarge):
+		writeError(w, r, http.StatusUnprocessableEntity, "The revisions differ in too many lines to compare")
+	default:
+		log.Printf("[%s] Error %s: %v", requestID(r), action, err)
+		writeError(w, r, http.StatusInternalServerError, "Error "+action)
+	}
+}
+
+func handleListNoteRevisions(w http.ResponseWriter, r *http.Request) {
+	noteID := mux.Vars(r)["id"]
+	owner, _, ok := authorize(w, r, acl.Note, noteID, acl.RoleViewer)
+	if !ok {
+		return
+	}
+
+	revs, err := noteService.Revisions(r.Context(), owner, noteID)
+	if err != nil {
+		writeNoteError(w, r, err, "listing revisions")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revs)
+}
+
+func handleGetNoteRevision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	owner, _, ok := authorize(w, r, acl.Note, vars["id"], acl.RoleViewer)
+	if !ok {
+		return
+	}
+
+	rev, err := strconv.Atoi(vars["rev"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid revision")
+		return
+	}
+
+	revision, err := noteService.Revision(r.Context(), owner, vars["id"], rev)
+	if err != nil {
+		writeNoteError(w, r, err, "reading revision")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revision)
+}
+
+// noteDiff is the body of a diff reply
+type noteDiff struct {
+	From  int              `json:"from"`
+	To    int              `json:"to"`
+	Lines []notes.DiffLine `json:"lines"`
+}
+
+// handleDiffNoteRevisions serves GET /notes/{id}/diff?from=N&to=M. to
+// defaults to the latest revision and from to the one before it.
+func handleDiffNoteRevisions(w http.ResponseWriter, r *http.Request) {
+	noteID := mux.Vars(r)["id"]
+	query := r.URL.Query()
+	owner, _, ok := authorize(w, r, acl.Note, noteID, acl.RoleViewer)
+	if !ok {
+		return
+	}
+
+	to, err := strconv.Atoi(query.Get("to"))
+	if query.Get("to") == "" {
+		to, err = noteService.LatestRevision(r.Context(), owner, noteID)
+		if err != nil {
+			writeNoteError(w, r, err, "listing revisions")
+			return
+		}
+	} else if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid to revision")
+		return
+	}
+
+	from, err := strconv.Atoi(query.Get("from"))
+	if query.Get("from") == "" {
+		from = to - 1
+	} else if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid from revision")
+		return
+	}
+
+	lines, err := noteService.DiffRevisions(r.Context(), owner, noteID, from, to)
+	if err != nil {
+		writeNoteError(w, r, err, "computing diff")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(noteDiff{From: from, To: to, Lines: lines})
+}
+
+func handleRestoreNoteRevision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	owner, email, ok := authorize(w, r, acl.Note, vars["id"], acl.RoleEditor)
+	if !ok {
+		return
+	}
+
+	rev, err := strconv.Atoi(vars["rev"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid revision")
+		return
+	}
+
+	expected, ok := ifMatchVersion(r)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "Invalid If-Match header")
+		return
+	}
+
+	note, err := noteService.RestoreAs(r.Context(), owner, email, vars["id"], rev, expected)
+	if err != nil {
+		writeNoteError(w, r, err, "restoring revision")
+		return
+	}
+	notify(r.Context(), owner, acl.Note, note.ID, ws.NoteUpdated, note)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", noteETag(note.Version))
+	json.NewEncoder(w).Encode(note)
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"cloud/internal/acl"
+	"cloud/internal/db"
+	"cloud/internal/files"
+	"cloud/internal/folders"
+	"cloud/internal/notes"
+	"cloud/internal/quota"
+	"cloud/internal/shares"
+	"cloud/internal/trash"
+	"cloud/internal/uploads"
+	"cloud/internal/ws"
+)
+
+// apiRoute is one documented /api/v1 endpoint. registerAPIRoutes mounts
+// every entry and buildOpenAPI describes them, so the table is the single
+// place a route is declared.
+type apiRoute struct {
+	Method  string
+	Path    string // relative to apiPrefix
+	Handler http.HandlerFunc
+	Public  bool // served without a session
+	Admin   bool // served only to ADMIN_EMAILS
+
+	Summary string
+	Tag     string
+	Query   []apiParam
+	Headers []apiParam
+
+	// Request and Response are zero values of the body types, nil for no
+	// body. multipartFile and binaryContent stand for non-JSON bodies.
+	Request  interface{}
+	Response interface{}
+	Status   int   // success status, 200 if zero
+	Errors   []int // besides 401 and 500, which every private route can return
+}
+
+type apiParam struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// multipartFile marks an upload request with a "file" form field
+type multipartFile struct{}
+
+// binaryContent marks a response that streams file content
+type binaryContent struct{}
+
+// errorBodies overrides the error envelope for statuses that carry more
+var errorBodies = map[int]interface{}{
+	http.StatusPreconditionFailed: noteConflict{},
+}
+
+var ifMatchHeader = apiParam{Name: "If-Match", Description: "ETag of the note version the change is based on"}
+
+var tusResumableHeader = apiParam{Name: "Tus-Resumable", Description: "tus protocol version, 1.0.0"}
+
+var sharePasswordHeader = apiParam{Name: "X-Share-Password", Description: "password of a protected share link"}
+
+// Downloads answer Range with 206 Partial Content and a matching
+// If-None-Match or If-Modified-Since with 304 Not Modified
+var (
+	downloadQuery   = []apiParam{{Name: "inline", Description: "1 to display images, video, audio, PDF and plain text in the browser"}}
+	downloadHeaders = []apiParam{
+		{Name: "Range", Description: "byte range to download, such as bytes=0-1023"},
+		{Name: "If-Range", Description: "ETag or date the Range is valid for"},
+		{Name: "If-None-Match", Description: "ETag of a cached copy"},
+		{Name: "If-Modified-Since", Description: "date of a cached copy"},
+	}
+)
+
+var apiRoutes = []apiRoute{
+	// Files
+	{Method: "GET", Path: "/files", Handler: handleListFiles, Tag: "files",
+		Summary: "List all files", Response: []db.File{}},
+	{Method: "POST", Path: "/files", Handler: handleFileUpload, Tag: "files",
+		Summary: "Upload a file", Request: multipartFile{}, Response: db.File{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge}},
+	{Method: "GET", Path: "/files/{id}", Handler: handleGetFile, Tag: "files",
+		Summary: "Get file metadata", Response: db.File{}, Errors: []int{http.StatusNotFound}},
+	{Method: "PATCH", Path: "/files/{id}", Handler: handleUpdateFile, Tag: "files",
+		Summary: "Move a file to another folder", Request: fileUpdate{}, Response: db.File{},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+	{Method: "DELETE", Path: "/files/{id}", Handler: handleDeleteFile, Tag: "files",
+		Summary: "Move a file to the trash", Errors: []int{http.StatusForbidden, http.StatusNotFound}},
+	{Method: "GET", Path: "/files/{id}/content", Handler: handleDownloadFile, Tag: "files",
+		Summary: "Download a file", Response: binaryContent{}, Query: downloadQuery, Headers: downloadHeaders,
+		Errors: []int{http.StatusNotFound, http.StatusRequestedRangeNotSatisfiable}},
+	{Method: "GET", Path: "/files/{id}/versions", Handler: handleListFileVersions, Tag: "files",
+		Summary: "List the stored versions of a file", Response: []db.FileVersion{}, Errors: []int{http.StatusNotFound}},
+	{Method: "POST", Path: "/files/{id}/versions", Handler: handleUploadFileVersion, Tag: "files",
+		Summary: "Upload new content as the next version", Request: multipartFile{}, Response: db.File{},
+		Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusRequestEntityTooLarge}},
+	{Method: "GET", Path: "/files/{id}/versions/{version}/content", Handler: handleDownloadFileVersion, Tag: "files",
+		Summary: "Download a specific version", Response: binaryContent{}, Query: downloadQuery, Headers: downloadHeaders,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusRequestedRangeNotSatisfiable}},
+	{Method: "POST", Path: "/files/{id}/versions/{version}/restore", Handler: handleRestoreFileVersion, Tag: "files",
+		Summary: "Copy an older version into a new current version", Response: db.File{},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusRequestEntityTooLarge}},
+
+	// Resumable uploads (tus 1.0)
+	{Method: "OPTIONS", Path: "/uploads", Handler: handleUploadOptions, Public: true, Tag: "uploads",
+		Summary: "Discover the supported tus version and extensions", Status: http.StatusNoContent},
+	{Method: "POST", Path: "/uploads", Handler: handleCreateUpload, Tag: "uploads",
+		Summary: "Start a resumable upload; its URL is in Location", Response: uploads.Status{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge,
+			http.StatusPreconditionFailed},
+		Headers: []apiParam{
+			{Name: "Upload-Length", Description: "total size in bytes", Required: true},
+			{Name: "Upload-Metadata", Description: "base64 encoded filename (required), filetype and parent_id", Required: true},
+			tusResumableHeader,
+		}},
+	{Method: "HEAD", Path: "/uploads/{id}", Handler: handleUploadOffset, Tag: "uploads",
+		Summary: "Get the stored offset of an upload in Upload-Offset", Headers: []apiParam{tusResumableHeader},
+		Errors: []int{http.StatusNotFound, http.StatusPreconditionFailed}},
+	{Method: "GET", Path: "/uploads/{id}", Handler: handleGetUpload, Tag: "uploads",
+		Summary: "Get the status of an upload, including the file it created", Response: uploads.Status{},
+		Errors: []int{http.StatusNotFound}},
+	{Method: "PATCH", Path: "/uploads/{id}", Handler: handleWriteUpload, Tag: "uploads",
+		Summary: "Store a chunk at Upload-Offset; the last chunk creates the file", Request: uploadChunk{},
+		Status: http.StatusNoContent,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusLengthRequired,
+			http.StatusPreconditionFailed, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusLocked},
+		Headers: []apiParam{
+			{Name: "Upload-Offset", Description: "offset the chunk starts at, from HEAD", Required: true},
+			tusResumableHeader,
+		}},
+	{Method: "DELETE", Path: "/uploads/{id}", Handler: handleCancelUpload, Tag: "uploads",
+		Summary: "Cancel an upload and discard its chunks", Status: http.StatusNoContent, Headers: []apiParam{tusResumableHeader},
+		Errors: []int{http.StatusNotFound, http.StatusPreconditionFailed, http.StatusLocked}},
+
+	// Direct transfers
+	{Method: "POST", Path: "/uploads/presigned", Handler: handleCreatePresignedUpload, Tag: "uploads",
+		Summary: "Start an upload the client sends straight into storage", Request: presignUploadRequest{},
+		Response: presignedUpload{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge}},
+	{Method: "POST", Path: "/uploads/{id}/complete", Handler: handleCompleteUpload, Tag: "uploads",
+		Summary: "Check the stored content of a direct upload and create the file", Response: db.File{},
+		Errors: []int{http.StatusNotFound, http.StatusConflict, http.StatusRequestEntityTooLarge, http.StatusLocked}},
+	{Method: "GET", Path: "/files/{id}/content-url", Handler: handleFileContentURL, Tag: "files",
+		Summary: "Get a short lived direct download URL", Response: presignedURL{}, Errors: []int{http.StatusNotFound}},
+	{Method: "PUT", Path: "/blobs/{token}", Handler: handlePutBlob, Public: true, Tag: "uploads",
+		Summary: "Signed upload URL of the disk backend", Request: binaryContent{},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusInternalServerError}},
+	{Method: "GET", Path: "/blobs/{token}", Handler: handleGetBlob, Public: true, Tag: "files",
+		Summary: "Signed download URL of the disk backend", Response: binaryContent{}, Query: downloadQuery, Headers: downloadHeaders,
+		Errors: []int{http.StatusForbidden, http.StatusNotFound, http.StatusRequestedRangeNotSatisfiable, http.StatusInternalServerError}},
+
+	// Share links
+	{Method: "POST", Path: "/files/{id}/shares", Handler: handleCreateShare, Tag: "shares",
+		Summary: "Create a public link to a file", Request: shares.Options{}, Response: shareLink{},
+		Status: http.StatusCreated, Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+	{Method: "GET", Path: "/shares", Handler: handleListShares, Tag: "shares",
+		Summary: "List active share links with their download counts", Response: []shares.Info{}},
+	{Method: "DELETE", Path: "/shares/{id}", Handler: handleRevokeShare, Tag: "shares",
+		Summary: "Revoke a share link", Status: http.StatusNoContent, Errors: []int{http.StatusNotFound}},
+	{Method: "GET", Path: "/shared/{token}", Handler: handleGetShared, Public: true, Tag: "shares",
+		Summary: "Describe the file behind a share link", Response: sharedFile{}, Headers: []apiParam{sharePasswordHeader},
+		Errors: []int{http.StatusUnauthorized, http.StatusNotFound, http.StatusGone, http.StatusInternalServerError}},
+	{Method: "GET", Path: "/shared/{token}/content", Handler: handleDownloadShared, Public: true, Tag: "shares",
+		Summary: "Download the file behind a share link; every request for content, ranged or not, counts against max_downloads", Response: binaryContent{}, Query: downloadQuery,
+		Headers: append([]apiParam{sharePasswordHeader}, downloadHeaders...), Errors: []int{http.StatusUnauthorized, http.StatusNotFound, http.StatusGone, http.StatusRequestedRangeNotSatisfiable, http.StatusInternalServerError}},
+	{Method: "POST", Path: "/shared/{token}/content", Handler: handleDownloadSharedForm, Public: true, Tag: "shares",
+		Summary: "Download the file behind a share link, with the password in a form", Request: sharePassword{},
+		Response: binaryContent{}, Errors: []int{http.StatusUnauthorized, http.StatusNotFound, http.StatusGone, http.StatusInternalServerError}},
+
+	// Folders
+	{Method: "POST", Path: "/folders", Handler: handleCreateFolder, Tag: "folders",
+		Summary: "Create a folder", Request: folderRequest{}, Response: db.Folder{}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict}},
+	{Method: "GET", Path: "/folders/{id}", Handler: handleGetFolder, Tag: "folders",
+		Summary: `List a folder; "root" lists the top level`, Response: folders.Listing{},
+		Errors: []int{http.StatusNotFound}},
+	{Method: "PATCH", Path: "/folders/{id}", Handler: handleUpdateFolder, Tag: "folders",
+		Summary: "Rename and/or move a folder", Request: folderUpdate{}, Response: db.Folder{},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict}},
+	{Method: "DELETE", Path: "/folders/{id}", Handler: handleDeleteFolder, Tag: "folders",
+		Summary: "Delete a folder; its files go to the trash", Errors: []int{http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+		Query: []apiParam{{Name: "recursive", Description: "true to delete the folder with everything in it"}}},
+
+	// Notes
+	{Method: "GET", Path: "/notes", Handler: handleListNotes, Tag: "notes",
+		Summary: "List notes, most recently updated first", Response: []notes.Note{}},
+	{Method: "POST", Path: "/notes", Handler: handleCreateNote, Tag: "notes",
+		Summary: "Create a note", Request: notes.Note{}, Response: notes.Note{},
+		Errors: []int{http.StatusBadRequest}},
+	{Method: "GET", Path: "/notes/{id}", Handler: handleGetNote, Tag: "notes",
+		Summary: "Get a note", Response: notes.Note{}, Errors: []int{http.StatusNotFound}},
+	{Method: "PUT", Path: "/notes/{id}", Handler: handleUpdateNote, Tag: "notes",
+		Summary: "Update a note", Request: notes.Note{}, Response: notes.Note{}, Headers: []apiParam{ifMatchHeader},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusPreconditionFailed}},
+	{Method: "DELETE", Path: "/notes/{id}", Handler: handleDeleteNote, Tag: "notes",
+		Summary: "Move a note to the trash", Headers: []apiParam{ifMatchHeader},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusPreconditionFailed}},
+	{Method: "GET", Path: "/notes/{id}/revisions", Handler: handleListNoteRevisions, Tag: "notes",
+		Summary: "List the revisions of a note", Response: []notes.Revision{}, Errors: []int{http.StatusNotFound}},
+	{Method: "GET", Path: "/notes/{id}/revisions/{rev}", Handler: handleGetNoteRevision, Tag: "notes",
+		Summary: "Get a revision", Response: notes.Revision{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound}},
+	{Method: "POST", Path: "/notes/{id}/revisions/{rev}/restore", Handler: handleRestoreNoteRevision, Tag: "notes",
+		Summary: "Restore a revision as a new version", Response: notes.Note{}, Headers: []apiParam{ifMatchHeader},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusPreconditionFailed}},
+	{Method: "GET", Path: "/notes/{id}/diff", Handler: handleDiffNoteRevisions, Tag: "notes",
+		Summary: "Line diff between two revisions", Response: noteDiff{},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity},
+		Query: []apiParam{
+			{Name: "from", Description: "older revision, default the one before to"},
+			{Name: "to", Description: "newer revision, default the latest"},
+		}},
+
+	// Permissions
+	{Method: "GET", Path: "/files/{id}/permissions", Handler: handleListFilePermissions, Tag: "permissions",
+		Summary: "List who else has access to a file", Response: []acl.Grant{},
+		Errors: []int{http.StatusForbidden, http.StatusNotFound}},
+	{Method: "PUT", Path: "/files/{id}/permissions/{email}", Handler: handleGrantFilePermission, Tag: "permissions",
+		Summary: "Give a user a role on a file", Request: grantRequest{}, Response: acl.Grant{},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+	{Method: "DELETE", Path: "/files/{id}/permissions/{email}", Handler: handleRevokeFilePermission, Tag: "permissions",
+		Summary: "Take away a user's access to a file", Status: http.StatusNoContent,
+		Errors: []int{http.StatusForbidden, http.StatusNotFound}},
+	{Method: "GET", Path: "/folders/{id}/permissions", Handler: handleListFolderPermissions, Tag: "permissions",
+		Summary: "List who else has access to a folder and everything in it", Response: []acl.Grant{},
+		Errors: []int{http.StatusForbidden, http.StatusNotFound}},
+	{Method: "PUT", Path: "/folders/{id}/permissions/{email}", Handler: handleGrantFolderPermission, Tag: "permissions",
+		Summary: "Give a user a role on a folder and everything in it", Request: grantRequest{}, Response: acl.Grant{},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+	{Method: "DELETE", Path: "/folders/{id}/permissions/{email}", Handler: handleRevokeFolderPermission, Tag: "permissions",
+		Summary: "Take away a user's access to a folder", Status: http.StatusNoContent,
+		Errors: []int{http.StatusForbidden, http.StatusNotFound}},
+	{Method: "GET", Path: "/notes/{id}/permissions", Handler: handleListNotePermissions, Tag: "permissions",
+		Summary: "List who else has access to a note", Response: []acl.Grant{},
+		Errors: []int{http.StatusForbidden, http.StatusNotFound}},
+	{Method: "PUT", Path: "/notes/{id}/permissions/{email}", Handler: handleGrantNotePermission, Tag: "permissions",
+		Summary: "Give a user a role on a note", Request: grantRequest{}, Response: acl.Grant{},
+		Errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound}},
+	{Method: "DELETE", Path: "/notes/{id}/permissions/{email}", Handler: handleRevokeNotePermission, Tag: "permissions",
+		Summary: "Take away a user's access to a note", Status: http.StatusNoContent,
+		Errors: []int{http.StatusForbidden, http.StatusNotFound}},
+	{Method: "GET", Path: "/me/shared", Handler: handleSharedWithMe, Tag: "permissions",
+		Summary: "List files, folders and notes other users shared with you", Response: []acl.SharedItem{}},
+
+	// Trash
+	{Method: "GET", Path: "/trash", Handler: handleListTrash, Tag: "trash",
+		Summary: "List trashed files and notes, most recently deleted first", Response: []trash.Item{}},
+	{Method: "DELETE", Path: "/trash", Handler: handleEmptyTrash, Tag: "trash",
+		Summary: "Permanently delete everything in the trash", Response: trashEmptied{}},
+	{Method: "POST", Path: "/trash/files/{id}/restore", Handler: handleRestoreTrashedFile, Tag: "trash",
+		Summary: "Restore a file to its folder, or the top level if the folder is gone", Response: db.File{},
+		Errors: []int{http.StatusNotFound}},
+	{Method: "DELETE", Path: "/trash/files/{id}", Handler: handleDeleteTrashedFile, Tag: "trash",
+		Summary: "Permanently delete a trashed file and its versions", Status: http.StatusNoContent,
+		Errors: []int{http.StatusNotFound}},
+	{Method: "POST", Path: "/trash/notes/{id}/restore", Handler: handleRestoreTrashedNote, Tag: "trash",
+		Summary: "Restore a note", Response: notes.Note{}, Errors: []int{http.StatusNotFound}},
+	{Method: "DELETE", Path: "/trash/notes/{id}", Handler: handleDeleteTrashedNote, Tag: "trash",
+		Summary: "Permanently delete a trashed note and its revisions", Status: http.StatusNoContent,
+		Errors: []int{http.StatusNotFound}},
+
+	// Usage
+	{Method: "GET", Path: "/me/usage", Handler: handleGetUsage, Tag: "usage",
+		Summary: "Get the bytes used by files, old versions and trash, and the quota", Response: quota.Report{}},
+
+	// Search
+	{Method: "GET", Path: "/search", Handler: handleSearch, Tag: "search",
+		Summary: "Search notes and file names", Response: searchResponse{}, Errors: []int{http.StatusBadRequest},
+		Query: []apiParam{
+			{Name: "q", Description: "search words, matched by stem or as prefixes", Required: true},
+			{Name: "type", Description: "comma separated notes, files"},
+			{Name: "limit", Description: "1 to 100, default 20"},
+		}},
+
+	// Admin
+	{Method: "GET", Path: "/admin/reconcile", Handler: handleGetReconcileReport, Admin: true, Tag: "admin",
+		Summary: "Get the report of the last background reconcile pass", Response: files.ReconcileReport{},
+		Errors: []int{http.StatusForbidden, http.StatusNotFound}},
+	{Method: "POST", Path: "/admin/reconcile", Handler: handleRunReconcile, Admin: true, Tag: "admin",
+		Summary:  "Compare file records with object storage now and repair what is inconsistent",
+		Response: files.ReconcileReport{}, Errors: []int{http.StatusForbidden},
+		Query: []apiParam{{Name: "dry_run", Description: "true to only report"}}},
+	{Method: "GET", Path: "/admin/websockets", Handler: handleGetWebSocketStats, Admin: true, Tag: "admin",
+		Summary:  "Count open WebSocket connections and the events delivered to or dropped for them",
+		Response: ws.Stats{}, Errors: []int{http.StatusForbidden}},
+
+	// Meta
+	{Method: "GET", Path: "/openapi.json", Handler: handleOpenAPI, Public: true, Tag: "meta",
+		Summary: "This document", Response: map[string]interface{}{}},
+}
+
+// apiSpec is the rendered OpenAPI document, built once at startup
+var apiSpec []byte
+
+// checkAPISpec builds the OpenAPI document from the router and stops the
+// server if any /api/v1 route is undocumented or vice versa
+func checkAPISpec(r *mux.Router) {
+	spec, err := buildOpenAPI(r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "API routes and OpenAPI table disagree: %v\n", err)
+		os.Exit(1)
+	}
+	apiSpec = spec
+}
+
+// runOpenAPI implements "server openapi", which prints the spec without
+// starting the server. It fails like startup does when the spec is out of
+// date, so CI can run it as a check.
+func runOpenAPI() {
+	checkAPISpec(newRouter())
+	os.Stdout.Write(apiSpec)
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(apiSpec)
+}
+
+func handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "web/templates/api-docs.html")
+}
+
+// buildOpenAPI walks the router and describes every route mounted under
+// apiPrefix from its apiRoutes entry
+func buildOpenAPI(r *mux.Router) ([]byte, error) {
+	documented := make(map[string]apiRoute)
+	for _, route := range apiRoutes {
+		documented[route.Method+" "+apiPrefix+route.Path] = route
+	}
+
+	schemas := schemaSet{}
+	paths := make(map[string]map[string]interface{})
+	routed := make(map[string]bool)
+	var undocumented []string
+
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, apiPrefix+"/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			key := method + " " + tpl
+			doc, ok := documented[key]
+			if !ok {
+				undocumented = append(undocumented, key)
+				continue
+			}
+			routed[key] = true
+			if paths[tpl] == nil {
+				paths[tpl] = make(map[string]interface{})
+			}
+			paths[tpl][strings.ToLower(method)] = doc.operation(schemas)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var unrouted []string
+	for key := range documented {
+		if !routed[key] {
+			unrouted = append(unrouted, key)
+		}
+	}
+	if len(undocumented) > 0 || len(unrouted) > 0 {
+		sort.Strings(undocumented)
+		sort.Strings(unrouted)
+		return nil, fmt.Errorf("undocumented routes %v, documented but not routed %v", undocumented, unrouted)
+	}
+
+	schemas.schema(reflect.TypeOf(errorResponse{}))
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Personal Cloud Storage API",
+			"version": strings.TrimPrefix(apiPrefix, "/api/"),
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "session"},
+				"bearer":  map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"session": []string{}},
+			map[string]interface{}{"bearer": []string{}},
+		},
+	}
+	return json.MarshalIndent(spec, "", "  ")
+}
+
+var pathParam = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+
+func (route apiRoute) operation(schemas schemaSet) map[string]interface{} {
+	op := map[string]interface{}{
+		"summary":     route.Summary,
+		"operationId": operationID(route.Handler),
+		"tags":        []string{route.Tag},
+	}
+	if route.Public {
+		op["security"] = []interface{}{}
+	}
+	if route.Admin {
+		op["description"] = "Only for the users listed in ADMIN_EMAILS."
+	}
+
+	var params []interface{}
+	for _, m := range pathParam.FindAllStringSubmatch(route.Path, -1) {
+		params = append(params, map[string]interface{}{
+			"name": m[1], "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+		})
+	}
+	for _, p := range route.Query {
+		params = append(params, p.describe("query"))
+	}
+	for _, p := range route.Headers {
+		params = append(params, p.describe("header"))
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	switch route.Request.(type) {
+	case nil:
+	case binaryContent:
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/octet-stream": map[string]interface{}{
+					"schema": map[string]string{"type": "string", "format": "binary"},
+				},
+			},
+		}
+	case uploadChunk:
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/offset+octet-stream": map[string]interface{}{
+					"schema": map[string]string{"type": "string", "format": "binary"},
+				},
+			},
+		}
+	case sharePassword:
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/x-www-form-urlencoded": map[string]interface{}{
+					"schema": map[string]interface{}{
+						"type":       "object",
+						"properties": map[string]interface{}{"password": map[string]string{"type": "string"}},
+					},
+				},
+			},
+		}
+	case multipartFile:
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"multipart/form-data": map[string]interface{}{
+					"schema": map[string]interface{}{
+						"type":     "object",
+						"required": []string{"file"},
+						"properties": map[string]interface{}{
+							"file":      map[string]string{"type": "string", "format": "binary"},
+							"parent_id": map[string]string{"type": "string"},
+						},
+					},
+				},
+			},
+		}
+	default:
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  jsonContent(schemas.schema(reflect.TypeOf(route.Request))),
+		}
+	}
+
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	switch route.Response.(type) {
+	case nil:
+	case binaryContent:
+		success["content"] = map[string]interface{}{
+			"application/octet-stream": map[string]interface{}{
+				"schema": map[string]string{"type": "string", "format": "binary"},
+			},
+		}
+	default:
+		success["content"] = jsonContent(schemas.schema(reflect.TypeOf(route.Response)))
+	}
+	responses := map[string]interface{}{fmt.Sprint(status): success}
+
+	errs := route.Errors
+	if !route.Public {
+		errs = append([]int{http.StatusUnauthorized, http.StatusInternalServerError}, errs...)
+	}
+	for _, code := range errs {
+		var body interface{} = errorResponse{}
+		if b, ok := errorBodies[code]; ok {
+			body = b
+		}
+		responses[fmt.Sprint(code)] = map[string]interface{}{
+			"description": http.StatusText(code),
+			"content":     jsonContent(schemas.schema(reflect.TypeOf(body))),
+		}
+	}
+	op["responses"] = responses
+	return op
+}
+
+func (p apiParam) describe(in string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        p.Name,
+		"in":          in,
+		"description": p.Description,
+		"required":    p.Required,
+		"schema":      map[string]string{"type": "string"},
+	}
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+// operationID derives "listFiles" from handleListFiles
+func operationID(h http.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	name = name[strings.LastIndex(name, ".")+1:]
+	name = strings.TrimPrefix(name, "handle")
+	if name == "" {
+		return ""
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// schemaSet collects the component schemas of named Go types, keyed by
+// type name, as they are referenced
+type schemaSet map[string]interface{}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema describes t the way encoding/json serialises it
+func (s schemaSet) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		inner := s.schema(t.Elem())
+		if _, ref := inner["$ref"]; ref {
+			return map[string]interface{}{"allOf": []interface{}{inner}, "nullable": true}
+		}
+		inner["nullable"] = true
+		return inner
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := s[name]; !ok {
+			s[name] = map[string]interface{}{} // placeholder for recursive types
+			s[name] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (s schemaSet) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.schema(field.Type)
+		if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+
+	obj := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		obj["required"] = required
+	}
+	return obj
+}
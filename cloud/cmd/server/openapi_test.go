@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// routedAPI walks the server's router and returns every method and path
+// mounted under apiPrefix, as "METHOD /api/v1/path"
+func routedAPI(t *testing.T) map[string]bool {
+	t.Helper()
+	routed := make(map[string]bool)
+	err := newRouter().Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tpl, apiPrefix+"/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			routed[method+" "+tpl] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walking router: %v", err)
+	}
+	if len(routed) == 0 {
+		t.Fatal("no routes under " + apiPrefix)
+	}
+	return routed
+}
+
+func TestAPIRoutesMatchRouter(t *testing.T) {
+	routed := routedAPI(t)
+
+	documented := make(map[string]bool)
+	for _, route := range apiRoutes {
+		key := route.Method + " " + apiPrefix + route.Path
+		if documented[key] {
+			t.Errorf("%s is in apiRoutes twice", key)
+		}
+		documented[key] = true
+		if !routed[key] {
+			t.Errorf("%s is in apiRoutes but not routed", key)
+		}
+	}
+	for key := range routed {
+		if !documented[key] {
+			t.Errorf("%s is routed but missing from apiRoutes", key)
+		}
+	}
+}
+
+func TestOpenAPIDescribesEveryRoute(t *testing.T) {
+	spec, err := buildOpenAPI(newRouter())
+	if err != nil {
+		t.Fatalf("building spec: %v", err)
+	}
+	var doc struct {
+		Paths map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		t.Fatalf("decoding spec: %v", err)
+	}
+
+	operations := make(map[string]string)
+	for key := range routedAPI(t) {
+		method, path, _ := strings.Cut(key, " ")
+		op, ok := doc.Paths[path][strings.ToLower(method)]
+		if !ok {
+			t.Errorf("%s is routed but not in the spec", key)
+			continue
+		}
+		if other, ok := operations[op.OperationID]; ok {
+			t.Errorf("%s and %s share operationId %q", key, other, op.OperationID)
+		}
+		operations[op.OperationID] = key
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"cloud/internal/acl"
+	"cloud/internal/ws"
+)
+
+var aclService *acl.Service
+
+// resourceNames are used in error messages about a resource
+var resourceNames = map[acl.Resource]string{
+	acl.File:   "File",
+	acl.Folder: "Folder",
+	acl.Note:   "Note",
+}
+
+// writeACLError maps acl service errors onto HTTP responses
+func writeACLError(w http.ResponseWriter, r *http.Request, res acl.Resource, err error, action string) {
+	switch {
+	case errors.Is(err, acl.ErrNotFound):
+		writeError(w, r, http.StatusNotFound, resourceNames[res]+" not found")
+	case errors.Is(err, acl.ErrForbidden):
+		writeError(w, r, http.StatusForbidden, err.Error())
+	case errors.Is(err, acl.ErrInvalidRole), errors.Is(err, acl.ErrSelf):
+		writeError(w, r, http.StatusBadRequest, err.Error())
+	case errors.Is(err, acl.ErrUnknownUser):
+		writeError(w, r, http.StatusNotFound, err.Error())
+	default:
+		log.Printf("[%s] Error %s: %v", requestID(r), action, err)
+		writeError(w, r, http.StatusInternalServerError, "Error "+action)
+	}
+}
+
+// authorize checks that the session user may act on a resource with at
+// least role need. It returns the owner, whose email the services address
+// the resource by, and the session user. On failure the error response has
+// been written.
+func authorize(w http.ResponseWriter, r *http.Request, res acl.Resource, id string, need acl.Role) (owner, email string, ok bool) {
+	email = userEmail(r)
+
+	access, err := aclService.Check(r.Context(), email, res, id, need)
+	if err != nil {
+		writeACLError(w, r, res, err, "checking access")
+		return "", "", false
+	}
+	return access.Owner, email, true
+}
+
+// grantRequest is the body of a permission grant
+type grantRequest struct {
+	Role acl.Role `json:"role"`
+}
+
+func listPermissions(w http.ResponseWriter, r *http.Request, res acl.Resource) {
+	email := userEmail(r)
+
+	grants, err := aclService.Grants(r.Context(), email, res, mux.Vars(r)["id"])
+	if err != nil {
+		writeACLError(w, r, res, err, "listing permissions")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grants)
+}
+
+func grantPermission(w http.ResponseWriter, r *http.Request, res acl.Resource) {
+	email := userEmail(r)
+	vars := mux.Vars(r)
+
+	var req grantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	grant, err := aclService.Grant(r.Context(), email, res, vars["id"], vars["email"], req.Role)
+	if err != nil {
+		writeACLError(w, r, res, err, "granting permission")
+		return
+	}
+	publish(accessAudience(r.Context(), email, res, vars["id"]), ws.PermissionsChanged,
+		permissionChange{Type: res, ID: vars["id"], Email: grant.Email, Role: grant.Role})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grant)
+}
+
+func revokePermission(w http.ResponseWriter, r *http.Request, res acl.Resource) {
+	email := userEmail(r)
+	vars := mux.Vars(r)
+
+	// Work out who to tell while email still has access; the user who lost
+	// it is told as well
+	to := append(accessAudience(r.Context(), email, res, vars["id"]), vars["email"])
+	if err := aclService.Revoke(r.Context(), email, res, vars["id"], vars["email"]); err != nil {
+		writeACLError(w, r, res, err, "revoking permission")
+		return
+	}
+	publish(to, ws.PermissionsChanged, permissionChange{Type: res, ID: vars["id"], Email: vars["email"]})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleListFilePermissions(w http.ResponseWriter, r *http.Request) {
+	listPermissions(w, r, acl.File)
+}
+
+func handleGrantFilePermission(w http.ResponseWriter, r *http.Request) {
+	grantPermission(w, r, acl.File)
+}
+
+func handleRevokeFilePermission(w http.ResponseWriter, r *http.Request) {
+	revokePermission(w, r, acl.File)
+}
+
+func handleListFolderPermissions(w http.ResponseWriter, r *http.Request) {
+	listPermissions(w, r, acl.Folder)
+}
+
+func handleGrantFolderPermission(w http.ResponseWriter, r *http.Request) {
+	grantPermission(w, r, acl.Folder)
+}
+
+func handleRevokeFolderPermission(w http.ResponseWriter, r *http.Request) {
+	revokePermission(w, r, acl.Folder)
+}
+
+func handleListNotePermissions(w http.ResponseWriter, r *http.Request) {
+	listPermissions(w, r, acl.Note)
+}
+
+func handleGrantNotePermission(w http.ResponseWriter, r *http.Request) {
+	grantPermission(w, r, acl.Note)
+}
+
+func handleRevokeNotePermission(w http.ResponseWriter, r *http.Request) {
+	revokePermission(w, r, acl.Note)
+}
+
+// handleSharedWithMe lists the files, folders and notes other users have
+// shared with the session user
+func handleSharedWithMe(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	items, err := aclService.SharedWith(r.Context(), email)
+	if err != nil {
+		log.Printf("[%s] Error listing shared items: %v", requestID(r), err)
+		writeError(w, r, http.StatusInternalServerError, "Error listing shared items")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cloud/internal/notes"
+)
+
+// noteETag formats a note version as a strong entity tag
+func noteETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ifMatchVersion reads the note version from an If-Match header. A missing
+// header or "*" yields notes.AnyVersion; ok is false if the header does not
+// name a version this server issued.
+func ifMatchVersion(r *http.Request) (version int, ok bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return notes.AnyVersion, true
+	}
+
+	// Only a single tag is meaningful for a single note; weak tags are
+	// accepted since the version is the whole validator
+	tag := strings.TrimPrefix(header, "W/")
+	version, err := strconv.Atoi(strings.Trim(tag, `"`))
+	if err != nil || version < 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// noteConflict is the body of a 412 reply to a note write
+type noteConflict struct {
+	Error   apiError   `json:"error"`
+	Current notes.Note `json:"current"`
+}
+
+// writeNoteConflict answers a failed If-Match with 412 and the current
+// server copy so the client can merge or retry
+func writeNoteConflict(w http.ResponseWriter, r *http.Request, conflict *notes.ConflictError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", noteETag(conflict.Current.Version))
+	w.WriteHeader(http.StatusPreconditionFailed)
+	json.NewEncoder(w).Encode(noteConflict{
+		Error:   newAPIError(r, http.StatusPreconditionFailed, "Note has been modified"),
+		Current: conflict.Current,
+	})
+}
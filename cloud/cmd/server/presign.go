@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"cloud/internal/acl"
+	"cloud/internal/storage"
+	"cloud/internal/uploads"
+)
+
+var (
+	// presigner issues direct transfer URLs: the object store's own when it
+	// can sign them, urlSigner's otherwise
+	presigner storage.Presigner
+	// urlSigner is set when transfers are proxied through /api/v1/blobs
+	urlSigner *storage.URLSigner
+	// presignExpiry is how long issued URLs stay valid
+	presignExpiry = 15 * time.Minute
+)
+
+// openPresigner picks how direct transfer URLs are signed. Backends that
+// cannot sign URLs get tokens for the blob routes, signed with
+// URL_SIGNING_SECRET (or a key derived from SESSION_SECRET).
+func openPresigner() {
+	if v := os.Getenv("PRESIGN_EXPIRY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid PRESIGN_EXPIRY %q", v)
+		}
+		presignExpiry = d
+	}
+
+	if p, ok := objects.(storage.Presigner); ok {
+		presigner = p
+		return
+	}
+
+	urlSigner = storage.NewURLSigner(signingKey("URL_SIGNING_SECRET", "cloud url signing"), apiPrefix+"/blobs/")
+	presigner = urlSigner
+}
+
+// presignUploadRequest announces a file the client will put into storage
+// itself
+type presignUploadRequest struct {
+	Filename    string `json:"filename"`
+	ParentID    string `json:"parent_id"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// presignedUpload tells the client where and how to put the content: a
+// PUT of the body with Headers, or a multipart POST of Fields followed by
+// a "file" field
+type presignedUpload struct {
+	Upload    uploads.Status    `json:"upload"`
+	URL       string            `json:"url"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+// presignedURL is a short lived download link
+type presignedURL struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// handleCreatePresignedUpload starts a direct upload. The client sends the
+// content to the returned URL and then calls handleCompleteUpload.
+func handleCreatePresignedUpload(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	var req presignUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Filename == "" {
+		writeError(w, r, http.StatusBadRequest, "Filename is required")
+		return
+	}
+
+	parentID, err := folderService.ResolveParent(r.Context(), email, req.ParentID)
+	if err != nil {
+		writeFolderError(w, r, err, "checking folder")
+		return
+	}
+
+	st, err := uploadService.CreateDirect(r.Context(), email, uploads.NewUpload{
+		Filename:    req.Filename,
+		ParentID:    parentID,
+		ContentType: req.ContentType,
+		Length:      req.Size,
+	})
+	if err != nil {
+		writeUploadError(w, r, err, "creating upload")
+		return
+	}
+
+	expires := time.Now().Add(presignExpiry)
+	target, err := presigner.PresignUpload(r.Context(), uploads.Key(email, st.ID), req.ContentType, req.Size, presignExpiry)
+	if err != nil {
+		log.Printf("[%s] Error presigning upload: %v", requestID(r), err)
+		writeError(w, r, http.StatusInternalServerError, "Error presigning upload")
+		return
+	}
+
+	headers := map[string]string{}
+	if target.Method == http.MethodPut && req.ContentType != "" {
+		headers["Content-Type"] = req.ContentType
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(presignedUpload{
+		Upload:    st,
+		URL:       target.URL,
+		Method:    target.Method,
+		Headers:   headers,
+		Fields:    target.Fields,
+		ExpiresAt: expires,
+	})
+}
+
+// handleCompleteUpload is called by the client after putting the content
+// of a direct upload. It checks the object and creates the file.
+func handleCompleteUpload(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	st, err := uploadService.Complete(r.Context(), email, mux.Vars(r)["id"])
+	if err != nil {
+		writeUploadError(w, r, err, "completing upload")
+		return
+	}
+
+	fileRecord, err := fileService.Get(r.Context(), email, st.FileID)
+	if err != nil {
+		writeFileError(w, r, err, "reading file")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileRecord)
+}
+
+// handleFileContentURL issues a short lived URL that downloads a file
+// without going through the server, where the backend allows it
+func handleFileContentURL(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := authorize(w, r, acl.File, mux.Vars(r)["id"], acl.RoleViewer)
+	if !ok {
+		return
+	}
+
+	fileRecord, err := fileService.Get(r.Context(), owner, mux.Vars(r)["id"])
+	if err != nil {
+		writeFileError(w, r, err, "reading file")
+		return
+	}
+
+	expires := time.Now().Add(presignExpiry)
+	url, err := presigner.PresignGet(r.Context(), fileRecord.StoragePath, fileRecord.Filename, presignExpiry)
+	if err != nil {
+		log.Printf("[%s] Error presigning download: %v", requestID(r), err)
+		writeError(w, r, http.StatusInternalServerError, "Error presigning download")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presignedURL{URL: url, ExpiresAt: expires})
+}
+
+// signedRequest checks the token of a blob route. Like a pre-signed URL it
+// is all the authorisation the request carries.
+func signedRequest(w http.ResponseWriter, r *http.Request, method string) (storage.SignedRequest, bool) {
+	if urlSigner == nil {
+		writeError(w, r, http.StatusNotFound, "No such endpoint")
+		return storage.SignedRequest{}, false
+	}
+	req, err := urlSigner.Verify(mux.Vars(r)["token"], method)
+	if err != nil {
+		writeError(w, r, http.StatusForbidden, "Invalid or expired URL")
+		return storage.SignedRequest{}, false
+	}
+	return req, true
+}
+
+// handlePutBlob stores the body at the key of a signed PUT URL
+func handlePutBlob(w http.ResponseWriter, r *http.Request) {
+	req, ok := signedRequest(w, r, "PUT")
+	if !ok {
+		return
+	}
+	if r.ContentLength != req.Size {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Content-Length must be %d", req.Size))
+		return
+	}
+
+	info, err := objects.Put(r.Context(), req.Key, r.Body, req.Size, req.ContentType)
+	if err != nil {
+		log.Printf("[%s] Error storing signed upload: %v", requestID(r), err)
+		writeError(w, r, http.StatusInternalServerError, "Error storing upload")
+		return
+	}
+
+	w.Header().Set("ETag", `"`+info.ETag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleGetBlob streams the object of a signed GET URL
+func handleGetBlob(w http.ResponseWriter, r *http.Request) {
+	req, ok := signedRequest(w, r, "GET")
+	if !ok {
+		return
+	}
+
+	object, info, err := objects.Get(r.Context(), req.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeError(w, r, http.StatusNotFound, "Object not found")
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] Error reading signed download: %v", requestID(r), err)
+		writeError(w, r, http.StatusInternalServerError, "Error downloading file")
+		return
+	}
+	defer object.Close()
+
+	serveContent(w, r, object, download{
+		Filename:    req.Filename,
+		ContentType: mime.TypeByExtension(path.Ext(req.Filename)),
+		ETag:        `"` + info.ETag + `"`,
+		Modified:    info.LastModified,
+	})
+}
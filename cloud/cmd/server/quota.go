@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"cloud/internal/quota"
+)
+
+var quotaService *quota.Service
+
+// checkQuota turns away an upload whose request body alone would take
+// the user over their quota, before any of it is read. It writes the error
+// response and returns false if so.
+func checkQuota(w http.ResponseWriter, r *http.Request, email string) bool {
+	if r.ContentLength <= 0 {
+		return true
+	}
+	if err := quotaService.Check(r.Context(), email, r.ContentLength); err != nil {
+		writeFileError(w, r, err, "checking quota")
+		return false
+	}
+	return true
+}
+
+// handleGetUsage reports how much of their quota the session user has used
+func handleGetUsage(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	report, err := quotaService.Report(r.Context(), email)
+	if err != nil {
+		log.Printf("[%s] Error reading usage: %v", requestID(r), err)
+		writeError(w, r, http.StatusInternalServerError, "Error reading usage")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// runQuota implements "server quota <email> [size|default|unlimited]",
+// which shows a user's usage or sets their own quota
+func runQuota(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: server quota <email> [size|default|unlimited]")
+		os.Exit(2)
+	}
+
+	metadata, err := openMetadataStore()
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer metadata.Close()
+	limit, err := quota.LimitFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	quotas := quota.NewService(metadata, limit)
+
+	ctx := context.Background()
+	email := args[0]
+	if _, err := metadata.GetUser(ctx, email); err != nil {
+		log.Fatalf("Unknown user %s: %v", email, err)
+	}
+
+	if len(args) == 2 {
+		var limit int64
+		switch args[1] {
+		case "default":
+		case "unlimited":
+			limit = quota.Unlimited
+		default:
+			if limit, err = quota.ParseSize(args[1]); err != nil || limit == 0 {
+				log.Fatalf("Invalid size %q (expected a size such as 500MB or 5GB)", args[1])
+			}
+		}
+		if err := quotas.SetLimit(ctx, email, limit); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	report, err := quotas.Report(ctx, email)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("files     %d\nversions  %d\ntrash     %d\nused      %d\n", report.Files, report.Versions, report.Trash, report.Used)
+	if report.Quota == nil {
+		fmt.Println("quota     unlimited")
+	} else {
+		fmt.Printf("quota     %d\n", *report.Quota)
+	}
+}
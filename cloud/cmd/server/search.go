@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud/internal/db"
+	"cloud/internal/notes"
+	"cloud/internal/search"
+)
+
+// openSearchIndex loads the saved search index, rebuilding it from the
+// metadata store when there is none, and keeps it saved in the background
+func openSearchIndex(ctx context.Context) *search.Index {
+	path := os.Getenv("SEARCH_INDEX_PATH")
+	if path == "" {
+		path = filepath.Join("data", "search-index.json")
+	}
+
+	idx, err := search.Load(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error loading search index, rebuilding: %v", err)
+		}
+		idx, err = rebuildSearchIndex(ctx)
+		if err != nil {
+			log.Fatalf("Failed to build search index: %v", err)
+		}
+		if err := idx.Save(path); err != nil {
+			log.Printf("Error saving search index: %v", err)
+		}
+	}
+
+	go idx.Autosave(path, 10*time.Second)
+	return idx
+}
+
+func rebuildSearchIndex(ctx context.Context) (*search.Index, error) {
+	idx := search.New()
+	count := 0
+
+	// Nothing in the trash is searchable
+	err := metadata.ScanNotes(ctx, func(n db.Note) error {
+		if !n.DeletedAt.IsZero() {
+			return nil
+		}
+		idx.Put(search.Document{
+			Type:      search.TypeNote,
+			Owner:     n.UserEmail,
+			ID:        n.NoteID,
+			Title:     n.Title,
+			Body:      n.Content,
+			UpdatedAt: n.UpdatedAt,
+		})
+		count++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = metadata.ScanFiles(ctx, func(f db.File) error {
+		if !f.Committed() || !f.DeletedAt.IsZero() {
+			return nil
+		}
+		idx.Put(fileDocument(f))
+		count++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Rebuilt search index with %d documents", count)
+	return idx, nil
+}
+
+func fileDocument(f db.File) search.Document {
+	return search.Document{
+		Type:      search.TypeFile,
+		Owner:     f.UserEmail,
+		ID:        f.FileID,
+		Title:     f.Filename,
+		UpdatedAt: f.UploadedAt,
+	}
+}
+
+// indexNoteChange keeps the search index in step with the notes service
+func indexNoteChange(c notes.Change) {
+	switch c.Kind {
+	case notes.NoteSaved:
+		searchIndex.Put(search.Document{
+			Type:      search.TypeNote,
+			Owner:     c.UserEmail,
+			ID:        c.Note.ID,
+			Title:     c.Note.Title,
+			Body:      c.Note.Content,
+			UpdatedAt: c.Note.UpdatedAt,
+		})
+	case notes.NoteDeleted:
+		searchIndex.Delete(c.UserEmail, search.TypeNote, c.Note.ID)
+	}
+}
+
+// searchResponse is the body of a search reply
+type searchResponse struct {
+	Query   string          `json:"query"`
+	Results []search.Result `json:"results"`
+}
+
+// handleSearch serves GET /search?q=...&type=notes,files&limit=N
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+	query := r.URL.Query()
+
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		writeError(w, r, http.StatusBadRequest, "Missing search query")
+		return
+	}
+
+	var types []search.DocType
+	if t := query.Get("type"); t != "" {
+		for _, name := range strings.Split(t, ",") {
+			switch strings.TrimSpace(name) {
+			case "notes", "note":
+				types = append(types, search.TypeNote)
+			case "files", "file":
+				types = append(types, search.TypeFile)
+			default:
+				writeError(w, r, http.StatusBadRequest, "Invalid type, expected notes or files")
+				return
+			}
+		}
+	}
+
+	limit := 20
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > 100 {
+			writeError(w, r, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(searchResponse{
+		Query:   q,
+		Results: searchIndex.Search(email, q, types, limit),
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"log"
+	"os"
+)
+
+// signingKey returns the key named by env, or one derived from
+// SESSION_SECRET for purpose when it is not set. Each purpose gets its own
+// key, so a value signed for one is never accepted by another, and none
+// of them reveals the session secret.
+func signingKey(env, purpose string) []byte {
+	if key := os.Getenv(env); key != "" {
+		return []byte(key)
+	}
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		return deriveKey([]byte(secret), purpose)
+	}
+
+	// Without a configured secret, whatever is signed stops working on restart
+	log.Printf("No %s or SESSION_SECRET set, using a random key", env)
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate %s: %v", env, err)
+	}
+	return key
+}
+
+// deriveKey is HKDF-SHA256 (RFC 5869) of secret with purpose as the info,
+// producing one 32 byte key
+func deriveKey(secret []byte, purpose string) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(purpose))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
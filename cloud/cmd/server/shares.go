@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"cloud/internal/acl"
+	"cloud/internal/shares"
+	"cloud/internal/ws"
+)
+
+var shareService *shares.Service
+
+// shareLink is a new share with the link that opens it. The link is only
+// ever shown here.
+type shareLink struct {
+	Share shares.Info `json:"share"`
+	Token string      `json:"token"`
+	URL   string      `json:"url"`
+}
+
+// sharedFile is what anyone holding a link sees of the file
+type sharedFile struct {
+	Filename    string     `json:"filename"`
+	Size        int64      `json:"size"`
+	ContentType string     `json:"content_type"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	// DownloadsLeft is omitted for links without a download limit
+	DownloadsLeft *int `json:"downloads_left,omitempty"`
+}
+
+// sharePassword marks a form body carrying a share link's password
+type sharePassword struct{}
+
+// writeShareError maps shares service errors onto HTTP responses
+func writeShareError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	switch {
+	case errors.Is(err, shares.ErrNotFound):
+		writeError(w, r, http.StatusNotFound, "Share link not found")
+	case errors.Is(err, shares.ErrExpired), errors.Is(err, shares.ErrExhausted):
+		writeError(w, r, http.StatusGone, err.Error())
+	case errors.Is(err, shares.ErrPasswordRequired), errors.Is(err, shares.ErrWrongPassword):
+		writeError(w, r, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, shares.ErrInvalidExpiry), errors.Is(err, shares.ErrInvalidLimit):
+		writeError(w, r, http.StatusBadRequest, err.Error())
+	default:
+		writeFileError(w, r, err, action)
+	}
+}
+
+// handleCreateShare creates a public link to a file
+func handleCreateShare(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := authorize(w, r, acl.File, mux.Vars(r)["id"], acl.RoleOwner)
+	if !ok {
+		return
+	}
+
+	var opts shares.Options
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	info, token, err := shareService.Create(r.Context(), owner, mux.Vars(r)["id"], opts)
+	if err != nil {
+		writeShareError(w, r, err, "creating share")
+		return
+	}
+	// Links are only listed to their owner
+	publish([]string{owner}, ws.ShareCreated, info)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(shareLink{Share: info, Token: token, URL: "/s/" + token})
+}
+
+// handleListShares lists the user's links that still work
+func handleListShares(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	list, err := shareService.List(r.Context(), email)
+	if err != nil {
+		log.Printf("[%s] Error listing shares: %v", requestID(r), err)
+		writeError(w, r, http.StatusInternalServerError, "Error listing shares")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleRevokeShare deletes a link
+func handleRevokeShare(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	if err := shareService.Revoke(r.Context(), email, mux.Vars(r)["id"]); err != nil {
+		writeShareError(w, r, err, "revoking share")
+		return
+	}
+	publish([]string{email}, ws.ShareRevoked, ws.Deleted{ID: mux.Vars(r)["id"]})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sharePasswordFrom takes the password from X-Share-Password, or from the
+// form of the share page
+func sharePasswordFrom(r *http.Request) string {
+	if p := r.Header.Get("X-Share-Password"); p != "" {
+		return p
+	}
+	if r.Method == "POST" {
+		return r.PostFormValue("password")
+	}
+	return ""
+}
+
+// handleGetShared describes a shared file to anyone holding the link
+func handleGetShared(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	share, file, err := shareService.Resolve(r.Context(), mux.Vars(r)["token"], sharePasswordFrom(r))
+	if err != nil {
+		writeShareError(w, r, err, "reading shared file")
+		return
+	}
+
+	resp := sharedFile{Filename: file.Filename, Size: file.Size, ContentType: file.ContentType}
+	if !share.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &share.ExpiresAt
+	}
+	if share.MaxDownloads > 0 {
+		left := share.MaxDownloads - share.Downloads
+		resp.DownloadsLeft = &left
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleDownloadShared sends a shared file. Every request for content
+// counts as a download, ranged ones included, so that no form of Range
+// gets around a download limit; a video player seeking or a resumed
+// download uses up the limit too. Only revalidations answered with 304
+// are free.
+func handleDownloadShared(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	share, file, err := shareService.Resolve(r.Context(), mux.Vars(r)["token"], sharePasswordFrom(r))
+	if err != nil {
+		writeShareError(w, r, err, "reading shared file")
+		return
+	}
+
+	if !notModified(r, fileDownload(file)) {
+		if err := shareService.CountDownload(r.Context(), share); err != nil {
+			writeShareError(w, r, err, "counting download")
+			return
+		}
+	}
+
+	fileRecord, object, err := fileService.Open(r.Context(), share.UserEmail, file.FileID)
+	if err != nil {
+		writeFileError(w, r, err, "downloading shared file")
+		return
+	}
+	defer object.Close()
+
+	serveContent(w, r, object, fileDownload(fileRecord))
+}
+
+// handleDownloadSharedForm is the download button of the share page,
+// which posts the password as a form field
+func handleDownloadSharedForm(w http.ResponseWriter, r *http.Request) {
+	handleDownloadShared(w, r)
+}
+
+// handleSharePage serves the page a share link opens
+func handleSharePage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.ServeFile(w, r, "web/templates/share.html")
+}
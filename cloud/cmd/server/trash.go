@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"cloud/internal/acl"
+	"cloud/internal/trash"
+	"cloud/internal/ws"
+)
+
+var trashService *trash.Service
+
+// trashEmptied is the response to emptying the trash
+type trashEmptied struct {
+	Deleted int `json:"deleted"`
+}
+
+// writeTrashError maps trash service errors onto HTTP responses
+func writeTrashError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	switch {
+	case errors.Is(err, trash.ErrNotFound):
+		writeError(w, r, http.StatusNotFound, "Not in the trash")
+	case errors.Is(err, trash.ErrInvalidType):
+		writeError(w, r, http.StatusBadRequest, err.Error())
+	default:
+		log.Printf("[%s] Error %s: %v", requestID(r), action, err)
+		writeError(w, r, http.StatusInternalServerError, "Error "+action)
+	}
+}
+
+// handleListTrash lists the session user's trashed files and notes
+func handleListTrash(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	items, err := trashService.List(r.Context(), email)
+	if err != nil {
+		writeTrashError(w, r, err, "listing trash")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// handleEmptyTrash permanently deletes everything in the trash. Trashed
+// files already left the search index when they were trashed.
+func handleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	n, err := trashService.Empty(r.Context(), email)
+	if err != nil {
+		writeTrashError(w, r, err, "emptying trash")
+		return
+	}
+	publish([]string{email}, ws.TrashEmptied, trashEmptied{Deleted: n})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trashEmptied{Deleted: n})
+}
+
+// handleRestoreTrashedFile moves a file out of the trash, back into its
+// folder if that still exists
+func handleRestoreTrashedFile(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	file, err := trashService.RestoreFile(r.Context(), email, mux.Vars(r)["id"])
+	if err != nil {
+		writeTrashError(w, r, err, "restoring file")
+		return
+	}
+	searchIndex.Put(fileDocument(file))
+	notify(r.Context(), email, acl.File, file.FileID, ws.FileRestored, file)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+// handleRestoreTrashedNote moves a note out of the trash
+func handleRestoreTrashedNote(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	note, err := trashService.RestoreNote(r.Context(), email, mux.Vars(r)["id"])
+	if err != nil {
+		writeTrashError(w, r, err, "restoring note")
+		return
+	}
+	notify(r.Context(), email, acl.Note, note.ID, ws.NoteRestored, note)
+
+	w.Header().Set("ETag", noteETag(note.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(note)
+}
+
+// handleDeleteTrashedFile permanently deletes a file in the trash with all
+// its versions
+func handleDeleteTrashedFile(w http.ResponseWriter, r *http.Request) {
+	deleteTrashed(w, r, trash.File)
+}
+
+// handleDeleteTrashedNote permanently deletes a note in the trash with its
+// history
+func handleDeleteTrashedNote(w http.ResponseWriter, r *http.Request) {
+	deleteTrashed(w, r, trash.Note)
+}
+
+func deleteTrashed(w http.ResponseWriter, r *http.Request, t trash.Type) {
+	email := userEmail(r)
+
+	if err := trashService.Delete(r.Context(), email, t, mux.Vars(r)["id"]); err != nil {
+		writeTrashError(w, r, err, "deleting "+string(t))
+		return
+	}
+	// Only the owner could see it while it was in the trash
+	event := ws.FileDeleted
+	if t == trash.Note {
+		event = ws.NoteDeleted
+	}
+	publish([]string{email}, event, ws.Deleted{ID: mux.Vars(r)["id"], Permanent: true})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"cloud/internal/uploads"
+)
+
+// Resumable uploads follow the tus 1.0 protocol (https://tus.io) with the
+// creation, expiration and termination extensions, so stock tus clients
+// work against /api/v1/uploads. Each PATCH is stored whole or not at all
+// and must carry at least 5 MiB unless it is the last one.
+const tusVersion = "1.0.0"
+
+// uploadChunk marks a PATCH body of raw upload content
+type uploadChunk struct{}
+
+// tusHeaders sets the headers every tus response carries and rejects
+// clients speaking another protocol version
+func tusHeaders(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, r, http.StatusPreconditionFailed, "Unsupported tus version "+v)
+		return false
+	}
+	return true
+}
+
+// setUploadHeaders reports the progress of an upload
+func setUploadHeaders(w http.ResponseWriter, st uploads.Status) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(st.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(st.Length, 10))
+	w.Header().Set("Upload-Expires", st.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// writeUploadError maps uploads service errors onto HTTP responses
+func writeUploadError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	switch {
+	case errors.Is(err, uploads.ErrNotFound):
+		writeError(w, r, http.StatusNotFound, "Upload not found")
+	case errors.Is(err, uploads.ErrOffsetMismatch):
+		writeError(w, r, http.StatusConflict, "Upload-Offset does not match the upload, check it with HEAD")
+	case errors.Is(err, uploads.ErrDirect), errors.Is(err, uploads.ErrNotDirect),
+		errors.Is(err, uploads.ErrNotUploaded), errors.Is(err, uploads.ErrSizeMismatch):
+		writeError(w, r, http.StatusConflict, err.Error())
+	case errors.Is(err, uploads.ErrBusy):
+		writeError(w, r, http.StatusLocked, err.Error())
+	case errors.Is(err, uploads.ErrInvalidLength), errors.Is(err, uploads.ErrTooLarge),
+		errors.Is(err, uploads.ErrChunkTooSmall), errors.Is(err, uploads.ErrChunkTooLarge),
+		errors.Is(err, uploads.ErrTooManyChunks):
+		writeError(w, r, http.StatusBadRequest, err.Error())
+	default:
+		writeFileError(w, r, err, action)
+	}
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header, a comma
+// separated list of "key base64(value)" pairs
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// handleUploadOptions answers tus discovery requests
+func handleUploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration,termination")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCreateUpload starts an upload. The size comes from Upload-Length,
+// the name, type and folder from the filename, filetype and parent_id
+// metadata.
+func handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+	if !tusHeaders(w, r) {
+		return
+	}
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeError(w, r, http.StatusBadRequest, "Upload-Defer-Length is not supported")
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, r, http.StatusBadRequest, "Missing or invalid Upload-Length")
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid Upload-Metadata")
+		return
+	}
+	if meta["filename"] == "" {
+		writeError(w, r, http.StatusBadRequest, "Upload-Metadata must include filename")
+		return
+	}
+
+	parentID, err := folderService.ResolveParent(r.Context(), email, meta["parent_id"])
+	if err != nil {
+		writeFolderError(w, r, err, "checking folder")
+		return
+	}
+
+	st, err := uploadService.Create(r.Context(), email, uploads.NewUpload{
+		Filename:    meta["filename"],
+		ParentID:    parentID,
+		ContentType: meta["filetype"],
+		Length:      length,
+	})
+	if err != nil {
+		writeUploadError(w, r, err, "creating upload")
+		return
+	}
+
+	setUploadHeaders(w, st)
+	w.Header().Set("Location", apiPrefix+"/uploads/"+st.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(st)
+}
+
+// handleUploadOffset reports how much of an upload has been stored, which
+// is where a client resumes
+func handleUploadOffset(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+	if !tusHeaders(w, r) {
+		return
+	}
+
+	st, err := uploadService.Get(r.Context(), email, mux.Vars(r)["id"])
+	if err != nil {
+		writeUploadError(w, r, err, "reading upload")
+		return
+	}
+
+	setUploadHeaders(w, st)
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+
+	st, err := uploadService.Get(r.Context(), email, mux.Vars(r)["id"])
+	if err != nil {
+		writeUploadError(w, r, err, "reading upload")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// handleWriteUpload stores one chunk at Upload-Offset. The chunk that
+// completes the upload creates the file; its ID is then in the upload
+// status.
+func handleWriteUpload(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+	if !tusHeaders(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, r, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, r, http.StatusBadRequest, "Missing or invalid Upload-Offset")
+		return
+	}
+	if r.ContentLength < 0 {
+		writeError(w, r, http.StatusLengthRequired, "Content-Length is required")
+		return
+	}
+
+	st, err := uploadService.Write(r.Context(), email, mux.Vars(r)["id"], offset, r.Body, r.ContentLength)
+	if err != nil {
+		writeUploadError(w, r, err, "writing upload")
+		return
+	}
+
+	setUploadHeaders(w, st)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleCancelUpload terminates an upload and discards what it stored
+func handleCancelUpload(w http.ResponseWriter, r *http.Request) {
+	email := userEmail(r)
+	if !tusHeaders(w, r) {
+		return
+	}
+
+	if err := uploadService.Cancel(r.Context(), email, mux.Vars(r)["id"]); err != nil {
+		writeUploadError(w, r, err, "cancelling upload")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
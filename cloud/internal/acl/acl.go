@@ -0,0 +1,440 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"cloud/internal/db"
+)
+
+var (
+	ErrNotFound        = errors.New("resource not found")
+	ErrForbidden       = errors.New("you do not have permission to do that")
+	ErrInvalidRole     = errors.New("role must be viewer, editor or owner")
+	ErrInvalidResource = errors.New("resource type must be file, folder or note")
+	ErrUnknownUser     = errors.New("no user with that email")
+	ErrSelf            = errors.New("the owner already has full access")
+)
+
+// errTrashed hides files and notes in the trash from everyone, owners
+// included. It matches ErrNotFound.
+var errTrashed = fmt.Errorf("%w: it is in the trash", ErrNotFound)
+
+// Role is what a user may do with a resource. Each role includes the ones
+// before it: viewers read, editors also change content, owners also
+// delete, move and share.
+type Role string
+
+const (
+	RoleViewer Role = "viewer"
+	RoleEditor Role = "editor"
+	RoleOwner  Role = "owner"
+)
+
+func (r Role) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleEditor:
+		return 2
+	case RoleOwner:
+		return 3
+	}
+	return 0
+}
+
+// Allows reports whether r includes need
+func (r Role) Allows(need Role) bool {
+	return r.rank() >= need.rank() && r.rank() > 0
+}
+
+// Resource is the kind of thing a grant is on
+type Resource string
+
+const (
+	File   Resource = "file"
+	Folder Resource = "folder"
+	Note   Resource = "note"
+)
+
+func (r Resource) valid() bool {
+	return r == File || r == Folder || r == Note
+}
+
+// Store is the persistence backend used by Service. db.MetadataStore
+// satisfies it.
+type Store interface {
+	GetUser(ctx context.Context, email string) (db.User, error)
+	GetFile(ctx context.Context, userEmail, fileID string) (db.File, error)
+	GetFolder(ctx context.Context, userEmail, folderID string) (db.Folder, error)
+	GetNote(ctx context.Context, userEmail, noteID string) (db.Note, error)
+
+	SaveGrant(ctx context.Context, grant db.Grant) error
+	GetResourceGrants(ctx context.Context, ownerEmail, resourceType, resourceID string) ([]db.Grant, error)
+	GetGranteeGrants(ctx context.Context, granteeEmail string) ([]db.Grant, error)
+	DeleteGrant(ctx context.Context, grant db.Grant) error
+}
+
+// Access is what a user may do with a resource and whose it is. Services
+// keep addressing resources by their owner.
+type Access struct {
+	Owner string
+	Role  Role
+}
+
+// Grant is a user's access to a resource as shown to clients
+type Grant struct {
+	Email     string    `json:"email"`
+	Role      Role      `json:"role"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+// SharedItem is a resource someone else shared with the user
+type SharedItem struct {
+	Type      Resource  `json:"type"`
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Role      Role      `json:"role"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+// Service checks and manages access to resources. Everything belongs to
+// the user whose email it is stored under; grants let other users in.
+type Service struct {
+	store Store
+}
+
+func NewService(store Store) *Service {
+	return &Service{store: store}
+}
+
+// maxDepth bounds the walk up a folder tree, which guards against cycles
+// in damaged data
+const maxDepth = 64
+
+// Check returns the access email has to a resource if it includes need.
+// Resources email cannot see at all are reported as ErrNotFound, so their
+// existence is not revealed; ErrForbidden means the role is too low.
+func (s *Service) Check(ctx context.Context, email string, res Resource, id string, need Role) (Access, error) {
+	if !res.valid() {
+		return Access{}, ErrInvalidResource
+	}
+
+	_, err := s.name(ctx, email, res, id)
+	if err == nil {
+		return Access{Owner: email, Role: RoleOwner}, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return Access{}, err
+	}
+
+	grants, err := s.store.GetGranteeGrants(ctx, email)
+	if err != nil {
+		return Access{}, fmt.Errorf("failed to read grants: %v", err)
+	}
+	byOwner := make(map[string][]db.Grant)
+	for _, g := range grants {
+		byOwner[g.OwnerEmail] = append(byOwner[g.OwnerEmail], g)
+	}
+
+	for owner, grants := range byOwner {
+		role, err := s.role(ctx, owner, grants, res, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return Access{}, err
+		}
+		if role == "" {
+			return Access{}, ErrNotFound
+		}
+		if !role.Allows(need) {
+			return Access{}, ErrForbidden
+		}
+		return Access{Owner: owner, Role: role}, nil
+	}
+	return Access{}, ErrNotFound
+}
+
+// role works out the best role grants give on one of owner's resources,
+// directly or through the folders above it. It fails with ErrNotFound if
+// owner has no such resource.
+func (s *Service) role(ctx context.Context, owner string, grants []db.Grant, res Resource, id string) (Role, error) {
+	granted := make(map[string]Role)
+	for _, g := range grants {
+		granted[g.ResourceType+"/"+g.ResourceID] = Role(g.Role)
+	}
+
+	var best Role
+	consider := func(r Role) {
+		if r.rank() > best.rank() {
+			best = r
+		}
+	}
+	consider(granted[string(res)+"/"+id])
+
+	var parentID string
+	switch res {
+	case File:
+		file, err := s.store.GetFile(ctx, owner, id)
+		if err != nil {
+			return "", notFound(err)
+		}
+		if !file.Committed() {
+			return "", ErrNotFound
+		}
+		if !file.DeletedAt.IsZero() {
+			return "", errTrashed
+		}
+		parentID = file.ParentID
+	case Folder:
+		folder, err := s.store.GetFolder(ctx, owner, id)
+		if err != nil {
+			return "", notFound(err)
+		}
+		parentID = folder.ParentID
+	case Note:
+		note, err := s.store.GetNote(ctx, owner, id)
+		if err != nil {
+			return "", notFound(err)
+		}
+		if !note.DeletedAt.IsZero() {
+			return "", errTrashed
+		}
+	}
+
+	for depth := 0; parentID != "" && depth < maxDepth; depth++ {
+		consider(granted[string(Folder)+"/"+parentID])
+		folder, err := s.store.GetFolder(ctx, owner, parentID)
+		if errors.Is(err, db.ErrNotFound) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read folder: %v", err)
+		}
+		parentID = folder.ParentID
+	}
+	return best, nil
+}
+
+// name returns the display name of one of owner's resources. Files and
+// notes in the trash are reported as errTrashed.
+func (s *Service) name(ctx context.Context, owner string, res Resource, id string) (string, error) {
+	switch res {
+	case File:
+		file, err := s.store.GetFile(ctx, owner, id)
+		if err == nil && !file.Committed() {
+			return "", ErrNotFound
+		}
+		if err == nil && !file.DeletedAt.IsZero() {
+			return "", errTrashed
+		}
+		return file.Filename, notFound(err)
+	case Folder:
+		folder, err := s.store.GetFolder(ctx, owner, id)
+		return folder.Name, notFound(err)
+	case Note:
+		note, err := s.store.GetNote(ctx, owner, id)
+		if err == nil && !note.DeletedAt.IsZero() {
+			return "", errTrashed
+		}
+		return note.Title, notFound(err)
+	}
+	return "", ErrInvalidResource
+}
+
+func notFound(err error) error {
+	if errors.Is(err, db.ErrNotFound) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read resource: %v", err)
+	}
+	return nil
+}
+
+// Grants lists who else has access to a resource. Only owners see it.
+func (s *Service) Grants(ctx context.Context, email string, res Resource, id string) ([]Grant, error) {
+	access, err := s.Check(ctx, email, res, id, RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	grants, err := s.store.GetResourceGrants(ctx, access.Owner, string(res), id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read grants: %v", err)
+	}
+
+	list := make([]Grant, 0, len(grants))
+	for _, g := range grants {
+		list = append(list, Grant{Email: g.GranteeEmail, Role: Role(g.Role), GrantedAt: g.GrantedAt})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Email < list[j].Email
+	})
+	return list, nil
+}
+
+// Grant gives grantee role on a resource, replacing any role they had on
+// it. email must be an owner of the resource.
+func (s *Service) Grant(ctx context.Context, email string, res Resource, id, grantee string, role Role) (Grant, error) {
+	if role.rank() == 0 {
+		return Grant{}, ErrInvalidRole
+	}
+	access, err := s.Check(ctx, email, res, id, RoleOwner)
+	if err != nil {
+		return Grant{}, err
+	}
+	if grantee == access.Owner {
+		return Grant{}, ErrSelf
+	}
+	if _, err := s.store.GetUser(ctx, grantee); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return Grant{}, ErrUnknownUser
+		}
+		return Grant{}, fmt.Errorf("failed to read user: %v", err)
+	}
+
+	g := db.Grant{
+		OwnerEmail:   access.Owner,
+		ResourceType: string(res),
+		ResourceID:   id,
+		GranteeEmail: grantee,
+		Role:         string(role),
+		GrantedAt:    time.Now(),
+	}
+	if err := s.store.SaveGrant(ctx, g); err != nil {
+		return Grant{}, fmt.Errorf("failed to save grant: %v", err)
+	}
+
+	log.Printf("User %s gave %s %s access to %s %s", email, grantee, role, res, id)
+	return Grant{Email: grantee, Role: role, GrantedAt: g.GrantedAt}, nil
+}
+
+// Revoke takes away grantee's grant on a resource. Owners can revoke any
+// grant and everyone can give up their own.
+func (s *Service) Revoke(ctx context.Context, email string, res Resource, id, grantee string) error {
+	need := RoleOwner
+	if grantee == email {
+		need = RoleViewer
+	}
+	access, err := s.Check(ctx, email, res, id, need)
+	if err != nil {
+		return err
+	}
+
+	err = s.store.DeleteGrant(ctx, db.Grant{
+		OwnerEmail:   access.Owner,
+		ResourceType: string(res),
+		ResourceID:   id,
+		GranteeEmail: grantee,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete grant: %v", err)
+	}
+	return nil
+}
+
+// SharedWith lists what other users shared with email, most recent first.
+// Grants on resources that have since been deleted are removed; those in
+// the trash are kept, but left out, until the resource is restored.
+func (s *Service) SharedWith(ctx context.Context, email string) ([]SharedItem, error) {
+	grants, err := s.store.GetGranteeGrants(ctx, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read grants: %v", err)
+	}
+
+	items := make([]SharedItem, 0, len(grants))
+	for _, g := range grants {
+		name, err := s.name(ctx, g.OwnerEmail, Resource(g.ResourceType), g.ResourceID)
+		if errors.Is(err, errTrashed) {
+			continue
+		}
+		if errors.Is(err, ErrNotFound) {
+			if err := s.store.DeleteGrant(ctx, g); err != nil {
+				log.Printf("Error removing grant on deleted %s %s: %v", g.ResourceType, g.ResourceID, err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, SharedItem{
+			Type:      Resource(g.ResourceType),
+			ID:        g.ResourceID,
+			Name:      name,
+			Owner:     g.OwnerEmail,
+			Role:      Role(g.Role),
+			GrantedAt: g.GrantedAt,
+		})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].GrantedAt.After(items[j].GrantedAt)
+	})
+	return items, nil
+}
+
+// Audience lists everyone who can see one of owner's resources: the owner
+// and whoever has a grant on it or a folder above it. Resources in the
+// trash or already deleted still have an audience, so their removal can
+// be announced.
+func (s *Service) Audience(ctx context.Context, owner string, res Resource, id string) ([]string, error) {
+	if !res.valid() {
+		return nil, ErrInvalidResource
+	}
+
+	seen := map[string]bool{owner: true}
+	audience := []string{owner}
+	add := func(res Resource, id string) error {
+		grants, err := s.store.GetResourceGrants(ctx, owner, string(res), id)
+		if err != nil {
+			return fmt.Errorf("failed to read grants: %v", err)
+		}
+		for _, g := range grants {
+			if !seen[g.GranteeEmail] {
+				seen[g.GranteeEmail] = true
+				audience = append(audience, g.GranteeEmail)
+			}
+		}
+		return nil
+	}
+	if err := add(res, id); err != nil {
+		return nil, err
+	}
+
+	var parentID string
+	switch res {
+	case File:
+		file, err := s.store.GetFile(ctx, owner, id)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return nil, fmt.Errorf("failed to read file: %v", err)
+		}
+		parentID = file.ParentID
+	case Folder:
+		folder, err := s.store.GetFolder(ctx, owner, id)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return nil, fmt.Errorf("failed to read folder: %v", err)
+		}
+		parentID = folder.ParentID
+	}
+
+	for depth := 0; parentID != "" && depth < maxDepth; depth++ {
+		if err := add(Folder, parentID); err != nil {
+			return nil, err
+		}
+		folder, err := s.store.GetFolder(ctx, owner, parentID)
+		if errors.Is(err, db.ErrNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read folder: %v", err)
+		}
+		parentID = folder.ParentID
+	}
+	return audience, nil
+}
@@ -0,0 +1,149 @@
+package acl_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud/internal/acl"
+	"cloud/internal/database"
+	"cloud/internal/db"
+)
+
+const (
+	owner  = "ann@example.com"
+	viewer = "bob@example.com"
+	editor = "cat@example.com"
+	other  = "dan@example.com"
+)
+
+// setup stores a file in a subfolder of owner's, shares the top folder
+// with viewer and the file itself with editor
+func setup(t *testing.T) *acl.Service {
+	t.Helper()
+	ctx := context.Background()
+	meta, err := database.NewDB(filepath.Join(t.TempDir(), "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{owner, viewer, editor, other} {
+		if err := meta.CreateUser(ctx, db.User{Email: email}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	folders := []db.Folder{
+		{UserEmail: owner, FolderID: "top", Name: "Top"},
+		{UserEmail: owner, FolderID: "sub", ParentID: "top", Name: "Sub"},
+	}
+	for _, f := range folders {
+		if err := meta.SaveFolder(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := db.File{UserEmail: owner, FileID: "file", ParentID: "sub", Filename: "a.txt", UploadedAt: time.Now()}
+	if err := meta.SaveFileMetadata(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+
+	s := acl.NewService(meta)
+	if _, err := s.Grant(ctx, owner, acl.Folder, "top", viewer, acl.RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Grant(ctx, owner, acl.File, "file", editor, acl.RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	s := setup(t)
+
+	tests := []struct {
+		name  string
+		email string
+		res   acl.Resource
+		id    string
+		need  acl.Role
+		want  acl.Role
+		err   error
+	}{
+		{name: "owner", email: owner, res: acl.File, id: "file", need: acl.RoleOwner, want: acl.RoleOwner},
+		{name: "inherited from a folder", email: viewer, res: acl.File, id: "file", need: acl.RoleViewer, want: acl.RoleViewer},
+		{name: "subfolder", email: viewer, res: acl.Folder, id: "sub", need: acl.RoleViewer, want: acl.RoleViewer},
+		{name: "inherited role too low", email: viewer, res: acl.File, id: "file", need: acl.RoleEditor, err: acl.ErrForbidden},
+		{name: "direct grant", email: editor, res: acl.File, id: "file", need: acl.RoleEditor, want: acl.RoleEditor},
+		{name: "editor cannot share", email: editor, res: acl.File, id: "file", need: acl.RoleOwner, err: acl.ErrForbidden},
+		{name: "grant does not reach up", email: editor, res: acl.Folder, id: "sub", need: acl.RoleViewer, err: acl.ErrNotFound},
+		{name: "no grant", email: other, res: acl.File, id: "file", need: acl.RoleViewer, err: acl.ErrNotFound},
+		{name: "missing file", email: viewer, res: acl.File, id: "nope", need: acl.RoleViewer, err: acl.ErrNotFound},
+		{name: "bad resource", email: owner, res: "disk", id: "file", need: acl.RoleViewer, err: acl.ErrInvalidResource},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access, err := s.Check(ctx, tt.email, tt.res, tt.id, tt.need)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if access.Owner != owner || access.Role != tt.want {
+				t.Fatalf("got %+v, want %s access to %s's file", access, tt.want, owner)
+			}
+		})
+	}
+}
+
+func TestGrant(t *testing.T) {
+	ctx := context.Background()
+	s := setup(t)
+
+	tests := []struct {
+		name    string
+		email   string
+		grantee string
+		role    acl.Role
+		want    error
+	}{
+		{name: "unknown role", email: owner, grantee: other, role: "admin", want: acl.ErrInvalidRole},
+		{name: "unknown user", email: owner, grantee: "eve@example.com", role: acl.RoleViewer, want: acl.ErrUnknownUser},
+		{name: "to the owner", email: owner, grantee: owner, role: acl.RoleViewer, want: acl.ErrSelf},
+		{name: "by a viewer", email: viewer, grantee: other, role: acl.RoleViewer, want: acl.ErrForbidden},
+		{name: "by a stranger", email: other, grantee: other, role: acl.RoleViewer, want: acl.ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Grant(ctx, tt.email, acl.Folder, "top", tt.grantee, tt.role); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	ctx := context.Background()
+	s := setup(t)
+
+	// Grantees can give up their own access but not take away anyone else's
+	if err := s.Revoke(ctx, viewer, acl.File, "file", editor); !errors.Is(err, acl.ErrForbidden) {
+		t.Fatalf("viewer revoking a file grant: got %v, want ErrForbidden", err)
+	}
+	if err := s.Revoke(ctx, editor, acl.File, "file", editor); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Check(ctx, editor, acl.File, "file", acl.RoleViewer); !errors.Is(err, acl.ErrNotFound) {
+		t.Fatalf("after revoking: got %v, want ErrNotFound", err)
+	}
+
+	if err := s.Revoke(ctx, owner, acl.Folder, "top", viewer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Check(ctx, viewer, acl.File, "file", acl.RoleViewer); !errors.Is(err, acl.ErrNotFound) {
+		t.Fatalf("after revoking the folder: got %v, want ErrNotFound", err)
+	}
+}
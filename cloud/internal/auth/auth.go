@@ -1,28 +1,60 @@
 package auth
 
 import (
-	"cloud/internal/database"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"net/http"
-	"os"
+	"net/mail"
+	"strings"
 	"time"
 
+	"cloud/internal/db"
+
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrEmailTaken         = errors.New("an account with this email already exists")
+	ErrInvalidEmail       = errors.New("invalid email address")
+	ErrWeakPassword       = fmt.Errorf("password must be at least %d characters", minPasswordLen)
+	ErrInvalidToken       = errors.New("invalid token")
+	// ErrUnverifiedEmail is returned when Google has not verified the email
+	// of an account that already has a password
+	ErrUnverifiedEmail = errors.New("email not verified by Google")
+)
+
+const (
+	minPasswordLen = 8
+	tokenTTL       = 24 * time.Hour
+)
+
+// Users is the part of the metadata store that holds user records
+type Users interface {
+	CreateUser(ctx context.Context, user db.User) error
+	UpdateUser(ctx context.Context, user db.User) error
+	GetUser(ctx context.Context, email string) (db.User, error)
+	GetUserByID(ctx context.Context, id string) (db.User, error)
+}
+
+// Auth signs users in with a password or with Google and issues the JWTs
+// API clients authenticate with. Both ways of signing in lead to the same
+// user record for an email.
 type Auth struct {
-	db *database.DB
+	users  Users
+	secret []byte
 }
 
+// Claims are the contents of a token. UserID is the user's stable ID.
 type Claims struct {
-	UserID int64 `json:"user_id"`
+	UserID string `json:"user_id"`
 	jwt.RegisteredClaims
 }
 
-func NewAuth(db *database.DB) *Auth {
-	return &Auth{db: db}
+func NewAuth(users Users, secret []byte) *Auth {
+	return &Auth{users: users, secret: secret}
 }
 
 func (a *Auth) HashPassword(password string) (string, error) {
@@ -35,142 +67,200 @@ func (a *Auth) CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-func (a *Auth) GenerateToken(userID int64) (string, error) {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "your-256-bit-secret" // Default secret for development
-	}
-
+func (a *Auth) GenerateToken(userID string) (string, error) {
 	claims := &Claims{
 		UserID: userID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	return token.SignedString(a.secret)
 }
 
 func (a *Auth) ValidateToken(tokenString string) (*Claims, error) {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "your-256-bit-secret" // Default secret for development
-	}
-
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(secret), nil
+		return a.secret, nil
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && claims.UserID != "" {
 		return claims, nil
 	}
 
-	return nil, fmt.Errorf("invalid token")
-}
-
-func (a *Auth) AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip auth for login and register endpoints
-		if r.URL.Path == "/auth/login" || r.URL.Path == "/auth/register" {
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		claims, err := a.ValidateToken(tokenString)
-		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
-
-		// Add user ID to request context
-		ctx := r.Context()
-		r = r.WithContext(ctx)
-		r.Header.Set("X-User-ID", fmt.Sprintf("%d", claims.UserID))
-
-		next.ServeHTTP(w, r)
-	})
-}
-
-type LoginRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	return nil, ErrInvalidToken
 }
 
-type RegisterRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+// Authenticate returns the user a token was issued to
+func (a *Auth) Authenticate(ctx context.Context, tokenString string) (db.User, error) {
+	claims, err := a.ValidateToken(tokenString)
+	if err != nil {
+		return db.User{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	user, err := a.users.GetUserByID(ctx, claims.UserID)
+	if errors.Is(err, db.ErrNotFound) {
+		return db.User{}, ErrInvalidToken
+	}
+	if err != nil {
+		return db.User{}, fmt.Errorf("failed to read user: %v", err)
+	}
+	return user, nil
 }
 
-type AuthResponse struct {
-	Token string `json:"token"`
+// Current reports whether the user a session was started for still has
+// the ID it was started with. Sessions from before IDs carry none and are
+// taken as current.
+func (a *Auth) Current(ctx context.Context, email, userID string) (bool, error) {
+	if userID == "" {
+		return true, nil
+	}
+	user, err := a.users.GetUser(ctx, email)
+	if errors.Is(err, db.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read user: %v", err)
+	}
+	return user.ID == userID, nil
 }
 
-func (a *Auth) HandleLogin(w http.ResponseWriter, r *http.Request) {
-	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// normalizeEmail lower cases an email typed in by a user, or returns
+// ErrInvalidEmail
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", ErrInvalidEmail
 	}
+	return email, nil
+}
 
-	user, err := a.db.GetUserByEmail(req.Email)
+// Register creates a user who signs in with a password. Emails already
+// known, from either way of signing in, are refused: only Google can tie
+// a password account to an existing user. Nothing proves the email is
+// theirs until its owner signs in with Google, which drops the password if
+// someone else chose it.
+func (a *Auth) Register(ctx context.Context, email, password, name string) (db.User, error) {
+	email, err := normalizeEmail(email)
 	if err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-		return
+		return db.User{}, err
 	}
-
-	if !a.CheckPasswordHash(req.Password, user.Password) {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-		return
+	if len(password) < minPasswordLen {
+		return db.User{}, ErrWeakPassword
 	}
 
-	token, err := a.GenerateToken(user.ID)
+	hash, err := a.HashPassword(password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return db.User{}, fmt.Errorf("failed to hash password: %v", err)
 	}
-
-	json.NewEncoder(w).Encode(AuthResponse{Token: token})
+	now := time.Now()
+	user := db.User{
+		ID:           uuid.New().String(),
+		Email:        email,
+		Name:         strings.TrimSpace(name),
+		PasswordHash: hash,
+		CreatedAt:    now,
+		LastLogin:    now,
+	}
+	if err := a.users.CreateUser(ctx, user); err != nil {
+		if errors.Is(err, db.ErrConflict) {
+			return db.User{}, ErrEmailTaken
+		}
+		return db.User{}, fmt.Errorf("failed to create user: %v", err)
+	}
+	return user, nil
 }
 
-func (a *Auth) HandleRegister(w http.ResponseWriter, r *http.Request) {
-	var req RegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// Login checks a password and records the sign in
+func (a *Auth) Login(ctx context.Context, email, password string) (db.User, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return db.User{}, ErrInvalidCredentials
+	}
+	user, err := a.users.GetUser(ctx, email)
+	if errors.Is(err, db.ErrNotFound) {
+		return db.User{}, ErrInvalidCredentials
 	}
-
-	hashedPassword, err := a.HashPassword(req.Password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return db.User{}, fmt.Errorf("failed to read user: %v", err)
+	}
+	if user.PasswordHash == "" || !a.CheckPasswordHash(password, user.PasswordHash) {
+		return db.User{}, ErrInvalidCredentials
 	}
+	return a.signedIn(ctx, user)
+}
 
-	user, err := a.db.CreateUser(req.Email, hashedPassword)
+// SignInWithGoogle finds or creates the user of a Google account, keeping
+// their name up to date.
+//
+// The first sign in with a verified email proves the account is its
+// owner's. A password set before then may have been registered by someone
+// else waiting for the owner to start using the account, so it is dropped,
+// and the user gets a new ID so the tokens and sessions it gave out stop
+// working.
+func (a *Auth) SignInWithGoogle(ctx context.Context, info *GoogleUserInfo) (db.User, error) {
+	// Stored the way Register stores it, so both find the same user
+	email, err := normalizeEmail(info.Email)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return db.User{}, err
+	}
+	user, err := a.users.GetUser(ctx, email)
+	if errors.Is(err, db.ErrNotFound) {
+		now := time.Now()
+		user = db.User{
+			ID:            uuid.New().String(),
+			Email:         email,
+			Name:          info.Name,
+			EmailVerified: info.VerifiedEmail,
+			CreatedAt:     now,
+			LastLogin:     now,
+		}
+		err = a.users.CreateUser(ctx, user)
+		if err == nil {
+			return user, nil
+		}
+		if !errors.Is(err, db.ErrConflict) {
+			return db.User{}, fmt.Errorf("failed to create user: %v", err)
+		}
+		// Signed in twice at once; use the user the other one created
+		user, err = a.users.GetUser(ctx, email)
 	}
-
-	token, err := a.GenerateToken(user.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return db.User{}, fmt.Errorf("failed to read user: %v", err)
+	}
+
+	if user.PasswordHash != "" && !info.VerifiedEmail {
+		return db.User{}, ErrUnverifiedEmail
+	}
+	if info.VerifiedEmail && !user.EmailVerified {
+		if user.PasswordHash != "" {
+			user.PasswordHash = ""
+			user.ID = uuid.New().String()
+		}
+		user.EmailVerified = true
+	}
+	if info.Name != "" {
+		user.Name = info.Name
 	}
+	return a.signedIn(ctx, user)
+}
 
-	json.NewEncoder(w).Encode(AuthResponse{Token: token})
+// signedIn records a sign in, giving users from before IDs theirs
+func (a *Auth) signedIn(ctx context.Context, user db.User) (db.User, error) {
+	if user.ID == "" {
+		user.ID = uuid.New().String()
+	}
+	user.LastLogin = time.Now()
+	if err := a.users.UpdateUser(ctx, user); err != nil {
+		return db.User{}, fmt.Errorf("failed to update user: %v", err)
+	}
+	return user, nil
 }
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"cloud/internal/db"
 	"encoding/json"
 	"io"
 	"log"
@@ -65,7 +66,16 @@ func HandleGoogleLogin(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
-func HandleGoogleCallback(w http.ResponseWriter, r *http.Request) {
+// StartSession signs user in to the browser that sent r
+func StartSession(w http.ResponseWriter, r *http.Request, user db.User) error {
+	session, _ := store.Get(r, "session")
+	session.Values["email"] = user.Email
+	session.Values["name"] = user.Name
+	session.Values["user_id"] = user.ID
+	return session.Save(r, w)
+}
+
+func (a *Auth) HandleGoogleCallback(w http.ResponseWriter, r *http.Request) {
 	state := r.URL.Query().Get("state")
 	if state != "state" {
 		log.Printf("Invalid oauth state: %s", state)
@@ -89,10 +99,17 @@ func HandleGoogleCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, _ := store.Get(r, "session")
-	session.Values["email"] = userInfo.Email
-	session.Values["name"] = userInfo.Name
-	session.Save(r, w)
+	user, err := a.SignInWithGoogle(r.Context(), userInfo)
+	if err != nil {
+		log.Printf("Failed to sign in %s: %v", userInfo.Email, err)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	if err := StartSession(w, r, user); err != nil {
+		log.Printf("Failed to save session: %v", err)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
 
 	log.Printf("Successfully authenticated user: %s (%s)", userInfo.Name, userInfo.Email)
 	http.Redirect(w, r, "/dashboard", http.StatusTemporaryRedirect)
@@ -0,0 +1,627 @@
+package collab
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"cloud/internal/notes"
+	"cloud/internal/ws"
+)
+
+// Message types of collaborative editing. Clients send join, leave, edit,
+// cursor and title; the server answers with joined and ack and tells the
+// other editors about edit, cursor (as presence) and title.
+const (
+	TypeJoin     = "collab.join"
+	TypeJoined   = "collab.joined"
+	TypeLeave    = "collab.leave"
+	TypeEdit     = "collab.edit"
+	TypeAck      = "collab.ack"
+	TypeCursor   = "collab.cursor"
+	TypeTitle    = "collab.title"
+	TypePresence = "collab.presence"
+	TypeClosed   = "collab.closed"
+)
+
+// DefaultSnapshotInterval is how often changed notes are saved
+const DefaultSnapshotInterval = 10 * time.Second
+
+// SnapshotIntervalFromEnv reads NOTE_SNAPSHOT_INTERVAL as a duration such
+// as "30s"
+func SnapshotIntervalFromEnv() (time.Duration, error) {
+	v := os.Getenv("NOTE_SNAPSHOT_INTERVAL")
+	if v == "" {
+		return DefaultSnapshotInterval, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid NOTE_SNAPSHOT_INTERVAL %q", v)
+	}
+	return d, nil
+}
+
+// Notes is the notes backend. *notes.Service implements it.
+type Notes interface {
+	Get(ctx context.Context, userEmail, noteID string) (notes.Note, error)
+	UpdateAs(ctx context.Context, userEmail, author, noteID string, updated notes.Note, expectedVersion int) (notes.Note, error)
+}
+
+// Sender delivers messages to single connections. *ws.Hub implements it.
+type Sender interface {
+	SendToClient(client *ws.Client, message ws.Message)
+}
+
+// Access finds the owner of a note email can see and whether email may
+// edit it. Notes email cannot see fail with an error matching
+// notes.ErrNotFound.
+type Access func(ctx context.Context, email, noteID string) (owner string, canEdit bool, err error)
+
+// join is the payload of TypeJoin. Clients reconnecting pass the session
+// and revision they had, and are sent the edits they missed if the
+// session still has them.
+type join struct {
+	NoteID   string `json:"note_id"`
+	ClientID string `json:"client_id"`
+	Session  string `json:"session,omitempty"`
+	Rev      int    `json:"rev,omitempty"`
+}
+
+// joined is the payload of TypeJoined. Edits is set when the client caught
+// up on its session; otherwise Content is the text at Rev.
+type joined struct {
+	NoteID  string   `json:"note_id"`
+	Session string   `json:"session"`
+	Rev     int      `json:"rev"`
+	Title   string   `json:"title"`
+	Content *string  `json:"content,omitempty"`
+	Edits   []edit   `json:"edits,omitempty"`
+	CanEdit bool     `json:"can_edit"`
+	Editors []editor `json:"editors"`
+}
+
+// editRequest is the payload of TypeEdit from clients: op made at Rev.
+// Seq numbers a client's edits so resent ones are applied once.
+type editRequest struct {
+	NoteID string `json:"note_id"`
+	Rev    int    `json:"rev"`
+	Seq    int    `json:"seq"`
+	Op     Op     `json:"op"`
+}
+
+// editNotice is the payload of TypeEdit to the other editors
+type editNotice struct {
+	NoteID string `json:"note_id"`
+	edit
+}
+
+// ack is the payload of TypeAck: the client's edit Seq became Rev
+type ack struct {
+	NoteID string `json:"note_id"`
+	Rev    int    `json:"rev"`
+	Seq    int    `json:"seq"`
+}
+
+// cursor is the payload of TypeCursor: a selection at Rev
+type cursor struct {
+	NoteID string `json:"note_id"`
+	Rev    int    `json:"rev"`
+	Anchor int    `json:"anchor"`
+	Head   int    `json:"head"`
+}
+
+// title is the payload of TypeTitle
+type title struct {
+	NoteID string `json:"note_id"`
+	Title  string `json:"title"`
+	Email  string `json:"email,omitempty"`
+}
+
+// presence is the payload of TypePresence
+type presence struct {
+	NoteID  string   `json:"note_id"`
+	Editors []editor `json:"editors"`
+}
+
+// closed is the payload of TypeClosed, sent when a note stops being
+// editable together, such as when it is deleted
+type closed struct {
+	NoteID string `json:"note_id"`
+	Reason string `json:"reason"`
+}
+
+// noteRef is enough of any payload to find its note
+type noteRef struct {
+	NoteID string `json:"note_id"`
+}
+
+// Service lets several connections edit a note at once. Edits are
+// operations on the text, transformed against those made concurrently so
+// every editor ends up with the same text. The text is saved to the notes
+// store as a new revision every snapshot interval while it changes, and
+// when the last editor leaves.
+//
+// Sessions live in the instance their editors are connected to, so
+// editors of the same note must reach the same instance.
+type Service struct {
+	notes  Notes
+	send   Sender
+	access Access
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	saveMu   sync.Mutex // one snapshot at a time
+	onSave   []func(owner string, note notes.Note)
+}
+
+func NewService(n Notes, send Sender, access Access) *Service {
+	return &Service{
+		notes:    n,
+		send:     send,
+		access:   access,
+		sessions: make(map[string]*session),
+	}
+}
+
+// OnSave registers fn to be called with every snapshot saved. It must be
+// registered before the service is used.
+func (s *Service) OnSave(fn func(owner string, note notes.Note)) {
+	s.onSave = append(s.onSave, fn)
+}
+
+func sessionKey(owner, noteID string) string {
+	return owner + "/" + noteID
+}
+
+// Handle handles a message from a client. Messages of other features are
+// ignored.
+func (s *Service) Handle(c *ws.Client, msg ws.Incoming) {
+	var err error
+	switch msg.Type {
+	case TypeJoin:
+		var req join
+		if err = decode(msg, &req); err == nil {
+			err = s.join(c, req)
+		}
+	case TypeLeave:
+		var req noteRef
+		if err = decode(msg, &req); err == nil {
+			s.leave(c, req.NoteID)
+		}
+	case TypeEdit:
+		var req editRequest
+		if err = decode(msg, &req); err == nil {
+			err = s.edit(c, req)
+		}
+	case TypeCursor:
+		var req cursor
+		if err = decode(msg, &req); err == nil {
+			err = s.cursor(c, req)
+		}
+	case TypeTitle:
+		var req title
+		if err = decode(msg, &req); err == nil {
+			err = s.setTitle(c, req)
+		}
+	default:
+		return
+	}
+
+	if err != nil {
+		s.send.SendToClient(c, ws.Message{Type: ws.TypeError, Payload: ws.ErrorPayload{Request: msg.Type, Message: errorMessage(err)}})
+	}
+}
+
+func decode(msg ws.Incoming, v interface{}) error {
+	if err := json.Unmarshal(msg.Payload, v); err != nil {
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return nil
+}
+
+var (
+	errBadRequest = errors.New("invalid request")
+	errNotJoined  = errors.New("join the note first")
+	errReadOnly   = errors.New("you can only view this note")
+)
+
+// errorMessage is what clients are told about err
+func errorMessage(err error) string {
+	switch {
+	case errors.Is(err, notes.ErrNotFound):
+		return "Note not found"
+	case errors.Is(err, errBadRequest), errors.Is(err, ErrInvalidOp),
+		errors.Is(err, errNotJoined), errors.Is(err, errReadOnly):
+		return err.Error()
+	}
+	log.Printf("Error in collaborative editing: %v", err)
+	return "Something went wrong"
+}
+
+// join adds a connection to the session of a note, starting one if
+// needed, and sends it the text or the edits it missed
+func (s *Service) join(c *ws.Client, req join) error {
+	if req.NoteID == "" || req.ClientID == "" {
+		return fmt.Errorf("%w: note_id and client_id are required", errBadRequest)
+	}
+	ctx := context.Background()
+	owner, canEdit, err := s.access(ctx, c.UserEmail, req.NoteID)
+	if err != nil {
+		return err
+	}
+
+	key := sessionKey(owner, req.NoteID)
+	s.mu.Lock()
+	sess := s.sessions[key]
+	if sess == nil {
+		// Every session shares s.mu, so the note is read without it
+		s.mu.Unlock()
+		note, err := s.notes.Get(ctx, owner, req.NoteID)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		// Another join may have started the session meanwhile
+		if sess = s.sessions[key]; sess == nil {
+			sess = &session{
+				key:     key,
+				owner:   owner,
+				noteID:  req.NoteID,
+				id:      uuid.New().String(),
+				doc:     note.Content,
+				title:   note.Title,
+				editors: make(map[*ws.Client]*editor),
+				lastSeq: make(map[string]int),
+				version: note.Version,
+				saved:   note.Content,
+			}
+			s.sessions[key] = sess
+		}
+	}
+	defer s.mu.Unlock()
+
+	sess.editors[c] = &editor{ClientID: req.ClientID, Email: c.UserEmail, CanEdit: canEdit}
+
+	reply := joined{
+		NoteID:  req.NoteID,
+		Session: sess.id,
+		Rev:     sess.rev(),
+		Title:   sess.title,
+		CanEdit: canEdit,
+		Editors: sess.presence(),
+	}
+	if missed, ok := sess.since(req.Rev); ok && req.Session == sess.id {
+		reply.Rev = req.Rev
+		reply.Edits = missed
+	} else {
+		doc := sess.doc
+		reply.Content = &doc
+	}
+	s.send.SendToClient(c, ws.Message{Type: TypeJoined, Payload: reply})
+	s.broadcastPresence(sess, c)
+	return nil
+}
+
+// leave takes a connection out of a session. The last one to leave saves
+// the note and ends the session.
+func (s *Service) leave(c *ws.Client, noteID string) {
+	s.mu.Lock()
+	var last *session
+	for _, sess := range s.sessions {
+		if sess.noteID != noteID || sess.editors[c] == nil {
+			continue
+		}
+		delete(sess.editors, c)
+		if len(sess.editors) == 0 {
+			last = sess
+			s.end(sess)
+		} else {
+			s.broadcastPresence(sess, nil)
+		}
+	}
+	s.mu.Unlock()
+
+	if last != nil {
+		if err := s.flush(context.Background(), last); err != nil {
+			log.Printf("Error saving note on close: %v", err)
+		}
+	}
+}
+
+// Disconnect takes a closed connection out of every session
+func (s *Service) Disconnect(c *ws.Client) {
+	s.mu.Lock()
+	var ids []string
+	for _, sess := range s.sessions {
+		if sess.editors[c] != nil {
+			ids = append(ids, sess.noteID)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		s.leave(c, id)
+	}
+}
+
+// end removes a session so the next join starts a new one. Callers hold
+// s.mu.
+func (s *Service) end(sess *session) {
+	sess.closed = true
+	delete(s.sessions, sess.key)
+}
+
+// joinedSession returns the session of a note c has joined. Callers hold
+// s.mu.
+func (s *Service) joinedSession(c *ws.Client, noteID string) (*session, *editor, error) {
+	for _, sess := range s.sessions {
+		if ed := sess.editors[c]; sess.noteID == noteID && ed != nil {
+			return sess, ed, nil
+		}
+	}
+	return nil, nil, errNotJoined
+}
+
+// mayEdit reads whether c may still edit a note. Grants change while
+// editors are joined, so it is checked again for every change rather than
+// trusted from the join; connections that lost access to the note are
+// taken out of its session.
+func (s *Service) mayEdit(c *ws.Client, noteID string) (bool, error) {
+	_, canEdit, err := s.access(context.Background(), c.UserEmail, noteID)
+	if errors.Is(err, notes.ErrNotFound) {
+		s.leave(c, noteID)
+	}
+	return canEdit, err
+}
+
+// setCanEdit records whether an editor may still edit, telling the others
+// when it changed. Callers hold s.mu.
+func (s *Service) setCanEdit(sess *session, ed *editor, canEdit bool) {
+	if ed.CanEdit != canEdit {
+		ed.CanEdit = canEdit
+		s.broadcastPresence(sess, nil)
+	}
+}
+
+func (s *Service) edit(c *ws.Client, req editRequest) error {
+	canEdit, err := s.mayEdit(c, req.NoteID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ed, err := s.joinedSession(c, req.NoteID)
+	if err != nil {
+		return err
+	}
+	s.setCanEdit(sess, ed, canEdit)
+	if !ed.CanEdit {
+		return errReadOnly
+	}
+	if req.Seq <= 0 {
+		return fmt.Errorf("%w: seq must be positive", errBadRequest)
+	}
+
+	// A resent edit is acknowledged again but not applied twice
+	if e, ok := sess.applied(ed.ClientID, req.Seq); ok {
+		s.send.SendToClient(c, ws.Message{Type: TypeAck, Payload: ack{NoteID: req.NoteID, Rev: e.Rev, Seq: req.Seq}})
+		return nil
+	}
+
+	e, err := sess.apply(req.Rev, req.Op, ed.ClientID, req.Seq, c.UserEmail)
+	if err != nil {
+		return err
+	}
+	s.send.SendToClient(c, ws.Message{Type: TypeAck, Payload: ack{NoteID: req.NoteID, Rev: e.Rev, Seq: req.Seq}})
+	s.broadcast(sess, c, ws.Message{Type: TypeEdit, Payload: editNotice{NoteID: req.NoteID, edit: e}})
+	return nil
+}
+
+func (s *Service) cursor(c *ws.Client, req cursor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ed, err := s.joinedSession(c, req.NoteID)
+	if err != nil {
+		return err
+	}
+	later, ok := sess.since(req.Rev)
+	if !ok {
+		// Too old to place; the next one will do
+		return nil
+	}
+	anchor, head := req.Anchor, req.Head
+	for _, e := range later {
+		anchor = TransformIndex(anchor, e.Op, false)
+		head = TransformIndex(head, e.Op, false)
+	}
+	ed.Anchor, ed.Head = clamp(anchor, sess.doc), clamp(head, sess.doc)
+	s.broadcastPresence(sess, c)
+	return nil
+}
+
+func clamp(i int, doc string) int {
+	if n := len([]rune(doc)); i > n {
+		return n
+	}
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+func (s *Service) setTitle(c *ws.Client, req title) error {
+	canEdit, err := s.mayEdit(c, req.NoteID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ed, err := s.joinedSession(c, req.NoteID)
+	if err != nil {
+		return err
+	}
+	s.setCanEdit(sess, ed, canEdit)
+	if !ed.CanEdit {
+		return errReadOnly
+	}
+	if req.Title == sess.title {
+		return nil
+	}
+	sess.title = req.Title
+	sess.dirty = true
+	sess.author = c.UserEmail
+	s.broadcast(sess, c, ws.Message{Type: TypeTitle, Payload: title{NoteID: req.NoteID, Title: req.Title, Email: c.UserEmail}})
+	return nil
+}
+
+// broadcast sends a message to every editor of a session but except.
+// Callers hold s.mu, which keeps messages in revision order.
+func (s *Service) broadcast(sess *session, except *ws.Client, msg ws.Message) {
+	for c := range sess.editors {
+		if c != except {
+			s.send.SendToClient(c, msg)
+		}
+	}
+}
+
+func (s *Service) broadcastPresence(sess *session, except *ws.Client) {
+	s.broadcast(sess, except, ws.Message{Type: TypePresence, Payload: presence{NoteID: sess.noteID, Editors: sess.presence()}})
+}
+
+// NoteChanged keeps sessions in step with notes changed outside them. Pass
+// it to notes.Service.OnChange. Changes saved through the API are merged
+// into the session as an edit; deleted notes end their session.
+func (s *Service) NoteChanged(change notes.Change) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := s.sessions[sessionKey(change.UserEmail, change.Note.ID)]
+	if sess == nil {
+		return
+	}
+	note := change.Note
+
+	if change.Kind == notes.NoteDeleted {
+		s.broadcast(sess, nil, ws.Message{Type: TypeClosed, Payload: closed{NoteID: note.ID, Reason: "The note was deleted"}})
+		s.end(sess)
+		return
+	}
+	if note.Version <= sess.version {
+		return
+	}
+	sess.version = note.Version
+
+	// Our own snapshot
+	if sess.saving != nil && sess.saving.content == note.Content && sess.saving.title == note.Title {
+		sess.saved, sess.savedRev = note.Content, sess.saving.rev
+		return
+	}
+
+	// Someone saved the whole note. Their change is what they did to the
+	// last saved text; if the edits since then are no longer kept it is
+	// taken as what they did to the current text.
+	base, rev := sess.saved, sess.savedRev
+	if _, ok := sess.since(rev); !ok {
+		base, rev = sess.doc, sess.rev()
+	}
+	e, err := sess.apply(rev, Diff(base, note.Content), "", 0, "")
+	if err != nil {
+		log.Printf("Error merging outside change to note %s: %v", note.ID, err)
+		return
+	}
+	if note.Title != sess.title {
+		sess.title = note.Title
+		s.broadcast(sess, nil, ws.Message{Type: TypeTitle, Payload: title{NoteID: note.ID, Title: note.Title}})
+	}
+	// The merged text is saved by the next snapshot
+	sess.saved, sess.savedRev = sess.doc, sess.rev()
+	s.broadcast(sess, nil, ws.Message{Type: TypeEdit, Payload: editNotice{NoteID: note.ID, edit: e}})
+}
+
+// flush saves a session's text and title if they changed since the last
+// snapshot. Saves that lose to a change made through the API are retried
+// by the next snapshot, after the change has been merged.
+func (s *Service) flush(ctx context.Context, sess *session) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	if !sess.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	snap := &snapshot{title: sess.title, content: sess.doc, rev: sess.rev()}
+	expected, author := sess.version, sess.author
+	sess.saving, sess.dirty = snap, false
+	s.mu.Unlock()
+
+	note, err := s.notes.UpdateAs(ctx, sess.owner, author, sess.noteID, notes.Note{Title: snap.title, Content: snap.content}, expected)
+
+	s.mu.Lock()
+	sess.saving = nil
+	if err != nil {
+		sess.dirty = !errors.Is(err, notes.ErrNotFound)
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to save note %s: %v", sess.noteID, err)
+	}
+	for _, fn := range s.onSave {
+		fn(sess.owner, note)
+	}
+	return nil
+}
+
+// Snapshot saves every session that changed and returns how many were
+// saved
+func (s *Service) Snapshot(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	var dirty []*session
+	for _, sess := range s.sessions {
+		if sess.dirty {
+			dirty = append(dirty, sess)
+		}
+	}
+	s.mu.Unlock()
+
+	saved := 0
+	var lastErr error
+	for _, sess := range dirty {
+		if err := s.flush(ctx, sess); err != nil {
+			lastErr = err
+			continue
+		}
+		saved++
+	}
+	return saved, lastErr
+}
+
+// RunSnapshotter calls Snapshot every interval until ctx is cancelled
+func (s *Service) RunSnapshotter(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := s.Snapshot(ctx); err != nil {
+			log.Printf("Error saving edited notes: %v", err)
+		}
+	}
+}
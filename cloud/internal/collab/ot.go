@@ -0,0 +1,332 @@
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+// ErrInvalidOp is returned for operations that do not fit the document
+// they are applied to or transformed against
+var ErrInvalidOp = errors.New("invalid operation")
+
+// Op is an edit of a whole document: a walk over it that keeps, inserts
+// and deletes text. Positions and lengths count Unicode code points.
+//
+// In JSON an Op is an array in which a positive number retains that many
+// characters, a negative number deletes that many and a string is
+// inserted, so [3, "abc", -2] keeps 3 characters, inserts "abc" and
+// deletes the next 2.
+type Op []Component
+
+// Component is one step of an Op. Exactly one of its fields is set.
+type Component struct {
+	Retain int
+	Insert string
+	Delete int
+}
+
+func (op Op) MarshalJSON() ([]byte, error) {
+	out := make([]interface{}, 0, len(op))
+	for _, c := range op {
+		switch {
+		case c.Retain > 0:
+			out = append(out, c.Retain)
+		case c.Delete > 0:
+			out = append(out, -c.Delete)
+		default:
+			out = append(out, c.Insert)
+		}
+	}
+	return json.Marshal(out)
+}
+
+func (op *Op) UnmarshalJSON(data []byte) error {
+	var raw []interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	var b builder
+	base := 0
+	for _, v := range raw {
+		switch v := v.(type) {
+		case float64:
+			// No document is longer than maxDocLen, so neither is any
+			// count or their sum
+			if v != math.Trunc(v) || v == 0 || math.Abs(v) > maxDocLen-float64(base) {
+				return ErrInvalidOp
+			}
+			n := int(v)
+			base += int(math.Abs(v))
+			if n > 0 {
+				b.retain(n)
+			} else {
+				b.delete(-n)
+			}
+		case string:
+			b.insert(v)
+		default:
+			return ErrInvalidOp
+		}
+	}
+	*op = b.op
+	return nil
+}
+
+// BaseLen is the length of the documents op applies to. Ops with negative
+// counts, or whose counts do not fit in an int, apply to none.
+func (op Op) BaseLen() (int, error) {
+	n := 0
+	for _, c := range op {
+		if c.Retain < 0 || c.Delete < 0 {
+			return 0, fmt.Errorf("%w: negative count", ErrInvalidOp)
+		}
+		if n += c.Retain + c.Delete; n < 0 {
+			return 0, fmt.Errorf("%w: counts overflow", ErrInvalidOp)
+		}
+	}
+	return n, nil
+}
+
+// TargetLen is the length of the documents op produces
+func (op Op) TargetLen() int {
+	n := 0
+	for _, c := range op {
+		n += c.Retain + utf8.RuneCountInString(c.Insert)
+	}
+	return n
+}
+
+// IsNoop reports whether op leaves every document unchanged
+func (op Op) IsNoop() bool {
+	for _, c := range op {
+		if c.Retain == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// builder appends components to an Op, merging neighbours of the same
+// kind and keeping inserts before deletes at the same position, so equal
+// edits always build equal Ops
+type builder struct {
+	op Op
+}
+
+func (b *builder) retain(n int) {
+	if n <= 0 {
+		return
+	}
+	if last := len(b.op) - 1; last >= 0 && b.op[last].Retain > 0 {
+		b.op[last].Retain += n
+		return
+	}
+	b.op = append(b.op, Component{Retain: n})
+}
+
+func (b *builder) insert(s string) {
+	if s == "" {
+		return
+	}
+	last := len(b.op) - 1
+	if last >= 0 && b.op[last].Insert != "" {
+		b.op[last].Insert += s
+		return
+	}
+	if last >= 0 && b.op[last].Delete > 0 {
+		if last > 0 && b.op[last-1].Insert != "" {
+			b.op[last-1].Insert += s
+			return
+		}
+		b.op = append(b.op, b.op[last])
+		b.op[last] = Component{Insert: s}
+		return
+	}
+	b.op = append(b.op, Component{Insert: s})
+}
+
+func (b *builder) delete(n int) {
+	if n <= 0 {
+		return
+	}
+	if last := len(b.op) - 1; last >= 0 && b.op[last].Delete > 0 {
+		b.op[last].Delete += n
+		return
+	}
+	b.op = append(b.op, Component{Delete: n})
+}
+
+// Apply returns doc with op applied
+func Apply(doc string, op Op) (string, error) {
+	text := []rune(doc)
+	base, err := op.BaseLen()
+	if err != nil {
+		return "", err
+	}
+	if base != len(text) {
+		return "", fmt.Errorf("%w: it applies to %d characters, not %d", ErrInvalidOp, base, len(text))
+	}
+
+	out := make([]rune, 0, len(text))
+	pos := 0
+	for _, c := range op {
+		switch {
+		case c.Retain > 0:
+			out = append(out, text[pos:pos+c.Retain]...)
+			pos += c.Retain
+		case c.Delete > 0:
+			pos += c.Delete
+		default:
+			out = append(out, []rune(c.Insert)...)
+		}
+	}
+	return string(out), nil
+}
+
+// Transform takes two operations made concurrently on the same document
+// and returns a' and b' such that applying a then b' gives the same
+// document as applying b then a'. When both insert at the same position
+// a's text comes first.
+func Transform(a, b Op) (Op, Op, error) {
+	baseA, err := a.BaseLen()
+	if err != nil {
+		return nil, nil, err
+	}
+	baseB, err := b.BaseLen()
+	if err != nil {
+		return nil, nil, err
+	}
+	if baseA != baseB {
+		return nil, nil, fmt.Errorf("%w: concurrent operations apply to different documents", ErrInvalidOp)
+	}
+
+	var a1, b1 builder
+	ia, ib := newCursor(a), newCursor(b)
+	for !ia.done() || !ib.done() {
+		ca, cb := ia.peek(), ib.peek()
+
+		if ca.Insert != "" {
+			a1.insert(ca.Insert)
+			b1.retain(utf8.RuneCountInString(ca.Insert))
+			ia.next(0)
+			continue
+		}
+		if cb.Insert != "" {
+			a1.retain(utf8.RuneCountInString(cb.Insert))
+			b1.insert(cb.Insert)
+			ib.next(0)
+			continue
+		}
+		if ia.done() || ib.done() {
+			return nil, nil, fmt.Errorf("%w: concurrent operations apply to different documents", ErrInvalidOp)
+		}
+
+		n := shorter(ia.remaining(), ib.remaining())
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			a1.retain(n)
+			b1.retain(n)
+		case ca.Delete > 0 && cb.Retain > 0:
+			a1.delete(n)
+		case ca.Retain > 0 && cb.Delete > 0:
+			b1.delete(n)
+		}
+		// Text both deleted is simply gone
+		ia.next(n)
+		ib.next(n)
+	}
+	return a1.op, b1.op, nil
+}
+
+// TransformIndex moves a position in a document to where it is after op.
+// Text inserted at the position goes before it only if own is set, for
+// the cursor of whoever typed it.
+func TransformIndex(index int, op Op, own bool) int {
+	pos, moved := 0, index
+	for _, c := range op {
+		if pos > index {
+			break
+		}
+		switch {
+		case c.Retain > 0:
+			pos += c.Retain
+		case c.Delete > 0:
+			moved -= shorter(c.Delete, index-pos)
+			pos += c.Delete
+		case pos < index || own:
+			moved += utf8.RuneCountInString(c.Insert)
+		}
+	}
+	return moved
+}
+
+// Diff returns an operation that turns old into new. It replaces the part
+// between their common prefix and suffix, which is what a single edit of a
+// text box changes.
+func Diff(old, new string) Op {
+	a, b := []rune(old), []rune(new)
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var op builder
+	op.retain(prefix)
+	op.insert(string(b[prefix : len(b)-suffix]))
+	op.delete(len(a) - prefix - suffix)
+	op.retain(suffix)
+	return op.op
+}
+
+// opCursor walks the components of an Op, splitting retains and deletes
+// as the other side of a transform requires
+type opCursor struct {
+	op   Op
+	i    int
+	used int // of the current retain or delete
+}
+
+func newCursor(op Op) *opCursor {
+	return &opCursor{op: op}
+}
+
+func (c *opCursor) done() bool {
+	return c.i >= len(c.op)
+}
+
+func (c *opCursor) peek() Component {
+	if c.done() {
+		return Component{}
+	}
+	return c.op[c.i]
+}
+
+func (c *opCursor) remaining() int {
+	comp := c.peek()
+	return comp.Retain + comp.Delete - c.used
+}
+
+// next moves past n characters of the current retain or delete, or past
+// the current insert
+func (c *opCursor) next(n int) {
+	if c.peek().Insert != "" || c.remaining() == n {
+		c.i++
+		c.used = 0
+		return
+	}
+	c.used += n
+}
+
+func shorter(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,193 @@
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// converge applies a then b' and b then a' to doc and fails unless both
+// give want
+func converge(t *testing.T, doc string, a, b Op, want string) {
+	t.Helper()
+	a1, b1, err := Transform(a, b)
+	if err != nil {
+		t.Fatalf("Transform: %v", err)
+	}
+
+	afterA, err := Apply(doc, a)
+	if err != nil {
+		t.Fatalf("Apply a: %v", err)
+	}
+	ab, err := Apply(afterA, b1)
+	if err != nil {
+		t.Fatalf("Apply b': %v", err)
+	}
+	afterB, err := Apply(doc, b)
+	if err != nil {
+		t.Fatalf("Apply b: %v", err)
+	}
+	ba, err := Apply(afterB, a1)
+	if err != nil {
+		t.Fatalf("Apply a': %v", err)
+	}
+
+	if ab != ba {
+		t.Fatalf("a then b' gives %q, b then a' gives %q", ab, ba)
+	}
+	if want != "" && ab != want {
+		t.Fatalf("got %q, want %q", ab, want)
+	}
+}
+
+func TestTransformConverges(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		a, b Op
+		want string
+	}{
+		{
+			name: "inserts at different positions",
+			doc:  "hello",
+			a:    Op{{Insert: "A"}, {Retain: 5}},
+			b:    Op{{Retain: 5}, {Insert: "B"}},
+			want: "AhelloB",
+		},
+		{
+			name: "inserts at the same position put a first",
+			doc:  "ab",
+			a:    Op{{Retain: 1}, {Insert: "X"}, {Retain: 1}},
+			b:    Op{{Retain: 1}, {Insert: "Y"}, {Retain: 1}},
+			want: "aXYb",
+		},
+		{
+			name: "insert inside deleted text",
+			doc:  "abcdef",
+			a:    Op{{Retain: 1}, {Delete: 4}, {Retain: 1}},
+			b:    Op{{Retain: 3}, {Insert: "X"}, {Retain: 3}},
+			want: "aXf",
+		},
+		{
+			name: "overlapping deletes",
+			doc:  "abcdef",
+			a:    Op{{Retain: 1}, {Delete: 3}, {Retain: 2}},
+			b:    Op{{Retain: 2}, {Delete: 3}, {Retain: 1}},
+			want: "af",
+		},
+		{
+			name: "same delete",
+			doc:  "abc",
+			a:    Op{{Delete: 3}},
+			b:    Op{{Delete: 3}},
+			want: "",
+		},
+		{
+			name: "replace against retain",
+			doc:  "one two",
+			a:    Op{{Retain: 4}, {Insert: "2"}, {Delete: 3}},
+			b:    Op{{Retain: 7}},
+			want: "one 2",
+		},
+		{
+			name: "empty document",
+			doc:  "",
+			a:    Op{{Insert: "x"}},
+			b:    Op{{Insert: "y"}},
+			want: "xy",
+		},
+		{
+			name: "code points rather than bytes",
+			doc:  "é😀z",
+			a:    Op{{Retain: 1}, {Delete: 1}, {Retain: 1}},
+			b:    Op{{Retain: 2}, {Insert: "ü"}, {Retain: 1}},
+			want: "éüz",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			converge(t, tt.doc, tt.a, tt.b, tt.want)
+		})
+	}
+}
+
+// randomOp builds a valid operation on doc
+func randomOp(r *rand.Rand, doc string) Op {
+	n := len([]rune(doc))
+	var b builder
+	for pos := 0; pos < n; {
+		k := 1 + r.Intn(n-pos)
+		switch r.Intn(3) {
+		case 0:
+			b.retain(k)
+		case 1:
+			b.delete(k)
+		default:
+			b.insert([]string{"a", "é", "😀x", "\n"}[r.Intn(4)])
+			b.retain(k)
+		}
+		pos += k
+	}
+	if r.Intn(2) == 0 {
+		b.insert("z")
+	}
+	return b.op
+}
+
+func TestTransformConvergesOnRandomOps(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		doc := []string{"", "a", "hello world", "é😀 line\nnext"}[r.Intn(4)]
+		converge(t, doc, randomOp(r, doc), randomOp(r, doc), "")
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		op   Op
+		want string
+		err  bool
+	}{
+		{name: "retain all", doc: "abc", op: Op{{Retain: 3}}, want: "abc"},
+		{name: "insert delete", doc: "abc", op: Op{{Retain: 1}, {Insert: "X"}, {Delete: 1}, {Retain: 1}}, want: "aXc"},
+		{name: "too short", doc: "abc", op: Op{{Retain: 2}}, err: true},
+		{name: "too long", doc: "abc", op: Op{{Retain: 4}}, err: true},
+		{name: "negative count", doc: "abc", op: Op{{Retain: 5}, {Delete: -2}}, err: true},
+		{name: "overflowing counts", doc: "a", op: Op{{Retain: int(^uint(0) >> 1)}, {Delete: 2}}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Apply(tt.doc, tt.op)
+			if tt.err {
+				if !errors.Is(err, ErrInvalidOp) {
+					t.Fatalf("got %q, %v, want ErrInvalidOp", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalOp(t *testing.T) {
+	var op Op
+	if err := json.Unmarshal([]byte(`[3, "abc", -2]`), &op); err != nil {
+		t.Fatal(err)
+	}
+	if len(op) != 3 || op[0].Retain != 3 || op[1].Insert != "abc" || op[2].Delete != 2 {
+		t.Fatalf("got %+v", op)
+	}
+
+	for _, bad := range []string{`[0]`, `[1.5]`, `[1e300]`, `[-9223372036854775807]`, `[1048576, 1]`, `[true]`} {
+		if err := json.Unmarshal([]byte(bad), &op); err == nil {
+			t.Errorf("%s was accepted", bad)
+		}
+	}
+}
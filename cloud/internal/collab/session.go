@@ -0,0 +1,155 @@
+package collab
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"cloud/internal/ws"
+)
+
+// maxHistory is how many edits a session keeps for clients catching up
+// after a reconnect. Clients further behind start over from the current
+// text.
+const maxHistory = 1000
+
+// maxDocLen caps the length of a note edited together, in characters
+const maxDocLen = 1 << 20
+
+// edit is an edit applied to a session. Rev is the revision it produced.
+type edit struct {
+	Rev      int    `json:"rev"`
+	Op       Op     `json:"op"`
+	ClientID string `json:"client_id,omitempty"`
+	Seq      int    `json:"seq,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+// editor is a connection taking part in a session
+type editor struct {
+	ClientID string `json:"client_id"`
+	Email    string `json:"email"`
+	CanEdit  bool   `json:"can_edit"`
+	Anchor   int    `json:"anchor"`
+	Head     int    `json:"head"`
+}
+
+// session is the shared state of a note while someone has it open. Edits
+// are numbered by revision; the text at revision base+len(history) is doc.
+// All fields are guarded by the service's session lock.
+type session struct {
+	key    string
+	owner  string
+	noteID string
+	id     string // tells clients a new session apart from one they knew
+
+	doc     string
+	title   string
+	base    int
+	history []edit
+	editors map[*ws.Client]*editor
+	lastSeq map[string]int // newest edit applied per client ID
+
+	// What the notes store holds. Edits made through the API are merged
+	// as changes since the saved text.
+	version  int
+	saved    string
+	savedRev int
+
+	dirty  bool
+	author string // of the latest change, recorded on the snapshot
+	saving *snapshot
+	closed bool
+}
+
+// snapshot is a copy of a session being written to the notes store
+type snapshot struct {
+	title   string
+	content string
+	rev     int
+}
+
+func (s *session) rev() int {
+	return s.base + len(s.history)
+}
+
+// since returns the edits after rev, or false if they are no longer kept
+func (s *session) since(rev int) ([]edit, bool) {
+	if rev < s.base || rev > s.rev() {
+		return nil, false
+	}
+	return s.history[rev-s.base:], true
+}
+
+// apply transforms op, made at revision rev, against the edits since and
+// applies it. It returns the edit as applied.
+func (s *session) apply(rev int, op Op, clientID string, seq int, email string) (edit, error) {
+	later, ok := s.since(rev)
+	if !ok {
+		return edit{}, fmt.Errorf("%w: revision %d is not available", ErrInvalidOp, rev)
+	}
+	for _, e := range later {
+		var err error
+		if op, _, err = Transform(op, e.Op); err != nil {
+			return edit{}, err
+		}
+	}
+
+	doc, err := Apply(s.doc, op)
+	if err != nil {
+		return edit{}, err
+	}
+	if utf8.RuneCountInString(doc) > maxDocLen {
+		return edit{}, fmt.Errorf("%w: notes edited together are limited to %d characters", ErrInvalidOp, maxDocLen)
+	}
+
+	s.doc = doc
+	e := edit{Rev: s.rev() + 1, Op: op, ClientID: clientID, Seq: seq, Email: email}
+	s.history = append(s.history, e)
+	if len(s.history) > maxHistory {
+		drop := len(s.history) - maxHistory
+		s.history = append([]edit(nil), s.history[drop:]...)
+		s.base += drop
+	}
+	if clientID != "" {
+		s.lastSeq[clientID] = seq
+	}
+	s.dirty = true
+	if email != "" {
+		s.author = email
+	}
+
+	for _, ed := range s.editors {
+		own := clientID != "" && ed.ClientID == clientID
+		ed.Anchor = TransformIndex(ed.Anchor, op, own)
+		ed.Head = TransformIndex(ed.Head, op, own)
+	}
+	return e, nil
+}
+
+// applied finds an edit a client already sent, for clients resending
+// edits whose acknowledgement they missed
+func (s *session) applied(clientID string, seq int) (edit, bool) {
+	if s.lastSeq[clientID] < seq {
+		return edit{}, false
+	}
+	for _, e := range s.history {
+		if e.ClientID == clientID && e.Seq == seq {
+			return e, true
+		}
+	}
+	// Older than the history; only its revision is lost
+	return edit{Rev: s.rev(), ClientID: clientID, Seq: seq}, true
+}
+
+// presence lists the editors as sent to clients
+func (s *session) presence() []editor {
+	list := make([]editor, 0, len(s.editors))
+	for _, ed := range s.editors {
+		list = append(list, *ed)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ClientID < list[j].ClientID
+	})
+	return list
+}
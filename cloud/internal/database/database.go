@@ -1,179 +1,194 @@
 package database
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
+
+	"cloud/internal/db"
 )
 
+// DB is an embedded metadata store that keeps everything in a single JSON
+// file. It implements db.MetadataStore so the server can run without any
+// external database.
 type DB struct {
 	sync.RWMutex
 	path string
 	data Data
 }
 
-type Data struct {
-	Users []User           `json:"users"`
-	Files []FileMetadata   `json:"files"`
-}
-
-type User struct {
-	ID        int64     `json:"id"`
-	Email     string    `json:"email"`
-	Password  string    `json:"-"`
-	CreatedAt time.Time `json:"created_at"`
-}
+var _ db.MetadataStore = (*DB)(nil)
 
-type FileMetadata struct {
-	ID        int64     `json:"id"`
-	Name      string    `json:"name"`
-	Size      int64     `json:"size"`
-	UserID    int64     `json:"user_id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+type Data struct {
+	Users   []db.User   `json:"users"`
+	Files   []db.File   `json:"files"`
+	Folders []db.Folder `json:"folders"`
+	Notes   []db.Note   `json:"notes"`
+
+	NoteRevisions []db.NoteRevision `json:"note_revisions"`
+	FileVersions  []db.FileVersion  `json:"file_versions"`
+	Uploads       []db.Upload       `json:"uploads"`
+	UploadParts   []db.UploadPart   `json:"upload_parts"`
+	Shares        []db.Share        `json:"shares"`
+	Grants        []db.Grant        `json:"grants"`
+	Usage         []db.Usage        `json:"usage"`
 }
 
 func NewDB(path string) (*DB, error) {
-	db := &DB{
+	d := &DB{
 		path: path,
 		data: Data{
-			Users: make([]User, 0),
-			Files: make([]FileMetadata, 0),
+			Users:   make([]db.User, 0),
+			Files:   make([]db.File, 0),
+			Folders: make([]db.Folder, 0),
+			Notes:   make([]db.Note, 0),
+
+			NoteRevisions: make([]db.NoteRevision, 0),
+			FileVersions:  make([]db.FileVersion, 0),
+			Uploads:       make([]db.Upload, 0),
+			UploadParts:   make([]db.UploadPart, 0),
+			Shares:        make([]db.Share, 0),
+			Grants:        make([]db.Grant, 0),
+			Usage:         make([]db.Usage, 0),
 		},
 	}
 
-	if err := db.load(); err != nil && !os.IsNotExist(err) {
+	if err := d.load(); err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
 
-	return db, nil
+	return d, nil
 }
 
-func (db *DB) load() error {
-	db.Lock()
-	defer db.Unlock()
+func (d *DB) load() error {
+	d.Lock()
+	defer d.Unlock()
 
-	data, err := os.ReadFile(db.path)
+	data, err := os.ReadFile(d.path)
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(data, &db.data)
+	return json.Unmarshal(data, &d.data)
 }
 
-func (db *DB) save() error {
-	db.Lock()
-	defer db.Unlock()
-
-	dir := filepath.Dir(db.path)
+// save writes the data file; callers must hold the write lock
+func (d *DB) save() error {
+	dir := filepath.Dir(d.path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
 
-	data, err := json.MarshalIndent(db.data, "", "  ")
+	data, err := json.MarshalIndent(d.data, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(db.path, data, 0644)
+	// Write then rename so a crash never leaves a truncated data file
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
 }
 
-func (db *DB) CreateUser(email, password string) (*User, error) {
-	db.Lock()
-	defer db.Unlock()
+// User operations
 
-	// Check if user exists
-	for _, u := range db.data.Users {
-		if u.Email == email {
-			return nil, fmt.Errorf("user already exists")
+func (d *DB) CreateUser(ctx context.Context, user db.User) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, u := range d.data.Users {
+		if u.Email == user.Email {
+			return db.ErrConflict
 		}
 	}
 
-	user := User{
-		ID:        time.Now().UnixNano(),
-		Email:     email,
-		Password:  password,
-		CreatedAt: time.Now(),
-	}
+	d.data.Users = append(d.data.Users, user)
+	return d.save()
+}
 
-	db.data.Users = append(db.data.Users, user)
-	if err := db.save(); err != nil {
-		return nil, err
+func (d *DB) UpdateUser(ctx context.Context, user db.User) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, u := range d.data.Users {
+		if u.Email == user.Email {
+			d.data.Users[i] = user
+			return d.save()
+		}
 	}
 
-	return &user, nil
+	return db.ErrNotFound
 }
 
-func (db *DB) GetUser(id int64) (*User, error) {
-	db.RLock()
-	defer db.RUnlock()
+func (d *DB) GetUser(ctx context.Context, email string) (db.User, error) {
+	d.RLock()
+	defer d.RUnlock()
 
-	for _, u := range db.data.Users {
-		if u.ID == id {
-			return &u, nil
+	for _, u := range d.data.Users {
+		if u.Email == email {
+			return u, nil
 		}
 	}
 
-	return nil, fmt.Errorf("user not found")
+	return db.User{}, db.ErrNotFound
 }
 
-func (db *DB) GetUserByEmail(email string) (*User, error) {
-	db.RLock()
-	defer db.RUnlock()
+func (d *DB) GetUserByID(ctx context.Context, id string) (db.User, error) {
+	d.RLock()
+	defer d.RUnlock()
 
-	for _, u := range db.data.Users {
-		if u.Email == email {
-			return &u, nil
+	for _, u := range d.data.Users {
+		if u.ID != "" && u.ID == id {
+			return u, nil
 		}
 	}
 
-	return nil, fmt.Errorf("user not found")
+	return db.User{}, db.ErrNotFound
 }
 
-func (db *DB) CreateFileMetadata(name string, size int64, userID int64) (*FileMetadata, error) {
-	db.Lock()
-	defer db.Unlock()
+// File operations
 
-	file := FileMetadata{
-		ID:        time.Now().UnixNano(),
-		Name:      name,
-		Size:      size,
-		UserID:    userID,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
+func (d *DB) SaveFileMetadata(ctx context.Context, file db.File) error {
+	d.Lock()
+	defer d.Unlock()
 
-	db.data.Files = append(db.data.Files, file)
-	if err := db.save(); err != nil {
-		return nil, err
+	for i, f := range d.data.Files {
+		if f.UserEmail == file.UserEmail && f.FileID == file.FileID {
+			d.data.Files[i] = file
+			return d.save()
+		}
 	}
 
-	return &file, nil
+	d.data.Files = append(d.data.Files, file)
+	return d.save()
 }
 
-func (db *DB) GetFileMetadata(id int64) (*FileMetadata, error) {
-	db.RLock()
-	defer db.RUnlock()
+func (d *DB) GetFile(ctx context.Context, userEmail, fileID string) (db.File, error) {
+	d.RLock()
+	defer d.RUnlock()
 
-	for _, f := range db.data.Files {
-		if f.ID == id {
-			return &f, nil
+	for _, f := range d.data.Files {
+		if f.UserEmail == userEmail && f.FileID == fileID {
+			return f, nil
 		}
 	}
 
-	return nil, fmt.Errorf("file not found")
+	return db.File{}, db.ErrNotFound
 }
 
-func (db *DB) GetUserFiles(userID int64) ([]FileMetadata, error) {
-	db.RLock()
-	defer db.RUnlock()
+func (d *DB) GetUserFiles(ctx context.Context, userEmail string) ([]db.File, error) {
+	d.RLock()
+	defer d.RUnlock()
 
-	var files []FileMetadata
-	for _, f := range db.data.Files {
-		if f.UserID == userID {
+	var files []db.File
+	for _, f := range d.data.Files {
+		if f.UserEmail == userEmail {
 			files = append(files, f)
 		}
 	}
@@ -181,21 +196,641 @@ func (db *DB) GetUserFiles(userID int64) ([]FileMetadata, error) {
 	return files, nil
 }
 
-func (db *DB) DeleteFileMetadata(id int64) error {
-	db.Lock()
-	defer db.Unlock()
+func (d *DB) DeleteFile(ctx context.Context, userEmail, fileID string) error {
+	d.Lock()
+	defer d.Unlock()
 
-	for i, f := range db.data.Files {
-		if f.ID == id {
+	for i, f := range d.data.Files {
+		if f.UserEmail == userEmail && f.FileID == fileID {
 			// Remove the file from the slice
-			db.data.Files = append(db.data.Files[:i], db.data.Files[i+1:]...)
-			return db.save()
+			d.data.Files = append(d.data.Files[:i], d.data.Files[i+1:]...)
+			return d.save()
+		}
+	}
+
+	return nil
+}
+
+// File version operations
+
+func (d *DB) SaveFileVersion(ctx context.Context, version db.FileVersion) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, v := range d.data.FileVersions {
+		if v.UserEmail == version.UserEmail && v.FileID == version.FileID && v.Version == version.Version {
+			return db.ErrConflict
+		}
+	}
+
+	d.data.FileVersions = append(d.data.FileVersions, version)
+	return d.save()
+}
+
+func (d *DB) GetFileVersion(ctx context.Context, userEmail, fileID string, version int) (db.FileVersion, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	for _, v := range d.data.FileVersions {
+		if v.UserEmail == userEmail && v.FileID == fileID && v.Version == version {
+			return v, nil
+		}
+	}
+
+	return db.FileVersion{}, db.ErrNotFound
+}
+
+func (d *DB) GetFileVersions(ctx context.Context, userEmail, fileID string) ([]db.FileVersion, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	var versions []db.FileVersion
+	for _, v := range d.data.FileVersions {
+		if v.UserEmail == userEmail && v.FileID == fileID {
+			versions = append(versions, v)
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+	return versions, nil
+}
+
+func (d *DB) DeleteFileVersion(ctx context.Context, userEmail, fileID string, version int) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, v := range d.data.FileVersions {
+		if v.UserEmail == userEmail && v.FileID == fileID && v.Version == version {
+			d.data.FileVersions = append(d.data.FileVersions[:i], d.data.FileVersions[i+1:]...)
+			return d.save()
+		}
+	}
+
+	return nil
+}
+
+func (d *DB) DeleteFileVersions(ctx context.Context, userEmail, fileID string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	kept := d.data.FileVersions[:0]
+	for _, v := range d.data.FileVersions {
+		if v.UserEmail != userEmail || v.FileID != fileID {
+			kept = append(kept, v)
+		}
+	}
+	d.data.FileVersions = kept
+	return d.save()
+}
+
+// Folder operations
+
+func (d *DB) SaveFolder(ctx context.Context, folder db.Folder) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, f := range d.data.Folders {
+		if f.UserEmail == folder.UserEmail && f.FolderID == folder.FolderID {
+			d.data.Folders[i] = folder
+			return d.save()
+		}
+	}
+
+	d.data.Folders = append(d.data.Folders, folder)
+	return d.save()
+}
+
+func (d *DB) GetFolder(ctx context.Context, userEmail, folderID string) (db.Folder, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	for _, f := range d.data.Folders {
+		if f.UserEmail == userEmail && f.FolderID == folderID {
+			return f, nil
+		}
+	}
+
+	return db.Folder{}, db.ErrNotFound
+}
+
+func (d *DB) GetUserFolders(ctx context.Context, userEmail string) ([]db.Folder, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	var folders []db.Folder
+	for _, f := range d.data.Folders {
+		if f.UserEmail == userEmail {
+			folders = append(folders, f)
+		}
+	}
+
+	return folders, nil
+}
+
+func (d *DB) DeleteFolder(ctx context.Context, userEmail, folderID string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, f := range d.data.Folders {
+		if f.UserEmail == userEmail && f.FolderID == folderID {
+			d.data.Folders = append(d.data.Folders[:i], d.data.Folders[i+1:]...)
+			return d.save()
+		}
+	}
+
+	return nil
+}
+
+// Upload operations
+
+func (d *DB) SaveUpload(ctx context.Context, upload db.Upload) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, u := range d.data.Uploads {
+		if u.UserEmail == upload.UserEmail && u.UploadID == upload.UploadID {
+			d.data.Uploads[i] = upload
+			return d.save()
+		}
+	}
+
+	d.data.Uploads = append(d.data.Uploads, upload)
+	return d.save()
+}
+
+func (d *DB) GetUpload(ctx context.Context, userEmail, uploadID string) (db.Upload, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	for _, u := range d.data.Uploads {
+		if u.UserEmail == userEmail && u.UploadID == uploadID {
+			return u, nil
+		}
+	}
+
+	return db.Upload{}, db.ErrNotFound
+}
+
+func (d *DB) DeleteUpload(ctx context.Context, userEmail, uploadID string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	kept := d.data.UploadParts[:0]
+	for _, p := range d.data.UploadParts {
+		if p.UserEmail != userEmail || p.UploadID != uploadID {
+			kept = append(kept, p)
+		}
+	}
+	d.data.UploadParts = kept
+
+	for i, u := range d.data.Uploads {
+		if u.UserEmail == userEmail && u.UploadID == uploadID {
+			d.data.Uploads = append(d.data.Uploads[:i], d.data.Uploads[i+1:]...)
+			break
+		}
+	}
+	return d.save()
+}
+
+func (d *DB) SaveUploadPart(ctx context.Context, part db.UploadPart) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, p := range d.data.UploadParts {
+		if p.UserEmail == part.UserEmail && p.UploadID == part.UploadID && p.Number == part.Number {
+			return db.ErrConflict
+		}
+	}
+
+	d.data.UploadParts = append(d.data.UploadParts, part)
+	return d.save()
+}
+
+func (d *DB) GetUploadParts(ctx context.Context, userEmail, uploadID string) ([]db.UploadPart, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	var parts []db.UploadPart
+	for _, p := range d.data.UploadParts {
+		if p.UserEmail == userEmail && p.UploadID == uploadID {
+			parts = append(parts, p)
+		}
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+	return parts, nil
+}
+
+// Share operations
+
+func (d *DB) SaveShare(ctx context.Context, share db.Share) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, sh := range d.data.Shares {
+		if sh.UserEmail == share.UserEmail && sh.ShareID == share.ShareID {
+			d.data.Shares[i] = share
+			return d.save()
+		}
+	}
+
+	d.data.Shares = append(d.data.Shares, share)
+	return d.save()
+}
+
+func (d *DB) GetShare(ctx context.Context, userEmail, shareID string) (db.Share, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	for _, sh := range d.data.Shares {
+		if sh.UserEmail == userEmail && sh.ShareID == shareID {
+			return sh, nil
+		}
+	}
+
+	return db.Share{}, db.ErrNotFound
+}
+
+func (d *DB) GetShareByToken(ctx context.Context, tokenHash string) (db.Share, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	for _, sh := range d.data.Shares {
+		if sh.TokenHash == tokenHash {
+			return sh, nil
+		}
+	}
+
+	return db.Share{}, db.ErrNotFound
+}
+
+func (d *DB) GetUserShares(ctx context.Context, userEmail string) ([]db.Share, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	var shares []db.Share
+	for _, sh := range d.data.Shares {
+		if sh.UserEmail == userEmail {
+			shares = append(shares, sh)
+		}
+	}
+
+	return shares, nil
+}
+
+func (d *DB) CountShareDownload(ctx context.Context, share db.Share, expected int, at time.Time) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, sh := range d.data.Shares {
+		if sh.UserEmail == share.UserEmail && sh.ShareID == share.ShareID {
+			if sh.Downloads != expected {
+				return db.ErrConflict
+			}
+			d.data.Shares[i].Downloads = expected + 1
+			d.data.Shares[i].LastAccessedAt = at
+			return d.save()
+		}
+	}
+
+	return db.ErrConflict
+}
+
+func (d *DB) DeleteShare(ctx context.Context, userEmail, shareID string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, sh := range d.data.Shares {
+		if sh.UserEmail == userEmail && sh.ShareID == shareID {
+			d.data.Shares = append(d.data.Shares[:i], d.data.Shares[i+1:]...)
+			return d.save()
+		}
+	}
+
+	return nil
+}
+
+// Grant operations
+
+func sameGrant(a, b db.Grant) bool {
+	return a.OwnerEmail == b.OwnerEmail && a.ResourceType == b.ResourceType &&
+		a.ResourceID == b.ResourceID && a.GranteeEmail == b.GranteeEmail
+}
+
+func (d *DB) SaveGrant(ctx context.Context, grant db.Grant) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, g := range d.data.Grants {
+		if sameGrant(g, grant) {
+			d.data.Grants[i] = grant
+			return d.save()
 		}
 	}
 
-	return fmt.Errorf("file not found")
+	d.data.Grants = append(d.data.Grants, grant)
+	return d.save()
 }
 
-func (db *DB) Close() error {
-	return db.save()
+func (d *DB) GetResourceGrants(ctx context.Context, ownerEmail, resourceType, resourceID string) ([]db.Grant, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	var grants []db.Grant
+	for _, g := range d.data.Grants {
+		if g.OwnerEmail == ownerEmail && g.ResourceType == resourceType && g.ResourceID == resourceID {
+			grants = append(grants, g)
+		}
+	}
+
+	return grants, nil
+}
+
+func (d *DB) GetGranteeGrants(ctx context.Context, granteeEmail string) ([]db.Grant, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	var grants []db.Grant
+	for _, g := range d.data.Grants {
+		if g.GranteeEmail == granteeEmail {
+			grants = append(grants, g)
+		}
+	}
+
+	return grants, nil
+}
+
+func (d *DB) DeleteGrant(ctx context.Context, grant db.Grant) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, g := range d.data.Grants {
+		if sameGrant(g, grant) {
+			d.data.Grants = append(d.data.Grants[:i], d.data.Grants[i+1:]...)
+			return d.save()
+		}
+	}
+
+	return nil
+}
+
+// Usage operations
+
+func (d *DB) GetUsage(ctx context.Context, userEmail string) (db.Usage, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	for _, u := range d.data.Usage {
+		if u.UserEmail == userEmail {
+			return u, nil
+		}
+	}
+
+	return db.Usage{}, db.ErrNotFound
+}
+
+func (d *DB) UpdateUsage(ctx context.Context, usage db.Usage, expectedRevision int) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, u := range d.data.Usage {
+		if u.UserEmail == usage.UserEmail {
+			if u.Revision != expectedRevision {
+				return db.ErrConflict
+			}
+			usage.Quota = u.Quota
+			d.data.Usage[i] = usage
+			return d.save()
+		}
+	}
+
+	if expectedRevision != 0 {
+		return db.ErrConflict
+	}
+	usage.Quota = 0
+	d.data.Usage = append(d.data.Usage, usage)
+	return d.save()
+}
+
+func (d *DB) SetQuota(ctx context.Context, userEmail string, quota int64) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, u := range d.data.Usage {
+		if u.UserEmail == userEmail {
+			d.data.Usage[i].Quota = quota
+			return d.save()
+		}
+	}
+
+	d.data.Usage = append(d.data.Usage, db.Usage{UserEmail: userEmail, Quota: quota})
+	return d.save()
+}
+
+// Note operations
+
+func (d *DB) SaveNote(ctx context.Context, note db.Note) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, n := range d.data.Notes {
+		if n.UserEmail == note.UserEmail && n.NoteID == note.NoteID {
+			d.data.Notes[i] = note
+			return d.save()
+		}
+	}
+
+	d.data.Notes = append(d.data.Notes, note)
+	return d.save()
+}
+
+func (d *DB) GetNote(ctx context.Context, userEmail, noteID string) (db.Note, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	for _, n := range d.data.Notes {
+		if n.UserEmail == userEmail && n.NoteID == noteID {
+			return n, nil
+		}
+	}
+
+	return db.Note{}, db.ErrNotFound
+}
+
+func (d *DB) GetUserNotes(ctx context.Context, userEmail string) ([]db.Note, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	var notes []db.Note
+	for _, n := range d.data.Notes {
+		if n.UserEmail == userEmail {
+			notes = append(notes, n)
+		}
+	}
+
+	return notes, nil
+}
+
+func (d *DB) UpdateNote(ctx context.Context, note db.Note, expectedVersion int) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, n := range d.data.Notes {
+		if n.UserEmail == note.UserEmail && n.NoteID == note.NoteID {
+			if n.Version != expectedVersion {
+				return db.ErrConflict
+			}
+			n.Title = note.Title
+			n.Content = note.Content
+			n.UpdatedAt = note.UpdatedAt
+			n.Version = note.Version
+			n.DeletedAt = note.DeletedAt
+			d.data.Notes[i] = n
+			return d.save()
+		}
+	}
+
+	return db.ErrConflict
+}
+
+func (d *DB) DeleteNote(ctx context.Context, userEmail, noteID string, expectedVersion int) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for i, n := range d.data.Notes {
+		if n.UserEmail == userEmail && n.NoteID == noteID {
+			if n.Version != expectedVersion {
+				return db.ErrConflict
+			}
+			d.data.Notes = append(d.data.Notes[:i], d.data.Notes[i+1:]...)
+			return d.save()
+		}
+	}
+
+	return db.ErrConflict
+}
+
+// Note revision operations
+
+func (d *DB) SaveNoteRevision(ctx context.Context, rev db.NoteRevision) error {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, r := range d.data.NoteRevisions {
+		if r.UserEmail == rev.UserEmail && r.NoteID == rev.NoteID && r.Revision == rev.Revision {
+			return db.ErrConflict
+		}
+	}
+
+	d.data.NoteRevisions = append(d.data.NoteRevisions, rev)
+	return d.save()
+}
+
+func (d *DB) GetNoteRevision(ctx context.Context, userEmail, noteID string, revision int) (db.NoteRevision, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	for _, r := range d.data.NoteRevisions {
+		if r.UserEmail == userEmail && r.NoteID == noteID && r.Revision == revision {
+			return r, nil
+		}
+	}
+
+	return db.NoteRevision{}, db.ErrNotFound
+}
+
+func (d *DB) GetNoteRevisions(ctx context.Context, userEmail, noteID string) ([]db.NoteRevision, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	var revs []db.NoteRevision
+	for _, r := range d.data.NoteRevisions {
+		if r.UserEmail == userEmail && r.NoteID == noteID {
+			revs = append(revs, r)
+		}
+	}
+
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].Revision < revs[j].Revision
+	})
+	return revs, nil
+}
+
+func (d *DB) LatestNoteRevision(ctx context.Context, userEmail, noteID string) (int, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	latest := 0
+	for _, r := range d.data.NoteRevisions {
+		if r.UserEmail == userEmail && r.NoteID == noteID && r.Revision > latest {
+			latest = r.Revision
+		}
+	}
+	return latest, nil
+}
+
+func (d *DB) DeleteNoteRevisions(ctx context.Context, userEmail, noteID string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	kept := d.data.NoteRevisions[:0]
+	for _, r := range d.data.NoteRevisions {
+		if r.UserEmail != userEmail || r.NoteID != noteID {
+			kept = append(kept, r)
+		}
+	}
+	d.data.NoteRevisions = kept
+	return d.save()
+}
+
+// Full scans
+
+func (d *DB) ScanFiles(ctx context.Context, fn func(db.File) error) error {
+	d.RLock()
+	files := append([]db.File(nil), d.data.Files...)
+	d.RUnlock()
+
+	for _, f := range files {
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DB) ScanNotes(ctx context.Context, fn func(db.Note) error) error {
+	d.RLock()
+	notes := append([]db.Note(nil), d.data.Notes...)
+	d.RUnlock()
+
+	for _, n := range notes {
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DB) ScanUploads(ctx context.Context, fn func(db.Upload) error) error {
+	d.RLock()
+	uploads := append([]db.Upload(nil), d.data.Uploads...)
+	d.RUnlock()
+
+	for _, u := range uploads {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DB) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.save()
 }
@@ -1,19 +1,134 @@
 package db
 
 import (
+    "context"
+    "errors"
     "log"
+    "os"
+    "strings"
     "time"
 
     "github.com/gocql/gocql"
 )
 
-var Session *gocql.Session
+// ErrNotFound is returned by MetadataStore lookups that match no record
+var ErrNotFound = errors.New("record not found")
 
+// ErrConflict is returned when a write would replace a record that must not
+// change
+var ErrConflict = errors.New("record already exists")
+
+// MetadataStore is the persistence layer for users, file records and notes.
+// It is implemented by CassandraStore and by the embedded JSON store in
+// internal/database.
+type MetadataStore interface {
+    // CreateUser fails with ErrConflict if a user with the same email
+    // exists. UpdateUser replaces an existing user's record.
+    CreateUser(ctx context.Context, user User) error
+    UpdateUser(ctx context.Context, user User) error
+    GetUser(ctx context.Context, email string) (User, error)
+    GetUserByID(ctx context.Context, id string) (User, error)
+
+    SaveFileMetadata(ctx context.Context, file File) error
+    GetFile(ctx context.Context, userEmail, fileID string) (File, error)
+    GetUserFiles(ctx context.Context, userEmail string) ([]File, error)
+    DeleteFile(ctx context.Context, userEmail, fileID string) error
+
+    // File versions are immutable like note revisions: saving an existing
+    // version number fails with ErrConflict
+    SaveFileVersion(ctx context.Context, version FileVersion) error
+    GetFileVersion(ctx context.Context, userEmail, fileID string, version int) (FileVersion, error)
+    GetFileVersions(ctx context.Context, userEmail, fileID string) ([]FileVersion, error)
+    DeleteFileVersion(ctx context.Context, userEmail, fileID string, version int) error
+    DeleteFileVersions(ctx context.Context, userEmail, fileID string) error
+
+    // Folders form a tree per user; an empty ParentID is the root. Saving
+    // an existing folder replaces it, which is how renames and moves are
+    // written.
+    SaveFolder(ctx context.Context, folder Folder) error
+    GetFolder(ctx context.Context, userEmail, folderID string) (Folder, error)
+    GetUserFolders(ctx context.Context, userEmail string) ([]Folder, error)
+    DeleteFolder(ctx context.Context, userEmail, folderID string) error
+
+    // Uploads are resumable upload sessions. Parts are immutable: saving
+    // an existing part number fails with ErrConflict, which is what keeps
+    // two writers from appending at the same offset. DeleteUpload removes
+    // the session with its parts.
+    SaveUpload(ctx context.Context, upload Upload) error
+    GetUpload(ctx context.Context, userEmail, uploadID string) (Upload, error)
+    DeleteUpload(ctx context.Context, userEmail, uploadID string) error
+    SaveUploadPart(ctx context.Context, part UploadPart) error
+    GetUploadParts(ctx context.Context, userEmail, uploadID string) ([]UploadPart, error)
+
+    // Shares are public links to a file, found by the SHA-256 hash of
+    // their token. CountShareDownload adds one to the download count if it
+    // is still expected and fails with ErrConflict otherwise.
+    SaveShare(ctx context.Context, share Share) error
+    GetShare(ctx context.Context, userEmail, shareID string) (Share, error)
+    GetShareByToken(ctx context.Context, tokenHash string) (Share, error)
+    GetUserShares(ctx context.Context, userEmail string) ([]Share, error)
+    CountShareDownload(ctx context.Context, share Share, expected int, at time.Time) error
+    DeleteShare(ctx context.Context, userEmail, shareID string) error
+
+    // Grants give other users access to a file, folder or note. They are
+    // kept per resource and per grantee; saving an existing grant replaces
+    // its role.
+    SaveGrant(ctx context.Context, grant Grant) error
+    GetResourceGrants(ctx context.Context, ownerEmail, resourceType, resourceID string) ([]Grant, error)
+    GetGranteeGrants(ctx context.Context, granteeEmail string) ([]Grant, error)
+    DeleteGrant(ctx context.Context, grant Grant) error
+
+    // Usage counts the bytes each user stores. UpdateUsage only applies if
+    // the stored usage is still at expectedRevision and fails with
+    // ErrConflict otherwise; it writes usage.Revision as the new revision.
+    // The quota is only written by SetQuota.
+    GetUsage(ctx context.Context, userEmail string) (Usage, error)
+    UpdateUsage(ctx context.Context, usage Usage, expectedRevision int) error
+    SetQuota(ctx context.Context, userEmail string, quota int64) error
+
+    SaveNote(ctx context.Context, note Note) error
+    GetNote(ctx context.Context, userEmail, noteID string) (Note, error)
+    GetUserNotes(ctx context.Context, userEmail string) ([]Note, error)
+    // UpdateNote and DeleteNote only apply if the stored note is still at
+    // expectedVersion and fail with ErrConflict otherwise. UpdateNote
+    // writes note.Version as the new version.
+    UpdateNote(ctx context.Context, note Note, expectedVersion int) error
+    DeleteNote(ctx context.Context, userEmail, noteID string, expectedVersion int) error
+
+    // Revisions are immutable: saving an existing revision number fails
+    // with ErrConflict
+    SaveNoteRevision(ctx context.Context, rev NoteRevision) error
+    GetNoteRevision(ctx context.Context, userEmail, noteID string, revision int) (NoteRevision, error)
+    GetNoteRevisions(ctx context.Context, userEmail, noteID string) ([]NoteRevision, error)
+    // LatestNoteRevision returns the newest revision number of a note, or 0
+    // if it has none, without reading any content
+    LatestNoteRevision(ctx context.Context, userEmail, noteID string) (int, error)
+    DeleteNoteRevisions(ctx context.Context, userEmail, noteID string) error
+
+    // ScanFiles and ScanNotes visit every record across all users, for
+    // rebuilding derived data such as the search index. Returning an
+    // error from fn stops the scan.
+    ScanFiles(ctx context.Context, fn func(File) error) error
+    ScanNotes(ctx context.Context, fn func(Note) error) error
+    ScanUploads(ctx context.Context, fn func(Upload) error) error
+
+    Close() error
+}
+
+// User is anyone who has signed in, with Google or with a password. ID
+// never changes and is what tokens name; everything a user owns is still
+// keyed by email. PasswordHash is empty for users who only sign in with
+// Google.
 type User struct {
-    Email     string    `json:"email"`
-    Name      string    `json:"name"`
-    CreatedAt time.Time `json:"created_at"`
-    LastLogin time.Time `json:"last_login"`
+    ID           string `json:"id"`
+    Email        string `json:"email"`
+    Name         string `json:"name"`
+    PasswordHash string `json:"password_hash"`
+    // EmailVerified is set once the user proved they own the email, by
+    // signing in with a Google account that verified it
+    EmailVerified bool      `json:"email_verified"`
+    CreatedAt     time.Time `json:"created_at"`
+    LastLogin     time.Time `json:"last_login"`
 }
 
 type File struct {
@@ -24,6 +139,119 @@ type File struct {
     ContentType  string    `json:"content_type"`
     StoragePath  string    `json:"storage_path"`
     UploadedAt   time.Time `json:"uploaded_at"`
+    ParentID     string    `json:"parent_id"`
+    Version      int       `json:"version"`
+    // DeletedAt is set while the file is in the trash
+    DeletedAt    time.Time `json:"deleted_at"`
+    State        string    `json:"state"`
+}
+
+// File states. A file is saved pending before its content is stored and
+// committed once it is, and marked deleting before its content is removed,
+// so a failure half way leaves a record the reconciler can finish or roll
+// back. Records from before states have none and count as committed.
+const (
+    FilePending   = "pending"
+    FileCommitted = "committed"
+    FileDeleting  = "deleting"
+)
+
+// Committed reports whether a file's content is stored and not being
+// removed
+func (f File) Committed() bool {
+    return f.State == "" || f.State == FileCommitted
+}
+
+// FileVersion is one stored copy of a file's content. The File record
+// mirrors its current version.
+type FileVersion struct {
+    UserEmail    string    `json:"user_email"`
+    FileID       string    `json:"file_id"`
+    Version      int       `json:"version"`
+    Size         int64     `json:"size"`
+    ContentType  string    `json:"content_type"`
+    StoragePath  string    `json:"storage_path"`
+    UploadedAt   time.Time `json:"uploaded_at"`
+}
+
+// Folder groups files. Folders only exist in metadata; moving a file or a
+// folder never touches object storage.
+type Folder struct {
+    UserEmail  string    `json:"user_email"`
+    FolderID   string    `json:"folder_id"`
+    ParentID   string    `json:"parent_id"`
+    Name       string    `json:"name"`
+    CreatedAt  time.Time `json:"created_at"`
+    UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Upload is a resumable upload in progress. Its content is assembled in
+// a multipart upload at StoragePath; MultipartID is cleared once that is
+// complete and FileID set once the file record exists. Direct uploads have
+// no multipart upload: the client puts the object at StoragePath itself
+// through a pre-signed URL.
+type Upload struct {
+    UserEmail    string    `json:"user_email"`
+    UploadID     string    `json:"upload_id"`
+    Filename     string    `json:"filename"`
+    ParentID     string    `json:"parent_id"`
+    ContentType  string    `json:"content_type"`
+    Length       int64     `json:"length"`
+    StoragePath  string    `json:"storage_path"`
+    MultipartID  string    `json:"multipart_id"`
+    FileID       string    `json:"file_id"`
+    Direct       bool      `json:"direct"`
+    CreatedAt    time.Time `json:"created_at"`
+    ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// UploadPart is one stored chunk of an upload
+type UploadPart struct {
+    UserEmail  string `json:"user_email"`
+    UploadID   string `json:"upload_id"`
+    Number     int    `json:"number"`
+    ETag       string `json:"etag"`
+    Size       int64  `json:"size"`
+}
+
+// Share is a public link to a file. Only the hash of its token is kept, so
+// the link itself cannot be read back from the store. A zero ExpiresAt or
+// MaxDownloads means no limit.
+type Share struct {
+    UserEmail       string    `json:"user_email"`
+    ShareID         string    `json:"share_id"`
+    FileID          string    `json:"file_id"`
+    TokenHash       string    `json:"token_hash"`
+    PasswordHash    string    `json:"password_hash"`
+    ExpiresAt       time.Time `json:"expires_at"`
+    MaxDownloads    int       `json:"max_downloads"`
+    Downloads       int       `json:"downloads"`
+    CreatedAt       time.Time `json:"created_at"`
+    LastAccessedAt  time.Time `json:"last_accessed_at"`
+}
+
+// Grant gives GranteeEmail a role on one of OwnerEmail's files, folders or
+// notes. A grant on a folder covers everything below it.
+type Grant struct {
+    OwnerEmail    string    `json:"owner_email"`
+    ResourceType  string    `json:"resource_type"`
+    ResourceID    string    `json:"resource_id"`
+    GranteeEmail  string    `json:"grantee_email"`
+    Role          string    `json:"role"`
+    GrantedAt     time.Time `json:"granted_at"`
+}
+
+// Usage is how many bytes a user stores, kept up to date as content is
+// added and removed. A Revision of 0 means the bytes have not been counted
+// yet. Quota overrides the default limit when set; -1 means no limit.
+type Usage struct {
+    UserEmail     string    `json:"user_email"`
+    FileBytes     int64     `json:"file_bytes"`
+    VersionBytes  int64     `json:"version_bytes"`
+    TrashBytes    int64     `json:"trash_bytes"`
+    Quota         int64     `json:"quota"`
+    Revision      int       `json:"revision"`
+    UpdatedAt     time.Time `json:"updated_at"`
 }
 
 type Note struct {
@@ -33,113 +261,793 @@ type Note struct {
     Content    string    `json:"content"`
     CreatedAt  time.Time `json:"created_at"`
     UpdatedAt  time.Time `json:"updated_at"`
+    Version    int       `json:"version"`
+    // DeletedAt is set while the note is in the trash
+    DeletedAt  time.Time `json:"deleted_at"`
 }
 
-func InitDB() error {
-    cluster := gocql.NewCluster("localhost:9042")
-    cluster.Keyspace = "cloud_storage"
-    cluster.Consistency = gocql.Quorum
-    cluster.ConnectTimeout = time.Second * 10
+// NoteRevision is a snapshot of a note taken every time it is saved
+type NoteRevision struct {
+    UserEmail   string    `json:"user_email"`
+    NoteID      string    `json:"note_id"`
+    Revision    int       `json:"revision"`
+    Title       string    `json:"title"`
+    Content     string    `json:"content"`
+    Author      string    `json:"author"`
+    ContentHash string    `json:"content_hash"`
+    CreatedAt   time.Time `json:"created_at"`
+}
 
-    var err error
-    Session, err = cluster.CreateSession()
+// CassandraConfig holds the connection settings for CassandraStore
+type CassandraConfig struct {
+    Hosts    []string
+    Keyspace string
+
+    // Replication is the CQL replication map used when Migrate creates the
+    // keyspace
+    Replication string
+}
+
+// CassandraConfigFromEnv reads CASSANDRA_HOSTS (comma separated),
+// CASSANDRA_KEYSPACE and CASSANDRA_REPLICATION, falling back to a local
+// single node
+func CassandraConfigFromEnv() CassandraConfig {
+    cfg := CassandraConfig{
+        Hosts:       []string{"localhost:9042"},
+        Keyspace:    "cloud_storage",
+        Replication: "{'class': 'SimpleStrategy', 'replication_factor': 1}",
+    }
+    if hosts := os.Getenv("CASSANDRA_HOSTS"); hosts != "" {
+        cfg.Hosts = strings.Split(hosts, ",")
+    }
+    if keyspace := os.Getenv("CASSANDRA_KEYSPACE"); keyspace != "" {
+        cfg.Keyspace = keyspace
+    }
+    if replication := os.Getenv("CASSANDRA_REPLICATION"); replication != "" {
+        cfg.Replication = replication
+    }
+    return cfg
+}
+
+// CassandraStore implements MetadataStore on ScyllaDB/Cassandra
+type CassandraStore struct {
+    session *gocql.Session
+}
+
+var _ MetadataStore = (*CassandraStore)(nil)
+
+// NewCassandraStore connects to the keyspace and refuses to return a store
+// if the schema is behind the migrations compiled into the binary
+func NewCassandraStore(ctx context.Context, cfg CassandraConfig) (*CassandraStore, error) {
+    session, err := newSession(cfg)
     if err != nil {
-        return err
+        return nil, err
+    }
+
+    if err := checkSchema(ctx, session, cfg.Keyspace); err != nil {
+        session.Close()
+        return nil, err
     }
 
     log.Println("Database connection established")
+    return &CassandraStore{session: session}, nil
+}
+
+func newSession(cfg CassandraConfig) (*gocql.Session, error) {
+    cluster := gocql.NewCluster(cfg.Hosts...)
+    cluster.Keyspace = cfg.Keyspace
+    cluster.Consistency = gocql.Quorum
+    cluster.ConnectTimeout = time.Second * 10
+
+    return cluster.CreateSession()
+}
+
+func (s *CassandraStore) Close() error {
+    s.session.Close()
     return nil
 }
 
+// notFound maps gocql's sentinel onto ErrNotFound
+func notFound(err error) error {
+    if errors.Is(err, gocql.ErrNotFound) {
+        return ErrNotFound
+    }
+    return err
+}
+
 // User operations
-func CreateUser(user User) error {
-    return Session.Query(`
-        INSERT INTO users (email, name, created_at, last_login)
-        VALUES (?, ?, ?, ?)`,
-        user.Email, user.Name, user.CreatedAt, user.LastLogin,
-    ).Exec()
+func (s *CassandraStore) CreateUser(ctx context.Context, user User) error {
+    applied, err := s.session.Query(`
+        INSERT INTO users (email, id, name, password_hash, email_verified, created_at, last_login)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        IF NOT EXISTS`,
+        user.Email, user.ID, user.Name, user.PasswordHash, user.EmailVerified, user.CreatedAt, user.LastLogin,
+    ).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+    if err != nil {
+        return err
+    }
+    if !applied {
+        return ErrConflict
+    }
+    return s.saveUserID(ctx, user)
+}
+
+func (s *CassandraStore) UpdateUser(ctx context.Context, user User) error {
+    err := s.session.Query(`
+        UPDATE users SET id = ?, name = ?, password_hash = ?, email_verified = ?, created_at = ?, last_login = ?
+        WHERE email = ?`,
+        user.ID, user.Name, user.PasswordHash, user.EmailVerified, user.CreatedAt, user.LastLogin, user.Email,
+    ).WithContext(ctx).Exec()
+    if err != nil {
+        return err
+    }
+    // Users from before IDs get theirs on the next sign in
+    return s.saveUserID(ctx, user)
 }
 
-func GetUser(email string) (User, error) {
+// saveUserID records the email of a user ID in user_ids
+func (s *CassandraStore) saveUserID(ctx context.Context, user User) error {
+    return s.session.Query(`
+        INSERT INTO user_ids (id, email) VALUES (?, ?)`,
+        user.ID, user.Email,
+    ).WithContext(ctx).Exec()
+}
+
+func (s *CassandraStore) GetUser(ctx context.Context, email string) (User, error) {
     var user User
-    err := Session.Query(`
-        SELECT email, name, created_at, last_login
+    err := s.session.Query(`
+        SELECT email, id, name, password_hash, email_verified, created_at, last_login
         FROM users WHERE email = ?`, email,
-    ).Scan(&user.Email, &user.Name, &user.CreatedAt, &user.LastLogin)
+    ).WithContext(ctx).Scan(&user.Email, &user.ID, &user.Name, &user.PasswordHash, &user.EmailVerified, &user.CreatedAt, &user.LastLogin)
+    return user, notFound(err)
+}
+
+func (s *CassandraStore) GetUserByID(ctx context.Context, id string) (User, error) {
+    var email string
+    err := s.session.Query(`
+        SELECT email FROM user_ids WHERE id = ?`, id,
+    ).WithContext(ctx).Scan(&email)
+    if err != nil {
+        return User{}, notFound(err)
+    }
+    user, err := s.GetUser(ctx, email)
+    if err == nil && user.ID != id {
+        return User{}, ErrNotFound
+    }
     return user, err
 }
 
 // File operations
-func SaveFileMetadata(file File) error {
-    return Session.Query(`
-        INSERT INTO files (user_email, file_id, filename, size, content_type, storage_path, uploaded_at)
-        VALUES (?, ?, ?, ?, ?, ?, ?)`,
-        file.UserEmail, file.FileID, file.Filename, file.Size, file.ContentType, file.StoragePath, file.UploadedAt,
-    ).Exec()
+func (s *CassandraStore) SaveFileMetadata(ctx context.Context, file File) error {
+    return s.session.Query(`
+        INSERT INTO files (user_email, file_id, filename, size, content_type, storage_path, uploaded_at, parent_id, version, deleted_at, state)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+        file.UserEmail, file.FileID, file.Filename, file.Size, file.ContentType, file.StoragePath, file.UploadedAt, file.ParentID, file.Version,
+        file.DeletedAt, file.State,
+    ).WithContext(ctx).Exec()
+}
+
+func (s *CassandraStore) GetFile(ctx context.Context, userEmail, fileID string) (File, error) {
+    var file File
+    err := s.session.Query(`
+        SELECT user_email, file_id, filename, size, content_type, storage_path, uploaded_at, parent_id, version, deleted_at, state
+        FROM files WHERE user_email = ? AND file_id = ?`, userEmail, fileID,
+    ).WithContext(ctx).Scan(
+        &file.UserEmail, &file.FileID, &file.Filename, &file.Size,
+        &file.ContentType, &file.StoragePath, &file.UploadedAt, &file.ParentID, &file.Version, &file.DeletedAt, &file.State,
+    )
+    return file, notFound(err)
 }
 
-func GetUserFiles(userEmail string) ([]File, error) {
+func (s *CassandraStore) GetUserFiles(ctx context.Context, userEmail string) ([]File, error) {
     var files []File
-    iter := Session.Query(`
-        SELECT user_email, file_id, filename, size, content_type, storage_path, uploaded_at
+    iter := s.session.Query(`
+        SELECT user_email, file_id, filename, size, content_type, storage_path, uploaded_at, parent_id, version, deleted_at, state
         FROM files WHERE user_email = ?`, userEmail,
-    ).Iter()
+    ).WithContext(ctx).Iter()
 
     var file File
     for iter.Scan(
         &file.UserEmail, &file.FileID, &file.Filename, &file.Size,
-        &file.ContentType, &file.StoragePath, &file.UploadedAt,
+        &file.ContentType, &file.StoragePath, &file.UploadedAt, &file.ParentID, &file.Version, &file.DeletedAt, &file.State,
     ) {
         files = append(files, file)
     }
     return files, iter.Close()
 }
 
-func DeleteFile(userEmail, filename string) error {
-    return Session.Query(`
+func (s *CassandraStore) DeleteFile(ctx context.Context, userEmail, fileID string) error {
+    return s.session.Query(`
         DELETE FROM files
-        WHERE user_email = ? AND filename = ?`,
-        userEmail, filename,
-    ).Exec()
+        WHERE user_email = ? AND file_id = ?`,
+        userEmail, fileID,
+    ).WithContext(ctx).Exec()
 }
 
-// Note operations
-func SaveNote(note Note) error {
-    return Session.Query(`
-        INSERT INTO notes (user_email, note_id, title, content, created_at, updated_at)
+// File version operations
+func (s *CassandraStore) SaveFileVersion(ctx context.Context, v FileVersion) error {
+    applied, err := s.session.Query(`
+        INSERT INTO file_versions (user_email, file_id, version, size, content_type, storage_path, uploaded_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        IF NOT EXISTS`,
+        v.UserEmail, v.FileID, v.Version, v.Size, v.ContentType, v.StoragePath, v.UploadedAt,
+    ).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+    if err != nil {
+        return err
+    }
+    if !applied {
+        return ErrConflict
+    }
+    return nil
+}
+
+func (s *CassandraStore) GetFileVersion(ctx context.Context, userEmail, fileID string, version int) (FileVersion, error) {
+    var v FileVersion
+    err := s.session.Query(`
+        SELECT user_email, file_id, version, size, content_type, storage_path, uploaded_at
+        FROM file_versions WHERE user_email = ? AND file_id = ? AND version = ?`,
+        userEmail, fileID, version,
+    ).WithContext(ctx).Scan(
+        &v.UserEmail, &v.FileID, &v.Version, &v.Size, &v.ContentType, &v.StoragePath, &v.UploadedAt,
+    )
+    return v, notFound(err)
+}
+
+func (s *CassandraStore) GetFileVersions(ctx context.Context, userEmail, fileID string) ([]FileVersion, error) {
+    var versions []FileVersion
+    iter := s.session.Query(`
+        SELECT user_email, file_id, version, size, content_type, storage_path, uploaded_at
+        FROM file_versions WHERE user_email = ? AND file_id = ?`,
+        userEmail, fileID,
+    ).WithContext(ctx).Iter()
+
+    var v FileVersion
+    for iter.Scan(
+        &v.UserEmail, &v.FileID, &v.Version, &v.Size, &v.ContentType, &v.StoragePath, &v.UploadedAt,
+    ) {
+        versions = append(versions, v)
+    }
+    return versions, iter.Close()
+}
+
+func (s *CassandraStore) DeleteFileVersion(ctx context.Context, userEmail, fileID string, version int) error {
+    return s.session.Query(`
+        DELETE FROM file_versions WHERE user_email = ? AND file_id = ? AND version = ?`,
+        userEmail, fileID, version,
+    ).WithContext(ctx).Exec()
+}
+
+func (s *CassandraStore) DeleteFileVersions(ctx context.Context, userEmail, fileID string) error {
+    return s.session.Query(`
+        DELETE FROM file_versions WHERE user_email = ? AND file_id = ?`,
+        userEmail, fileID,
+    ).WithContext(ctx).Exec()
+}
+
+// Folder operations
+func (s *CassandraStore) SaveFolder(ctx context.Context, folder Folder) error {
+    return s.session.Query(`
+        INSERT INTO folders (user_email, folder_id, parent_id, name, created_at, updated_at)
         VALUES (?, ?, ?, ?, ?, ?)`,
-        note.UserEmail, note.NoteID, note.Title, note.Content, note.CreatedAt, note.UpdatedAt,
-    ).Exec()
+        folder.UserEmail, folder.FolderID, folder.ParentID, folder.Name, folder.CreatedAt, folder.UpdatedAt,
+    ).WithContext(ctx).Exec()
+}
+
+func (s *CassandraStore) GetFolder(ctx context.Context, userEmail, folderID string) (Folder, error) {
+    var folder Folder
+    err := s.session.Query(`
+        SELECT user_email, folder_id, parent_id, name, created_at, updated_at
+        FROM folders WHERE user_email = ? AND folder_id = ?`, userEmail, folderID,
+    ).WithContext(ctx).Scan(
+        &folder.UserEmail, &folder.FolderID, &folder.ParentID, &folder.Name,
+        &folder.CreatedAt, &folder.UpdatedAt,
+    )
+    return folder, notFound(err)
+}
+
+func (s *CassandraStore) GetUserFolders(ctx context.Context, userEmail string) ([]Folder, error) {
+    var folders []Folder
+    iter := s.session.Query(`
+        SELECT user_email, folder_id, parent_id, name, created_at, updated_at
+        FROM folders WHERE user_email = ?`, userEmail,
+    ).WithContext(ctx).Iter()
+
+    var folder Folder
+    for iter.Scan(
+        &folder.UserEmail, &folder.FolderID, &folder.ParentID, &folder.Name,
+        &folder.CreatedAt, &folder.UpdatedAt,
+    ) {
+        folders = append(folders, folder)
+    }
+    return folders, iter.Close()
+}
+
+func (s *CassandraStore) DeleteFolder(ctx context.Context, userEmail, folderID string) error {
+    return s.session.Query(`
+        DELETE FROM folders
+        WHERE user_email = ? AND folder_id = ?`,
+        userEmail, folderID,
+    ).WithContext(ctx).Exec()
+}
+
+// Upload operations
+func (s *CassandraStore) SaveUpload(ctx context.Context, u Upload) error {
+    return s.session.Query(`
+        INSERT INTO uploads (user_email, upload_id, filename, parent_id, content_type, length,
+            storage_path, multipart_id, file_id, direct, created_at, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+        u.UserEmail, u.UploadID, u.Filename, u.ParentID, u.ContentType, u.Length,
+        u.StoragePath, u.MultipartID, u.FileID, u.Direct, u.CreatedAt, u.ExpiresAt,
+    ).WithContext(ctx).Exec()
+}
+
+func (s *CassandraStore) GetUpload(ctx context.Context, userEmail, uploadID string) (Upload, error) {
+    var u Upload
+    err := s.session.Query(`
+        SELECT user_email, upload_id, filename, parent_id, content_type, length,
+            storage_path, multipart_id, file_id, direct, created_at, expires_at
+        FROM uploads WHERE user_email = ? AND upload_id = ?`,
+        userEmail, uploadID,
+    ).WithContext(ctx).Scan(
+        &u.UserEmail, &u.UploadID, &u.Filename, &u.ParentID, &u.ContentType, &u.Length,
+        &u.StoragePath, &u.MultipartID, &u.FileID, &u.Direct, &u.CreatedAt, &u.ExpiresAt,
+    )
+    return u, notFound(err)
+}
+
+func (s *CassandraStore) DeleteUpload(ctx context.Context, userEmail, uploadID string) error {
+    err := s.session.Query(`
+        DELETE FROM upload_parts WHERE user_email = ? AND upload_id = ?`,
+        userEmail, uploadID,
+    ).WithContext(ctx).Exec()
+    if err != nil {
+        return err
+    }
+    return s.session.Query(`
+        DELETE FROM uploads WHERE user_email = ? AND upload_id = ?`,
+        userEmail, uploadID,
+    ).WithContext(ctx).Exec()
 }
 
-func GetUserNotes(userEmail string) ([]Note, error) {
+func (s *CassandraStore) SaveUploadPart(ctx context.Context, p UploadPart) error {
+    applied, err := s.session.Query(`
+        INSERT INTO upload_parts (user_email, upload_id, number, etag, size)
+        VALUES (?, ?, ?, ?, ?)
+        IF NOT EXISTS`,
+        p.UserEmail, p.UploadID, p.Number, p.ETag, p.Size,
+    ).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+    if err != nil {
+        return err
+    }
+    if !applied {
+        return ErrConflict
+    }
+    return nil
+}
+
+func (s *CassandraStore) GetUploadParts(ctx context.Context, userEmail, uploadID string) ([]UploadPart, error) {
+    var parts []UploadPart
+    iter := s.session.Query(`
+        SELECT user_email, upload_id, number, etag, size
+        FROM upload_parts WHERE user_email = ? AND upload_id = ?`,
+        userEmail, uploadID,
+    ).WithContext(ctx).Iter()
+
+    var p UploadPart
+    for iter.Scan(&p.UserEmail, &p.UploadID, &p.Number, &p.ETag, &p.Size) {
+        parts = append(parts, p)
+    }
+    return parts, iter.Close()
+}
+
+// Share operations
+func (s *CassandraStore) SaveShare(ctx context.Context, sh Share) error {
+    err := s.session.Query(`
+        INSERT INTO shares (user_email, share_id, file_id, token_hash, password_hash, expires_at,
+            max_downloads, downloads, created_at, last_accessed_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+        sh.UserEmail, sh.ShareID, sh.FileID, sh.TokenHash, sh.PasswordHash, sh.ExpiresAt,
+        sh.MaxDownloads, sh.Downloads, sh.CreatedAt, sh.LastAccessedAt,
+    ).WithContext(ctx).Exec()
+    if err != nil {
+        return err
+    }
+    return s.session.Query(`
+        INSERT INTO share_tokens (token_hash, user_email, share_id)
+        VALUES (?, ?, ?)`,
+        sh.TokenHash, sh.UserEmail, sh.ShareID,
+    ).WithContext(ctx).Exec()
+}
+
+func (s *CassandraStore) GetShare(ctx context.Context, userEmail, shareID string) (Share, error) {
+    var sh Share
+    err := s.session.Query(`
+        SELECT user_email, share_id, file_id, token_hash, password_hash, expires_at,
+            max_downloads, downloads, created_at, last_accessed_at
+        FROM shares WHERE user_email = ? AND share_id = ?`,
+        userEmail, shareID,
+    ).WithContext(ctx).Scan(
+        &sh.UserEmail, &sh.ShareID, &sh.FileID, &sh.TokenHash, &sh.PasswordHash, &sh.ExpiresAt,
+        &sh.MaxDownloads, &sh.Downloads, &sh.CreatedAt, &sh.LastAccessedAt,
+    )
+    return sh, notFound(err)
+}
+
+func (s *CassandraStore) GetShareByToken(ctx context.Context, tokenHash string) (Share, error) {
+    var userEmail, shareID string
+    err := s.session.Query(`
+        SELECT user_email, share_id FROM share_tokens WHERE token_hash = ?`,
+        tokenHash,
+    ).WithContext(ctx).Scan(&userEmail, &shareID)
+    if err != nil {
+        return Share{}, notFound(err)
+    }
+    return s.GetShare(ctx, userEmail, shareID)
+}
+
+func (s *CassandraStore) GetUserShares(ctx context.Context, userEmail string) ([]Share, error) {
+    var shares []Share
+    iter := s.session.Query(`
+        SELECT user_email, share_id, file_id, token_hash, password_hash, expires_at,
+            max_downloads, downloads, created_at, last_accessed_at
+        FROM shares WHERE user_email = ?`,
+        userEmail,
+    ).WithContext(ctx).Iter()
+
+    var sh Share
+    for iter.Scan(
+        &sh.UserEmail, &sh.ShareID, &sh.FileID, &sh.TokenHash, &sh.PasswordHash, &sh.ExpiresAt,
+        &sh.MaxDownloads, &sh.Downloads, &sh.CreatedAt, &sh.LastAccessedAt,
+    ) {
+        shares = append(shares, sh)
+    }
+    return shares, iter.Close()
+}
+
+func (s *CassandraStore) CountShareDownload(ctx context.Context, sh Share, expected int, at time.Time) error {
+    applied, err := s.session.Query(`
+        UPDATE shares SET downloads = ?, last_accessed_at = ?
+        WHERE user_email = ? AND share_id = ?
+        IF downloads = ?`,
+        expected+1, at, sh.UserEmail, sh.ShareID, expected,
+    ).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+    if err != nil {
+        return err
+    }
+    if !applied {
+        return ErrConflict
+    }
+    return nil
+}
+
+func (s *CassandraStore) DeleteShare(ctx context.Context, userEmail, shareID string) error {
+    sh, err := s.GetShare(ctx, userEmail, shareID)
+    if errors.Is(err, ErrNotFound) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    err = s.session.Query(`
+        DELETE FROM share_tokens WHERE token_hash = ?`,
+        sh.TokenHash,
+    ).WithContext(ctx).Exec()
+    if err != nil {
+        return err
+    }
+    return s.session.Query(`
+        DELETE FROM shares WHERE user_email = ? AND share_id = ?`,
+        userEmail, shareID,
+    ).WithContext(ctx).Exec()
+}
+
+// Grant operations
+func (s *CassandraStore) SaveGrant(ctx context.Context, g Grant) error {
+    err := s.session.Query(`
+        INSERT INTO grants_by_resource (owner_email, resource_type, resource_id, grantee_email, role, granted_at)
+        VALUES (?, ?, ?, ?, ?, ?)`,
+        g.OwnerEmail, g.ResourceType, g.ResourceID, g.GranteeEmail, g.Role, g.GrantedAt,
+    ).WithContext(ctx).Exec()
+    if err != nil {
+        return err
+    }
+    return s.session.Query(`
+        INSERT INTO grants_by_grantee (grantee_email, owner_email, resource_type, resource_id, role, granted_at)
+        VALUES (?, ?, ?, ?, ?, ?)`,
+        g.GranteeEmail, g.OwnerEmail, g.ResourceType, g.ResourceID, g.Role, g.GrantedAt,
+    ).WithContext(ctx).Exec()
+}
+
+func (s *CassandraStore) GetResourceGrants(ctx context.Context, ownerEmail, resourceType, resourceID string) ([]Grant, error) {
+    var grants []Grant
+    iter := s.session.Query(`
+        SELECT owner_email, resource_type, resource_id, grantee_email, role, granted_at
+        FROM grants_by_resource WHERE owner_email = ? AND resource_type = ? AND resource_id = ?`,
+        ownerEmail, resourceType, resourceID,
+    ).WithContext(ctx).Iter()
+
+    var g Grant
+    for iter.Scan(&g.OwnerEmail, &g.ResourceType, &g.ResourceID, &g.GranteeEmail, &g.Role, &g.GrantedAt) {
+        grants = append(grants, g)
+    }
+    return grants, iter.Close()
+}
+
+func (s *CassandraStore) GetGranteeGrants(ctx context.Context, granteeEmail string) ([]Grant, error) {
+    var grants []Grant
+    iter := s.session.Query(`
+        SELECT grantee_email, owner_email, resource_type, resource_id, role, granted_at
+        FROM grants_by_grantee WHERE grantee_email = ?`,
+        granteeEmail,
+    ).WithContext(ctx).Iter()
+
+    var g Grant
+    for iter.Scan(&g.GranteeEmail, &g.OwnerEmail, &g.ResourceType, &g.ResourceID, &g.Role, &g.GrantedAt) {
+        grants = append(grants, g)
+    }
+    return grants, iter.Close()
+}
+
+func (s *CassandraStore) DeleteGrant(ctx context.Context, g Grant) error {
+    err := s.session.Query(`
+        DELETE FROM grants_by_grantee
+        WHERE grantee_email = ? AND owner_email = ? AND resource_type = ? AND resource_id = ?`,
+        g.GranteeEmail, g.OwnerEmail, g.ResourceType, g.ResourceID,
+    ).WithContext(ctx).Exec()
+    if err != nil {
+        return err
+    }
+    return s.session.Query(`
+        DELETE FROM grants_by_resource
+        WHERE owner_email = ? AND resource_type = ? AND resource_id = ? AND grantee_email = ?`,
+        g.OwnerEmail, g.ResourceType, g.ResourceID, g.GranteeEmail,
+    ).WithContext(ctx).Exec()
+}
+
+// Usage operations
+func (s *CassandraStore) GetUsage(ctx context.Context, userEmail string) (Usage, error) {
+    var u Usage
+    err := s.session.Query(`
+        SELECT user_email, file_bytes, version_bytes, trash_bytes, quota, revision, updated_at
+        FROM user_usage WHERE user_email = ?`, userEmail,
+    ).WithContext(ctx).Scan(&u.UserEmail, &u.FileBytes, &u.VersionBytes, &u.TrashBytes, &u.Quota, &u.Revision, &u.UpdatedAt)
+    return u, notFound(err)
+}
+
+func (s *CassandraStore) UpdateUsage(ctx context.Context, u Usage, expectedRevision int) error {
+    // Rows that only hold a quota have no revision yet
+    cond, condArgs := "IF revision = ?", []interface{}{expectedRevision}
+    if expectedRevision == 0 {
+        cond, condArgs = "IF revision = null", nil
+    }
+    args := append([]interface{}{
+        u.FileBytes, u.VersionBytes, u.TrashBytes, u.Revision, u.UpdatedAt, u.UserEmail,
+    }, condArgs...)
+
+    applied, err := s.session.Query(`
+        UPDATE user_usage SET file_bytes = ?, version_bytes = ?, trash_bytes = ?, revision = ?, updated_at = ?
+        WHERE user_email = ? `+cond,
+        args...,
+    ).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+    if err != nil {
+        return err
+    }
+    if !applied {
+        return ErrConflict
+    }
+    return nil
+}
+
+func (s *CassandraStore) SetQuota(ctx context.Context, userEmail string, quota int64) error {
+    return s.session.Query(`
+        UPDATE user_usage SET quota = ? WHERE user_email = ?`,
+        quota, userEmail,
+    ).WithContext(ctx).Exec()
+}
+
+// Note operations
+func (s *CassandraStore) SaveNote(ctx context.Context, note Note) error {
+    return s.session.Query(`
+        INSERT INTO notes (user_email, note_id, title, content, created_at, updated_at, version, deleted_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+        note.UserEmail, note.NoteID, note.Title, note.Content, note.CreatedAt, note.UpdatedAt, note.Version, note.DeletedAt,
+    ).WithContext(ctx).Exec()
+}
+
+func (s *CassandraStore) GetNote(ctx context.Context, userEmail, noteID string) (Note, error) {
+    var note Note
+    err := s.session.Query(`
+        SELECT user_email, note_id, title, content, created_at, updated_at, version, deleted_at
+        FROM notes WHERE user_email = ? AND note_id = ?`, userEmail, noteID,
+    ).WithContext(ctx).Scan(
+        &note.UserEmail, &note.NoteID, &note.Title, &note.Content,
+        &note.CreatedAt, &note.UpdatedAt, &note.Version, &note.DeletedAt,
+    )
+    return note, notFound(err)
+}
+
+func (s *CassandraStore) GetUserNotes(ctx context.Context, userEmail string) ([]Note, error) {
     var notes []Note
-    iter := Session.Query(`
-        SELECT user_email, note_id, title, content, created_at, updated_at
+    iter := s.session.Query(`
+        SELECT user_email, note_id, title, content, created_at, updated_at, version, deleted_at
         FROM notes WHERE user_email = ?`, userEmail,
-    ).Iter()
+    ).WithContext(ctx).Iter()
 
     var note Note
     for iter.Scan(
         &note.UserEmail, &note.NoteID, &note.Title, &note.Content,
-        &note.CreatedAt, &note.UpdatedAt,
+        &note.CreatedAt, &note.UpdatedAt, &note.Version, &note.DeletedAt,
     ) {
         notes = append(notes, note)
     }
     return notes, iter.Close()
 }
 
-func UpdateNote(note Note) error {
-    return Session.Query(`
-        UPDATE notes SET title = ?, content = ?, updated_at = ?
+// casNote applies a conditional write of a note if the stored note is at
+// expectedVersion. Notes written before the version column existed have it
+// unset and notes imported by older releases have it 0; both read as
+// version 0, so a write at version 0 is tried against each.
+func (s *CassandraStore) casNote(ctx context.Context, stmt string, args []interface{}, expectedVersion int) error {
+    conds := []string{"IF version = ?"}
+    if expectedVersion == 0 {
+        conds = []string{"IF version = null", "IF version = 0"}
+    }
+    for _, cond := range conds {
+        condArgs := args
+        if expectedVersion != 0 {
+            condArgs = append(append([]interface{}(nil), args...), expectedVersion)
+        }
+        applied, err := s.session.Query(stmt+" "+cond, condArgs...).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+        if err != nil {
+            return err
+        }
+        if applied {
+            return nil
+        }
+    }
+    return ErrConflict
+}
+
+func (s *CassandraStore) UpdateNote(ctx context.Context, note Note, expectedVersion int) error {
+    return s.casNote(ctx, `
+        UPDATE notes SET title = ?, content = ?, updated_at = ?, version = ?, deleted_at = ?
         WHERE user_email = ? AND note_id = ?`,
-        note.Title, note.Content, note.UpdatedAt, note.UserEmail, note.NoteID,
-    ).Exec()
+        []interface{}{note.Title, note.Content, note.UpdatedAt, note.Version, note.DeletedAt, note.UserEmail, note.NoteID},
+        expectedVersion,
+    )
 }
 
-func DeleteNote(userEmail, noteID string) error {
-    return Session.Query(`
+func (s *CassandraStore) DeleteNote(ctx context.Context, userEmail, noteID string, expectedVersion int) error {
+    return s.casNote(ctx, `
         DELETE FROM notes WHERE user_email = ? AND note_id = ?`,
+        []interface{}{userEmail, noteID},
+        expectedVersion,
+    )
+}
+
+// Note revision operations
+func (s *CassandraStore) SaveNoteRevision(ctx context.Context, rev NoteRevision) error {
+    applied, err := s.session.Query(`
+        INSERT INTO note_revisions (user_email, note_id, revision, title, content, author, content_hash, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        IF NOT EXISTS`,
+        rev.UserEmail, rev.NoteID, rev.Revision, rev.Title, rev.Content, rev.Author, rev.ContentHash, rev.CreatedAt,
+    ).WithContext(ctx).MapScanCAS(map[string]interface{}{})
+    if err != nil {
+        return err
+    }
+    if !applied {
+        return ErrConflict
+    }
+    return nil
+}
+
+func (s *CassandraStore) GetNoteRevision(ctx context.Context, userEmail, noteID string, revision int) (NoteRevision, error) {
+    var rev NoteRevision
+    err := s.session.Query(`
+        SELECT user_email, note_id, revision, title, content, author, content_hash, created_at
+        FROM note_revisions WHERE user_email = ? AND note_id = ? AND revision = ?`,
+        userEmail, noteID, revision,
+    ).WithContext(ctx).Scan(
+        &rev.UserEmail, &rev.NoteID, &rev.Revision, &rev.Title, &rev.Content,
+        &rev.Author, &rev.ContentHash, &rev.CreatedAt,
+    )
+    return rev, notFound(err)
+}
+
+func (s *CassandraStore) GetNoteRevisions(ctx context.Context, userEmail, noteID string) ([]NoteRevision, error) {
+    var revs []NoteRevision
+    iter := s.session.Query(`
+        SELECT user_email, note_id, revision, title, content, author, content_hash, created_at
+        FROM note_revisions WHERE user_email = ? AND note_id = ?`,
         userEmail, noteID,
-    ).Exec()
+    ).WithContext(ctx).Iter()
+
+    var rev NoteRevision
+    for iter.Scan(
+        &rev.UserEmail, &rev.NoteID, &rev.Revision, &rev.Title, &rev.Content,
+        &rev.Author, &rev.ContentHash, &rev.CreatedAt,
+    ) {
+        revs = append(revs, rev)
+    }
+    return revs, iter.Close()
+}
+
+func (s *CassandraStore) LatestNoteRevision(ctx context.Context, userEmail, noteID string) (int, error) {
+    var revision int
+    err := s.session.Query(`
+        SELECT revision FROM note_revisions WHERE user_email = ? AND note_id = ?
+        ORDER BY revision DESC LIMIT 1`,
+        userEmail, noteID,
+    ).WithContext(ctx).Scan(&revision)
+    if errors.Is(err, gocql.ErrNotFound) {
+        return 0, nil
+    }
+    return revision, err
+}
+
+func (s *CassandraStore) DeleteNoteRevisions(ctx context.Context, userEmail, noteID string) error {
+    return s.session.Query(`
+        DELETE FROM note_revisions WHERE user_email = ? AND note_id = ?`,
+        userEmail, noteID,
+    ).WithContext(ctx).Exec()
+}
+
+// Full table scans
+func (s *CassandraStore) ScanFiles(ctx context.Context, fn func(File) error) error {
+    iter := s.session.Query(`
+        SELECT user_email, file_id, filename, size, content_type, storage_path, uploaded_at, parent_id, version, deleted_at, state
+        FROM files`,
+    ).WithContext(ctx).PageSize(500).Iter()
+
+    var file File
+    for iter.Scan(
+        &file.UserEmail, &file.FileID, &file.Filename, &file.Size,
+        &file.ContentType, &file.StoragePath, &file.UploadedAt, &file.ParentID, &file.Version, &file.DeletedAt, &file.State,
+    ) {
+        if err := fn(file); err != nil {
+            iter.Close()
+            return err
+        }
+    }
+    return iter.Close()
+}
+
+func (s *CassandraStore) ScanNotes(ctx context.Context, fn func(Note) error) error {
+    iter := s.session.Query(`
+        SELECT user_email, note_id, title, content, created_at, updated_at, version, deleted_at
+        FROM notes`,
+    ).WithContext(ctx).PageSize(500).Iter()
+
+    var note Note
+    for iter.Scan(
+        &note.UserEmail, &note.NoteID, &note.Title, &note.Content,
+        &note.CreatedAt, &note.UpdatedAt, &note.Version, &note.DeletedAt,
+    ) {
+        if err := fn(note); err != nil {
+            iter.Close()
+            return err
+        }
+    }
+    return iter.Close()
+}
+
+func (s *CassandraStore) ScanUploads(ctx context.Context, fn func(Upload) error) error {
+    iter := s.session.Query(`
+        SELECT user_email, upload_id, filename, parent_id, content_type, length,
+            storage_path, multipart_id, file_id, direct, created_at, expires_at
+        FROM uploads`,
+    ).WithContext(ctx).PageSize(500).Iter()
+
+    var u Upload
+    for iter.Scan(
+        &u.UserEmail, &u.UploadID, &u.Filename, &u.ParentID, &u.ContentType, &u.Length,
+        &u.StoragePath, &u.MultipartID, &u.FileID, &u.Direct, &u.CreatedAt, &u.ExpiresAt,
+    ) {
+        if err := fn(u); err != nil {
+            iter.Close()
+            return err
+        }
+    }
+    return iter.Close()
 }
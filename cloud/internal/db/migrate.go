@@ -0,0 +1,324 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+//go:embed migrations/*.cql
+var migrationFiles embed.FS
+
+// ErrSchemaOutdated is returned when the keyspace is behind the migrations
+// compiled into the binary
+var ErrSchemaOutdated = errors.New("database schema is out of date, run the migrate command")
+
+// ErrLegacySchema is returned when the keyspace holds tables created by
+// the scripts used before migrations, whose columns differ from
+// 0001_initial. CREATE TABLE IF NOT EXISTS would leave them as they are.
+var ErrLegacySchema = errors.New("keyspace has tables from the schema used before migrations")
+
+// initialKeys are the key columns 0001_initial gives the tables that
+// existed before migrations, with their CQL types
+var initialKeys = map[string]map[string]string{
+	"users": {"email": "text"},
+	"files": {"user_email": "text", "file_id": "text"},
+	"notes": {"user_email": "text", "note_id": "text"},
+}
+
+// Migration is one versioned schema change shipped in migrations/
+type Migration struct {
+	Version    int
+	Name       string
+	Checksum   string
+	Statements []string
+}
+
+// MigrationStatus reports whether a migration has been applied
+type MigrationStatus struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// Migrations returns the embedded migrations ordered by version. Files are
+// named NNNN_description.cql and hold semicolon separated statements.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		name := entry.Name()
+		prefix, desc, ok := strings.Cut(strings.TrimSuffix(name, ".cql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: expected NNNN_description.cql", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version: %v", name, err)
+		}
+
+		body, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(body)
+
+		migrations = append(migrations, Migration{
+			Version:    version,
+			Name:       desc,
+			Checksum:   hex.EncodeToString(sum[:]),
+			Statements: splitStatements(string(body)),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// splitStatements strips -- comments and splits a CQL script on semicolons
+func splitStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	var statements []string
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
+
+// LatestSchemaVersion is the highest embedded migration version
+func LatestSchemaVersion() int {
+	migrations, err := Migrations()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+const createMigrationsTable = `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version int PRIMARY KEY,
+        name text,
+        checksum text,
+        applied_at timestamp
+    )`
+
+// Migrate creates the keyspace if needed and applies every pending
+// migration in order, returning the ones it applied
+func Migrate(ctx context.Context, cfg CassandraConfig) ([]Migration, error) {
+	if err := createKeyspace(ctx, cfg); err != nil {
+		return nil, err
+	}
+
+	session, err := newSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	if err := checkLegacyTables(ctx, session, cfg.Keyspace); err != nil {
+		return nil, err
+	}
+	if err := session.Query(createMigrationsTable).WithContext(ctx).Exec(); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	status, err := migrationStatus(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range status {
+		if !m.AppliedAt.IsZero() {
+			continue
+		}
+
+		for _, stmt := range m.Statements {
+			if err := session.Query(stmt).WithContext(ctx).Exec(); err != nil && !alreadyApplied(err) {
+				return applied, fmt.Errorf("migration %04d_%s failed: %v", m.Version, m.Name, err)
+			}
+		}
+
+		if err := session.Query(`
+            INSERT INTO schema_migrations (version, name, checksum, applied_at)
+            VALUES (?, ?, ?, ?)`,
+			m.Version, m.Name, m.Checksum, time.Now(),
+		).WithContext(ctx).Exec(); err != nil {
+			return applied, fmt.Errorf("failed to record migration %04d: %v", m.Version, err)
+		}
+
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+		applied = append(applied, m.Migration)
+	}
+
+	return applied, nil
+}
+
+// SchemaStatus lists every embedded migration with the time it was applied,
+// or a zero time if it is still pending
+func SchemaStatus(ctx context.Context, cfg CassandraConfig) ([]MigrationStatus, error) {
+	session, err := newSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	return migrationStatus(ctx, session)
+}
+
+func migrationStatus(ctx context.Context, session *gocql.Session) ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	type record struct {
+		checksum  string
+		appliedAt time.Time
+	}
+	applied := make(map[int]record)
+
+	iter := session.Query(`SELECT version, checksum, applied_at FROM schema_migrations`).WithContext(ctx).Iter()
+	var (
+		version int
+		rec     record
+	)
+	for iter.Scan(&version, &rec.checksum, &rec.appliedAt) {
+		applied[version] = rec
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		status[i].Migration = m
+		if rec, ok := applied[m.Version]; ok {
+			if rec.checksum != m.Checksum {
+				return nil, fmt.Errorf("migration %04d_%s has changed since it was applied", m.Version, m.Name)
+			}
+			status[i].AppliedAt = rec.appliedAt
+		}
+	}
+	return status, nil
+}
+
+// checkSchema fails with ErrSchemaOutdated unless every embedded migration
+// has been applied, and with ErrLegacySchema if the tables predate them
+func checkSchema(ctx context.Context, session *gocql.Session, keyspace string) error {
+	var table string
+	err := session.Query(`
+        SELECT table_name FROM system_schema.tables
+        WHERE keyspace_name = ? AND table_name = 'schema_migrations'`, keyspace,
+	).WithContext(ctx).Scan(&table)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return ErrSchemaOutdated
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look for schema_migrations: %v", err)
+	}
+
+	if err := checkLegacyTables(ctx, session, keyspace); err != nil {
+		return err
+	}
+	status, err := migrationStatus(ctx, session)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range status {
+		if m.AppliedAt.IsZero() {
+			return fmt.Errorf("%w (missing %04d_%s)", ErrSchemaOutdated, m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+// checkLegacyTables fails with ErrLegacySchema if users, files or notes
+// exist with other key columns than 0001_initial gives them, such as the
+// uuid ids of the old schema.cql or the id keyed tables of init.cql. Their
+// data has to be exported and the tables dropped before migrating.
+func checkLegacyTables(ctx context.Context, session *gocql.Session, keyspace string) error {
+	for table, keys := range initialKeys {
+		columns := make(map[string]string)
+		iter := session.Query(`
+            SELECT column_name, type FROM system_schema.columns
+            WHERE keyspace_name = ? AND table_name = ?`, keyspace, table,
+		).WithContext(ctx).Iter()
+		var name, typ string
+		for iter.Scan(&name, &typ) {
+			columns[name] = typ
+		}
+		if err := iter.Close(); err != nil {
+			return fmt.Errorf("failed to read columns of %s: %v", table, err)
+		}
+		if len(columns) == 0 {
+			continue
+		}
+
+		for column, want := range keys {
+			if got, ok := columns[column]; !ok {
+				return fmt.Errorf("%w: %s has no %s column", ErrLegacySchema, table, column)
+			} else if got != want {
+				return fmt.Errorf("%w: %s.%s is %s, not %s", ErrLegacySchema, table, column, got, want)
+			}
+		}
+	}
+	return nil
+}
+
+func createKeyspace(ctx context.Context, cfg CassandraConfig) error {
+	noKeyspace := cfg
+	noKeyspace.Keyspace = ""
+
+	session, err := newSession(noKeyspace)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stmt := fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH replication = %s", cfg.Keyspace, cfg.Replication)
+	if err := session.Query(stmt).WithContext(ctx).Exec(); err != nil {
+		return fmt.Errorf("failed to create keyspace: %v", err)
+	}
+	return nil
+}
+
+// alreadyApplied reports whether a DDL error means the change is already
+// in place, so a migration interrupted halfway can be re-run. CQL has no
+// IF NOT EXISTS for ALTER TABLE ADD.
+func alreadyApplied(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "already exist") || strings.Contains(msg, "conflicts with an existing column")
+}
@@ -0,0 +1,432 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"cloud/internal/db"
+	"cloud/internal/quota"
+	"cloud/internal/storage"
+)
+
+var (
+	ErrNotFound    = errors.New("file not found")
+	ErrDuplicate   = errors.New("a file with that name already exists here")
+	ErrInvalidName = errors.New("invalid filename")
+	// ErrSizeChanged is returned when the copy of an Upload's Source does
+	// not have the announced size
+	ErrSizeChanged = errors.New("copied content does not have the announced size")
+
+	// ErrTrashed is returned for files in the trash. It matches
+	// ErrNotFound, so trashed files are hidden from everything but the
+	// trash.
+	ErrTrashed = fmt.Errorf("%w: it is in the trash", ErrNotFound)
+)
+
+// DuplicatePolicy decides what an upload does when the folder already holds
+// a file with the same name
+type DuplicatePolicy string
+
+const (
+	// PolicyRename stores the upload as "name (1).ext", "name (2).ext", ...
+	PolicyRename DuplicatePolicy = "rename"
+	// PolicyReject fails the upload with ErrDuplicate
+	PolicyReject DuplicatePolicy = "reject"
+	// PolicyVersion adds the upload as a new version of the existing file,
+	// which keeps its ID
+	PolicyVersion DuplicatePolicy = "version"
+)
+
+// ParseDuplicatePolicy accepts the policy names used in configuration
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch p := DuplicatePolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case PolicyRename, PolicyReject, PolicyVersion:
+		return p, nil
+	case "":
+		return PolicyRename, nil
+	}
+	return "", fmt.Errorf("unknown duplicate policy %q (expected rename, reject or version)", s)
+}
+
+// PolicyFromEnv reads FILE_DUPLICATE_POLICY, defaulting to rename
+func PolicyFromEnv() (DuplicatePolicy, error) {
+	return ParseDuplicatePolicy(os.Getenv("FILE_DUPLICATE_POLICY"))
+}
+
+// ObjectKey is where the content of a file lives in object storage. It only
+// depends on IDs, so renaming or moving a file never touches its object.
+// Later versions are stored next to it, see VersionKey.
+func ObjectKey(userEmail, fileID string) string {
+	return userEmail + "/" + fileID
+}
+
+// Store is the persistence backend used by Service. db.MetadataStore
+// satisfies it.
+type Store interface {
+	SaveFileMetadata(ctx context.Context, file db.File) error
+	GetFile(ctx context.Context, userEmail, fileID string) (db.File, error)
+	GetUserFiles(ctx context.Context, userEmail string) ([]db.File, error)
+	DeleteFile(ctx context.Context, userEmail, fileID string) error
+	ScanFiles(ctx context.Context, fn func(db.File) error) error
+
+	SaveFileVersion(ctx context.Context, version db.FileVersion) error
+	GetFileVersion(ctx context.Context, userEmail, fileID string, version int) (db.FileVersion, error)
+	GetFileVersions(ctx context.Context, userEmail, fileID string) ([]db.FileVersion, error)
+	DeleteFileVersion(ctx context.Context, userEmail, fileID string, version int) error
+	DeleteFileVersions(ctx context.Context, userEmail, fileID string) error
+
+	GetFolder(ctx context.Context, userEmail, folderID string) (db.Folder, error)
+	ScanUploads(ctx context.Context, fn func(db.Upload) error) error
+}
+
+// Meter keeps count of the bytes each user stores and refuses content
+// over their quota. *quota.Service implements it.
+type Meter interface {
+	Check(ctx context.Context, userEmail string, size int64) error
+	Charge(ctx context.Context, userEmail string, d quota.Delta) error
+	Refund(ctx context.Context, userEmail string, d quota.Delta)
+	Recount(ctx context.Context, userEmail string) error
+}
+
+// Upload describes a file being uploaded
+type Upload struct {
+	Filename    string
+	ParentID    string
+	ContentType string
+	Size        int64
+	Body        io.Reader
+
+	// Object is the key of content that is already in object storage,
+	// such as a finished chunked upload. When set it is used instead of
+	// Body and taken over by the file, so deleting the file deletes it.
+	Object string
+
+	// Source is the key of content in object storage that others may still
+	// write to, such as a pre-signed upload. When set the file gets a copy
+	// at its own key instead of Body; the source stays with the caller.
+	Source string
+}
+
+// Service stores file content and metadata together. Filenames are display
+// metadata only; objects are keyed by file ID. Content is charged to the
+// owner's quota before it is stored.
+type Service struct {
+	store   Store
+	objects storage.ObjectStore
+	policy  DuplicatePolicy
+	meter   Meter
+}
+
+func NewService(store Store, objects storage.ObjectStore, policy DuplicatePolicy, meter Meter) *Service {
+	return &Service{store: store, objects: objects, policy: policy, meter: meter}
+}
+
+// Get returns a file that is not in the trash
+func (s *Service) Get(ctx context.Context, userEmail, fileID string) (db.File, error) {
+	file, err := s.record(ctx, userEmail, fileID)
+	if err != nil {
+		return db.File{}, err
+	}
+	if !file.DeletedAt.IsZero() {
+		return db.File{}, ErrTrashed
+	}
+	return file, nil
+}
+
+// record returns a committed file whether or not it is in the trash.
+// Files still being uploaded or deleted are not found.
+func (s *Service) record(ctx context.Context, userEmail, fileID string) (db.File, error) {
+	file, err := s.store.GetFile(ctx, userEmail, fileID)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && !file.Committed()) {
+		return db.File{}, ErrNotFound
+	}
+	if err != nil {
+		return db.File{}, fmt.Errorf("failed to read file metadata: %v", err)
+	}
+	return file, nil
+}
+
+// List returns the user's files that are not in the trash
+func (s *Service) List(ctx context.Context, userEmail string) ([]db.File, error) {
+	all, err := s.store.GetUserFiles(ctx, userEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+
+	list := make([]db.File, 0, len(all))
+	for _, f := range all {
+		if f.Committed() && f.DeletedAt.IsZero() {
+			list = append(list, f)
+		}
+	}
+	return list, nil
+}
+
+// Open returns the file record and a handle on its content
+func (s *Service) Open(ctx context.Context, userEmail, fileID string) (db.File, storage.Object, error) {
+	file, err := s.Get(ctx, userEmail, fileID)
+	if err != nil {
+		return db.File{}, nil, err
+	}
+
+	object, _, err := s.objects.Get(ctx, file.StoragePath)
+	if errors.Is(err, storage.ErrNotFound) {
+		return db.File{}, nil, ErrNotFound
+	}
+	if err != nil {
+		return db.File{}, nil, fmt.Errorf("failed to read object: %v", err)
+	}
+	return file, object, nil
+}
+
+// Upload stores a new file, applying the duplicate policy if the folder
+// already has a file with the same name. The returned record is the one
+// that now holds the content.
+func (s *Service) Upload(ctx context.Context, userEmail string, up Upload) (db.File, error) {
+	name, err := cleanName(up.Filename)
+	if err != nil {
+		return db.File{}, err
+	}
+
+	siblings, err := s.siblings(ctx, userEmail, up.ParentID)
+	if err != nil {
+		return db.File{}, err
+	}
+
+	if existing, ok := siblings[strings.ToLower(name)]; ok {
+		switch s.policy {
+		case PolicyReject:
+			return db.File{}, ErrDuplicate
+		case PolicyVersion:
+			return s.addVersion(ctx, existing, up)
+		default:
+			name = uniqueName(name, siblings)
+		}
+	}
+
+	file := db.File{
+		UserEmail:   userEmail,
+		FileID:      uuid.New().String(),
+		Filename:    name,
+		Size:        up.Size,
+		ContentType: up.ContentType,
+		UploadedAt:  time.Now(),
+		ParentID:    up.ParentID,
+		Version:     1,
+		State:       db.FilePending,
+	}
+	file.StoragePath = VersionKey(userEmail, file.FileID, 1)
+	if up.Object != "" {
+		file.StoragePath = up.Object
+	}
+	charge := quota.Delta{Files: up.Size}
+	if err := s.meter.Charge(ctx, userEmail, charge); err != nil {
+		return db.File{}, err
+	}
+
+	// The pending record goes in before the object, so an object can only
+	// exist without a record if the upload is still running
+	if err := s.store.SaveFileMetadata(ctx, file); err != nil {
+		s.meter.Refund(ctx, userEmail, charge)
+		return db.File{}, fmt.Errorf("failed to save file metadata: %v", err)
+	}
+	if _, err := s.put(ctx, file.StoragePath, up); err != nil {
+		s.rollBack(ctx, file, up.Object == "")
+		s.meter.Refund(ctx, userEmail, charge)
+		return db.File{}, err
+	}
+
+	file.State = db.FileCommitted
+	err = s.store.SaveFileVersion(ctx, versionOf(file))
+	if err == nil {
+		err = s.store.SaveFileMetadata(ctx, file)
+	}
+	if err != nil {
+		// Adopted objects stay with the caller, who can retry
+		s.rollBack(ctx, file, up.Object == "")
+		s.meter.Refund(ctx, userEmail, charge)
+		return db.File{}, fmt.Errorf("failed to save file metadata: %v", err)
+	}
+
+	log.Printf("Uploaded file for user %s: %s", userEmail, file.Filename)
+	return file, nil
+}
+
+// rollBack undoes a failed upload, removing its object too unless the
+// caller keeps it. Whatever cannot be removed is left pending, for the
+// reconciler to clear up.
+func (s *Service) rollBack(ctx context.Context, file db.File, removeObject bool) {
+	if removeObject {
+		if err := s.objects.Delete(ctx, file.StoragePath); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Error removing object %s after failed upload: %v", file.StoragePath, err)
+			return
+		}
+	}
+	if err := s.store.DeleteFileVersions(ctx, file.UserEmail, file.FileID); err != nil {
+		log.Printf("Error removing versions of failed upload %s: %v", file.FileID, err)
+		return
+	}
+	if err := s.store.DeleteFile(ctx, file.UserEmail, file.FileID); err != nil {
+		log.Printf("Error removing record of failed upload %s: %v", file.FileID, err)
+	}
+}
+
+// CheckUpload fails early, before any content is sent, for an upload that
+// Upload would refuse because of its name or size
+func (s *Service) CheckUpload(ctx context.Context, userEmail, filename, parentID string, size int64) error {
+	name, err := cleanName(filename)
+	if err != nil {
+		return err
+	}
+	if err := s.meter.Check(ctx, userEmail, size); err != nil {
+		return err
+	}
+	if s.policy != PolicyReject {
+		return nil
+	}
+
+	siblings, err := s.siblings(ctx, userEmail, parentID)
+	if err != nil {
+		return err
+	}
+	if _, ok := siblings[strings.ToLower(name)]; ok {
+		return ErrDuplicate
+	}
+	return nil
+}
+
+// put stores the content of an upload at key and returns where it lives,
+// which is the upload's own object if it has one
+func (s *Service) put(ctx context.Context, key string, up Upload) (string, error) {
+	if up.Object != "" {
+		return up.Object, nil
+	}
+	if up.Source != "" {
+		info, err := s.objects.Copy(ctx, up.Source, key)
+		if err != nil {
+			return "", fmt.Errorf("failed to copy object: %v", err)
+		}
+		// The source may have been replaced since it was checked
+		if info.Size != up.Size {
+			if err := s.objects.Delete(ctx, key); err != nil {
+				log.Printf("Error removing mismatched copy %s: %v", key, err)
+			}
+			return "", ErrSizeChanged
+		}
+		return key, nil
+	}
+	if _, err := s.objects.Put(ctx, key, up.Body, up.Size, up.ContentType); err != nil {
+		return "", fmt.Errorf("failed to store object: %v", err)
+	}
+	return key, nil
+}
+
+// Delete permanently removes a file, from the trash or not. The file is
+// marked deleting, then the objects of every version are removed and then
+// its records; if that fails part way the reconciler finishes it. The
+// space is given back first, while the records still show what it was
+// used for.
+func (s *Service) Delete(ctx context.Context, userEmail, fileID string) (db.File, error) {
+	file, err := s.record(ctx, userEmail, fileID)
+	if err != nil {
+		return db.File{}, err
+	}
+
+	versions, err := s.store.GetFileVersions(ctx, userEmail, fileID)
+	if err != nil {
+		return db.File{}, fmt.Errorf("failed to list versions: %v", err)
+	}
+	keys := []string{file.StoragePath}
+	freed := quota.Delta{Files: -file.Size}
+	for _, v := range versions {
+		if v.StoragePath != file.StoragePath {
+			keys = append(keys, v.StoragePath)
+			freed.Versions -= v.Size
+		}
+	}
+	if !file.DeletedAt.IsZero() {
+		freed = quota.Delta{Trash: freed.Files + freed.Versions}
+	}
+	if err := s.meter.Charge(ctx, userEmail, freed); err != nil {
+		return db.File{}, err
+	}
+
+	marked := file
+	marked.State = db.FileDeleting
+	if err := s.store.SaveFileMetadata(ctx, marked); err != nil {
+		s.meter.Refund(ctx, userEmail, freed)
+		return db.File{}, fmt.Errorf("failed to save file metadata: %v", err)
+	}
+	if err := s.remove(ctx, file, keys); err != nil {
+		log.Printf("Error deleting file %s, left for the reconciler: %v", fileID, err)
+	}
+	return file, nil
+}
+
+// remove deletes the objects at keys and then the records of a file
+func (s *Service) remove(ctx context.Context, file db.File, keys []string) error {
+	for _, key := range keys {
+		if err := s.objects.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("failed to delete object: %v", err)
+		}
+	}
+
+	if err := s.store.DeleteFileVersions(ctx, file.UserEmail, file.FileID); err != nil {
+		return fmt.Errorf("failed to delete versions: %v", err)
+	}
+	if err := s.store.DeleteFile(ctx, file.UserEmail, file.FileID); err != nil {
+		return fmt.Errorf("failed to delete file metadata: %v", err)
+	}
+	return nil
+}
+
+// siblings returns the files in a folder keyed by lower cased name
+func (s *Service) siblings(ctx context.Context, userEmail, parentID string) (map[string]db.File, error) {
+	all, err := s.store.GetUserFiles(ctx, userEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+
+	siblings := make(map[string]db.File)
+	for _, f := range all {
+		if f.ParentID == parentID && f.Committed() && f.DeletedAt.IsZero() {
+			siblings[strings.ToLower(f.Filename)] = f
+		}
+	}
+	return siblings, nil
+}
+
+// cleanName reduces an uploaded filename to its last path element
+func cleanName(filename string) (string, error) {
+	name := path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if name == "." || name == "/" || name == "" {
+		return "", ErrInvalidName
+	}
+	return name, nil
+}
+
+// uniqueName appends " (n)" before the extension until the name is free
+func uniqueName(name string, taken map[string]db.File) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if ext == name {
+		// Dot files such as ".env" have no extension to keep
+		base, ext = name, ""
+	}
+
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if _, ok := taken[strings.ToLower(candidate)]; !ok {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"cloud/internal/db"
+	"cloud/internal/storage"
+)
+
+// DefaultReconcileGrace is how long an upload may take before its pending
+// record or unclaimed object is treated as left over from a failure
+const DefaultReconcileGrace = 24 * time.Hour
+
+// Kinds of inconsistency between the metadata store and object storage
+const (
+	// ProblemStalePending is an upload that never committed. Its records
+	// are removed; the object, if any, is then an orphan.
+	ProblemStalePending = "stale_pending"
+	// ProblemUnfinishedDelete is a delete that stopped part way. It is
+	// finished.
+	ProblemUnfinishedDelete = "unfinished_delete"
+	// ProblemMissingObject is a file whose current content is gone. It
+	// falls back to its newest older version that still has content, or
+	// is removed if there is none.
+	ProblemMissingObject = "missing_object"
+	// ProblemMissingVersion is an older version whose content is gone.
+	// Its record is removed.
+	ProblemMissingVersion = "missing_version"
+	// ProblemOrphanObject is an object no file, version or upload points
+	// to. It is deleted.
+	ProblemOrphanObject = "orphan_object"
+)
+
+// Problem is one inconsistency found by Reconcile
+type Problem struct {
+	Kind      string `json:"kind"`
+	UserEmail string `json:"user_email,omitempty"`
+	FileID    string `json:"file_id,omitempty"`
+	Version   int    `json:"version,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Size      int64  `json:"size"`
+	Repaired  bool   `json:"repaired"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ReconcileReport is the outcome of one Reconcile pass
+type ReconcileReport struct {
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+	DryRun         bool      `json:"dry_run"`
+	FilesChecked   int       `json:"files_checked"`
+	ObjectsChecked int       `json:"objects_checked"`
+	Problems       []Problem `json:"problems"`
+}
+
+// ReconcileGraceFromEnv reads RECONCILE_GRACE, a duration such as "6h".
+// It defaults to DefaultReconcileGrace.
+func ReconcileGraceFromEnv() (time.Duration, error) {
+	v := os.Getenv("RECONCILE_GRACE")
+	if v == "" {
+		return DefaultReconcileGrace, nil
+	}
+	grace, err := time.ParseDuration(v)
+	if err != nil || grace <= 0 {
+		return 0, fmt.Errorf("invalid RECONCILE_GRACE %q", v)
+	}
+	return grace, nil
+}
+
+// ReconcileRepairFromEnv reads RECONCILE_REPAIR. Background passes only
+// report unless it is "true", since a repair deletes objects.
+func ReconcileRepairFromEnv() (bool, error) {
+	switch v := os.Getenv("RECONCILE_REPAIR"); v {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid RECONCILE_REPAIR %q", v)
+	}
+}
+
+// recordedFile is a file record with its versions, as read by Reconcile
+type recordedFile struct {
+	file     db.File
+	versions []db.FileVersion
+}
+
+// Reconcile compares every file record with object storage and repairs
+// what a failure left behind, unless dryRun is set, in which case it only
+// reports. Records and objects younger than grace may belong to uploads
+// still running and are left alone. Usage is recounted for every user
+// whose files were repaired.
+//
+// Only the prefixes of users with records are listed, and only objects
+// laid out the way this service names them can be orphans, so objects
+// written by anything else, such as files stored before there were
+// records, are never deleted.
+func (s *Service) Reconcile(ctx context.Context, grace time.Duration, dryRun bool) (ReconcileReport, error) {
+	report := ReconcileReport{StartedAt: time.Now(), DryRun: dryRun, Problems: []Problem{}}
+	cutoff := report.StartedAt.Add(-grace)
+
+	owners := make(map[string]bool)
+	referenced := make(map[string]bool)
+	err := s.store.ScanUploads(ctx, func(u db.Upload) error {
+		owners[u.UserEmail] = true
+		referenced[u.StoragePath] = true
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to list uploads: %v", err)
+	}
+
+	var recorded []recordedFile
+	err = s.store.ScanFiles(ctx, func(file db.File) error {
+		versions, err := s.store.GetFileVersions(ctx, file.UserEmail, file.FileID)
+		if err != nil {
+			return fmt.Errorf("failed to list versions of %s: %v", file.FileID, err)
+		}
+		for _, v := range versions {
+			referenced[v.StoragePath] = true
+		}
+		referenced[file.StoragePath] = true
+		owners[file.UserEmail] = true
+		recorded = append(recorded, recordedFile{file: file, versions: versions})
+		return ctx.Err()
+	})
+	if err != nil {
+		return report, err
+	}
+	report.FilesChecked = len(recorded)
+
+	// Objects are listed after the records are read. Records are always
+	// written before their object, so an object listed here without a
+	// record is either an orphan or newer than the records, and so within
+	// grace.
+	var objects []storage.ObjectInfo
+	for email := range owners {
+		listed, err := s.objects.List(ctx, email+"/")
+		if err != nil {
+			return report, fmt.Errorf("failed to list objects of %s: %v", email, err)
+		}
+		objects = append(objects, listed...)
+	}
+	stored := make(map[string]storage.ObjectInfo, len(objects))
+	for _, o := range objects {
+		stored[o.Key] = o
+	}
+	report.ObjectsChecked = len(objects)
+
+	recount := make(map[string]bool)
+	for _, r := range recorded {
+		for _, p := range s.check(ctx, r.file, r.versions, stored, cutoff, dryRun) {
+			if p.Repaired && p.Kind != ProblemUnfinishedDelete {
+				recount[r.file.UserEmail] = true
+			}
+			report.Problems = append(report.Problems, p)
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+	}
+
+	// Keys of removed records stay referenced for this pass; their objects
+	// are picked up as orphans by the next one
+	for _, o := range objects {
+		if referenced[o.Key] || !o.LastModified.Before(cutoff) || !ownKey(o.Key) {
+			continue
+		}
+		p := Problem{Kind: ProblemOrphanObject, Key: o.Key, Size: o.Size}
+		if !dryRun {
+			err := s.objects.Delete(ctx, o.Key)
+			p.Repaired, p.Error = repaired(err)
+		}
+		report.Problems = append(report.Problems, p)
+	}
+
+	for email := range recount {
+		if err := s.meter.Recount(ctx, email); err != nil {
+			log.Printf("Error recounting usage of user %s: %v", email, err)
+		}
+	}
+
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Kind < report.Problems[j].Kind
+	})
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+// ownKey reports whether key is laid out like the keys this service and
+// uploads write: "<email>/<id>", "<email>/<id>.v<n>" (see VersionKey) or
+// "<email>/uploads/<id>", with IDs that are UUIDs
+func ownKey(key string) bool {
+	_, rest, ok := strings.Cut(key, "/")
+	if !ok {
+		return false
+	}
+	if id, ok := strings.CutPrefix(rest, "uploads/"); ok {
+		return isID(id)
+	}
+	id, version, versioned := strings.Cut(rest, ".v")
+	if versioned {
+		if n, err := strconv.Atoi(version); err != nil || n < 2 || strconv.Itoa(n) != version {
+			return false
+		}
+	}
+	return isID(id)
+}
+
+func isID(s string) bool {
+	id, err := uuid.Parse(s)
+	return err == nil && id.String() == s
+}
+
+// check finds and, unless dryRun is set, repairs the problems of one file
+func (s *Service) check(ctx context.Context, file db.File, versions []db.FileVersion, stored map[string]storage.ObjectInfo, cutoff time.Time, dryRun bool) []Problem {
+	problem := func(kind string, v db.FileVersion) Problem {
+		return Problem{Kind: kind, UserEmail: file.UserEmail, FileID: file.FileID, Version: v.Version, Key: v.StoragePath, Size: v.Size}
+	}
+
+	switch {
+	case file.State == db.FileDeleting:
+		p := problem(ProblemUnfinishedDelete, versionOf(file))
+		if !dryRun {
+			keys := []string{file.StoragePath}
+			for _, v := range versions {
+				keys = append(keys, v.StoragePath)
+			}
+			p.Repaired, p.Error = repaired(s.remove(ctx, file, keys))
+		}
+		return []Problem{p}
+
+	case file.State == db.FilePending:
+		if !file.UploadedAt.Before(cutoff) {
+			return nil
+		}
+		p := problem(ProblemStalePending, versionOf(file))
+		if !dryRun {
+			err := s.store.DeleteFileVersions(ctx, file.UserEmail, file.FileID)
+			if err == nil {
+				err = s.store.DeleteFile(ctx, file.UserEmail, file.FileID)
+			}
+			p.Repaired, p.Error = repaired(err)
+		}
+		return []Problem{p}
+	}
+
+	var problems []Problem
+	var surviving []db.FileVersion
+	for _, v := range versions {
+		if _, ok := stored[v.StoragePath]; ok || !v.UploadedAt.Before(cutoff) {
+			surviving = append(surviving, v)
+			continue
+		}
+		if v.StoragePath == file.StoragePath {
+			continue
+		}
+		p := problem(ProblemMissingVersion, v)
+		if !dryRun {
+			p.Repaired, p.Error = repaired(s.store.DeleteFileVersion(ctx, file.UserEmail, file.FileID, v.Version))
+		}
+		problems = append(problems, p)
+	}
+
+	if _, ok := stored[file.StoragePath]; ok || !file.UploadedAt.Before(cutoff) {
+		return problems
+	}
+	p := problem(ProblemMissingObject, versionOf(file))
+	if !dryRun {
+		p.Repaired, p.Error = repaired(s.fallBack(ctx, file, surviving))
+	}
+	return append(problems, p)
+}
+
+// fallBack makes the newest surviving version of a file whose current
+// content is gone current again, or removes the file if none survived
+func (s *Service) fallBack(ctx context.Context, file db.File, surviving []db.FileVersion) error {
+	// The file may have changed since it was checked
+	current, err := s.store.GetFile(ctx, file.UserEmail, file.FileID)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file metadata: %v", err)
+	}
+	if current.StoragePath != file.StoragePath || !current.Committed() {
+		return fmt.Errorf("file changed while it was checked")
+	}
+
+	var newest *db.FileVersion
+	for i, v := range surviving {
+		if v.StoragePath != file.StoragePath && (newest == nil || v.Version > newest.Version) {
+			newest = &surviving[i]
+		}
+	}
+	if newest == nil {
+		return s.remove(ctx, file, nil)
+	}
+
+	if file.Version > 0 {
+		if err := s.store.DeleteFileVersion(ctx, file.UserEmail, file.FileID, file.Version); err != nil {
+			return fmt.Errorf("failed to delete version: %v", err)
+		}
+	}
+	current.Version = newest.Version
+	current.Size = newest.Size
+	current.ContentType = newest.ContentType
+	current.StoragePath = newest.StoragePath
+	current.UploadedAt = newest.UploadedAt
+	if err := s.store.SaveFileMetadata(ctx, current); err != nil {
+		return fmt.Errorf("failed to save file metadata: %v", err)
+	}
+	log.Printf("File %s of user %s lost its content and fell back to version %d", file.FileID, file.UserEmail, newest.Version)
+	return nil
+}
+
+// RunReconciler calls Reconcile every interval until ctx is cancelled and
+// hands each report to done. Unless repair is set the passes only report.
+func (s *Service) RunReconciler(ctx context.Context, grace, interval time.Duration, repair bool, done func(ReconcileReport)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := s.Reconcile(ctx, grace, !repair)
+		if err != nil {
+			log.Printf("Error reconciling files with object storage: %v", err)
+		} else {
+			if n := len(report.Problems); n > 0 {
+				log.Printf("Reconciled files with object storage: %d problems found", n)
+			}
+			done(report)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func repaired(err error) (bool, string) {
+	if err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
@@ -0,0 +1,127 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud/internal/db"
+	"cloud/internal/quota"
+	"cloud/internal/storage"
+)
+
+// Retention limits how many old versions of a file are kept. A version
+// other than the current one is pruned once it falls outside the newest
+// KeepLast versions or is older than MaxAge. Zero disables a limit.
+type Retention struct {
+	KeepLast int
+	MaxAge   time.Duration
+}
+
+// Enabled reports whether any limit is set
+func (r Retention) Enabled() bool {
+	return r.KeepLast > 0 || r.MaxAge > 0
+}
+
+// RetentionFromEnv reads FILE_VERSIONS_KEEP and FILE_VERSIONS_MAX_AGE_DAYS.
+// Both default to 0, which keeps every version.
+func RetentionFromEnv() (Retention, error) {
+	var r Retention
+	if v := os.Getenv("FILE_VERSIONS_KEEP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return Retention{}, fmt.Errorf("invalid FILE_VERSIONS_KEEP %q", v)
+		}
+		r.KeepLast = n
+	}
+	if v := os.Getenv("FILE_VERSIONS_MAX_AGE_DAYS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return Retention{}, fmt.Errorf("invalid FILE_VERSIONS_MAX_AGE_DAYS %q", v)
+		}
+		r.MaxAge = time.Duration(n) * 24 * time.Hour
+	}
+	return r, nil
+}
+
+// expired returns the versions the retention rule removes. versions must be
+// sorted oldest first; current is never returned.
+func (r Retention) expired(versions []db.FileVersion, current int, now time.Time) []db.FileVersion {
+	var out []db.FileVersion
+	for i, v := range versions {
+		if v.Version == current {
+			continue
+		}
+		newer := len(versions) - 1 - i
+		if (r.KeepLast > 0 && newer >= r.KeepLast) || (r.MaxAge > 0 && now.Sub(v.UploadedAt) > r.MaxAge) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Prune applies the retention rule to every file and returns the number of
+// versions removed
+func (s *Service) Prune(ctx context.Context, r Retention) (int, error) {
+	if !r.Enabled() {
+		return 0, nil
+	}
+
+	now := time.Now()
+	pruned := 0
+	err := s.store.ScanFiles(ctx, func(file db.File) error {
+		// Trashed files keep all their versions until they are purged, and
+		// files being uploaded or deleted are left to the reconciler
+		if !file.Committed() || !file.DeletedAt.IsZero() {
+			return nil
+		}
+		versions, err := s.store.GetFileVersions(ctx, file.UserEmail, file.FileID)
+		if err != nil {
+			return fmt.Errorf("failed to list versions of %s: %v", file.FileID, err)
+		}
+
+		for _, v := range r.expired(versions, file.Version, now) {
+			if v.StoragePath == file.StoragePath {
+				continue
+			}
+			if err := s.objects.Delete(ctx, v.StoragePath); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("Error deleting object of version %d of file %s: %v", v.Version, file.FileID, err)
+				continue
+			}
+			if err := s.meter.Charge(ctx, file.UserEmail, quota.Delta{Versions: -v.Size}); err != nil {
+				log.Printf("Error updating usage for version %d of file %s: %v", v.Version, file.FileID, err)
+			}
+			if err := s.store.DeleteFileVersion(ctx, file.UserEmail, file.FileID, v.Version); err != nil {
+				return fmt.Errorf("failed to delete version %d of %s: %v", v.Version, file.FileID, err)
+			}
+			pruned++
+		}
+		return ctx.Err()
+	})
+	return pruned, err
+}
+
+// RunPruner calls Prune every interval until ctx is cancelled
+func (s *Service) RunPruner(ctx context.Context, r Retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := s.Prune(ctx, r)
+		if err != nil {
+			log.Printf("Error pruning file versions: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d old file versions", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
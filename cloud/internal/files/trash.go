@@ -0,0 +1,141 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud/internal/db"
+	"cloud/internal/quota"
+)
+
+// Trash moves a file to the trash. Its content and versions are kept, and
+// count towards the quota as trash, until it is restored or deleted.
+func (s *Service) Trash(ctx context.Context, userEmail, fileID string) (db.File, error) {
+	file, err := s.Get(ctx, userEmail, fileID)
+	if err != nil {
+		return db.File{}, err
+	}
+	old, err := s.oldVersionBytes(ctx, file)
+	if err != nil {
+		return db.File{}, err
+	}
+
+	file.DeletedAt = time.Now()
+	if err := s.store.SaveFileMetadata(ctx, file); err != nil {
+		return db.File{}, fmt.Errorf("failed to save file metadata: %v", err)
+	}
+	if err := s.meter.Charge(ctx, userEmail, quota.Delta{Files: -file.Size, Versions: -old, Trash: file.Size + old}); err != nil {
+		log.Printf("Error updating usage for trashed file %s: %v", file.FileID, err)
+	}
+
+	log.Printf("Moved file %s of user %s to the trash", file.Filename, userEmail)
+	return file, nil
+}
+
+// Trashed lists the user's files in the trash
+func (s *Service) Trashed(ctx context.Context, userEmail string) ([]db.File, error) {
+	all, err := s.store.GetUserFiles(ctx, userEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+
+	var list []db.File
+	for _, f := range all {
+		if f.Committed() && !f.DeletedAt.IsZero() {
+			list = append(list, f)
+		}
+	}
+	return list, nil
+}
+
+// GetTrashed returns a file in the trash. Files that are not in it are
+// reported as ErrNotFound.
+func (s *Service) GetTrashed(ctx context.Context, userEmail, fileID string) (db.File, error) {
+	file, err := s.record(ctx, userEmail, fileID)
+	if err != nil {
+		return db.File{}, err
+	}
+	if file.DeletedAt.IsZero() {
+		return db.File{}, ErrNotFound
+	}
+	return file, nil
+}
+
+// Untrash restores a file from the trash to its folder, or to the root if
+// the folder has been deleted since. It is renamed if another file has
+// taken its name.
+func (s *Service) Untrash(ctx context.Context, userEmail, fileID string) (db.File, error) {
+	file, err := s.GetTrashed(ctx, userEmail, fileID)
+	if err != nil {
+		return db.File{}, err
+	}
+	old, err := s.oldVersionBytes(ctx, file)
+	if err != nil {
+		return db.File{}, err
+	}
+
+	if file.ParentID != "" {
+		_, err := s.store.GetFolder(ctx, userEmail, file.ParentID)
+		if errors.Is(err, db.ErrNotFound) {
+			file.ParentID = ""
+		} else if err != nil {
+			return db.File{}, fmt.Errorf("failed to read folder: %v", err)
+		}
+	}
+	siblings, err := s.siblings(ctx, userEmail, file.ParentID)
+	if err != nil {
+		return db.File{}, err
+	}
+	if _, ok := siblings[strings.ToLower(file.Filename)]; ok {
+		file.Filename = uniqueName(file.Filename, siblings)
+	}
+
+	file.DeletedAt = time.Time{}
+	if err := s.store.SaveFileMetadata(ctx, file); err != nil {
+		return db.File{}, fmt.Errorf("failed to save file metadata: %v", err)
+	}
+	if err := s.meter.Charge(ctx, userEmail, quota.Delta{Files: file.Size, Versions: old, Trash: -(file.Size + old)}); err != nil {
+		log.Printf("Error updating usage for restored file %s: %v", file.FileID, err)
+	}
+
+	log.Printf("Restored file %s of user %s from the trash", file.Filename, userEmail)
+	return file, nil
+}
+
+// PurgeTrash permanently deletes every file that went into the trash
+// before cutoff and returns how many there were
+func (s *Service) PurgeTrash(ctx context.Context, cutoff time.Time) (int, error) {
+	purged := 0
+	err := s.store.ScanFiles(ctx, func(file db.File) error {
+		if !file.Committed() || file.DeletedAt.IsZero() || !file.DeletedAt.Before(cutoff) {
+			return nil
+		}
+		if _, err := s.Delete(ctx, file.UserEmail, file.FileID); err != nil {
+			log.Printf("Error purging file %s from the trash: %v", file.FileID, err)
+			return nil
+		}
+		purged++
+		return ctx.Err()
+	})
+	return purged, err
+}
+
+// oldVersionBytes adds up the versions of a file other than its current
+// content
+func (s *Service) oldVersionBytes(ctx context.Context, file db.File) (int64, error) {
+	versions, err := s.store.GetFileVersions(ctx, file.UserEmail, file.FileID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list versions: %v", err)
+	}
+	var n int64
+	for _, v := range versions {
+		if v.StoragePath != file.StoragePath {
+			n += v.Size
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,218 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud/internal/db"
+	"cloud/internal/quota"
+	"cloud/internal/storage"
+)
+
+// ErrVersionNotFound is returned when a file exists but the requested
+// version does not (or has been pruned)
+var ErrVersionNotFound = errors.New("file version not found")
+
+// maxVersionAttempts bounds the retries when concurrent uploads race for
+// the same version number
+const maxVersionAttempts = 5
+
+// VersionKey is the object key of one version of a file. Version 1 lives at
+// ObjectKey, so files keep their key until they are first replaced.
+func VersionKey(userEmail, fileID string, version int) string {
+	if version <= 1 {
+		return ObjectKey(userEmail, fileID)
+	}
+	return fmt.Sprintf("%s.v%d", ObjectKey(userEmail, fileID), version)
+}
+
+func versionOf(file db.File) db.FileVersion {
+	return db.FileVersion{
+		UserEmail:   file.UserEmail,
+		FileID:      file.FileID,
+		Version:     file.Version,
+		Size:        file.Size,
+		ContentType: file.ContentType,
+		StoragePath: file.StoragePath,
+		UploadedAt:  file.UploadedAt,
+	}
+}
+
+// Versions lists every stored version of a file, oldest first. Files
+// uploaded before versioning report their current content as version 1.
+func (s *Service) Versions(ctx context.Context, userEmail, fileID string) ([]db.FileVersion, error) {
+	file, err := s.Get(ctx, userEmail, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := s.store.GetFileVersions(ctx, userEmail, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %v", err)
+	}
+	if len(versions) == 0 && file.Version == 0 {
+		file.Version = 1
+		versions = []db.FileVersion{versionOf(file)}
+	}
+	return versions, nil
+}
+
+// OpenVersion returns a version of a file and a handle on its content
+func (s *Service) OpenVersion(ctx context.Context, userEmail, fileID string, version int) (db.File, db.FileVersion, storage.Object, error) {
+	file, err := s.Get(ctx, userEmail, fileID)
+	if err != nil {
+		return db.File{}, db.FileVersion{}, nil, err
+	}
+
+	v, err := s.version(ctx, file, version)
+	if err != nil {
+		return db.File{}, db.FileVersion{}, nil, err
+	}
+
+	object, _, err := s.objects.Get(ctx, v.StoragePath)
+	if errors.Is(err, storage.ErrNotFound) {
+		return db.File{}, db.FileVersion{}, nil, ErrVersionNotFound
+	}
+	if err != nil {
+		return db.File{}, db.FileVersion{}, nil, fmt.Errorf("failed to read object: %v", err)
+	}
+	return file, v, object, nil
+}
+
+func (s *Service) version(ctx context.Context, file db.File, version int) (db.FileVersion, error) {
+	if file.Version == 0 && version == 1 {
+		file.Version = 1
+		return versionOf(file), nil
+	}
+
+	v, err := s.store.GetFileVersion(ctx, file.UserEmail, file.FileID, version)
+	if errors.Is(err, db.ErrNotFound) {
+		return db.FileVersion{}, ErrVersionNotFound
+	}
+	if err != nil {
+		return db.FileVersion{}, fmt.Errorf("failed to read version: %v", err)
+	}
+	return v, nil
+}
+
+// AddVersion stores new content for an existing file. The file keeps its
+// ID, name and folder; the previous content stays available as a version.
+func (s *Service) AddVersion(ctx context.Context, userEmail, fileID string, up Upload) (db.File, error) {
+	file, err := s.Get(ctx, userEmail, fileID)
+	if err != nil {
+		return db.File{}, err
+	}
+	return s.addVersion(ctx, file, up)
+}
+
+// Restore makes the content of an older version current again by copying
+// it into a new version, so no history is lost
+func (s *Service) Restore(ctx context.Context, userEmail, fileID string, version int) (db.File, error) {
+	file, v, object, err := s.OpenVersion(ctx, userEmail, fileID, version)
+	if err != nil {
+		return db.File{}, err
+	}
+	defer object.Close()
+
+	return s.addVersion(ctx, file, Upload{
+		ContentType: v.ContentType,
+		Size:        v.Size,
+		Body:        object,
+	})
+}
+
+func (s *Service) addVersion(ctx context.Context, file db.File, up Upload) (db.File, error) {
+	// Files from before versioning get their current content recorded as
+	// version 1 first
+	if file.Version == 0 {
+		file.Version = 1
+		if err := s.store.SaveFileVersion(ctx, versionOf(file)); err != nil && !errors.Is(err, db.ErrConflict) {
+			return db.File{}, fmt.Errorf("failed to record version 1: %v", err)
+		}
+	}
+
+	// The new content counts as an old version until it becomes current
+	charge := quota.Delta{Versions: up.Size}
+	if err := s.meter.Charge(ctx, file.UserEmail, charge); err != nil {
+		return db.File{}, err
+	}
+
+	// Claim the next version number before writing its object, so racing
+	// uploads can never write to the same key
+	next := db.FileVersion{
+		UserEmail:   file.UserEmail,
+		FileID:      file.FileID,
+		ContentType: up.ContentType,
+		Size:        up.Size,
+		UploadedAt:  time.Now(),
+	}
+	var err error
+	for attempt, latest := 0, file.Version; attempt < maxVersionAttempts; attempt++ {
+		next.Version = latest + 1
+		next.StoragePath = VersionKey(file.UserEmail, file.FileID, next.Version)
+		if up.Object != "" {
+			next.StoragePath = up.Object
+		}
+		if err = s.store.SaveFileVersion(ctx, next); !errors.Is(err, db.ErrConflict) {
+			break
+		}
+		if latest, err = s.latestVersion(ctx, file); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		s.meter.Refund(ctx, file.UserEmail, charge)
+		return db.File{}, fmt.Errorf("failed to record version: %v", err)
+	}
+
+	if next.StoragePath, err = s.put(ctx, next.StoragePath, up); err != nil {
+		s.store.DeleteFileVersion(ctx, file.UserEmail, file.FileID, next.Version)
+		s.meter.Refund(ctx, file.UserEmail, charge)
+		return db.File{}, err
+	}
+
+	// A slower concurrent upload must not move the file back to an older
+	// version
+	current, err := s.Get(ctx, file.UserEmail, file.FileID)
+	if err != nil {
+		return db.File{}, err
+	}
+	if current.Version > next.Version {
+		return current, nil
+	}
+
+	previous := current.Size
+	current.Version = next.Version
+	current.Size = next.Size
+	current.ContentType = next.ContentType
+	current.StoragePath = next.StoragePath
+	current.UploadedAt = next.UploadedAt
+	if err := s.store.SaveFileMetadata(ctx, current); err != nil {
+		return db.File{}, fmt.Errorf("failed to save file metadata: %v", err)
+	}
+	// Swapping which content is current moves bytes between the counts
+	// without changing the total, so it cannot go over the quota
+	if err := s.meter.Charge(ctx, current.UserEmail, quota.Delta{Files: next.Size - previous, Versions: previous - next.Size}); err != nil {
+		log.Printf("Error updating usage for version %d of file %s: %v", next.Version, current.FileID, err)
+	}
+
+	log.Printf("Stored version %d of file %s for user %s", next.Version, current.Filename, current.UserEmail)
+	return current, nil
+}
+
+func (s *Service) latestVersion(ctx context.Context, file db.File) (int, error) {
+	versions, err := s.store.GetFileVersions(ctx, file.UserEmail, file.FileID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list versions: %v", err)
+	}
+	latest := file.Version
+	for _, v := range versions {
+		if v.Version > latest {
+			latest = v.Version
+		}
+	}
+	return latest, nil
+}
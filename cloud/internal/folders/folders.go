@@ -0,0 +1,367 @@
+package folders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"cloud/internal/db"
+)
+
+// RootID names the root folder in URLs. Records store the root as an empty
+// ParentID.
+const RootID = "root"
+
+var (
+	ErrNotFound     = errors.New("folder not found")
+	ErrFileNotFound = errors.New("file not found")
+	ErrInvalidName  = errors.New("invalid folder name")
+	ErrNameTaken    = errors.New("a folder with that name already exists here")
+	ErrNotEmpty     = errors.New("folder is not empty")
+	ErrCycle        = errors.New("cannot move a folder into itself")
+)
+
+// Store is the persistence backend used by Service. db.MetadataStore
+// satisfies it.
+type Store interface {
+	SaveFileMetadata(ctx context.Context, file db.File) error
+	GetFile(ctx context.Context, userEmail, fileID string) (db.File, error)
+	GetUserFiles(ctx context.Context, userEmail string) ([]db.File, error)
+
+	SaveFolder(ctx context.Context, folder db.Folder) error
+	GetFolder(ctx context.Context, userEmail, folderID string) (db.Folder, error)
+	GetUserFolders(ctx context.Context, userEmail string) ([]db.Folder, error)
+	DeleteFolder(ctx context.Context, userEmail, folderID string) error
+}
+
+// Listing is the content of one folder. Folder is nil for the root and Path
+// holds its ancestors, root first.
+type Listing struct {
+	Folder  *db.Folder  `json:"folder"`
+	Path    []db.Folder `json:"path"`
+	Folders []db.Folder `json:"folders"`
+	Files   []db.File   `json:"files"`
+}
+
+// FileRemover moves a file to the trash. *files.Service implements it.
+type FileRemover interface {
+	Trash(ctx context.Context, userEmail, fileID string) (db.File, error)
+}
+
+// Service implements the folder tree on top of a Store. Files are only
+// touched when a folder is deleted together with them, which moves them
+// to the trash.
+type Service struct {
+	store Store
+	files FileRemover
+}
+
+func NewService(store Store, files FileRemover) *Service {
+	return &Service{store: store, files: files}
+}
+
+// tree is a snapshot of a user's folders
+type tree struct {
+	folders  map[string]db.Folder
+	children map[string][]db.Folder
+}
+
+func (s *Service) loadTree(ctx context.Context, userEmail string) (*tree, error) {
+	folders, err := s.store.GetUserFolders(ctx, userEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list folders: %v", err)
+	}
+
+	t := &tree{
+		folders:  make(map[string]db.Folder),
+		children: make(map[string][]db.Folder),
+	}
+	for _, f := range folders {
+		t.folders[f.FolderID] = f
+		t.children[f.ParentID] = append(t.children[f.ParentID], f)
+	}
+	return t, nil
+}
+
+// path returns the ancestors of id, root first
+func (t *tree) path(id string) []db.Folder {
+	var path []db.Folder
+	for parent := t.folders[id].ParentID; parent != ""; parent = t.folders[parent].ParentID {
+		f, ok := t.folders[parent]
+		if !ok || len(path) > len(t.folders) {
+			break
+		}
+		path = append([]db.Folder{f}, path...)
+	}
+	return path
+}
+
+// subtree returns id and every folder below it
+func (t *tree) subtree(id string) []string {
+	ids := []string{id}
+	for i := 0; i < len(ids); i++ {
+		for _, child := range t.children[ids[i]] {
+			ids = append(ids, child.FolderID)
+		}
+	}
+	return ids
+}
+
+func (t *tree) nameTaken(parentID, name, except string) bool {
+	for _, f := range t.children[parentID] {
+		if f.FolderID != except && strings.EqualFold(f.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeID(id string) string {
+	if id == RootID {
+		return ""
+	}
+	return id
+}
+
+func validName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || len(name) > 255 || strings.ContainsAny(name, "/\\") {
+		return "", ErrInvalidName
+	}
+	return name, nil
+}
+
+// ResolveParent checks that parentID names one of the user's folders and
+// returns it in stored form. Empty and RootID both mean the root.
+func (s *Service) ResolveParent(ctx context.Context, userEmail, parentID string) (string, error) {
+	parentID = normalizeID(parentID)
+	if parentID == "" {
+		return "", nil
+	}
+	if _, err := s.store.GetFolder(ctx, userEmail, parentID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("failed to read folder: %v", err)
+	}
+	return parentID, nil
+}
+
+func (s *Service) Create(ctx context.Context, userEmail, parentID, name string) (db.Folder, error) {
+	name, err := validName(name)
+	if err != nil {
+		return db.Folder{}, err
+	}
+
+	t, err := s.loadTree(ctx, userEmail)
+	if err != nil {
+		return db.Folder{}, err
+	}
+	parentID = normalizeID(parentID)
+	if _, ok := t.folders[parentID]; parentID != "" && !ok {
+		return db.Folder{}, ErrNotFound
+	}
+	if t.nameTaken(parentID, name, "") {
+		return db.Folder{}, ErrNameTaken
+	}
+
+	now := time.Now()
+	folder := db.Folder{
+		UserEmail: userEmail,
+		FolderID:  uuid.New().String(),
+		ParentID:  parentID,
+		Name:      name,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.store.SaveFolder(ctx, folder); err != nil {
+		return db.Folder{}, fmt.Errorf("failed to save folder: %v", err)
+	}
+
+	log.Printf("Created folder for user %s: %s", userEmail, name)
+	return folder, nil
+}
+
+// List returns the folders and files directly inside folderID, sorted by
+// name
+func (s *Service) List(ctx context.Context, userEmail, folderID string) (Listing, error) {
+	t, err := s.loadTree(ctx, userEmail)
+	if err != nil {
+		return Listing{}, err
+	}
+
+	folderID = normalizeID(folderID)
+	listing := Listing{
+		Path:    []db.Folder{},
+		Folders: []db.Folder{},
+		Files:   []db.File{},
+	}
+	if folderID != "" {
+		folder, ok := t.folders[folderID]
+		if !ok {
+			return Listing{}, ErrNotFound
+		}
+		listing.Folder = &folder
+		listing.Path = t.path(folderID)
+	}
+
+	listing.Folders = append(listing.Folders, t.children[folderID]...)
+	sort.Slice(listing.Folders, func(i, j int) bool {
+		return strings.ToLower(listing.Folders[i].Name) < strings.ToLower(listing.Folders[j].Name)
+	})
+
+	files, err := s.store.GetUserFiles(ctx, userEmail)
+	if err != nil {
+		return Listing{}, fmt.Errorf("failed to list files: %v", err)
+	}
+	for _, f := range files {
+		if f.ParentID == folderID && f.Committed() && f.DeletedAt.IsZero() {
+			listing.Files = append(listing.Files, f)
+		}
+	}
+	sort.Slice(listing.Files, func(i, j int) bool {
+		return strings.ToLower(listing.Files[i].Filename) < strings.ToLower(listing.Files[j].Filename)
+	})
+
+	return listing, nil
+}
+
+func (s *Service) Rename(ctx context.Context, userEmail, folderID, name string) (db.Folder, error) {
+	name, err := validName(name)
+	if err != nil {
+		return db.Folder{}, err
+	}
+
+	t, err := s.loadTree(ctx, userEmail)
+	if err != nil {
+		return db.Folder{}, err
+	}
+	folder, ok := t.folders[normalizeID(folderID)]
+	if !ok {
+		return db.Folder{}, ErrNotFound
+	}
+	if t.nameTaken(folder.ParentID, name, folder.FolderID) {
+		return db.Folder{}, ErrNameTaken
+	}
+
+	folder.Name = name
+	folder.UpdatedAt = time.Now()
+	if err := s.store.SaveFolder(ctx, folder); err != nil {
+		return db.Folder{}, fmt.Errorf("failed to save folder: %v", err)
+	}
+	return folder, nil
+}
+
+// Move reparents a folder. Its contents come along without being rewritten.
+func (s *Service) Move(ctx context.Context, userEmail, folderID, parentID string) (db.Folder, error) {
+	t, err := s.loadTree(ctx, userEmail)
+	if err != nil {
+		return db.Folder{}, err
+	}
+	folder, ok := t.folders[normalizeID(folderID)]
+	if !ok {
+		return db.Folder{}, ErrNotFound
+	}
+
+	parentID = normalizeID(parentID)
+	if _, ok := t.folders[parentID]; parentID != "" && !ok {
+		return db.Folder{}, ErrNotFound
+	}
+	for id, depth := parentID, 0; id != "" && depth <= len(t.folders); id, depth = t.folders[id].ParentID, depth+1 {
+		if id == folder.FolderID {
+			return db.Folder{}, ErrCycle
+		}
+	}
+	if t.nameTaken(parentID, folder.Name, folder.FolderID) {
+		return db.Folder{}, ErrNameTaken
+	}
+
+	folder.ParentID = parentID
+	folder.UpdatedAt = time.Now()
+	if err := s.store.SaveFolder(ctx, folder); err != nil {
+		return db.Folder{}, fmt.Errorf("failed to save folder: %v", err)
+	}
+	return folder, nil
+}
+
+// MoveFile changes the folder of a file. Only the metadata record changes;
+// the object key does not depend on the folder.
+func (s *Service) MoveFile(ctx context.Context, userEmail, fileID, parentID string) (db.File, error) {
+	file, err := s.store.GetFile(ctx, userEmail, fileID)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && (!file.Committed() || !file.DeletedAt.IsZero())) {
+		return db.File{}, ErrFileNotFound
+	}
+	if err != nil {
+		return db.File{}, fmt.Errorf("failed to read file: %v", err)
+	}
+
+	parentID, err = s.ResolveParent(ctx, userEmail, parentID)
+	if err != nil {
+		return db.File{}, err
+	}
+
+	file.ParentID = parentID
+	if err := s.store.SaveFileMetadata(ctx, file); err != nil {
+		return db.File{}, fmt.Errorf("failed to save file metadata: %v", err)
+	}
+	return file, nil
+}
+
+// Delete removes a folder. Unless recursive is set the folder must be
+// empty; otherwise every folder below it is deleted too and the files are
+// moved to the trash first. The trashed files are returned. Files already
+// in the trash do not keep a folder from being deleted; if they are
+// restored they go back to the root.
+func (s *Service) Delete(ctx context.Context, userEmail, folderID string, recursive bool) ([]db.File, error) {
+	t, err := s.loadTree(ctx, userEmail)
+	if err != nil {
+		return nil, err
+	}
+	folderID = normalizeID(folderID)
+	if _, ok := t.folders[folderID]; !ok {
+		return nil, ErrNotFound
+	}
+
+	ids := t.subtree(folderID)
+	inTree := make(map[string]bool)
+	for _, id := range ids {
+		inTree[id] = true
+	}
+
+	files, err := s.store.GetUserFiles(ctx, userEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+	var removed []db.File
+	for _, f := range files {
+		if inTree[f.ParentID] && f.Committed() && f.DeletedAt.IsZero() {
+			removed = append(removed, f)
+		}
+	}
+
+	if !recursive && (len(ids) > 1 || len(removed) > 0) {
+		return nil, ErrNotEmpty
+	}
+
+	for _, f := range removed {
+		if _, err := s.files.Trash(ctx, userEmail, f.FileID); err != nil {
+			return nil, fmt.Errorf("failed to trash file %s: %v", f.FileID, err)
+		}
+	}
+
+	// Deepest first, so an interrupted delete never leaves orphaned children
+	for i := len(ids) - 1; i >= 0; i-- {
+		if err := s.store.DeleteFolder(ctx, userEmail, ids[i]); err != nil {
+			return nil, fmt.Errorf("failed to delete folder: %v", err)
+		}
+	}
+
+	log.Printf("Deleted folder %s for user %s (%d folders, %d files trashed)", folderID, userEmail, len(ids), len(removed))
+	return removed, nil
+}
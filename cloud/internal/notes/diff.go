@@ -0,0 +1,100 @@
+package notes
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrDiffTooLarge is returned for revisions that differ in too many lines
+// to compare
+var ErrDiffTooLarge = errors.New("revisions differ in too many lines to compare")
+
+// maxDiffCells bounds the LCS table, the product of the numbers of lines
+// left after trimming common ones, which keeps a diff to a few tens of
+// megabytes
+const maxDiffCells = 4 << 20
+
+// DiffOp says how a line changed between two revisions
+type DiffOp string
+
+const (
+	DiffEqual  DiffOp = "equal"
+	DiffInsert DiffOp = "insert"
+	DiffDelete DiffOp = "delete"
+)
+
+// DiffLine is one line of a line based diff
+type DiffLine struct {
+	Op   DiffOp `json:"op"`
+	Text string `json:"text"`
+}
+
+// Diff computes a line based diff turning a into b, using the longest
+// common subsequence of lines. Common leading and trailing lines are
+// trimmed first so typical edits stay cheap; if the rest is still too
+// large it fails with ErrDiffTooLarge.
+func Diff(a, b string) ([]DiffLine, error) {
+	x := splitLines(a)
+	y := splitLines(b)
+
+	var head, tail []DiffLine
+	for len(x) > 0 && len(y) > 0 && x[0] == y[0] {
+		head = append(head, DiffLine{DiffEqual, x[0]})
+		x, y = x[1:], y[1:]
+	}
+	for len(x) > 0 && len(y) > 0 && x[len(x)-1] == y[len(y)-1] {
+		tail = append([]DiffLine{{DiffEqual, x[len(x)-1]}}, tail...)
+		x, y = x[:len(x)-1], y[:len(y)-1]
+	}
+
+	if len(x) > 0 && len(y) > maxDiffCells/len(x) {
+		return nil, ErrDiffTooLarge
+	}
+
+	// lcs[i][j] is the LCS length of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	lines := head
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			lines = append(lines, DiffLine{DiffEqual, x[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, DiffLine{DiffDelete, x[i]})
+			i++
+		default:
+			lines = append(lines, DiffLine{DiffInsert, y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		lines = append(lines, DiffLine{DiffDelete, x[i]})
+	}
+	for ; j < len(y); j++ {
+		lines = append(lines, DiffLine{DiffInsert, y[j]})
+	}
+
+	return append(lines, tail...), nil
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,84 @@
+package notes
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []DiffLine
+	}{
+		{name: "both empty", a: "", b: "", want: nil},
+		{
+			name: "from empty",
+			a:    "",
+			b:    "one\ntwo\n",
+			want: []DiffLine{{DiffInsert, "one"}, {DiffInsert, "two"}},
+		},
+		{
+			name: "to empty",
+			a:    "one",
+			b:    "",
+			want: []DiffLine{{DiffDelete, "one"}},
+		},
+		{
+			name: "changed middle line",
+			a:    "one\ntwo\nthree",
+			b:    "one\n2\nthree",
+			want: []DiffLine{{DiffEqual, "one"}, {DiffDelete, "two"}, {DiffInsert, "2"}, {DiffEqual, "three"}},
+		},
+		{
+			name: "moved line",
+			a:    "a\nb\nc",
+			b:    "b\nc\na",
+			want: []DiffLine{{DiffDelete, "a"}, {DiffEqual, "b"}, {DiffEqual, "c"}, {DiffInsert, "a"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Diff(tt.a, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// lines returns n distinct lines starting with prefix
+func lines(prefix string, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "%s %d\n", prefix, i)
+	}
+	return b.String()
+}
+
+func TestDiffTooLarge(t *testing.T) {
+	// 4096 x 1024 changed lines fill the table exactly
+	if _, err := Diff(lines("a", 4096), lines("b", 1024)); err != nil {
+		t.Fatalf("diff at the limit: %v", err)
+	}
+	if _, err := Diff(lines("a", 4096), lines("b", 1025)); !errors.Is(err, ErrDiffTooLarge) {
+		t.Fatalf("diff over the limit: got %v, want ErrDiffTooLarge", err)
+	}
+
+	// Common lines are trimmed before the table is sized
+	same := lines("same", 100000)
+	got, err := Diff(same+"old\n", same+"new\n")
+	if err != nil {
+		t.Fatalf("large note with a small change: %v", err)
+	}
+	if n := len(got); n != 100002 {
+		t.Fatalf("got %d lines, want 100002", n)
+	}
+}
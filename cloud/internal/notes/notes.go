@@ -1,149 +1,365 @@
 package notes
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
-	"sync"
+	"sort"
 	"time"
 
 	"github.com/google/uuid"
+
+	"cloud/internal/db"
+)
+
+var (
+	// ErrNotFound is returned when a note does not exist for the user
+	ErrNotFound = errors.New("note not found")
+
+	// ErrTrashed is returned for notes in the trash. It matches
+	// ErrNotFound, so trashed notes are hidden from everything but the
+	// trash.
+	ErrTrashed = fmt.Errorf("%w: it is in the trash", ErrNotFound)
 )
 
+// AnyVersion disables the version precondition on Update and Delete
+const AnyVersion = -1
+
+// ConflictError is returned when a note has changed since the version the
+// caller started from. Current holds the server copy.
+type ConflictError struct {
+	Current Note
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("note %s has changed (now at version %d)", e.Current.ID, e.Current.Version)
+}
+
+// Note is the representation of a note exchanged with clients. Version is
+// incremented on every save and is served as the note's ETag. DeletedAt is
+// only set on notes in the trash.
 type Note struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Title     string    `json:"title"`
-	Content   string    `json:"content"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        string     `json:"id"`
+	Title     string     `json:"title"`
+	Content   string     `json:"content"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	Version   int        `json:"version"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
 }
 
-var (
-	notesLock sync.RWMutex
+// Store is the persistence backend used by Service. db.MetadataStore
+// satisfies it.
+type Store interface {
+	SaveNote(ctx context.Context, note db.Note) error
+	GetNote(ctx context.Context, userEmail, noteID string) (db.Note, error)
+	GetUserNotes(ctx context.Context, userEmail string) ([]db.Note, error)
+	UpdateNote(ctx context.Context, note db.Note, expectedVersion int) error
+	DeleteNote(ctx context.Context, userEmail, noteID string, expectedVersion int) error
+	ScanNotes(ctx context.Context, fn func(db.Note) error) error
+
+	SaveNoteRevision(ctx context.Context, rev db.NoteRevision) error
+	GetNoteRevision(ctx context.Context, userEmail, noteID string, revision int) (db.NoteRevision, error)
+	GetNoteRevisions(ctx context.Context, userEmail, noteID string) ([]db.NoteRevision, error)
+	LatestNoteRevision(ctx context.Context, userEmail, noteID string) (int, error)
+	DeleteNoteRevisions(ctx context.Context, userEmail, noteID string) error
+}
+
+// ChangeKind says what happened to a note
+type ChangeKind string
+
+const (
+	NoteSaved   ChangeKind = "saved"
+	NoteDeleted ChangeKind = "deleted"
 )
 
-func getUserNotesPath(userID string) string {
-	return filepath.Join("notes", userID)
+// Change is passed to OnChange listeners after a note is written
+type Change struct {
+	Kind      ChangeKind
+	UserEmail string
+	Note      Note
 }
 
-func CreateNote(note Note) (*Note, error) {
-	notesLock.Lock()
-	defer notesLock.Unlock()
+// Service implements note operations on top of a Store
+type Service struct {
+	store     Store
+	listeners []func(Change)
+}
 
-	// Create user-specific notes directory
-	userDir := getUserNotesPath(note.UserID)
-	if err := os.MkdirAll(userDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create user notes directory: %v", err)
-	}
+func NewService(store Store) *Service {
+	return &Service{store: store}
+}
 
-	// Generate unique note ID
-	note.ID = uuid.New().String()
-	note.CreatedAt = time.Now()
-	note.UpdatedAt = time.Now()
+// OnChange registers fn to be called after every successful create, update
+// and delete. Listeners run synchronously on the caller's goroutine and
+// must be registered before the service is used.
+func (s *Service) OnChange(fn func(Change)) {
+	s.listeners = append(s.listeners, fn)
+}
 
-	// Save note to file
-	filePath := filepath.Join(userDir, note.ID+".json")
-	noteJSON, err := json.Marshal(note)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal note: %v", err)
+func (s *Service) notify(kind ChangeKind, userEmail string, note Note) {
+	for _, fn := range s.listeners {
+		fn(Change{Kind: kind, UserEmail: userEmail, Note: note})
 	}
+}
 
-	if err := os.WriteFile(filePath, noteJSON, 0644); err != nil {
-		return nil, fmt.Errorf("failed to save note: %v", err)
+func fromRecord(n db.Note) Note {
+	note := Note{
+		ID:        n.NoteID,
+		Title:     n.Title,
+		Content:   n.Content,
+		CreatedAt: n.CreatedAt,
+		UpdatedAt: n.UpdatedAt,
+		Version:   n.Version,
+	}
+	if !n.DeletedAt.IsZero() {
+		deleted := n.DeletedAt
+		note.DeletedAt = &deleted
 	}
+	return note
+}
 
-	log.Printf("Created note for user %s: %s", note.UserID, note.Title)
-	return &note, nil
+func toRecord(userEmail string, n Note) db.Note {
+	record := db.Note{
+		UserEmail: userEmail,
+		NoteID:    n.ID,
+		Title:     n.Title,
+		Content:   n.Content,
+		CreatedAt: n.CreatedAt,
+		UpdatedAt: n.UpdatedAt,
+		Version:   n.Version,
+	}
+	if n.DeletedAt != nil {
+		record.DeletedAt = *n.DeletedAt
+	}
+	return record
 }
 
-func ListUserNotes(userID string) ([]Note, error) {
-	notesLock.RLock()
-	defer notesLock.RUnlock()
+func (s *Service) Create(ctx context.Context, userEmail string, note Note) (Note, error) {
+	now := time.Now()
+	note.ID = uuid.New().String()
+	note.CreatedAt = now
+	note.UpdatedAt = now
+	note.Version = 1
 
-	userDir := getUserNotesPath(userID)
+	if err := s.store.SaveNote(ctx, toRecord(userEmail, note)); err != nil {
+		return Note{}, fmt.Errorf("failed to save note: %v", err)
+	}
 
-	// Check if directory exists
-	if _, err := os.Stat(userDir); os.IsNotExist(err) {
-		return []Note{}, nil
+	if err := s.recordRevision(ctx, userEmail, userEmail, nil, note); err != nil {
+		log.Printf("Error recording revision of note %s: %v", note.ID, err)
 	}
 
-	files, err := os.ReadDir(userDir)
+	log.Printf("Created note for user %s: %s", userEmail, note.Title)
+	s.notify(NoteSaved, userEmail, note)
+	return note, nil
+}
+
+// Get returns a note that is not in the trash
+func (s *Service) Get(ctx context.Context, userEmail, noteID string) (Note, error) {
+	note, err := s.record(ctx, userEmail, noteID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list notes: %v", err)
+		return Note{}, err
+	}
+	if note.DeletedAt != nil {
+		return Note{}, ErrTrashed
 	}
+	return note, nil
+}
 
-	var notes []Note
-	for _, file := range files {
-		if !file.IsDir() && filepath.Ext(file.Name()) == ".json" {
-			filePath := filepath.Join(userDir, file.Name())
-			noteData, err := os.ReadFile(filePath)
-			if err != nil {
-				log.Printf("Error reading note file: %v", err)
-				continue
-			}
+// record returns a note whether or not it is in the trash
+func (s *Service) record(ctx context.Context, userEmail, noteID string) (Note, error) {
+	record, err := s.store.GetNote(ctx, userEmail, noteID)
+	if errors.Is(err, db.ErrNotFound) {
+		return Note{}, ErrNotFound
+	}
+	if err != nil {
+		return Note{}, fmt.Errorf("failed to read note: %v", err)
+	}
+	return fromRecord(record), nil
+}
 
-			var note Note
-			if err := json.Unmarshal(noteData, &note); err != nil {
-				log.Printf("Error unmarshaling note: %v", err)
-				continue
-			}
+// List returns the user's notes that are not in the trash, most recently
+// updated first
+func (s *Service) List(ctx context.Context, userEmail string) ([]Note, error) {
+	records, err := s.store.GetUserNotes(ctx, userEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list notes: %v", err)
+	}
 
-			notes = append(notes, note)
+	notes := make([]Note, 0, len(records))
+	for _, record := range records {
+		if record.DeletedAt.IsZero() {
+			notes = append(notes, fromRecord(record))
 		}
 	}
 
+	sort.Slice(notes, func(i, j int) bool {
+		return notes[i].UpdatedAt.After(notes[j].UpdatedAt)
+	})
 	return notes, nil
 }
 
-func UpdateNote(noteID, userID string, updatedNote Note) (*Note, error) {
-	notesLock.Lock()
-	defer notesLock.Unlock()
+// maxUpdateAttempts bounds retries of unconditional writes that keep losing
+// the compare-and-set race
+const maxUpdateAttempts = 5
 
-	filePath := filepath.Join(getUserNotesPath(userID), noteID+".json")
+// Update replaces the title and content of an existing note and records the
+// result as a new revision. Unless expectedVersion is AnyVersion the update
+// only applies if the note is still at that version; otherwise it fails with
+// a *ConflictError carrying the current note.
+func (s *Service) Update(ctx context.Context, userEmail, noteID string, updated Note, expectedVersion int) (Note, error) {
+	return s.UpdateAs(ctx, userEmail, userEmail, noteID, updated, expectedVersion)
+}
 
-	// Read existing note
-	noteData, err := os.ReadFile(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("note not found: %v", err)
+// UpdateAs is Update made by author, who may be someone the note is shared
+// with rather than its owner. The revision records author.
+func (s *Service) UpdateAs(ctx context.Context, userEmail, author, noteID string, updated Note, expectedVersion int) (Note, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		note, err := s.Get(ctx, userEmail, noteID)
+		if err != nil {
+			return Note{}, err
+		}
+		if expectedVersion != AnyVersion && note.Version != expectedVersion {
+			return Note{}, &ConflictError{Current: note}
+		}
+		previous := note
+
+		note.Title = updated.Title
+		note.Content = updated.Content
+		note.UpdatedAt = time.Now()
+		note.Version = previous.Version + 1
+
+		err = s.store.UpdateNote(ctx, toRecord(userEmail, note), previous.Version)
+		if errors.Is(err, db.ErrConflict) {
+			// Someone saved between our read and write; re-read and either
+			// report the conflict or retry
+			continue
+		}
+		if err != nil {
+			return Note{}, fmt.Errorf("failed to save updated note: %v", err)
+		}
+
+		if err := s.recordRevision(ctx, userEmail, author, &previous, note); err != nil {
+			log.Printf("Error recording revision of note %s: %v", noteID, err)
+		}
+
+		log.Printf("Updated note %s for user %s by %s", noteID, userEmail, author)
+		s.notify(NoteSaved, userEmail, note)
+		return note, nil
 	}
+	return Note{}, fmt.Errorf("failed to save updated note: too many concurrent updates")
+}
 
-	var existingNote Note
-	if err := json.Unmarshal(noteData, &existingNote); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal note: %v", err)
+// Delete permanently removes a note and its history, from the trash or
+// not. expectedVersion works as in Update.
+func (s *Service) Delete(ctx context.Context, userEmail, noteID string, expectedVersion int) error {
+	var note Note
+	for attempt := 0; ; attempt++ {
+		var err error
+		note, err = s.record(ctx, userEmail, noteID)
+		if err != nil {
+			return err
+		}
+		if expectedVersion != AnyVersion && note.Version != expectedVersion {
+			return &ConflictError{Current: note}
+		}
+
+		err = s.store.DeleteNote(ctx, userEmail, noteID, note.Version)
+		if errors.Is(err, db.ErrConflict) && attempt < maxUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete note: %v", err)
+		}
+		break
+	}
+	if err := s.store.DeleteNoteRevisions(ctx, userEmail, noteID); err != nil {
+		log.Printf("Error deleting revisions of note %s: %v", noteID, err)
 	}
 
-	// Update note fields
-	existingNote.Title = updatedNote.Title
-	existingNote.Content = updatedNote.Content
-	existingNote.UpdatedAt = time.Now()
+	log.Printf("Deleted note %s for user %s", noteID, userEmail)
+	s.notify(NoteDeleted, userEmail, note)
+	return nil
+}
 
-	// Save updated note
-	updatedNoteJSON, err := json.Marshal(existingNote)
+// ImportDir copies notes written by the old file based handlers
+// (<dir>/<email>/<id>.json) into the store. Each file is renamed to
+// <id>.json.imported once its note is in the store, so notes deleted later
+// do not come back on the next start. Notes already present in the store
+// are left untouched.
+func (s *Service) ImportDir(ctx context.Context, dir string) (int, error) {
+	users, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal updated note: %v", err)
+		return 0, fmt.Errorf("failed to read notes directory: %v", err)
 	}
 
-	if err := os.WriteFile(filePath, updatedNoteJSON, 0644); err != nil {
-		return nil, fmt.Errorf("failed to save updated note: %v", err)
-	}
+	imported := 0
+	for _, user := range users {
+		if !user.IsDir() {
+			continue
+		}
+		userEmail := user.Name()
 
-	log.Printf("Updated note %s for user %s", noteID, userID)
-	return &existingNote, nil
-}
+		files, err := os.ReadDir(filepath.Join(dir, userEmail))
+		if err != nil {
+			return imported, fmt.Errorf("failed to list notes: %v", err)
+		}
+
+		for _, file := range files {
+			if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+				continue
+			}
 
-func DeleteNote(noteID, userID string) error {
-	notesLock.Lock()
-	defer notesLock.Unlock()
+			path := filepath.Join(dir, userEmail, file.Name())
+			noteData, err := os.ReadFile(path)
+			if err != nil {
+				log.Printf("Error reading note file: %v", err)
+				continue
+			}
 
-	filePath := filepath.Join(getUserNotesPath(userID), noteID+".json")
+			var note Note
+			if err := json.Unmarshal(noteData, &note); err != nil || note.ID == "" {
+				log.Printf("Skipping unreadable note file %s", file.Name())
+				continue
+			}
 
-	if err := os.Remove(filePath); err != nil {
-		return fmt.Errorf("failed to delete note: %v", err)
+			if _, err := s.store.GetNote(ctx, userEmail, note.ID); err == nil {
+				markImported(path)
+				continue
+			} else if !errors.Is(err, db.ErrNotFound) {
+				return imported, fmt.Errorf("failed to read note: %v", err)
+			}
+
+			// Old notes have no version; start them at 1 like new ones
+			if note.Version < 1 {
+				note.Version = 1
+			}
+			if err := s.store.SaveNote(ctx, toRecord(userEmail, note)); err != nil {
+				return imported, fmt.Errorf("failed to save note: %v", err)
+			}
+			if err := s.recordRevision(ctx, userEmail, userEmail, nil, note); err != nil {
+				log.Printf("Error recording revision of note %s: %v", note.ID, err)
+			}
+			markImported(path)
+			s.notify(NoteSaved, userEmail, note)
+			imported++
+		}
 	}
 
-	log.Printf("Deleted note %s for user %s", noteID, userID)
-	return nil
+	return imported, nil
+}
+
+// markImported renames an imported note file out of ImportDir's way
+func markImported(path string) {
+	if err := os.Rename(path, path+".imported"); err != nil {
+		log.Printf("Error marking note file %s imported: %v", path, err)
+	}
 }
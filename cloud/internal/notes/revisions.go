@@ -0,0 +1,167 @@
+package notes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud/internal/db"
+)
+
+// ErrRevisionNotFound is returned when a note has no such revision
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// Revision is an immutable snapshot of a note, recorded on every save
+type Revision struct {
+	Revision    int       `json:"revision"`
+	Title       string    `json:"title"`
+	Content     string    `json:"content,omitempty"`
+	Author      string    `json:"author"`
+	ContentHash string    `json:"contentHash"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func revisionFromRecord(r db.NoteRevision) Revision {
+	return Revision{
+		Revision:    r.Revision,
+		Title:       r.Title,
+		Content:     r.Content,
+		Author:      r.Author,
+		ContentHash: r.ContentHash,
+		CreatedAt:   r.CreatedAt,
+	}
+}
+
+func contentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordRevision appends a snapshot of note to its history. Notes created
+// before revisions existed get their previous state recorded first so the
+// first edit does not lose it.
+func (s *Service) recordRevision(ctx context.Context, userEmail, author string, previous *Note, note Note) error {
+	for attempt := 0; attempt < 3; attempt++ {
+		latest, err := s.store.LatestNoteRevision(ctx, userEmail, note.ID)
+		if err != nil {
+			return err
+		}
+
+		next := 1
+		if latest > 0 {
+			next = latest + 1
+		} else if previous != nil {
+			err := s.store.SaveNoteRevision(ctx, db.NoteRevision{
+				UserEmail:   userEmail,
+				NoteID:      note.ID,
+				Revision:    1,
+				Title:       previous.Title,
+				Content:     previous.Content,
+				Author:      userEmail,
+				ContentHash: contentHash(previous.Content),
+				CreatedAt:   previous.UpdatedAt,
+			})
+			if errors.Is(err, db.ErrConflict) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			next = 2
+		}
+
+		err = s.store.SaveNoteRevision(ctx, db.NoteRevision{
+			UserEmail:   userEmail,
+			NoteID:      note.ID,
+			Revision:    next,
+			Title:       note.Title,
+			Content:     note.Content,
+			Author:      author,
+			ContentHash: contentHash(note.Content),
+			CreatedAt:   note.UpdatedAt,
+		})
+		if !errors.Is(err, db.ErrConflict) {
+			return err
+		}
+		// Another save took this revision number; reload and try again
+	}
+	return fmt.Errorf("too many concurrent revisions")
+}
+
+// Revisions lists a note's history oldest first, without content
+func (s *Service) Revisions(ctx context.Context, userEmail, noteID string) ([]Revision, error) {
+	if _, err := s.Get(ctx, userEmail, noteID); err != nil {
+		return nil, err
+	}
+
+	records, err := s.store.GetNoteRevisions(ctx, userEmail, noteID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list revisions: %v", err)
+	}
+
+	revs := make([]Revision, 0, len(records))
+	for _, record := range records {
+		rev := revisionFromRecord(record)
+		rev.Content = ""
+		revs = append(revs, rev)
+	}
+	return revs, nil
+}
+
+// Revision returns a single revision including its content
+func (s *Service) Revision(ctx context.Context, userEmail, noteID string, revision int) (Revision, error) {
+	if _, err := s.Get(ctx, userEmail, noteID); err != nil {
+		return Revision{}, err
+	}
+
+	record, err := s.store.GetNoteRevision(ctx, userEmail, noteID, revision)
+	if errors.Is(err, db.ErrNotFound) {
+		return Revision{}, ErrRevisionNotFound
+	}
+	if err != nil {
+		return Revision{}, fmt.Errorf("failed to read revision: %v", err)
+	}
+	return revisionFromRecord(record), nil
+}
+
+// DiffRevisions compares the content of two revisions line by line
+func (s *Service) DiffRevisions(ctx context.Context, userEmail, noteID string, from, to int) ([]DiffLine, error) {
+	a, err := s.Revision(ctx, userEmail, noteID, from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.Revision(ctx, userEmail, noteID, to)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(a.Content, b.Content)
+}
+
+// LatestRevision returns the newest revision number of a note, or 0 if it
+// has no history yet
+func (s *Service) LatestRevision(ctx context.Context, userEmail, noteID string) (int, error) {
+	latest, err := s.store.LatestNoteRevision(ctx, userEmail, noteID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read latest revision: %v", err)
+	}
+	return latest, nil
+}
+
+// Restore saves the title and content of an old revision as the note's
+// current state. The restore itself is recorded as a new revision.
+// expectedVersion works as in Update.
+func (s *Service) Restore(ctx context.Context, userEmail, noteID string, revision, expectedVersion int) (Note, error) {
+	return s.RestoreAs(ctx, userEmail, userEmail, noteID, revision, expectedVersion)
+}
+
+// RestoreAs is Restore made by author, as in UpdateAs
+func (s *Service) RestoreAs(ctx context.Context, userEmail, author, noteID string, revision, expectedVersion int) (Note, error) {
+	rev, err := s.Revision(ctx, userEmail, noteID, revision)
+	if err != nil {
+		return Note{}, err
+	}
+	return s.UpdateAs(ctx, userEmail, author, noteID, Note{Title: rev.Title, Content: rev.Content}, expectedVersion)
+}
@@ -0,0 +1,122 @@
+package notes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"cloud/internal/db"
+)
+
+// Trash moves a note to the trash. expectedVersion works as in Update.
+// Listeners see it deleted; the note and its history are kept until it is
+// restored or deleted for good.
+func (s *Service) Trash(ctx context.Context, userEmail, noteID string, expectedVersion int) (Note, error) {
+	return s.setTrashed(ctx, userEmail, noteID, expectedVersion, true)
+}
+
+// Untrash restores a note from the trash. Listeners see it saved again.
+func (s *Service) Untrash(ctx context.Context, userEmail, noteID string) (Note, error) {
+	return s.setTrashed(ctx, userEmail, noteID, AnyVersion, false)
+}
+
+// setTrashed moves a note in or out of the trash. The version is bumped
+// so that an edit racing with the move fails its compare-and-set instead
+// of bringing a trashed note back.
+func (s *Service) setTrashed(ctx context.Context, userEmail, noteID string, expectedVersion int, trashed bool) (Note, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var note Note
+		var err error
+		if trashed {
+			note, err = s.Get(ctx, userEmail, noteID)
+		} else {
+			note, err = s.GetTrashed(ctx, userEmail, noteID)
+		}
+		if err != nil {
+			return Note{}, err
+		}
+		if expectedVersion != AnyVersion && note.Version != expectedVersion {
+			return Note{}, &ConflictError{Current: note}
+		}
+		previous := note.Version
+
+		note.Version++
+		note.DeletedAt = nil
+		if trashed {
+			now := time.Now()
+			note.DeletedAt = &now
+		}
+
+		err = s.store.UpdateNote(ctx, toRecord(userEmail, note), previous)
+		if errors.Is(err, db.ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return Note{}, fmt.Errorf("failed to save note: %v", err)
+		}
+
+		if trashed {
+			log.Printf("Moved note %s of user %s to the trash", noteID, userEmail)
+			s.notify(NoteDeleted, userEmail, note)
+		} else {
+			log.Printf("Restored note %s of user %s from the trash", noteID, userEmail)
+			s.notify(NoteSaved, userEmail, note)
+		}
+		return note, nil
+	}
+	return Note{}, fmt.Errorf("failed to save note: too many concurrent updates")
+}
+
+// Trashed lists the user's notes in the trash, most recently trashed first
+func (s *Service) Trashed(ctx context.Context, userEmail string) ([]Note, error) {
+	records, err := s.store.GetUserNotes(ctx, userEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list notes: %v", err)
+	}
+
+	var notes []Note
+	for _, record := range records {
+		if !record.DeletedAt.IsZero() {
+			notes = append(notes, fromRecord(record))
+		}
+	}
+
+	sort.Slice(notes, func(i, j int) bool {
+		return notes[i].DeletedAt.After(*notes[j].DeletedAt)
+	})
+	return notes, nil
+}
+
+// GetTrashed returns a note in the trash. Notes that are not in it are
+// reported as ErrNotFound.
+func (s *Service) GetTrashed(ctx context.Context, userEmail, noteID string) (Note, error) {
+	note, err := s.record(ctx, userEmail, noteID)
+	if err != nil {
+		return Note{}, err
+	}
+	if note.DeletedAt == nil {
+		return Note{}, ErrNotFound
+	}
+	return note, nil
+}
+
+// PurgeTrash permanently deletes every note that went into the trash
+// before cutoff and returns how many there were
+func (s *Service) PurgeTrash(ctx context.Context, cutoff time.Time) (int, error) {
+	purged := 0
+	err := s.store.ScanNotes(ctx, func(note db.Note) error {
+		if note.DeletedAt.IsZero() || !note.DeletedAt.Before(cutoff) {
+			return nil
+		}
+		if err := s.Delete(ctx, note.UserEmail, note.NoteID, note.Version); err != nil {
+			log.Printf("Error purging note %s from the trash: %v", note.NoteID, err)
+			return nil
+		}
+		purged++
+		return ctx.Err()
+	})
+	return purged, err
+}
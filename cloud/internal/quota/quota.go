@@ -0,0 +1,336 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud/internal/db"
+)
+
+var (
+	ErrExceeded    = errors.New("storage quota exceeded")
+	ErrInvalidSize = errors.New("invalid size")
+)
+
+// maxAttempts bounds the retries when concurrent changes race to update
+// the same usage
+const maxAttempts = 10
+
+// Unlimited is the quota of users without a storage limit
+const Unlimited int64 = -1
+
+// Store is the persistence backend used by Service. db.MetadataStore
+// satisfies it.
+type Store interface {
+	GetUsage(ctx context.Context, userEmail string) (db.Usage, error)
+	UpdateUsage(ctx context.Context, usage db.Usage, expectedRevision int) error
+	SetQuota(ctx context.Context, userEmail string, quota int64) error
+
+	GetUserFiles(ctx context.Context, userEmail string) ([]db.File, error)
+	GetFileVersions(ctx context.Context, userEmail, fileID string) ([]db.FileVersion, error)
+}
+
+// Delta is a change to the bytes a user stores
+type Delta struct {
+	Files    int64
+	Versions int64
+	Trash    int64
+}
+
+func (d Delta) total() int64 {
+	return d.Files + d.Versions + d.Trash
+}
+
+// Report is a user's usage as shown to clients. Quota and Available are
+// null for users without a limit.
+type Report struct {
+	Files     int64  `json:"files"`
+	Versions  int64  `json:"versions"`
+	Trash     int64  `json:"trash"`
+	Used      int64  `json:"used"`
+	Quota     *int64 `json:"quota"`
+	Available *int64 `json:"available"`
+}
+
+// Service keeps count of the bytes each user stores and enforces their
+// quota. Counts are kept up to date as content is added and removed;
+// users from before quotas are counted from their files the first time
+// their usage is needed.
+type Service struct {
+	store Store
+	limit int64
+}
+
+// NewService enforces limit on users without a quota of their own. A limit
+// of 0 means no limit.
+func NewService(store Store, limit int64) *Service {
+	return &Service{store: store, limit: limit}
+}
+
+// LimitFromEnv reads STORAGE_QUOTA, the default quota, as a size such as
+// "5GB". It defaults to no limit.
+func LimitFromEnv() (int64, error) {
+	v := os.Getenv("STORAGE_QUOTA")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := ParseSize(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid STORAGE_QUOTA %q", v)
+	}
+	return n, nil
+}
+
+var units = map[string]int64{
+	"":   1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// ParseSize reads a byte count with an optional KB, MB, GB or TB suffix,
+// which are powers of 1024
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := units[strings.TrimSpace(s[i:])]
+	if i == 0 || !ok {
+		return 0, ErrInvalidSize
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil || n > (1<<63-1)/unit {
+		return 0, ErrInvalidSize
+	}
+	return n * unit, nil
+}
+
+// usage returns the stored usage of a user, counting it first if it has
+// never been counted
+func (s *Service) usage(ctx context.Context, userEmail string) (db.Usage, error) {
+	u, err := s.store.GetUsage(ctx, userEmail)
+	if errors.Is(err, db.ErrNotFound) {
+		u, err = db.Usage{UserEmail: userEmail}, nil
+	}
+	if err != nil {
+		return db.Usage{}, fmt.Errorf("failed to read usage: %v", err)
+	}
+	if u.Revision > 0 {
+		return u, nil
+	}
+
+	counted, err := s.count(ctx, userEmail)
+	if err != nil {
+		return db.Usage{}, err
+	}
+	counted.Quota = u.Quota
+	counted.Revision = 1
+	counted.UpdatedAt = time.Now()
+	err = s.store.UpdateUsage(ctx, counted, 0)
+	if errors.Is(err, db.ErrConflict) {
+		// Counted concurrently; use theirs
+		counted, err = s.store.GetUsage(ctx, userEmail)
+	}
+	if err != nil {
+		return db.Usage{}, fmt.Errorf("failed to save usage: %v", err)
+	}
+	return counted, nil
+}
+
+// count adds up the bytes held by a user's files, their older versions and
+// the trash
+func (s *Service) count(ctx context.Context, userEmail string) (db.Usage, error) {
+	all, err := s.store.GetUserFiles(ctx, userEmail)
+	if err != nil {
+		return db.Usage{}, fmt.Errorf("failed to list files: %v", err)
+	}
+
+	u := db.Usage{UserEmail: userEmail}
+	for _, f := range all {
+		// Deletes give the space back before the content is removed
+		if f.State == db.FileDeleting {
+			continue
+		}
+		versions, err := s.store.GetFileVersions(ctx, userEmail, f.FileID)
+		if err != nil {
+			return db.Usage{}, fmt.Errorf("failed to list versions: %v", err)
+		}
+		var old int64
+		for _, v := range versions {
+			if v.Version != f.Version && v.StoragePath != f.StoragePath {
+				old += v.Size
+			}
+		}
+
+		if f.DeletedAt.IsZero() {
+			u.FileBytes += f.Size
+			u.VersionBytes += old
+		} else {
+			u.TrashBytes += f.Size + old
+		}
+	}
+	return u, nil
+}
+
+// Limit returns a user's quota in bytes, or Unlimited
+func (s *Service) Limit(ctx context.Context, userEmail string) (int64, error) {
+	u, err := s.store.GetUsage(ctx, userEmail)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return 0, fmt.Errorf("failed to read usage: %v", err)
+	}
+	return s.limitOf(u), nil
+}
+
+func (s *Service) limitOf(u db.Usage) int64 {
+	switch {
+	case u.Quota != 0:
+		return u.Quota
+	case s.limit > 0:
+		return s.limit
+	}
+	return Unlimited
+}
+
+// Check fails with ErrExceeded if storing size more bytes would take the
+// user over their quota. It reserves nothing, so Charge can still fail.
+func (s *Service) Check(ctx context.Context, userEmail string, size int64) error {
+	u, err := s.usage(ctx, userEmail)
+	if err != nil {
+		return err
+	}
+	if limit := s.limitOf(u); limit >= 0 && used(u)+size > limit {
+		return ErrExceeded
+	}
+	return nil
+}
+
+// Charge applies d to a user's usage. Changes that add bytes fail with
+// ErrExceeded if they would take the user over their quota; freeing space
+// always succeeds. Concurrent changes are applied with a compare-and-set,
+// so two uploads cannot both take the last of the space.
+func (s *Service) Charge(ctx context.Context, userEmail string, d Delta) error {
+	return s.apply(ctx, userEmail, d, true)
+}
+
+// Refund undoes a charge after the change it paid for failed. Giving back
+// freed space is not checked against the quota, since it was in use a
+// moment ago. Failures are only logged; the caller is already handling an
+// error.
+func (s *Service) Refund(ctx context.Context, userEmail string, d Delta) {
+	refund := Delta{Files: -d.Files, Versions: -d.Versions, Trash: -d.Trash}
+	if err := s.apply(ctx, userEmail, refund, false); err != nil {
+		log.Printf("Error refunding %d bytes to user %s: %v", d.total(), userEmail, err)
+	}
+}
+
+func (s *Service) apply(ctx context.Context, userEmail string, d Delta, enforce bool) error {
+	if d == (Delta{}) {
+		return nil
+	}
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		u, err := s.usage(ctx, userEmail)
+		if err != nil {
+			return err
+		}
+		if limit := s.limitOf(u); enforce && d.total() > 0 && limit >= 0 && used(u)+d.total() > limit {
+			return ErrExceeded
+		}
+
+		expected := u.Revision
+		u.FileBytes = nonNegative(u.FileBytes + d.Files)
+		u.VersionBytes = nonNegative(u.VersionBytes + d.Versions)
+		u.TrashBytes = nonNegative(u.TrashBytes + d.Trash)
+		u.Revision++
+		u.UpdatedAt = time.Now()
+
+		err = s.store.UpdateUsage(ctx, u, expected)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, db.ErrConflict) {
+			return fmt.Errorf("failed to save usage: %v", err)
+		}
+	}
+	return fmt.Errorf("failed to save usage: %v", db.ErrConflict)
+}
+
+// Recount replaces a user's usage with a fresh count of their files, for
+// when the running count may have drifted from what is stored
+func (s *Service) Recount(ctx context.Context, userEmail string) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		u, err := s.usage(ctx, userEmail)
+		if err != nil {
+			return err
+		}
+		counted, err := s.count(ctx, userEmail)
+		if err != nil {
+			return err
+		}
+		counted.Quota = u.Quota
+		counted.Revision = u.Revision + 1
+		counted.UpdatedAt = time.Now()
+
+		err = s.store.UpdateUsage(ctx, counted, u.Revision)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, db.ErrConflict) {
+			return fmt.Errorf("failed to save usage: %v", err)
+		}
+	}
+	return fmt.Errorf("failed to save usage: %v", db.ErrConflict)
+}
+
+// Report returns a user's usage and quota
+func (s *Service) Report(ctx context.Context, userEmail string) (Report, error) {
+	u, err := s.usage(ctx, userEmail)
+	if err != nil {
+		return Report{}, err
+	}
+
+	r := Report{
+		Files:    u.FileBytes,
+		Versions: u.VersionBytes,
+		Trash:    u.TrashBytes,
+		Used:     used(u),
+	}
+	if limit := s.limitOf(u); limit >= 0 {
+		available := nonNegative(limit - r.Used)
+		r.Quota, r.Available = &limit, &available
+	}
+	return r, nil
+}
+
+// SetLimit gives a user their own quota in bytes, or Unlimited. A limit of
+// 0 puts them back on the default.
+func (s *Service) SetLimit(ctx context.Context, userEmail string, limit int64) error {
+	if limit < Unlimited {
+		return ErrInvalidSize
+	}
+	if err := s.store.SetQuota(ctx, userEmail, limit); err != nil {
+		return fmt.Errorf("failed to save quota: %v", err)
+	}
+	return nil
+}
+
+func used(u db.Usage) int64 {
+	return u.FileBytes + u.VersionBytes + u.TrashBytes
+}
+
+func nonNegative(n int64) int64 {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
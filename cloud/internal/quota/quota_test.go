@@ -0,0 +1,180 @@
+package quota_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud/internal/database"
+	"cloud/internal/files"
+	"cloud/internal/quota"
+	"cloud/internal/storage"
+)
+
+const user = "ann@example.com"
+
+// failingStore is object storage that refuses every write
+type failingStore struct {
+	storage.ObjectStore
+}
+
+var errStorage = errors.New("storage unavailable")
+
+func (failingStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (storage.ObjectInfo, error) {
+	return storage.ObjectInfo{}, errStorage
+}
+
+func (failingStore) Copy(ctx context.Context, src, dst string) (storage.ObjectInfo, error) {
+	return storage.ObjectInfo{}, errStorage
+}
+
+// setup returns a metadata store, object storage and a quota service
+// enforcing limit
+func setup(t *testing.T, limit int64) (*database.DB, storage.ObjectStore, *quota.Service) {
+	t.Helper()
+	dir := t.TempDir()
+	meta, err := database.NewDB(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := storage.NewDiskStore(filepath.Join(dir, "objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta, objects, quota.NewService(meta, limit)
+}
+
+func upload(name, content string) files.Upload {
+	return files.Upload{Filename: name, Size: int64(len(content)), Body: strings.NewReader(content)}
+}
+
+func used(t *testing.T, q *quota.Service) int64 {
+	t.Helper()
+	report, err := q.Report(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report.Used
+}
+
+func TestChargeAndRefund(t *testing.T) {
+	ctx := context.Background()
+	_, _, q := setup(t, 10)
+
+	if err := q.Charge(ctx, user, quota.Delta{Files: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Charge(ctx, user, quota.Delta{Files: 5}); !errors.Is(err, quota.ErrExceeded) {
+		t.Fatalf("charge over the limit: got %v, want ErrExceeded", err)
+	}
+	if got := used(t, q); got != 6 {
+		t.Fatalf("a refused charge was counted: used %d, want 6", got)
+	}
+	// Freeing space always succeeds
+	if err := q.Charge(ctx, user, quota.Delta{Files: -6, Trash: 6}); err != nil {
+		t.Fatal(err)
+	}
+	q.Refund(ctx, user, quota.Delta{Trash: 6})
+	if got := used(t, q); got != 0 {
+		t.Fatalf("used %d after refund, want 0", got)
+	}
+}
+
+func TestConcurrentChargesStayWithinLimit(t *testing.T) {
+	ctx := context.Background()
+	_, _, q := setup(t, 15)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	charged := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := q.Charge(ctx, user, quota.Delta{Files: 2}); err == nil {
+				mu.Lock()
+				charged++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := used(t, q); got != int64(charged*2) || got > 15 {
+		t.Fatalf("used %d after %d charges of 2 bytes with a limit of 15", got, charged)
+	}
+}
+
+func TestFailedUploadReleasesReservation(t *testing.T) {
+	ctx := context.Background()
+	meta, objects, q := setup(t, 10)
+
+	broken := files.NewService(meta, failingStore{objects}, files.PolicyRename, q)
+	if _, err := broken.Upload(ctx, user, upload("a.txt", "0123456789")); err == nil {
+		t.Fatal("upload to failing storage succeeded")
+	}
+	if got := used(t, q); got != 0 {
+		t.Fatalf("failed upload left %d bytes charged", got)
+	}
+
+	// The whole quota is still available
+	working := files.NewService(meta, objects, files.PolicyRename, q)
+	if _, err := working.Upload(ctx, user, upload("a.txt", "0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if got := used(t, q); got != 10 {
+		t.Fatalf("used %d, want 10", got)
+	}
+	if _, err := working.Upload(ctx, user, upload("b.txt", "x")); !errors.Is(err, quota.ErrExceeded) {
+		t.Fatalf("upload over the limit: got %v, want ErrExceeded", err)
+	}
+	if got := used(t, q); got != 10 {
+		t.Fatalf("refused upload was counted: used %d, want 10", got)
+	}
+}
+
+func TestFailedVersionReleasesReservation(t *testing.T) {
+	ctx := context.Background()
+	meta, objects, q := setup(t, 10)
+
+	working := files.NewService(meta, objects, files.PolicyVersion, q)
+	if _, err := working.Upload(ctx, user, upload("a.txt", "1234")); err != nil {
+		t.Fatal(err)
+	}
+
+	broken := files.NewService(meta, failingStore{objects}, files.PolicyVersion, q)
+	if _, err := broken.Upload(ctx, user, upload("a.txt", "123456")); err == nil {
+		t.Fatal("version upload to failing storage succeeded")
+	}
+	if got := used(t, q); got != 4 {
+		t.Fatalf("failed version left used at %d, want 4", got)
+	}
+
+	if _, err := working.Upload(ctx, user, upload("a.txt", "123456")); err != nil {
+		t.Fatal(err)
+	}
+	if got := used(t, q); got != 10 {
+		t.Fatalf("used %d after a new version, want 10", got)
+	}
+}
+
+func TestFailedCopyReleasesReservation(t *testing.T) {
+	ctx := context.Background()
+	meta, objects, q := setup(t, 10)
+	if _, err := objects.Put(ctx, user+"/uploads/direct", strings.NewReader("01234"), 5, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	broken := files.NewService(meta, failingStore{objects}, files.PolicyRename, q)
+	_, err := broken.Upload(ctx, user, files.Upload{Filename: "d.txt", Size: 5, Source: user + "/uploads/direct"})
+	if err == nil {
+		t.Fatal("upload from a failed copy succeeded")
+	}
+	if got := used(t, q); got != 0 {
+		t.Fatalf("failed copy left %d bytes charged", got)
+	}
+}
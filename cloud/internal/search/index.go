@@ -0,0 +1,347 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DocType distinguishes the kinds of documents in the index
+type DocType string
+
+const (
+	TypeNote DocType = "note"
+	TypeFile DocType = "file"
+)
+
+// Document is the unit of indexing. Documents are private to their owner.
+type Document struct {
+	Type      DocType   `json:"type"`
+	Owner     string    `json:"owner"`
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Result is a ranked search hit. Title and Snippet are HTML with matches
+// wrapped in <mark>; everything else in them is escaped.
+type Result struct {
+	Type      DocType   `json:"type"`
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Snippet   string    `json:"snippet"`
+	Score     float64   `json:"score"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type docRef struct {
+	typ DocType
+	id  string
+}
+
+// posting counts how often a term occurs in a document's title and body
+type posting struct {
+	title int
+	body  int
+}
+
+// shard holds one user's documents and postings
+type shard struct {
+	docs     map[docRef]*Document
+	lengths  map[docRef]int
+	postings map[string]map[docRef]posting
+	terms    []string // sorted keys of postings, for prefix lookups
+}
+
+func newShard() *shard {
+	return &shard{
+		docs:     make(map[docRef]*Document),
+		lengths:  make(map[docRef]int),
+		postings: make(map[string]map[docRef]posting),
+	}
+}
+
+// Index is an in-memory inverted index over notes and file names, sharded
+// by owner. It is safe for concurrent use.
+type Index struct {
+	mu     sync.RWMutex
+	shards map[string]*shard
+	dirty  bool
+}
+
+func New() *Index {
+	return &Index{shards: make(map[string]*shard)}
+}
+
+// Put adds or replaces a document
+func (idx *Index) Put(doc Document) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	s := idx.shards[doc.Owner]
+	if s == nil {
+		s = newShard()
+		idx.shards[doc.Owner] = s
+	}
+
+	ref := docRef{doc.Type, doc.ID}
+	s.remove(ref)
+
+	length := 0
+	counts := make(map[string]posting)
+	for _, t := range tokenize(doc.Title) {
+		if t.term != "" {
+			p := counts[t.term]
+			p.title++
+			counts[t.term] = p
+			length++
+		}
+	}
+	for _, t := range tokenize(doc.Body) {
+		if t.term != "" {
+			p := counts[t.term]
+			p.body++
+			counts[t.term] = p
+			length++
+		}
+	}
+
+	for term, p := range counts {
+		list := s.postings[term]
+		if list == nil {
+			list = make(map[docRef]posting)
+			s.postings[term] = list
+			s.addTerm(term)
+		}
+		list[ref] = p
+	}
+
+	d := doc
+	s.docs[ref] = &d
+	s.lengths[ref] = length
+	idx.dirty = true
+}
+
+// Delete removes a document if present
+func (idx *Index) Delete(owner string, typ DocType, id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if s := idx.shards[owner]; s != nil {
+		if s.remove(docRef{typ, id}) {
+			idx.dirty = true
+		}
+	}
+}
+
+func (s *shard) remove(ref docRef) bool {
+	doc := s.docs[ref]
+	if doc == nil {
+		return false
+	}
+
+	for _, text := range []string{doc.Title, doc.Body} {
+		for _, t := range tokenize(text) {
+			list := s.postings[t.term]
+			if list == nil {
+				continue
+			}
+			delete(list, ref)
+			if len(list) == 0 {
+				delete(s.postings, t.term)
+				s.removeTerm(t.term)
+			}
+		}
+	}
+
+	delete(s.docs, ref)
+	delete(s.lengths, ref)
+	return true
+}
+
+func (s *shard) addTerm(term string) {
+	i := sort.SearchStrings(s.terms, term)
+	s.terms = append(s.terms, "")
+	copy(s.terms[i+1:], s.terms[i:])
+	s.terms[i] = term
+}
+
+func (s *shard) removeTerm(term string) {
+	i := sort.SearchStrings(s.terms, term)
+	if i < len(s.terms) && s.terms[i] == term {
+		s.terms = append(s.terms[:i], s.terms[i+1:]...)
+	}
+}
+
+// withPrefix returns the indexed terms starting with prefix
+func (s *shard) withPrefix(prefix string) []string {
+	i := sort.SearchStrings(s.terms, prefix)
+	j := i
+	for j < len(s.terms) && strings.HasPrefix(s.terms[j], prefix) {
+		j++
+	}
+	return s.terms[i:j]
+}
+
+// Field weights and the discount applied to prefix expansions
+const (
+	titleWeight  = 3.0
+	bodyWeight   = 1.0
+	prefixWeight = 0.5
+	minPrefixLen = 2
+)
+
+// Search ranks the owner's documents against query. Every query word
+// matches its stemmed form exactly and, with a lower weight, any indexed
+// term it is a prefix of. types restricts the result kinds; empty means all.
+func (idx *Index) Search(owner, query string, types []DocType, limit int) []Result {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	s := idx.shards[owner]
+	if s == nil {
+		return []Result{}
+	}
+
+	allowed := make(map[DocType]bool)
+	for _, t := range types {
+		allowed[t] = true
+	}
+
+	var words []token
+	for _, t := range tokenize(query) {
+		if t.term != "" {
+			words = append(words, t)
+		}
+	}
+
+	scores := make(map[docRef]float64)
+	total := float64(len(s.docs))
+	for _, w := range words {
+		expansions := map[string]float64{w.term: 1}
+		if len(w.raw) >= minPrefixLen {
+			for _, term := range s.withPrefix(w.raw) {
+				if _, exact := expansions[term]; !exact {
+					expansions[term] = prefixWeight
+				}
+			}
+		}
+
+		for term, weight := range expansions {
+			list := s.postings[term]
+			if len(list) == 0 {
+				continue
+			}
+			idf := math.Log(1 + total/float64(len(list)))
+			for ref, p := range list {
+				if len(allowed) > 0 && !allowed[ref.typ] {
+					continue
+				}
+				tf := titleWeight*float64(p.title) + bodyWeight*float64(p.body)
+				scores[ref] += weight * idf * tf / math.Sqrt(float64(s.lengths[ref]))
+			}
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for ref, score := range scores {
+		doc := s.docs[ref]
+		results = append(results, Result{
+			Type:      doc.Type,
+			ID:        doc.ID,
+			Title:     highlight(doc.Title, words, 0),
+			Snippet:   highlight(doc.Body, words, snippetLength),
+			Score:     math.Round(score*1000) / 1000,
+			UpdatedAt: doc.UpdatedAt,
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].UpdatedAt.After(results[j].UpdatedAt)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// Load reads an index saved by Save. The error satisfies os.IsNotExist if
+// there is no saved index at path.
+func Load(path string) (*Index, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []Document
+	if err := json.Unmarshal(data, &docs); err != nil {
+		return nil, fmt.Errorf("failed to parse search index: %v", err)
+	}
+
+	idx := New()
+	for _, doc := range docs {
+		idx.Put(doc)
+	}
+	idx.dirty = false
+	return idx, nil
+}
+
+// Save writes the indexed documents to path. Postings are rebuilt on Load,
+// which keeps the file format independent of the index layout.
+func (idx *Index) Save(path string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	docs := make([]*Document, 0)
+	for _, s := range idx.shards {
+		for _, doc := range s.docs {
+			docs = append(docs, doc)
+		}
+	}
+
+	data, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	idx.dirty = false
+	return nil
+}
+
+// Autosave writes the index to path every interval while it has unsaved
+// changes. It never returns.
+func (idx *Index) Autosave(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		idx.mu.RLock()
+		dirty := idx.dirty
+		idx.mu.RUnlock()
+
+		if dirty {
+			if err := idx.Save(path); err != nil {
+				log.Printf("Error saving search index: %v", err)
+			}
+		}
+	}
+}
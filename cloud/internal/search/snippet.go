@@ -0,0 +1,100 @@
+package search
+
+import (
+	"html"
+	"strings"
+	"unicode/utf8"
+)
+
+// snippetLength is the approximate size in bytes of a body snippet
+const snippetLength = 160
+
+// matches reports whether a token of the document satisfies a query word,
+// using the same exact-or-prefix rule as Search
+func matches(t token, words []token) bool {
+	if t.term == "" {
+		return false
+	}
+	for _, w := range words {
+		if t.term == w.term {
+			return true
+		}
+		if len(w.raw) >= minPrefixLen && (strings.HasPrefix(t.term, w.raw) || strings.HasPrefix(t.raw, w.raw)) {
+			return true
+		}
+	}
+	return false
+}
+
+// highlight escapes text for HTML and wraps matching words in <mark>. If
+// maxLen is positive only a window of about that many bytes around the first
+// match is returned, with ellipses where text was cut.
+func highlight(text string, words []token, maxLen int) string {
+	tokens := tokenize(text)
+
+	start, end := 0, len(text)
+	if maxLen > 0 && len(text) > maxLen {
+		first := -1
+		for _, t := range tokens {
+			if matches(t, words) {
+				first = t.start
+				break
+			}
+		}
+
+		// Centre the window on the first match, snapped to word boundaries
+		start = 0
+		if first > maxLen/3 {
+			start = first - maxLen/3
+		}
+		end = start + maxLen
+		if end > len(text) {
+			end = len(text)
+			start = max(0, end-maxLen)
+		}
+		start, end = snap(text, tokens, start, end)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, t := range tokens {
+		if t.start < start || t.end > end {
+			continue
+		}
+		if matches(t, words) {
+			b.WriteString(html.EscapeString(text[pos:t.start]))
+			b.WriteString("<mark>")
+			b.WriteString(html.EscapeString(text[t.start:t.end]))
+			b.WriteString("</mark>")
+			pos = t.end
+		}
+	}
+	b.WriteString(html.EscapeString(text[pos:end]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// snap moves a byte window outwards so it cuts neither a word nor a
+// multi-byte character in half
+func snap(text string, tokens []token, start, end int) (int, int) {
+	for _, t := range tokens {
+		if t.start < start && t.end > start {
+			start = t.start
+		}
+		if t.start < end && t.end > end {
+			end = t.end
+		}
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+	return start, end
+}
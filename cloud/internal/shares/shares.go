@@ -0,0 +1,283 @@
+package shares
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"cloud/internal/db"
+	"cloud/internal/files"
+)
+
+var (
+	ErrNotFound         = errors.New("share not found")
+	ErrExpired          = errors.New("share link has expired")
+	ErrExhausted        = errors.New("share link has reached its download limit")
+	ErrPasswordRequired = errors.New("share link is password protected")
+	ErrWrongPassword    = errors.New("wrong password for share link")
+	ErrInvalidExpiry    = errors.New("expiry must be in the future")
+	ErrInvalidLimit     = errors.New("download limit cannot be negative")
+)
+
+// Store is the persistence backend used by Service. db.MetadataStore
+// satisfies it.
+type Store interface {
+	SaveShare(ctx context.Context, share db.Share) error
+	GetShare(ctx context.Context, userEmail, shareID string) (db.Share, error)
+	GetShareByToken(ctx context.Context, tokenHash string) (db.Share, error)
+	GetUserShares(ctx context.Context, userEmail string) ([]db.Share, error)
+	CountShareDownload(ctx context.Context, share db.Share, expected int, at time.Time) error
+	DeleteShare(ctx context.Context, userEmail, shareID string) error
+}
+
+// FileGetter looks up the shared files. *files.Service implements it.
+type FileGetter interface {
+	Get(ctx context.Context, userEmail, fileID string) (db.File, error)
+}
+
+// Options limits a new share. Zero values mean no password, no expiry and
+// no download limit. MaxDownloads limits requests for the content rather
+// than whole copies: every ranged request, such as a video player seeking
+// or a download being resumed, counts as one.
+type Options struct {
+	Password     string     `json:"password"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxDownloads int        `json:"max_downloads"`
+}
+
+// Info is what the owner sees of a share. The token is only known when
+// the share is created.
+type Info struct {
+	ID             string     `json:"id"`
+	FileID         string     `json:"file_id"`
+	Filename       string     `json:"filename"`
+	Password       bool       `json:"password_protected"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads   int        `json:"max_downloads"`
+	Downloads      int        `json:"downloads"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastAccessedAt *time.Time `json:"last_accessed_at,omitempty"`
+}
+
+// Service implements public share links. A link carries a random token;
+// only its SHA-256 hash is stored, so the links cannot be recovered from
+// the metadata store.
+type Service struct {
+	store Store
+	files FileGetter
+}
+
+func NewService(store Store, files FileGetter) *Service {
+	return &Service{store: store, files: files}
+}
+
+// HashToken is how a token is stored and looked up
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Create shares one of the user's files. The returned token goes into the
+// link; it cannot be looked up again later.
+func (s *Service) Create(ctx context.Context, userEmail, fileID string, opts Options) (Info, string, error) {
+	now := time.Now()
+	if opts.ExpiresAt != nil && !opts.ExpiresAt.After(now) {
+		return Info{}, "", ErrInvalidExpiry
+	}
+	if opts.MaxDownloads < 0 {
+		return Info{}, "", ErrInvalidLimit
+	}
+
+	file, err := s.files.Get(ctx, userEmail, fileID)
+	if err != nil {
+		return Info{}, "", err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return Info{}, "", fmt.Errorf("failed to generate share token: %v", err)
+	}
+
+	share := db.Share{
+		UserEmail:    userEmail,
+		ShareID:      uuid.New().String(),
+		FileID:       file.FileID,
+		TokenHash:    HashToken(token),
+		MaxDownloads: opts.MaxDownloads,
+		CreatedAt:    now,
+	}
+	if opts.ExpiresAt != nil {
+		share.ExpiresAt = *opts.ExpiresAt
+	}
+	if opts.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return Info{}, "", fmt.Errorf("failed to hash share password: %v", err)
+		}
+		share.PasswordHash = string(hash)
+	}
+
+	if err := s.store.SaveShare(ctx, share); err != nil {
+		return Info{}, "", fmt.Errorf("failed to save share: %v", err)
+	}
+	return info(share, file), token, nil
+}
+
+// List returns the user's active shares, newest first. Shares that can no
+// longer be used, because they expired, ran out of downloads or their file
+// is gone, are removed along the way. Shares of files in the trash are
+// left out but kept, so they work again once the file is restored.
+func (s *Service) List(ctx context.Context, userEmail string) ([]Info, error) {
+	shares, err := s.store.GetUserShares(ctx, userEmail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shares: %v", err)
+	}
+
+	now := time.Now()
+	list := make([]Info, 0, len(shares))
+	for _, share := range shares {
+		file, err := s.files.Get(ctx, userEmail, share.FileID)
+		if errors.Is(err, files.ErrTrashed) {
+			continue
+		}
+		if err != nil && !errors.Is(err, files.ErrNotFound) {
+			return nil, err
+		}
+		if err != nil || usable(share, now) != nil {
+			if err := s.store.DeleteShare(ctx, userEmail, share.ShareID); err != nil {
+				log.Printf("Error removing inactive share %s: %v", share.ShareID, err)
+			}
+			continue
+		}
+		list = append(list, info(share, file))
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list, nil
+}
+
+// Revoke deletes a share; its link stops working immediately
+func (s *Service) Revoke(ctx context.Context, userEmail, shareID string) error {
+	if _, err := s.store.GetShare(ctx, userEmail, shareID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("failed to read share: %v", err)
+	}
+	if err := s.store.DeleteShare(ctx, userEmail, shareID); err != nil {
+		return fmt.Errorf("failed to delete share: %v", err)
+	}
+	return nil
+}
+
+// Resolve checks a link's token and password and returns the share with
+// the file it points at
+func (s *Service) Resolve(ctx context.Context, token, password string) (db.Share, db.File, error) {
+	share, err := s.store.GetShareByToken(ctx, HashToken(token))
+	if errors.Is(err, db.ErrNotFound) {
+		return db.Share{}, db.File{}, ErrNotFound
+	}
+	if err != nil {
+		return db.Share{}, db.File{}, fmt.Errorf("failed to read share: %v", err)
+	}
+	if err := usable(share, time.Now()); err != nil {
+		return db.Share{}, db.File{}, err
+	}
+
+	if share.PasswordHash != "" {
+		if password == "" {
+			return db.Share{}, db.File{}, ErrPasswordRequired
+		}
+		if bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(password)) != nil {
+			return db.Share{}, db.File{}, ErrWrongPassword
+		}
+	}
+
+	file, err := s.files.Get(ctx, share.UserEmail, share.FileID)
+	if errors.Is(err, files.ErrNotFound) {
+		return db.Share{}, db.File{}, ErrNotFound
+	}
+	if err != nil {
+		return db.Share{}, db.File{}, err
+	}
+	return share, file, nil
+}
+
+// CountDownload records a download through a share, failing with
+// ErrExhausted once its limit is reached. Concurrent downloads are counted
+// with a compare-and-set so the limit cannot be overrun.
+func (s *Service) CountDownload(ctx context.Context, share db.Share) error {
+	for {
+		if share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+			return ErrExhausted
+		}
+		err := s.store.CountShareDownload(ctx, share, share.Downloads, time.Now())
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, db.ErrConflict) {
+			return fmt.Errorf("failed to count download: %v", err)
+		}
+
+		// Someone else downloaded in the meantime; start over from the new count
+		share, err = s.store.GetShare(ctx, share.UserEmail, share.ShareID)
+		if errors.Is(err, db.ErrNotFound) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read share: %v", err)
+		}
+	}
+}
+
+// usable reports why a share can no longer be used, if it cannot
+func usable(share db.Share, now time.Time) error {
+	if !share.ExpiresAt.IsZero() && !now.Before(share.ExpiresAt) {
+		return ErrExpired
+	}
+	if share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+		return ErrExhausted
+	}
+	return nil
+}
+
+func info(share db.Share, file db.File) Info {
+	i := Info{
+		ID:           share.ShareID,
+		FileID:       share.FileID,
+		Filename:     file.Filename,
+		Password:     share.PasswordHash != "",
+		MaxDownloads: share.MaxDownloads,
+		Downloads:    share.Downloads,
+		CreatedAt:    share.CreatedAt,
+	}
+	if !share.ExpiresAt.IsZero() {
+		expires := share.ExpiresAt
+		i.ExpiresAt = &expires
+	}
+	if !share.LastAccessedAt.IsZero() {
+		accessed := share.LastAccessedAt
+		i.LastAccessedAt = &accessed
+	}
+	return i
+}
@@ -0,0 +1,129 @@
+package shares_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud/internal/database"
+	"cloud/internal/files"
+	"cloud/internal/quota"
+	"cloud/internal/shares"
+	"cloud/internal/storage"
+)
+
+const owner = "ann@example.com"
+
+// setup returns a share service and the ID of a file it can share
+func setup(t *testing.T) (*shares.Service, string) {
+	t.Helper()
+	ctx := context.Background()
+	dir := t.TempDir()
+	meta, err := database.NewDB(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := storage.NewDiskStore(filepath.Join(dir, "objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := files.NewService(meta, objects, files.PolicyRename, quota.NewService(meta, 0))
+	file, err := fs.Upload(ctx, owner, files.Upload{Filename: "a.txt", Size: 2, Body: strings.NewReader("hi")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shares.NewService(meta, fs), file.FileID
+}
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	s, fileID := setup(t)
+	_, token, err := s.Create(ctx, owner, fileID, shares.Options{Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		password string
+		want     error
+	}{
+		{name: "right password", token: token, password: "secret"},
+		{name: "no password", token: token, want: shares.ErrPasswordRequired},
+		{name: "wrong password", token: token, password: "guess", want: shares.ErrWrongPassword},
+		{name: "unknown token", token: "x" + token, password: "secret", want: shares.ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, file, err := s.Resolve(ctx, tt.token, tt.password)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil && file.FileID != fileID {
+				t.Fatalf("got file %s, want %s", file.FileID, fileID)
+			}
+		})
+	}
+}
+
+func TestCreateRejectsBadOptions(t *testing.T) {
+	ctx := context.Background()
+	s, fileID := setup(t)
+	past := time.Now().Add(-time.Minute)
+
+	if _, _, err := s.Create(ctx, owner, fileID, shares.Options{ExpiresAt: &past}); !errors.Is(err, shares.ErrInvalidExpiry) {
+		t.Fatalf("expired share: got %v, want ErrInvalidExpiry", err)
+	}
+	if _, _, err := s.Create(ctx, owner, fileID, shares.Options{MaxDownloads: -1}); !errors.Is(err, shares.ErrInvalidLimit) {
+		t.Fatalf("negative limit: got %v, want ErrInvalidLimit", err)
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	ctx := context.Background()
+	s, fileID := setup(t)
+	_, token, err := s.Create(ctx, owner, fileID, shares.Options{MaxDownloads: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, _, err := s.Resolve(ctx, token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every request counts, so concurrent ones must not overrun the limit
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	counted, exhausted := 0, 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.CountDownload(ctx, share)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				counted++
+			case errors.Is(err, shares.ErrExhausted):
+				exhausted++
+			default:
+				t.Errorf("CountDownload: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counted != 3 || exhausted != 5 {
+		t.Fatalf("counted %d and refused %d downloads, want 3 and 5", counted, exhausted)
+	}
+	if _, _, err := s.Resolve(ctx, token, ""); !errors.Is(err, shares.ErrExhausted) {
+		t.Fatalf("resolving a used up share: got %v, want ErrExhausted", err)
+	}
+}
@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tmpDir holds in-flight writes inside the store root; it is hidden from List
+const tmpDir = ".tmp"
+
+// DiskStore keeps objects as plain files below a root directory
+type DiskStore struct {
+	root string
+}
+
+// NewDiskStore creates a DiskStore rooted at dir
+func NewDiskStore(dir string) (*DiskStore, error) {
+	// Create upload directory if it doesn't exist
+	if err := os.MkdirAll(filepath.Join(dir, tmpDir), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %v", err)
+	}
+	return &DiskStore{root: dir}, nil
+}
+
+// path maps an object key to a file below the root, rejecting keys that
+// would escape it
+func (s *DiskStore) path(key string) (string, error) {
+	clean := path.Clean("/" + key)[1:]
+	if clean == "" || clean != key || strings.HasPrefix(clean, tmpDir+"/") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+func (s *DiskStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error) {
+	dst, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	// Write to a temporary file first so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Join(s.root, tmpDir), "put-*")
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to create file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to save file: %v", err)
+	}
+	if size >= 0 && written != size {
+		return ObjectInfo{}, fmt.Errorf("failed to save file: wrote %d of %d bytes", written, size)
+	}
+
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to save file: %v", err)
+	}
+
+	return s.Stat(ctx, key)
+}
+
+func (s *DiskStore) Get(ctx context.Context, key string) (Object, ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ObjectInfo{}, ErrNotFound
+		}
+		return nil, ObjectInfo{}, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("failed to stat file: %v", err)
+	}
+
+	return file, diskInfo(key, fi), nil
+}
+
+func (s *DiskStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ObjectInfo{}, ErrNotFound
+		}
+		return ObjectInfo{}, fmt.Errorf("failed to stat file: %v", err)
+	}
+
+	return diskInfo(key, fi), nil
+}
+
+func (s *DiskStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	// Match S3 semantics: deleting a missing object is not an error
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete file: %v", err)
+	}
+	return nil
+}
+
+func (s *DiskStore) Copy(ctx context.Context, src, dst string) (ObjectInfo, error) {
+	object, info, err := s.Get(ctx, src)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer object.Close()
+
+	return s.Put(ctx, dst, object, info.Size, info.ContentType)
+}
+
+func (s *DiskStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if key == tmpDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, diskInfo(key, fi))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+
+	return objects, nil
+}
+
+func diskInfo(key string, fi os.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ContentType:  mime.TypeByExtension(path.Ext(key)),
+		ETag:         fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+		LastModified: fi.ModTime(),
+	}
+}
+
+// multipartDir holds the parts of unfinished multipart uploads, one
+// directory per upload, inside tmpDir
+const multipartDir = "multipart"
+
+var _ MultipartStore = (*DiskStore)(nil)
+
+// uploadDir maps a multipart upload ID to its directory. IDs are generated
+// by NewMultipartUpload and are plain hex, anything else is rejected.
+func (s *DiskStore) uploadDir(uploadID string) (string, error) {
+	if uploadID == "" || strings.Trim(uploadID, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("invalid upload ID %q", uploadID)
+	}
+	return filepath.Join(s.root, tmpDir, multipartDir, uploadID), nil
+}
+
+func (s *DiskStore) NewMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to create upload ID: %v", err)
+	}
+	uploadID := hex.EncodeToString(id)
+
+	dir, _ := s.uploadDir(uploadID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create upload directory: %v", err)
+	}
+	return uploadID, nil
+}
+
+func (s *DiskStore) PutPart(ctx context.Context, key, uploadID string, number int, r io.Reader, size int64) (Part, error) {
+	dir, err := s.uploadDir(uploadID)
+	if err != nil {
+		return Part{}, err
+	}
+	if number < 1 || number > MaxParts {
+		return Part{}, fmt.Errorf("invalid part number %d", number)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return Part{}, fmt.Errorf("unknown upload %s: %v", uploadID, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "part-*")
+	if err != nil {
+		return Part{}, fmt.Errorf("failed to create part: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Part{}, fmt.Errorf("failed to save part: %v", err)
+	}
+	if size >= 0 && written != size {
+		return Part{}, fmt.Errorf("failed to save part: wrote %d of %d bytes", written, size)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, strconv.Itoa(number))); err != nil {
+		return Part{}, fmt.Errorf("failed to save part: %v", err)
+	}
+	return Part{Number: number, ETag: hex.EncodeToString(hash.Sum(nil)), Size: written}, nil
+}
+
+// CompleteMultipartUpload concatenates the parts into the object. The
+// part files are checked against parts so a stale list is caught the same
+// way S3 would.
+func (s *DiskStore) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) (ObjectInfo, error) {
+	dir, err := s.uploadDir(uploadID)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err := checkParts(parts); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	var total int64
+	for _, part := range parts {
+		fi, err := os.Stat(filepath.Join(dir, strconv.Itoa(part.Number)))
+		if err != nil {
+			return ObjectInfo{}, fmt.Errorf("failed to stat part %d: %v", part.Number, err)
+		}
+		if fi.Size() != part.Size {
+			return ObjectInfo{}, fmt.Errorf("part %d has %d bytes, expected %d", part.Number, fi.Size(), part.Size)
+		}
+		total += part.Size
+	}
+
+	// Stream the parts one file at a time; an upload can have thousands
+	pr, pw := io.Pipe()
+	go func() {
+		for _, part := range parts {
+			f, err := os.Open(filepath.Join(dir, strconv.Itoa(part.Number)))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(pw, f)
+			f.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	defer pr.Close()
+
+	info, err := s.Put(ctx, key, pr, total, "")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Error removing parts of upload %s: %v", uploadID, err)
+	}
+	return info, nil
+}
+
+func (s *DiskStore) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	dir, err := s.uploadDir(uploadID)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove upload: %v", err)
+	}
+	return nil
+}
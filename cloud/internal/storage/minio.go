@@ -5,79 +5,241 @@ import (
     "fmt"
     "io"
     "log"
-    "os"
+    "mime"
+    "net/url"
+    "strings"
+    "time"
 
     "github.com/minio/minio-go/v7"
     "github.com/minio/minio-go/v7/pkg/credentials"
 )
 
-var minioClient *minio.Client
+// MinioStore keeps objects in a single MinIO (or S3 compatible) bucket
+type MinioStore struct {
+    client *minio.Client
+    bucket string
 
-func InitStorage() error {
-    endpoint := os.Getenv("MINIO_ENDPOINT")
-    accessKeyID := os.Getenv("MINIO_ACCESS_KEY")
-    secretAccessKey := os.Getenv("MINIO_SECRET_KEY")
-    useSSL := false
+    // signer presigns URLs for the public endpoint. Signing is local, the
+    // region is configured so it never has to ask the server.
+    signer *minio.Client
+}
 
-    var err error
-    minioClient, err = minio.New(endpoint, &minio.Options{
-        Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-        Secure: useSSL,
+func NewMinioStore(ctx context.Context, cfg Config) (*MinioStore, error) {
+    client, err := minio.New(cfg.Endpoint, &minio.Options{
+        Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+        Secure: cfg.UseSSL,
+        Region: cfg.Region,
     })
     if err != nil {
-        return fmt.Errorf("failed to connect to MinIO: %v", err)
+        return nil, fmt.Errorf("failed to connect to MinIO: %v", err)
+    }
+
+    signer := client
+    if cfg.PublicEndpoint != "" {
+        signer, err = minio.New(cfg.PublicEndpoint, &minio.Options{
+            Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+            Secure: cfg.UseSSL,
+            Region: cfg.Region,
+        })
+        if err != nil {
+            return nil, fmt.Errorf("failed to configure MinIO public endpoint: %v", err)
+        }
     }
 
     // Create bucket if it doesn't exist
-    bucketName := "cloud-storage"
-    exists, err := minioClient.BucketExists(context.Background(), bucketName)
+    exists, err := client.BucketExists(ctx, cfg.Bucket)
     if err != nil {
-        return fmt.Errorf("failed to check bucket: %v", err)
+        return nil, fmt.Errorf("failed to check bucket: %v", err)
     }
 
     if !exists {
-        err = minioClient.MakeBucket(context.Background(), bucketName, minio.MakeBucketOptions{})
+        err = client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{})
         if err != nil {
-            return fmt.Errorf("failed to create bucket: %v", err)
+            return nil, fmt.Errorf("failed to create bucket: %v", err)
         }
-        log.Printf("Created bucket: %s", bucketName)
+        log.Printf("Created bucket: %s", cfg.Bucket)
     }
 
-    return nil
+    return &MinioStore{client: client, bucket: cfg.Bucket, signer: signer}, nil
 }
 
-func UploadFile(userEmail, fileName string, fileSize int64, reader io.Reader) (string, error) {
-    bucketName := "cloud-storage"
-    objectName := fmt.Sprintf("%s/%s", userEmail, fileName)
-
-    _, err := minioClient.PutObject(context.Background(), bucketName, objectName, reader, fileSize, minio.PutObjectOptions{})
+func (s *MinioStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error) {
+    info, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType})
     if err != nil {
-        return "", fmt.Errorf("failed to upload file: %v", err)
+        return ObjectInfo{}, fmt.Errorf("failed to upload file: %v", err)
     }
 
-    return objectName, nil
+    return ObjectInfo{Key: key, Size: info.Size, ContentType: contentType, ETag: info.ETag}, nil
 }
 
-func DownloadFile(userEmail, fileName string) (*minio.Object, error) {
-    bucketName := "cloud-storage"
-    objectName := fmt.Sprintf("%s/%s", userEmail, fileName)
+func (s *MinioStore) Get(ctx context.Context, key string) (Object, ObjectInfo, error) {
+    object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+    if err != nil {
+        return nil, ObjectInfo{}, fmt.Errorf("failed to download file: %v", err)
+    }
 
-    object, err := minioClient.GetObject(context.Background(), bucketName, objectName, minio.GetObjectOptions{})
+    // GetObject is lazy; Stat forces the request so missing keys surface here
+    stat, err := object.Stat()
     if err != nil {
-        return nil, fmt.Errorf("failed to download file: %v", err)
+        object.Close()
+        return nil, ObjectInfo{}, minioError("failed to download file", err)
     }
 
-    return object, nil
+    return object, objectInfo(stat), nil
 }
 
-func DeleteFile(userEmail, fileName string) error {
-    bucketName := "cloud-storage"
-    objectName := fmt.Sprintf("%s/%s", userEmail, fileName)
+func (s *MinioStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+    stat, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+    if err != nil {
+        return ObjectInfo{}, minioError("failed to stat file", err)
+    }
 
-    err := minioClient.RemoveObject(context.Background(), bucketName, objectName, minio.RemoveObjectOptions{})
+    return objectInfo(stat), nil
+}
+
+func (s *MinioStore) Delete(ctx context.Context, key string) error {
+    err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
     if err != nil {
         return fmt.Errorf("failed to delete file: %v", err)
     }
 
     return nil
 }
+
+// Copy copies on the server side. ComposeObject, unlike CopyObject, also
+// copies objects over 5 GiB, in parts.
+func (s *MinioStore) Copy(ctx context.Context, src, dst string) (ObjectInfo, error) {
+    _, err := s.client.ComposeObject(ctx,
+        minio.CopyDestOptions{Bucket: s.bucket, Object: dst},
+        minio.CopySrcOptions{Bucket: s.bucket, Object: src},
+    )
+    if err != nil {
+        return ObjectInfo{}, minioError("failed to copy file", err)
+    }
+
+    return s.Stat(ctx, dst)
+}
+
+func (s *MinioStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+    var objects []ObjectInfo
+    for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+        if obj.Err != nil {
+            return nil, fmt.Errorf("failed to list files: %v", obj.Err)
+        }
+        objects = append(objects, objectInfo(obj))
+    }
+
+    return objects, nil
+}
+
+var _ MultipartStore = (*MinioStore)(nil)
+
+// Multipart uploads use the low level API so parts can arrive over
+// separate requests instead of from one reader
+func (s *MinioStore) core() minio.Core {
+    return minio.Core{Client: s.client}
+}
+
+func (s *MinioStore) NewMultipartUpload(ctx context.Context, key, contentType string) (string, error) {
+    uploadID, err := s.core().NewMultipartUpload(ctx, s.bucket, key, minio.PutObjectOptions{ContentType: contentType})
+    if err != nil {
+        return "", fmt.Errorf("failed to start upload: %v", err)
+    }
+    return uploadID, nil
+}
+
+func (s *MinioStore) PutPart(ctx context.Context, key, uploadID string, number int, r io.Reader, size int64) (Part, error) {
+    if number < 1 || number > MaxParts {
+        return Part{}, fmt.Errorf("invalid part number %d", number)
+    }
+
+    part, err := s.core().PutObjectPart(ctx, s.bucket, key, uploadID, number, r, size, minio.PutObjectPartOptions{})
+    if err != nil {
+        return Part{}, fmt.Errorf("failed to upload part: %v", err)
+    }
+    return Part{Number: number, ETag: strings.Trim(part.ETag, `"`), Size: part.Size}, nil
+}
+
+func (s *MinioStore) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) (ObjectInfo, error) {
+    if err := checkParts(parts); err != nil {
+        return ObjectInfo{}, err
+    }
+
+    complete := make([]minio.CompletePart, len(parts))
+    for i, part := range parts {
+        complete[i] = minio.CompletePart{PartNumber: part.Number, ETag: part.ETag}
+    }
+    if _, err := s.core().CompleteMultipartUpload(ctx, s.bucket, key, uploadID, complete, minio.PutObjectOptions{}); err != nil {
+        return ObjectInfo{}, fmt.Errorf("failed to complete upload: %v", err)
+    }
+
+    return s.Stat(ctx, key)
+}
+
+func (s *MinioStore) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+    err := s.core().AbortMultipartUpload(ctx, s.bucket, key, uploadID)
+    if err != nil && minio.ToErrorResponse(err).Code != "NoSuchUpload" {
+        return fmt.Errorf("failed to abort upload: %v", err)
+    }
+    return nil
+}
+
+var _ Presigner = (*MinioStore)(nil)
+
+// PresignUpload signs a POST policy rather than a PUT, since S3 cannot
+// bound the size of a pre-signed PUT but enforces a policy's
+// content-length-range
+func (s *MinioStore) PresignUpload(ctx context.Context, key, contentType string, size int64, expires time.Duration) (PresignedUpload, error) {
+    policy := minio.NewPostPolicy()
+    if err := policy.SetBucket(s.bucket); err != nil {
+        return PresignedUpload{}, fmt.Errorf("failed to presign upload: %v", err)
+    }
+    if err := policy.SetKey(key); err != nil {
+        return PresignedUpload{}, fmt.Errorf("failed to presign upload: %v", err)
+    }
+    if err := policy.SetExpires(time.Now().UTC().Add(expires)); err != nil {
+        return PresignedUpload{}, fmt.Errorf("failed to presign upload: %v", err)
+    }
+    if err := policy.SetContentLengthRange(size, size); err != nil {
+        return PresignedUpload{}, fmt.Errorf("failed to presign upload: %v", err)
+    }
+    if contentType != "" {
+        if err := policy.SetContentType(contentType); err != nil {
+            return PresignedUpload{}, fmt.Errorf("failed to presign upload: %v", err)
+        }
+    }
+
+    u, fields, err := s.signer.PresignedPostPolicy(ctx, policy)
+    if err != nil {
+        return PresignedUpload{}, fmt.Errorf("failed to presign upload: %v", err)
+    }
+    return PresignedUpload{Method: "POST", URL: u.String(), Fields: fields}, nil
+}
+
+func (s *MinioStore) PresignGet(ctx context.Context, key, filename string, expires time.Duration) (string, error) {
+    params := url.Values{}
+    params.Set("response-content-disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+    u, err := s.signer.PresignedGetObject(ctx, s.bucket, key, expires, params)
+    if err != nil {
+        return "", fmt.Errorf("failed to presign download: %v", err)
+    }
+    return u.String(), nil
+}
+
+func objectInfo(stat minio.ObjectInfo) ObjectInfo {
+    return ObjectInfo{
+        Key:          stat.Key,
+        Size:         stat.Size,
+        ContentType:  stat.ContentType,
+        ETag:         strings.Trim(stat.ETag, `"`),
+        LastModified: stat.LastModified,
+    }
+}
+
+func minioError(msg string, err error) error {
+    if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+        return ErrNotFound
+    }
+    return fmt.Errorf("%s: %v", msg, err)
+}
@@ -1,179 +1,170 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
-	"path/filepath"
+	"strings"
+	"time"
 )
 
-// FileStorage handles file operations
-type FileStorage struct {
-	uploadDir string
+// ErrNotFound is returned when an object does not exist in the store
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
 }
 
-// NewFileStorage creates a new FileStorage instance
-func NewFileStorage(uploadDir string) (*FileStorage, error) {
-	// Create upload directory if it doesn't exist
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create upload directory: %v", err)
-	}
-	return &FileStorage{uploadDir: uploadDir}, nil
+// Object is an open handle on the content of a stored object
+type Object interface {
+	io.Reader
+	io.Seeker
+	io.Closer
 }
 
-// SaveFile saves an uploaded file to disk
-func (fs *FileStorage) SaveFile(filename string, content io.Reader) error {
-	filepath := filepath.Join(fs.uploadDir, filename)
-	
-	// Create the file
-	dst, err := os.Create(filepath)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
-	}
-	defer dst.Close()
+// ObjectStore is implemented by every blob backend the server can run on.
+// Keys are slash separated paths such as "<email>/<name>".
+type ObjectStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (ObjectInfo, error)
+	Get(ctx context.Context, key string) (Object, ObjectInfo, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Copy stores a copy of the object at src under dst and returns the
+	// copy's info
+	Copy(ctx context.Context, src, dst string) (ObjectInfo, error)
+}
 
-	// Copy the content
-	if _, err := io.Copy(dst, content); err != nil {
-		return fmt.Errorf("failed to save file: %v", err)
-	}
+// MaxParts, MinPartSize and MaxPartSize are the limits of S3 multipart
+// uploads, which every MultipartStore enforces so backends behave alike
+const (
+	MaxParts    = 10000
+	MinPartSize = 5 << 20
+	MaxPartSize = 5 << 30
+)
 
-	return nil
+// Part is one uploaded piece of a multipart upload
+type Part struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
 }
 
-// GetFile retrieves a file by name
-func (fs *FileStorage) GetFile(filename string) (*os.File, error) {
-	filepath := filepath.Join(fs.uploadDir, filename)
-	file, err := os.Open(filepath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %v", err)
-	}
-	return file, nil
+// MultipartStore is implemented by backends that can assemble an object
+// from parts uploaded separately, possibly over several requests. Parts
+// are numbered from 1; all but the last must be at least MinPartSize.
+// The object only appears under key once the upload is completed.
+type MultipartStore interface {
+	ObjectStore
+	NewMultipartUpload(ctx context.Context, key, contentType string) (uploadID string, err error)
+	PutPart(ctx context.Context, key, uploadID string, number int, r io.Reader, size int64) (Part, error)
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) (ObjectInfo, error)
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
 }
 
-// ListFiles returns a list of all files in the upload directory
-func (fs *FileStorage) ListFiles() ([]string, error) {
-	var files []string
-	
-	entries, err := os.ReadDir(fs.uploadDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read directory: %v", err)
+// checkParts validates the part list of a multipart upload before it is
+// completed
+func checkParts(parts []Part) error {
+	if len(parts) == 0 {
+		return fmt.Errorf("multipart upload has no parts")
 	}
-
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			files = append(files, entry.Name())
+	for i, part := range parts {
+		if part.Number != i+1 {
+			return fmt.Errorf("multipart upload is missing part %d", i+1)
+		}
+		if i < len(parts)-1 && part.Size < MinPartSize {
+			return fmt.Errorf("part %d is smaller than %d bytes", part.Number, MinPartSize)
 		}
-	}
-
-	return files, nil
-}
-
-// DeleteFile deletes a file by name
-func (fs *FileStorage) DeleteFile(filename string) error {
-	filepath := filepath.Join(fs.uploadDir, filename)
-	if err := os.Remove(filepath); err != nil {
-		return fmt.Errorf("failed to delete file: %v", err)
 	}
 	return nil
 }
 
-type FileMetadata struct {
-	UserID   string
-	Filename string
-	Size     int64
-	Path     string
+// PresignedUpload is a request that stores an object's content without
+// going through the server. A PUT sends the content as the body. A POST
+// is a multipart/form-data upload of Fields followed by the content in a
+// field named "file".
+type PresignedUpload struct {
+	Method string
+	URL    string
+	Fields map[string]string
 }
 
-func getUserStoragePath(userID string) string {
-	return filepath.Join("uploads", userID)
+// Presigner is implemented by backends that can issue short lived URLs
+// for transferring an object directly, without going through the server.
+// Nothing but the URL is needed to use them.
+type Presigner interface {
+	// PresignUpload returns a request that stores exactly size bytes of
+	// content at key
+	PresignUpload(ctx context.Context, key, contentType string, size int64, expires time.Duration) (PresignedUpload, error)
+	// PresignGet returns a URL that downloads the object as an attachment
+	// named filename
+	PresignGet(ctx context.Context, key, filename string, expires time.Duration) (string, error)
 }
 
-func SaveUserFile(userID, filename string, file io.Reader) (*FileMetadata, error) {
-	// Create user-specific storage directory
-	userDir := getUserStoragePath(userID)
-	if err := os.MkdirAll(userDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create user directory: %v", err)
-	}
-
-	// Generate unique file path
-	filePath := filepath.Join(userDir, filename)
-	destFile, err := os.Create(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create file: %v", err)
-	}
-	defer destFile.Close()
+// Config selects and configures an ObjectStore backend
+type Config struct {
+	Backend string // "minio" or "disk"
 
-	// Copy file content
-	size, err := io.Copy(destFile, file)
-	if err != nil {
-		return nil, fmt.Errorf("failed to save file: %v", err)
-	}
+	// Disk backend
+	Dir string
 
-	metadata := &FileMetadata{
-		UserID:   userID,
-		Filename: filename,
-		Size:     size,
-		Path:     filePath,
-	}
+	// MinIO backend
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	UseSSL    bool
 
-	log.Printf("Saved file for user %s: %s (size: %d bytes)", userID, filename, size)
-	return metadata, nil
+	// PublicEndpoint is the MinIO address clients use, when it differs from
+	// Endpoint. Pre-signed URLs are signed for this host.
+	PublicEndpoint string
+	Region         string
 }
 
-func ListUserFiles(userID string) ([]FileMetadata, error) {
-	userDir := getUserStoragePath(userID)
-	
-	// Check if directory exists
-	if _, err := os.Stat(userDir); os.IsNotExist(err) {
-		return []FileMetadata{}, nil
-	}
+// ConfigFromEnv reads the storage configuration from the environment
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Backend:   strings.ToLower(os.Getenv("STORAGE_BACKEND")),
+		Dir:       os.Getenv("STORAGE_DIR"),
+		Endpoint:  os.Getenv("MINIO_ENDPOINT"),
+		AccessKey: os.Getenv("MINIO_ACCESS_KEY"),
+		SecretKey: os.Getenv("MINIO_SECRET_KEY"),
+		Bucket:    os.Getenv("MINIO_BUCKET"),
+		UseSSL:    os.Getenv("MINIO_USE_SSL") == "true",
 
-	files, err := os.ReadDir(userDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list files: %v", err)
+		PublicEndpoint: os.Getenv("MINIO_PUBLIC_ENDPOINT"),
+		Region:         os.Getenv("MINIO_REGION"),
 	}
-
-	var fileMetadata []FileMetadata
-	for _, file := range files {
-		if !file.IsDir() {
-			filePath := filepath.Join(userDir, file.Name())
-			fileInfo, err := file.Info()
-			if err != nil {
-				log.Printf("Error getting file info: %v", err)
-				continue
-			}
-
-			fileMetadata = append(fileMetadata, FileMetadata{
-				UserID:   userID,
-				Filename: file.Name(),
-				Size:     fileInfo.Size(),
-				Path:     filePath,
-			})
-		}
+	if cfg.Backend == "" {
+		cfg.Backend = "minio"
 	}
-
-	return fileMetadata, nil
-}
-
-func GetUserFile(userID, filename string) (*os.File, error) {
-	filePath := filepath.Join(getUserStoragePath(userID), filename)
-	
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("file not found: %v", err)
+	if cfg.Dir == "" {
+		cfg.Dir = "uploads"
 	}
-
-	return file, nil
+	if cfg.Bucket == "" {
+		cfg.Bucket = "cloud-storage"
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return cfg
 }
 
-func DeleteUserFile(userID, filename string) error {
-	filePath := filepath.Join(getUserStoragePath(userID), filename)
-	
-	if err := os.Remove(filePath); err != nil {
-		return fmt.Errorf("failed to delete file: %v", err)
+// Open creates the ObjectStore selected by cfg.Backend
+func Open(ctx context.Context, cfg Config) (ObjectStore, error) {
+	switch cfg.Backend {
+	case "minio":
+		return NewMinioStore(ctx, cfg)
+	case "disk", "local":
+		return NewDiskStore(cfg.Dir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
 	}
-
-	log.Printf("Deleted file %s for user %s", filename, userID)
-	return nil
 }
@@ -0,0 +1,233 @@
+package trash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud/internal/db"
+	"cloud/internal/files"
+	"cloud/internal/notes"
+)
+
+var (
+	ErrNotFound    = errors.New("item is not in the trash")
+	ErrInvalidType = errors.New("type must be file or note")
+)
+
+// Type says what kind of item is in the trash
+type Type string
+
+const (
+	File Type = "file"
+	Note Type = "note"
+)
+
+// DefaultRetention is how long items stay in the trash when
+// TRASH_RETENTION_DAYS is not set
+const DefaultRetention = 30 * 24 * time.Hour
+
+// Files is the part of the files service the trash works with.
+// *files.Service implements it.
+type Files interface {
+	Trashed(ctx context.Context, userEmail string) ([]db.File, error)
+	GetTrashed(ctx context.Context, userEmail, fileID string) (db.File, error)
+	Untrash(ctx context.Context, userEmail, fileID string) (db.File, error)
+	Delete(ctx context.Context, userEmail, fileID string) (db.File, error)
+	PurgeTrash(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+// Notes is the part of the notes service the trash works with.
+// *notes.Service implements it.
+type Notes interface {
+	Trashed(ctx context.Context, userEmail string) ([]notes.Note, error)
+	GetTrashed(ctx context.Context, userEmail, noteID string) (notes.Note, error)
+	Untrash(ctx context.Context, userEmail, noteID string) (notes.Note, error)
+	Delete(ctx context.Context, userEmail, noteID string, expectedVersion int) error
+	PurgeTrash(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+// Item is a file or note in the trash. PurgeAt is when it will be deleted
+// for good, and is null if the trash is never emptied automatically.
+type Item struct {
+	Type      Type       `json:"type"`
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Size      int64      `json:"size,omitempty"`
+	DeletedAt time.Time  `json:"deleted_at"`
+	PurgeAt   *time.Time `json:"purge_at"`
+}
+
+// Service lists, restores and empties the trash shared by files and notes
+type Service struct {
+	files     Files
+	notes     Notes
+	retention time.Duration
+}
+
+// NewService keeps trashed items for retention before purging them. A
+// retention of 0 keeps them until they are deleted by hand.
+func NewService(files Files, notes Notes, retention time.Duration) *Service {
+	return &Service{files: files, notes: notes, retention: retention}
+}
+
+// RetentionFromEnv reads TRASH_RETENTION_DAYS. It defaults to 30 days; 0
+// keeps items in the trash forever.
+func RetentionFromEnv() (time.Duration, error) {
+	v := os.Getenv("TRASH_RETENTION_DAYS")
+	if v == "" {
+		return DefaultRetention, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid TRASH_RETENTION_DAYS %q", v)
+	}
+	return time.Duration(n) * 24 * time.Hour, nil
+}
+
+// ParseType checks the type of an item named in a request
+func ParseType(s string) (Type, error) {
+	switch t := Type(s); t {
+	case File, Note:
+		return t, nil
+	}
+	return "", ErrInvalidType
+}
+
+func (s *Service) item(t Type, id, name string, size int64, deletedAt time.Time) Item {
+	it := Item{Type: t, ID: id, Name: name, Size: size, DeletedAt: deletedAt}
+	if s.retention > 0 {
+		purgeAt := deletedAt.Add(s.retention)
+		it.PurgeAt = &purgeAt
+	}
+	return it
+}
+
+// List returns the user's trash, most recently deleted first
+func (s *Service) List(ctx context.Context, userEmail string) ([]Item, error) {
+	trashedFiles, err := s.files.Trashed(ctx, userEmail)
+	if err != nil {
+		return nil, err
+	}
+	trashedNotes, err := s.notes.Trashed(ctx, userEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]Item, 0, len(trashedFiles)+len(trashedNotes))
+	for _, f := range trashedFiles {
+		items = append(items, s.item(File, f.FileID, f.Filename, f.Size, f.DeletedAt))
+	}
+	for _, n := range trashedNotes {
+		items = append(items, s.item(Note, n.ID, n.Title, 0, *n.DeletedAt))
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+	return items, nil
+}
+
+// RestoreFile moves a file out of the trash, back into its folder if that
+// still exists
+func (s *Service) RestoreFile(ctx context.Context, userEmail, fileID string) (db.File, error) {
+	file, err := s.files.Untrash(ctx, userEmail, fileID)
+	return file, notFound(err)
+}
+
+// RestoreNote moves a note out of the trash
+func (s *Service) RestoreNote(ctx context.Context, userEmail, noteID string) (notes.Note, error) {
+	note, err := s.notes.Untrash(ctx, userEmail, noteID)
+	return note, notFound(err)
+}
+
+// Delete permanently deletes one item in the trash
+func (s *Service) Delete(ctx context.Context, userEmail string, t Type, id string) error {
+	switch t {
+	case File:
+		if _, err := s.files.GetTrashed(ctx, userEmail, id); err != nil {
+			return notFound(err)
+		}
+		_, err := s.files.Delete(ctx, userEmail, id)
+		return notFound(err)
+	case Note:
+		if _, err := s.notes.GetTrashed(ctx, userEmail, id); err != nil {
+			return notFound(err)
+		}
+		return notFound(s.notes.Delete(ctx, userEmail, id, notes.AnyVersion))
+	}
+	return ErrInvalidType
+}
+
+// Empty permanently deletes everything in the user's trash and returns
+// how many items there were
+func (s *Service) Empty(ctx context.Context, userEmail string) (int, error) {
+	items, err := s.List(ctx, userEmail)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, it := range items {
+		err := s.Delete(ctx, userEmail, it.Type, it.ID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	log.Printf("Emptied the trash of user %s (%d items)", userEmail, deleted)
+	return deleted, nil
+}
+
+// Purge permanently deletes items that have been in the trash for longer
+// than the retention period, from the metadata store and object storage
+func (s *Service) Purge(ctx context.Context, now time.Time) (int, error) {
+	if s.retention <= 0 {
+		return 0, nil
+	}
+	cutoff := now.Add(-s.retention)
+
+	purgedFiles, err := s.files.PurgeTrash(ctx, cutoff)
+	if err != nil {
+		return purgedFiles, err
+	}
+	purgedNotes, err := s.notes.PurgeTrash(ctx, cutoff)
+	return purgedFiles + purgedNotes, err
+}
+
+// RunPurger calls Purge every interval until ctx is cancelled
+func (s *Service) RunPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := s.Purge(ctx, time.Now())
+		if err != nil {
+			log.Printf("Error purging the trash: %v", err)
+		} else if n > 0 {
+			log.Printf("Purged %d items from the trash", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// notFound folds the files and notes not found errors into ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, files.ErrNotFound) || errors.Is(err, notes.ErrNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,561 @@
+package uploads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"cloud/internal/db"
+	"cloud/internal/files"
+	"cloud/internal/quota"
+	"cloud/internal/storage"
+)
+
+var (
+	ErrNotFound       = errors.New("upload not found")
+	ErrInvalidLength  = errors.New("invalid upload length")
+	ErrOffsetMismatch = errors.New("offset does not match the upload")
+	ErrBusy           = errors.New("another chunk of this upload is being written")
+	ErrTooLarge       = errors.New("chunk goes past the end of the upload")
+	ErrChunkTooSmall  = fmt.Errorf("chunks other than the last must be at least %d bytes", storage.MinPartSize)
+	ErrChunkTooLarge  = fmt.Errorf("chunks must be at most %d bytes", storage.MaxPartSize)
+	ErrTooManyChunks  = fmt.Errorf("uploads are limited to %d chunks", storage.MaxParts)
+	ErrDirect         = errors.New("upload goes straight to storage and takes no chunks")
+	ErrNotDirect      = errors.New("upload is sent in chunks and finishes with the last one")
+	ErrNotUploaded    = errors.New("upload content has not been stored yet")
+	ErrSizeMismatch   = errors.New("stored content does not match the upload length")
+)
+
+// DefaultTTL is how long an upload survives without receiving a chunk
+const DefaultTTL = 24 * time.Hour
+
+// TTLFromEnv reads UPLOAD_SESSION_TTL as a duration such as "12h"
+func TTLFromEnv() (time.Duration, error) {
+	v := os.Getenv("UPLOAD_SESSION_TTL")
+	if v == "" {
+		return DefaultTTL, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid UPLOAD_SESSION_TTL %q", v)
+	}
+	return ttl, nil
+}
+
+// Key is where the content of an upload is assembled. The finished object
+// of a chunked upload stays there and becomes the content of the file.
+// Direct uploads are copied to the file's own key, since their pre-signed
+// URL can still write to this one.
+func Key(userEmail, uploadID string) string {
+	return userEmail + "/uploads/" + uploadID
+}
+
+// Store is the persistence backend used by Service. db.MetadataStore
+// satisfies it.
+type Store interface {
+	SaveUpload(ctx context.Context, upload db.Upload) error
+	GetUpload(ctx context.Context, userEmail, uploadID string) (db.Upload, error)
+	DeleteUpload(ctx context.Context, userEmail, uploadID string) error
+	SaveUploadPart(ctx context.Context, part db.UploadPart) error
+	GetUploadParts(ctx context.Context, userEmail, uploadID string) ([]db.UploadPart, error)
+	ScanUploads(ctx context.Context, fn func(db.Upload) error) error
+}
+
+// Committer turns finished content into a file. *files.Service implements
+// it.
+type Committer interface {
+	CheckUpload(ctx context.Context, userEmail, filename, parentID string, size int64) error
+	Upload(ctx context.Context, userEmail string, up files.Upload) (db.File, error)
+}
+
+// NewUpload describes an upload about to start
+type NewUpload struct {
+	Filename    string
+	ParentID    string
+	ContentType string
+	Length      int64
+}
+
+// Status is what clients see of an upload. FileID is set once the upload
+// is finished.
+type Status struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename"`
+	ParentID    string    `json:"parent_id"`
+	ContentType string    `json:"content_type"`
+	Length      int64     `json:"length"`
+	Offset      int64     `json:"offset"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	FileID      string    `json:"file_id"`
+	Direct      bool      `json:"direct"`
+}
+
+// Service implements resumable uploads. Each chunk becomes one part of a
+// multipart upload in object storage, so a dropped connection only costs
+// the chunk in flight. The upload is finished, and the file created, by
+// the chunk that reaches its length.
+type Service struct {
+	store   Store
+	objects storage.MultipartStore
+	files   Committer
+	ttl     time.Duration
+
+	listeners []func(db.File)
+
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+func NewService(store Store, objects storage.MultipartStore, files Committer, ttl time.Duration) *Service {
+	return &Service{store: store, objects: objects, files: files, ttl: ttl, busy: make(map[string]bool)}
+}
+
+// OnFinish registers fn to be called with the file created by every
+// finished upload. Listeners must be registered before the service is used.
+func (s *Service) OnFinish(fn func(db.File)) {
+	s.listeners = append(s.listeners, fn)
+}
+
+// Create starts an upload. Name conflicts and uploads over the quota that
+// would fail are reported now rather than after all the content has been
+// sent. Empty
+// uploads are finished straight away.
+func (s *Service) Create(ctx context.Context, userEmail string, nu NewUpload) (Status, error) {
+	u, err := s.newUpload(ctx, userEmail, nu)
+	if err != nil {
+		return Status{}, err
+	}
+
+	if u.Length == 0 {
+		file, err := s.files.Upload(ctx, userEmail, files.Upload{
+			Filename:    u.Filename,
+			ParentID:    u.ParentID,
+			ContentType: u.ContentType,
+			Body:        strings.NewReader(""),
+		})
+		if err != nil {
+			return Status{}, err
+		}
+		u.FileID = file.FileID
+		if err := s.store.SaveUpload(ctx, u); err != nil {
+			return Status{}, fmt.Errorf("failed to save upload: %v", err)
+		}
+		s.notify(file)
+		return status(u, nil), nil
+	}
+
+	multipartID, err := s.objects.NewMultipartUpload(ctx, u.StoragePath, u.ContentType)
+	if err != nil {
+		return Status{}, err
+	}
+	u.MultipartID = multipartID
+
+	if err := s.store.SaveUpload(ctx, u); err != nil {
+		s.abort(ctx, u)
+		return Status{}, fmt.Errorf("failed to save upload: %v", err)
+	}
+
+	log.Printf("Started upload %s for user %s: %s (%d bytes)", u.UploadID, userEmail, u.Filename, u.Length)
+	return status(u, nil), nil
+}
+
+// CreateDirect starts an upload whose content the client puts into object
+// storage itself, at Key(userEmail, ID), typically through a pre-signed
+// URL. Complete finishes it; until then it expires like any other upload,
+// which removes whatever the client stored.
+func (s *Service) CreateDirect(ctx context.Context, userEmail string, nu NewUpload) (Status, error) {
+	u, err := s.newUpload(ctx, userEmail, nu)
+	if err != nil {
+		return Status{}, err
+	}
+	u.Direct = true
+
+	if err := s.store.SaveUpload(ctx, u); err != nil {
+		return Status{}, fmt.Errorf("failed to save upload: %v", err)
+	}
+
+	log.Printf("Started direct upload %s for user %s: %s (%d bytes)", u.UploadID, userEmail, u.Filename, u.Length)
+	return status(u, nil), nil
+}
+
+func (s *Service) newUpload(ctx context.Context, userEmail string, nu NewUpload) (db.Upload, error) {
+	if nu.Length < 0 {
+		return db.Upload{}, ErrInvalidLength
+	}
+	if err := s.files.CheckUpload(ctx, userEmail, nu.Filename, nu.ParentID, nu.Length); err != nil {
+		return db.Upload{}, err
+	}
+
+	now := time.Now()
+	u := db.Upload{
+		UserEmail:   userEmail,
+		UploadID:    uuid.New().String(),
+		Filename:    nu.Filename,
+		ParentID:    nu.ParentID,
+		ContentType: nu.ContentType,
+		Length:      nu.Length,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.ttl),
+	}
+	u.StoragePath = Key(userEmail, u.UploadID)
+	return u, nil
+}
+
+// Complete finishes a direct upload once the client has stored the
+// content. The object must exist with exactly the announced length; one
+// that doesn't is deleted so the client can put it again.
+func (s *Service) Complete(ctx context.Context, userEmail, uploadID string) (Status, error) {
+	if !s.lock(uploadID) {
+		return Status{}, ErrBusy
+	}
+	defer s.unlock(uploadID)
+
+	u, parts, err := s.load(ctx, userEmail, uploadID)
+	if err != nil {
+		return Status{}, err
+	}
+	if !u.Direct {
+		return Status{}, ErrNotDirect
+	}
+	if u.FileID != "" {
+		return status(u, parts), nil
+	}
+
+	info, err := s.objects.Stat(ctx, u.StoragePath)
+	if errors.Is(err, storage.ErrNotFound) {
+		return Status{}, ErrNotUploaded
+	}
+	if err != nil {
+		return Status{}, fmt.Errorf("failed to check uploaded object: %v", err)
+	}
+	if info.Size != u.Length {
+		if err := s.objects.Delete(ctx, u.StoragePath); err != nil {
+			log.Printf("Error removing mismatched object of upload %s: %v", u.UploadID, err)
+		}
+		return Status{}, ErrSizeMismatch
+	}
+
+	if u, err = s.finish(ctx, u, parts); err != nil {
+		return Status{}, err
+	}
+	return status(u, parts), nil
+}
+
+// Get returns the current state of an upload
+func (s *Service) Get(ctx context.Context, userEmail, uploadID string) (Status, error) {
+	u, parts, err := s.load(ctx, userEmail, uploadID)
+	if err != nil {
+		return Status{}, err
+	}
+	return status(u, parts), nil
+}
+
+// Write appends size bytes from r at offset, which must be the current
+// offset of the upload. Concurrent writes to one upload fail with ErrBusy;
+// across servers the part numbers stored in the metadata store keep two
+// chunks from landing at the same offset.
+//
+// The chunk that reaches the upload length finishes it. If creating the
+// file fails for a reason that can pass, the upload stays complete but
+// unfinished and an empty write at the final offset retries.
+func (s *Service) Write(ctx context.Context, userEmail, uploadID string, offset int64, r io.Reader, size int64) (Status, error) {
+	if !s.lock(uploadID) {
+		return Status{}, ErrBusy
+	}
+	defer s.unlock(uploadID)
+
+	u, parts, err := s.load(ctx, userEmail, uploadID)
+	if err != nil {
+		return Status{}, err
+	}
+	if u.Direct {
+		return Status{}, ErrDirect
+	}
+	current := status(u, parts).Offset
+	if offset != current {
+		return Status{}, ErrOffsetMismatch
+	}
+	if size < 0 || offset+size > u.Length {
+		return Status{}, ErrTooLarge
+	}
+	if u.FileID != "" {
+		return status(u, parts), nil
+	}
+
+	if size > 0 {
+		if offset+size < u.Length && size < storage.MinPartSize {
+			return Status{}, ErrChunkTooSmall
+		}
+		if size > storage.MaxPartSize {
+			return Status{}, ErrChunkTooLarge
+		}
+		if len(parts) >= storage.MaxParts {
+			return Status{}, ErrTooManyChunks
+		}
+
+		part, err := s.objects.PutPart(ctx, u.StoragePath, u.MultipartID, len(parts)+1, r, size)
+		if err != nil {
+			return Status{}, err
+		}
+		record := db.UploadPart{
+			UserEmail: userEmail,
+			UploadID:  uploadID,
+			Number:    part.Number,
+			ETag:      part.ETag,
+			Size:      part.Size,
+		}
+		if err := s.store.SaveUploadPart(ctx, record); err != nil {
+			if errors.Is(err, db.ErrConflict) {
+				return Status{}, ErrOffsetMismatch
+			}
+			return Status{}, fmt.Errorf("failed to save upload part: %v", err)
+		}
+		parts = append(parts, record)
+
+		// Uploads that keep making progress don't expire
+		u.ExpiresAt = time.Now().Add(s.ttl)
+		if err := s.store.SaveUpload(ctx, u); err != nil {
+			return Status{}, fmt.Errorf("failed to save upload: %v", err)
+		}
+	}
+
+	if offset+size == u.Length {
+		if u, err = s.finish(ctx, u, parts); err != nil {
+			return Status{}, err
+		}
+	}
+	return status(u, parts), nil
+}
+
+// finish assembles the parts into one object and creates the file from it
+func (s *Service) finish(ctx context.Context, u db.Upload, parts []db.UploadPart) (db.Upload, error) {
+	if u.MultipartID != "" {
+		complete := make([]storage.Part, len(parts))
+		for i, p := range parts {
+			complete[i] = storage.Part{Number: p.Number, ETag: p.ETag, Size: p.Size}
+		}
+		if _, err := s.objects.CompleteMultipartUpload(ctx, u.StoragePath, u.MultipartID, complete); err != nil {
+			// A retry after a crash finds the object already assembled
+			info, serr := s.objects.Stat(ctx, u.StoragePath)
+			if serr != nil || info.Size != u.Length {
+				return db.Upload{}, err
+			}
+		}
+		u.MultipartID = ""
+		if err := s.store.SaveUpload(ctx, u); err != nil {
+			return db.Upload{}, fmt.Errorf("failed to save upload: %v", err)
+		}
+	}
+
+	up := files.Upload{
+		Filename:    u.Filename,
+		ParentID:    u.ParentID,
+		ContentType: u.ContentType,
+		Size:        u.Length,
+		Object:      u.StoragePath,
+	}
+	if u.Direct {
+		up.Object, up.Source = "", u.StoragePath
+	}
+	file, err := s.files.Upload(ctx, u.UserEmail, up)
+	if errors.Is(err, files.ErrDuplicate) || errors.Is(err, files.ErrInvalidName) || errors.Is(err, quota.ErrExceeded) {
+		// Retrying cannot help, so don't keep the content around
+		s.discard(ctx, u)
+		return db.Upload{}, err
+	}
+	if errors.Is(err, files.ErrSizeChanged) {
+		// Replaced while it was being copied; the client can send it again
+		if err := s.objects.Delete(ctx, u.StoragePath); err != nil {
+			log.Printf("Error removing mismatched object of upload %s: %v", u.UploadID, err)
+		}
+		return db.Upload{}, ErrSizeMismatch
+	}
+	if err != nil {
+		return db.Upload{}, err
+	}
+
+	u.FileID = file.FileID
+	if err := s.store.SaveUpload(ctx, u); err != nil {
+		// The file owns the object now; a session that still looks
+		// unfinished would delete it when cancelled or expired
+		log.Printf("Error saving finished upload %s: %v", u.UploadID, err)
+		if err := s.store.DeleteUpload(ctx, u.UserEmail, u.UploadID); err != nil {
+			log.Printf("Error deleting finished upload %s: %v", u.UploadID, err)
+		}
+	}
+	if u.Direct {
+		// The file has its own copy; an object left behind here is removed
+		// by the reconciler
+		if err := s.objects.Delete(ctx, u.StoragePath); err != nil {
+			log.Printf("Error removing object of direct upload %s: %v", u.UploadID, err)
+		}
+	}
+	s.notify(file)
+
+	log.Printf("Finished upload %s for user %s: %s", u.UploadID, u.UserEmail, file.Filename)
+	return u, nil
+}
+
+// Cancel stops an upload and removes what it stored. Cancelling a
+// finished upload only forgets the session; the file stays.
+func (s *Service) Cancel(ctx context.Context, userEmail, uploadID string) error {
+	if !s.lock(uploadID) {
+		return ErrBusy
+	}
+	defer s.unlock(uploadID)
+
+	u, _, err := s.load(ctx, userEmail, uploadID)
+	if err != nil {
+		return err
+	}
+	return s.discard(ctx, u)
+}
+
+// discard removes an upload, and its content unless a file owns it
+func (s *Service) discard(ctx context.Context, u db.Upload) error {
+	if u.FileID == "" {
+		if err := s.abort(ctx, u); err != nil {
+			return err
+		}
+	}
+	if err := s.store.DeleteUpload(ctx, u.UserEmail, u.UploadID); err != nil {
+		return fmt.Errorf("failed to delete upload: %v", err)
+	}
+	return nil
+}
+
+// abort removes the stored content of an unfinished upload
+func (s *Service) abort(ctx context.Context, u db.Upload) error {
+	if u.MultipartID != "" {
+		return s.objects.AbortMultipartUpload(ctx, u.StoragePath, u.MultipartID)
+	}
+	if err := s.objects.Delete(ctx, u.StoragePath); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Expire discards every upload past its expiry time, aborting the
+// multipart uploads of unfinished ones so their parts don't linger in
+// object storage
+func (s *Service) Expire(ctx context.Context, now time.Time) (int, error) {
+	var expired []db.Upload
+	err := s.store.ScanUploads(ctx, func(u db.Upload) error {
+		if now.After(u.ExpiresAt) {
+			expired = append(expired, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan uploads: %v", err)
+	}
+
+	count := 0
+	for _, u := range expired {
+		if !s.lock(u.UploadID) {
+			continue
+		}
+		err := s.discard(ctx, u)
+		s.unlock(u.UploadID)
+		if err != nil {
+			log.Printf("Error expiring upload %s: %v", u.UploadID, err)
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+// RunReaper calls Expire every interval until ctx is cancelled
+func (s *Service) RunReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := s.Expire(ctx, time.Now())
+		if err != nil {
+			log.Printf("Error expiring uploads: %v", err)
+		} else if n > 0 {
+			log.Printf("Expired %d abandoned uploads", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// load reads an upload with its parts. Expired uploads are reported as
+// not found even before the reaper has removed them.
+func (s *Service) load(ctx context.Context, userEmail, uploadID string) (db.Upload, []db.UploadPart, error) {
+	u, err := s.store.GetUpload(ctx, userEmail, uploadID)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && time.Now().After(u.ExpiresAt)) {
+		return db.Upload{}, nil, ErrNotFound
+	}
+	if err != nil {
+		return db.Upload{}, nil, fmt.Errorf("failed to read upload: %v", err)
+	}
+
+	parts, err := s.store.GetUploadParts(ctx, userEmail, uploadID)
+	if err != nil {
+		return db.Upload{}, nil, fmt.Errorf("failed to read upload parts: %v", err)
+	}
+	return u, parts, nil
+}
+
+func (s *Service) lock(uploadID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.busy[uploadID] {
+		return false
+	}
+	s.busy[uploadID] = true
+	return true
+}
+
+func (s *Service) unlock(uploadID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.busy, uploadID)
+}
+
+func (s *Service) notify(file db.File) {
+	for _, fn := range s.listeners {
+		fn(file)
+	}
+}
+
+func status(u db.Upload, parts []db.UploadPart) Status {
+	st := Status{
+		ID:          u.UploadID,
+		Filename:    u.Filename,
+		ParentID:    u.ParentID,
+		ContentType: u.ContentType,
+		Length:      u.Length,
+		CreatedAt:   u.CreatedAt,
+		ExpiresAt:   u.ExpiresAt,
+		FileID:      u.FileID,
+		Direct:      u.Direct,
+	}
+	for _, p := range parts {
+		st.Offset += p.Size
+	}
+	if u.FileID != "" {
+		// Direct uploads have no parts to count
+		st.Offset = u.Length
+	}
+	return st
+}
@@ -0,0 +1,171 @@
+package uploads_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud/internal/database"
+	"cloud/internal/files"
+	"cloud/internal/quota"
+	"cloud/internal/storage"
+	"cloud/internal/uploads"
+)
+
+const user = "ann@example.com"
+
+func setup(t *testing.T) (*uploads.Service, *files.Service, *storage.DiskStore) {
+	t.Helper()
+	dir := t.TempDir()
+	meta, err := database.NewDB(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := storage.NewDiskStore(filepath.Join(dir, "objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := files.NewService(meta, objects, files.PolicyRename, quota.NewService(meta, 0))
+	return uploads.NewService(meta, objects, fs, time.Hour), fs, objects
+}
+
+// content returns what fs stores for fileID
+func content(t *testing.T, fs *files.Service, fileID string) []byte {
+	t.Helper()
+	_, obj, err := fs.Open(context.Background(), user, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestChunkedUpload(t *testing.T) {
+	ctx := context.Background()
+	s, fs, _ := setup(t)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (storage.MinPartSize+1000)/16)
+	first := int64(storage.MinPartSize)
+	length := int64(len(data))
+	st, err := s.Create(ctx, user, uploads.NewUpload{Filename: "big.bin", Length: length})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		offset int64
+		chunk  []byte
+		size   int64
+		want   error
+	}{
+		{name: "short chunk", offset: 0, chunk: data[:10], size: 10, want: uploads.ErrChunkTooSmall},
+		{name: "wrong offset", offset: 5, chunk: data[5:first], size: first - 5, want: uploads.ErrOffsetMismatch},
+		{name: "past the end", offset: 0, chunk: data, size: length + 1, want: uploads.ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.Write(ctx, user, st.ID, tt.offset, bytes.NewReader(tt.chunk), tt.size); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// A chunk cut short by a dropped connection stores nothing
+	if _, err := s.Write(ctx, user, st.ID, 0, bytes.NewReader(data[:100]), first); err == nil {
+		t.Fatal("truncated chunk was accepted")
+	}
+	if st, err = s.Get(ctx, user, st.ID); err != nil || st.Offset != 0 {
+		t.Fatalf("after a truncated chunk: offset %d, %v", st.Offset, err)
+	}
+
+	if st, err = s.Write(ctx, user, st.ID, 0, bytes.NewReader(data[:first]), first); err != nil {
+		t.Fatal(err)
+	}
+	if st.Offset != first || st.FileID != "" {
+		t.Fatalf("after the first chunk: got %+v", st)
+	}
+	if st, err = s.Write(ctx, user, st.ID, first, bytes.NewReader(data[first:]), length-first); err != nil {
+		t.Fatal(err)
+	}
+	if st.FileID == "" {
+		t.Fatal("the last chunk did not finish the upload")
+	}
+	if got := content(t, fs, st.FileID); !bytes.Equal(got, data) {
+		t.Fatalf("stored %d bytes that differ from the %d uploaded", len(got), len(data))
+	}
+}
+
+func TestDirectUpload(t *testing.T) {
+	ctx := context.Background()
+	s, fs, objects := setup(t)
+
+	st, err := s.CreateDirect(ctx, user, uploads.NewUpload{Filename: "a.txt", Length: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Complete(ctx, user, st.ID); !errors.Is(err, uploads.ErrNotUploaded) {
+		t.Fatalf("completing before the put: got %v, want ErrNotUploaded", err)
+	}
+	if _, err := s.Write(ctx, user, st.ID, 0, strings.NewReader("hello"), 5); !errors.Is(err, uploads.ErrDirect) {
+		t.Fatalf("writing a chunk: got %v, want ErrDirect", err)
+	}
+
+	// The wrong length is removed so the client can put it again
+	key := uploads.Key(user, st.ID)
+	if _, err := objects.Put(ctx, key, strings.NewReader("hi"), 2, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Complete(ctx, user, st.ID); !errors.Is(err, uploads.ErrSizeMismatch) {
+		t.Fatalf("completing with the wrong size: got %v, want ErrSizeMismatch", err)
+	}
+	if _, err := objects.Stat(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("mismatched object: got %v, want it removed", err)
+	}
+
+	if _, err := objects.Put(ctx, key, strings.NewReader("hello"), 5, ""); err != nil {
+		t.Fatal(err)
+	}
+	if st, err = s.Complete(ctx, user, st.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := content(t, fs, st.FileID); string(got) != "hello" {
+		t.Fatalf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	ctx := context.Background()
+	s, _, objects := setup(t)
+
+	st, err := s.CreateDirect(ctx, user, uploads.NewUpload{Filename: "a.txt", Length: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := uploads.Key(user, st.ID)
+	if _, err := objects.Put(ctx, key, strings.NewReader("hello"), 5, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.Expire(ctx, time.Now()); err != nil || n != 0 {
+		t.Fatalf("before expiry: expired %d, %v", n, err)
+	}
+	if n, err := s.Expire(ctx, st.ExpiresAt.Add(time.Second)); err != nil || n != 1 {
+		t.Fatalf("after expiry: expired %d, %v", n, err)
+	}
+	if _, err := s.Get(ctx, user, st.ID); !errors.Is(err, uploads.ErrNotFound) {
+		t.Fatalf("expired upload: got %v, want ErrNotFound", err)
+	}
+	if _, err := objects.Stat(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expired upload content: got %v, want it removed", err)
+	}
+}
@@ -0,0 +1,113 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Bus carries messages between the hubs of every server instance, so a
+// change made through one instance reaches clients connected to another.
+// Hubs send everything through their bus, their own clients included.
+type Bus interface {
+	// Publish sends a message for a user to every subscriber
+	Publish(ctx context.Context, userEmail string, message []byte) error
+
+	// Subscribe calls fn with every message published, by any instance,
+	// until ctx is cancelled. It blocks until then.
+	Subscribe(ctx context.Context, fn func(userEmail string, message []byte)) error
+
+	Close() error
+}
+
+// BusConfig selects and configures a Bus
+type BusConfig struct {
+	Backend string // "local" or "redis"
+
+	// Redis backend
+	RedisAddr     string
+	RedisPassword string
+	Channel       string
+}
+
+// BusConfigFromEnv reads the event bus configuration from the environment
+func BusConfigFromEnv() BusConfig {
+	cfg := BusConfig{
+		Backend:       strings.ToLower(os.Getenv("EVENT_BUS")),
+		RedisAddr:     os.Getenv("REDIS_ADDR"),
+		RedisPassword: os.Getenv("REDIS_PASSWORD"),
+		Channel:       os.Getenv("REDIS_CHANNEL"),
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = "local"
+	}
+	if cfg.RedisAddr == "" {
+		cfg.RedisAddr = "localhost:6379"
+	}
+	if cfg.Channel == "" {
+		cfg.Channel = "cloud-events"
+	}
+	return cfg
+}
+
+// OpenBus creates the Bus selected by cfg.Backend
+func OpenBus(cfg BusConfig) (Bus, error) {
+	switch cfg.Backend {
+	case "local":
+		return NewLocalBus(), nil
+	case "redis":
+		return NewRedisBus(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown event bus %q", cfg.Backend)
+	}
+}
+
+// LocalBus delivers messages within the process. It is all a single
+// instance needs; hubs sharing one behave like instances sharing a
+// network bus.
+type LocalBus struct {
+	mu     sync.RWMutex
+	next   int
+	subs   map[int]func(string, []byte)
+	closed bool
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{subs: make(map[int]func(string, []byte))}
+}
+
+func (b *LocalBus) Publish(ctx context.Context, userEmail string, message []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return fmt.Errorf("event bus is closed")
+	}
+	for _, fn := range b.subs {
+		fn(userEmail, message)
+	}
+	return nil
+}
+
+func (b *LocalBus) Subscribe(ctx context.Context, fn func(string, []byte)) error {
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.subs[id] = fn
+	b.mu.Unlock()
+
+	<-ctx.Done()
+
+	b.mu.Lock()
+	delete(b.subs, id)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *LocalBus) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	return nil
+}
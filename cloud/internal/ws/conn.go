@@ -0,0 +1,124 @@
+package ws
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// writeWait bounds a single write to a client
+	writeWait = 10 * time.Second
+	// pongWait is how long a client may stay silent before it is dropped.
+	// Pings go out often enough for a live client to answer in time.
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+	// maxMessageSize caps what clients may send, which is at most a note
+	// edit
+	maxMessageSize = 1 << 20
+	// sendBuffer is how many messages may wait for a client before it
+	// counts as too slow and is disconnected
+	sendBuffer = 64
+	// outboxSize is how many messages may wait for the bus
+	outboxSize = 1024
+)
+
+// upgrader leaves CheckOrigin unset, so only pages served from this host
+// can open a connection with the session cookie
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// Serve upgrades the request to a WebSocket and sends the user's events
+// over it until the connection closes. It blocks until then.
+func (h *Hub) Serve(w http.ResponseWriter, r *http.Request, userEmail string) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered the request
+		log.Printf("Error upgrading WebSocket for user %s: %v", userEmail, err)
+		return
+	}
+
+	client := &Client{UserEmail: userEmail, Conn: conn, hub: h, send: make(chan []byte, sendBuffer)}
+	select {
+	case h.register <- client:
+	case <-h.done:
+		conn.Close()
+		return
+	}
+	go client.writePump()
+	client.readPump()
+}
+
+// readPump hands what the client sends to the hub's OnMessage handler
+// until the connection fails, keeping the read deadline moving with every
+// pong. Then it unregisters the client and calls the OnClose handlers.
+func (c *Client) readPump() {
+	defer func() {
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
+		c.Conn.Close()
+		for _, fn := range c.hub.onClose {
+			fn(c)
+		}
+	}()
+
+	c.Conn.SetReadLimit(maxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, data, err := c.Conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("WebSocket of user %s closed: %v", c.UserEmail, err)
+			}
+			return
+		}
+
+		var msg Incoming
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Type == "" {
+			c.hub.SendToClient(c, Message{Type: TypeError, Payload: ErrorPayload{Message: "Invalid message"}})
+			continue
+		}
+		if c.hub.onMessage != nil {
+			c.hub.onMessage(c, msg)
+		}
+	}
+}
+
+// writePump is the only writer of a connection. It sends queued messages
+// and pings until the hub closes the queue or a write fails.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
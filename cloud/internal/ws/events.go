@@ -0,0 +1,43 @@
+package ws
+
+// Message types sent to clients. The payload of a change is the resource
+// as the API returns it; deletions only carry its ID.
+const (
+	FileUploaded = "file.uploaded"
+	FileUpdated  = "file.updated"
+	FileDeleted  = "file.deleted"
+	FileRestored = "file.restored"
+
+	FolderCreated = "folder.created"
+	FolderUpdated = "folder.updated"
+	FolderDeleted = "folder.deleted"
+
+	NoteCreated  = "note.created"
+	NoteUpdated  = "note.updated"
+	NoteDeleted  = "note.deleted"
+	NoteRestored = "note.restored"
+
+	ShareCreated = "share.created"
+	ShareRevoked = "share.revoked"
+
+	PermissionsChanged = "permissions.changed"
+
+	TrashEmptied = "trash.emptied"
+
+	// TypeError answers a client message that could not be handled
+	TypeError = "error"
+)
+
+// ErrorPayload is the payload of TypeError. Request is the type of the
+// message it answers, if that could be read.
+type ErrorPayload struct {
+	Request string `json:"request,omitempty"`
+	Message string `json:"message"`
+}
+
+// Deleted is the payload of deletions. Permanent is set when the item did
+// not go to the trash.
+type Deleted struct {
+	ID        string `json:"id"`
+	Permanent bool   `json:"permanent,omitempty"`
+}
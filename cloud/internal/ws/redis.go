@@ -0,0 +1,274 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// redisTimeout bounds dialing and each command
+	redisTimeout = 5 * time.Second
+	// redisRetry is the longest wait between attempts to resubscribe
+	redisRetry = 30 * time.Second
+	// redisPing is how often a subscription is checked. Redis sends nothing
+	// on a quiet channel, so a dead connection would otherwise go unnoticed.
+	redisPing = 30 * time.Second
+)
+
+// redisEnvelope is what is published on the channel
+type redisEnvelope struct {
+	UserEmail string          `json:"user_email"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// RedisBus shares messages between instances through Redis pub/sub. It
+// speaks the few commands it needs itself. Pub/sub delivers at most once:
+// messages published while a subscriber is reconnecting are lost to it,
+// which clients cover by reloading when their own connection drops.
+type RedisBus struct {
+	cfg BusConfig
+
+	mu   sync.Mutex // guards pub, the connection used to publish
+	pub  *redisConn
+	done bool
+}
+
+func NewRedisBus(cfg BusConfig) *RedisBus {
+	return &RedisBus{cfg: cfg}
+}
+
+// redisConn is one connection speaking RESP, the Redis protocol
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (b *RedisBus) dial(ctx context.Context) (*redisConn, error) {
+	d := net.Dialer{Timeout: redisTimeout}
+	conn, err := d.DialContext(ctx, "tcp", b.cfg.RedisAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if b.cfg.RedisPassword != "" {
+		if _, err := c.do("AUTH", b.cfg.RedisPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to authenticate to redis: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and reads its reply
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisConn) send(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// redisError is an error reply
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// read reads one reply: a string, an int64, a []interface{}, nil for a
+// null, or a redisError
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("malformed redis reply %q", line)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("malformed redis reply %q", line)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("malformed redis reply %q", line)
+}
+
+// Publish publishes on the configured channel, reconnecting once if the
+// connection has gone bad
+func (b *RedisBus) Publish(ctx context.Context, userEmail string, message []byte) error {
+	payload, err := json.Marshal(redisEnvelope{UserEmail: userEmail, Message: message})
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return fmt.Errorf("event bus is closed")
+	}
+
+	for attempt := 0; ; attempt++ {
+		if b.pub == nil {
+			if b.pub, err = b.dial(ctx); err != nil {
+				return err
+			}
+		}
+		_, err = b.pub.do("PUBLISH", b.cfg.Channel, string(payload))
+		var replyErr redisError
+		if err == nil || errors.As(err, &replyErr) {
+			return err
+		}
+		b.pub.conn.Close()
+		b.pub = nil
+		if attempt > 0 {
+			return fmt.Errorf("failed to publish to redis: %v", err)
+		}
+	}
+}
+
+// Subscribe listens on the configured channel, resubscribing with backoff
+// whenever the connection fails
+func (b *RedisBus) Subscribe(ctx context.Context, fn func(string, []byte)) error {
+	wait := time.Second
+	for {
+		err := b.listen(ctx, fn, func() { wait = time.Second })
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("Error listening to redis channel %s, retrying in %v: %v", b.cfg.Channel, wait, err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > redisRetry {
+			wait = redisRetry
+		}
+	}
+}
+
+// listen subscribes once and delivers messages until the connection fails
+// or ctx is cancelled. subscribed is called once the subscription is
+// confirmed.
+func (b *RedisBus) listen(ctx context.Context, fn func(string, []byte), subscribed func()) error {
+	c, err := b.dial(ctx)
+	if err != nil {
+		return err
+	}
+	// Closing the connection is the only way to interrupt a blocked read
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		c.conn.Close()
+	}()
+
+	if _, err := c.do("SUBSCRIBE", b.cfg.Channel); err != nil {
+		return err
+	}
+	subscribed()
+
+	go func() {
+		ticker := time.NewTicker(redisPing)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := c.send("PING"); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(2 * redisPing))
+		reply, err := c.read()
+		if err != nil {
+			return err
+		}
+		// Messages are ["message", channel, payload]; pongs are ignored
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 || items[0] != "message" {
+			continue
+		}
+		payload, _ := items[2].(string)
+
+		var env redisEnvelope
+		if err := json.Unmarshal([]byte(payload), &env); err != nil {
+			log.Printf("Skipping unreadable message on redis channel %s: %v", b.cfg.Channel, err)
+			continue
+		}
+		fn(env.UserEmail, env.Message)
+	}
+}
+
+func (b *RedisBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done = true
+	if b.pub != nil {
+		err := b.pub.conn.Close()
+		b.pub = nil
+		return err
+	}
+	return nil
+}
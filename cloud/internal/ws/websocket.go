@@ -1,16 +1,22 @@
 package ws
 
 import (
+    "context"
     "encoding/json"
     "log"
-    "sync"
+    "sync/atomic"
 
     "github.com/gorilla/websocket"
 )
 
+// Client is one open connection. Messages for it are queued on send and
+// written by its own goroutine, since a connection takes one writer at a
+// time.
 type Client struct {
     UserEmail string
     Conn      *websocket.Conn
+    hub       *Hub
+    send      chan []byte
 }
 
 type Message struct {
@@ -18,41 +24,228 @@ type Message struct {
     Payload interface{} `json:"payload"`
 }
 
-var (
-    clients    = make(map[*Client]bool)
-    clientsMux sync.RWMutex
-)
+// Incoming is a message from a client. Its payload is decoded by whoever
+// handles its type.
+type Incoming struct {
+    Type    string          `json:"type"`
+    Payload json.RawMessage `json:"payload"`
+}
+
+// Stats are the hub's counters since it started. Dropped counts messages
+// lost because a client or the bus could not keep up.
+type Stats struct {
+    Clients      int64 `json:"clients"`
+    Users        int64 `json:"users"`
+    Sent         int64 `json:"sent"`
+    Dropped      int64 `json:"dropped"`
+    Disconnected int64 `json:"disconnected"`
+}
+
+// delivery is a message on its way to a user's clients
+type delivery struct {
+    userEmail string
+    message   []byte
+}
+
+// directDelivery is a message on its way to a single client
+type directDelivery struct {
+    client  *Client
+    message []byte
+}
+
+// Hub keeps the open connections of every user and fans messages out to
+// them. Its index is only touched by the Run goroutine, so registering,
+// unregistering and sending never race; sending never blocks on a client.
+// A client whose queue is full has fallen behind: the message is dropped
+// and the client disconnected, so it reconnects and reloads rather than
+// showing a stale view.
+//
+// Messages go out through a Bus and come back in from it, so with a
+// network bus they reach clients of every instance.
+type Hub struct {
+    bus        Bus
+    outbox     chan delivery
+    register   chan *Client
+    unregister chan *Client
+    broadcast  chan delivery
+    direct     chan directDelivery
+    done       chan struct{}
+    users      map[string]map[*Client]bool
+
+    onMessage func(*Client, Incoming)
+    onClose   []func(*Client)
+
+    clients      int64
+    userCount    int64
+    sent         int64
+    dropped      int64
+    disconnected int64
+}
+
+func NewHub(bus Bus) *Hub {
+    return &Hub{
+        bus:        bus,
+        outbox:     make(chan delivery, outboxSize),
+        register:   make(chan *Client),
+        unregister: make(chan *Client),
+        broadcast:  make(chan delivery, sendBuffer),
+        direct:     make(chan directDelivery, sendBuffer),
+        done:       make(chan struct{}),
+        users:      make(map[string]map[*Client]bool),
+    }
+}
+
+// Run is the hub's event loop. It must be running for Serve and
+// BroadcastToUser to make progress, and closes every connection when ctx
+// is cancelled. Messages sent after that are discarded.
+func (h *Hub) Run(ctx context.Context) {
+    defer close(h.done)
+    go h.publish(ctx)
+    go func() {
+        err := h.bus.Subscribe(ctx, func(userEmail string, message []byte) {
+            select {
+            case h.broadcast <- delivery{userEmail: userEmail, message: message}:
+            case <-ctx.Done():
+            }
+        })
+        if err != nil {
+            log.Printf("Error subscribing to events: %v", err)
+        }
+    }()
+
+    for {
+        select {
+        case client := <-h.register:
+            h.add(client)
+        case client := <-h.unregister:
+            h.remove(client)
+        case d := <-h.broadcast:
+            for client := range h.users[d.userEmail] {
+                h.deliver(client, d.message)
+            }
+        case d := <-h.direct:
+            if h.users[d.client.UserEmail][d.client] {
+                h.deliver(d.client, d.message)
+            }
+        case <-ctx.Done():
+            for _, clients := range h.users {
+                for client := range clients {
+                    h.remove(client)
+                }
+            }
+            return
+        }
+    }
+}
+
+// deliver queues a message for a client, disconnecting it if its queue
+// is full
+func (h *Hub) deliver(client *Client, message []byte) {
+    select {
+    case client.send <- message:
+        atomic.AddInt64(&h.sent, 1)
+    default:
+        log.Printf("Disconnecting a slow client of user %s", client.UserEmail)
+        atomic.AddInt64(&h.dropped, 1)
+        atomic.AddInt64(&h.disconnected, 1)
+        h.remove(client)
+    }
+}
 
-func AddClient(client *Client) {
-    clientsMux.Lock()
+func (h *Hub) add(client *Client) {
+    clients := h.users[client.UserEmail]
+    if clients == nil {
+        clients = make(map[*Client]bool)
+        h.users[client.UserEmail] = clients
+        atomic.AddInt64(&h.userCount, 1)
+    }
     clients[client] = true
-    clientsMux.Unlock()
+    atomic.AddInt64(&h.clients, 1)
 }
 
-func RemoveClient(client *Client) {
-    clientsMux.Lock()
+// remove unregisters a client and stops its writer. Clients already gone
+// are ignored, since both the reader and a full queue can remove one.
+func (h *Hub) remove(client *Client) {
+    clients := h.users[client.UserEmail]
+    if !clients[client] {
+        return
+    }
     delete(clients, client)
-    clientsMux.Unlock()
+    close(client.send)
+    atomic.AddInt64(&h.clients, -1)
+    if len(clients) == 0 {
+        delete(h.users, client.UserEmail)
+        atomic.AddInt64(&h.userCount, -1)
+    }
 }
 
-func BroadcastToUser(userEmail string, message Message) {
-    clientsMux.RLock()
-    defer clientsMux.RUnlock()
+// publish hands queued messages to the bus until ctx is cancelled
+func (h *Hub) publish(ctx context.Context) {
+    for {
+        select {
+        case d := <-h.outbox:
+            if err := h.bus.Publish(ctx, d.userEmail, d.message); err != nil {
+                log.Printf("Error publishing message for user %s: %v", d.userEmail, err)
+                atomic.AddInt64(&h.dropped, 1)
+            }
+        case <-ctx.Done():
+            return
+        }
+    }
+}
 
+// BroadcastToUser sends message to every open connection of a user, on
+// any instance. It does not wait for the bus; if the bus has fallen too
+// far behind the message is dropped.
+func (h *Hub) BroadcastToUser(userEmail string, message Message) {
     messageJSON, err := json.Marshal(message)
     if err != nil {
         log.Printf("Error marshaling message: %v", err)
         return
     }
+    select {
+    case h.outbox <- delivery{userEmail: userEmail, message: messageJSON}:
+    default:
+        log.Printf("Dropping %s message for user %s, the event bus is behind", message.Type, userEmail)
+        atomic.AddInt64(&h.dropped, 1)
+    }
+}
 
-    for client := range clients {
-        if client.UserEmail == userEmail {
-            err := client.Conn.WriteMessage(websocket.TextMessage, messageJSON)
-            if err != nil {
-                log.Printf("Error sending message to client: %v", err)
-                client.Conn.Close()
-                RemoveClient(client)
-            }
-        }
+// SendToClient sends message to one connection only. Unlike
+// BroadcastToUser it does not go through the bus, since the connection is
+// on this instance.
+func (h *Hub) SendToClient(client *Client, message Message) {
+    messageJSON, err := json.Marshal(message)
+    if err != nil {
+        log.Printf("Error marshaling message: %v", err)
+        return
+    }
+    select {
+    case h.direct <- directDelivery{client: client, message: messageJSON}:
+    case <-h.done:
+    }
+}
+
+// OnMessage sets the handler of messages from clients. It is called on
+// the connection's own goroutine, one message at a time, and must be set
+// before the hub is used.
+func (h *Hub) OnMessage(fn func(*Client, Incoming)) {
+    h.onMessage = fn
+}
+
+// OnClose registers fn to be called after a connection has closed. It
+// must be registered before the hub is used.
+func (h *Hub) OnClose(fn func(*Client)) {
+    h.onClose = append(h.onClose, fn)
+}
+
+// Stats returns the hub's counters
+func (h *Hub) Stats() Stats {
+    return Stats{
+        Clients:      atomic.LoadInt64(&h.clients),
+        Users:        atomic.LoadInt64(&h.userCount),
+        Sent:         atomic.LoadInt64(&h.sent),
+        Dropped:      atomic.LoadInt64(&h.dropped),
+        Disconnected: atomic.LoadInt64(&h.disconnected),
     }
 }
@@ -6,4 +6,4 @@ mkdir web\templates 2>nul
 mkdir notes 2>nul
 
 echo Starting server...
-go run cmd/server/main.go
+go run ./cmd/server
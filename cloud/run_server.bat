@@ -1,3 +1,3 @@
 @echo off
 cd %~dp0
-go run cmd/server/main.go
+go run ./cmd/server
@@ -35,9 +35,8 @@ echo Waiting for services to initialize (30 seconds)...
 timeout /t 30 /nobreak
 
 :: Initialize ScyllaDB schema
-echo Initializing database schema...
-docker cp ./internal/db/schema.cql scylla-node:/schema.cql
-docker exec -it scylla-node cqlsh -f /schema.cql
+echo Applying database migrations...
+go run ./cmd/server migrate
 
 :: Install Go dependencies
 echo Installing Go dependencies...